@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// loadConfig reads a YAML configuration file and sets all flags it contains
+// that weren't set on the command line. The keys are the flag names, the
+// values are taken as written, lists are comma separated like on the
+// command line, e.g.
+//
+//	token-file: /etc/hcloud-csi/token
+//	action-timeout: 2m
+//	fstrim-interval: 24h
+//	socket-mode: 0660
+//	topology-key-aliases: csi.hetzner.cloud/location,topology.kubernetes.io/region
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file failed: %s", err)
+	}
+
+	// the values are read as the text of the scalars, e.g. yaml would turn
+	// the socket mode 0660 into the integer 432, and YAML lists are rejected
+	var config map[string]string
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing config file %q failed: %s", path, err)
+	}
+
+	// flags on the command line take precedence over the config file
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range config {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("config file %q contains unknown option %q", path, name)
+		}
+
+		if set[name] {
+			continue
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %q contains invalid value for %q: %s", path, name, err)
+		}
+	}
+
+	return nil
+}
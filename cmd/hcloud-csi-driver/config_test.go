@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		args    []string
+		want    map[string]string
+		err     bool
+	}{
+		{
+			name:    "octal socket mode",
+			content: "socket-mode: 0660\n",
+			want:    map[string]string{"socket-mode": "0660"},
+		},
+		{
+			name:    "comma separated list",
+			content: "topology-key-aliases: csi.hetzner.cloud/location,topology.kubernetes.io/region\n",
+			want:    map[string]string{"topology-key-aliases": "csi.hetzner.cloud/location,topology.kubernetes.io/region"},
+		},
+		{
+			name:    "yaml list",
+			content: "topology-key-aliases:\n  - csi.hetzner.cloud/location\n  - topology.kubernetes.io/region\n",
+			err:     true,
+		},
+		{
+			name:    "durations and empty values",
+			content: "action-timeout: 2m\ntoken-file:\n",
+			want:    map[string]string{"action-timeout": "2m0s", "token-file": ""},
+		},
+		{
+			name:    "command line takes precedence",
+			content: "socket-mode: 0660\n",
+			args:    []string{"--socket-mode=0600"},
+			want:    map[string]string{"socket-mode": "0600"},
+		},
+		{
+			name:    "unknown option",
+			content: "sockt-mode: 0660\n",
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+
+			if _, err := f.WriteString(tt.content); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("config", "", "")
+			fs.String("socket-mode", "", "")
+			fs.String("topology-key-aliases", "", "")
+			fs.String("token-file", "/etc/hcloud/token", "")
+			fs.Duration("action-timeout", 0, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err = loadConfig(fs, f.Name())
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
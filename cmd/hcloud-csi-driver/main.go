@@ -17,36 +17,348 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apricote/hcloud-csi-driver/driver"
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
 )
 
+// doctorTimeout bounds the checks of the doctor subcommand.
+const doctorTimeout = time.Minute
+
 func main() {
+	// "hcloud-csi-driver selftest|doctor [flags]" runs the command with the
+	// configuration of the flags instead of serving the CSI endpoint
+	var command string
+	if len(os.Args) > 1 && (os.Args[1] == "selftest" || os.Args[1] == "doctor") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	var (
-		endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/de.apricote.hcloud.csi.volumes/csi.sock", "CSI endpoint")
-		token    = flag.String("token", "", "Hetzner Cloud access token")
-		url      = flag.String("url", "https://api.hetzner.cloud/v1", "Hetzner Cloud API URL")
-		hostname = flag.String("hostname", "", "Name of the current node")
-		version  = flag.Bool("version", false, "Print the version and exit.")
+		endpoint       = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/de.apricote.hcloud.csi.volumes/csi.sock", "CSI endpoint, a unix domain socket, a TCP address like tcp://0.0.0.0:10000 or systemd:// for systemd socket activation")
+		token          = flag.String("token", "", "Hetzner Cloud access token, without a token only the node service is started")
+		tokenFile      = flag.String("token-file", "", "File to read the Hetzner Cloud access token from, it is reloaded when it changes")
+		tokenSecret    = flag.String("token-secret", "", "Kubernetes Secret namespace/name to read the Hetzner Cloud access token from its access-token key, changes are picked up right away")
+		projectsFile   = flag.String("projects-file", "", "YAML file mapping aliases of further Hetzner Cloud projects to their access tokens, the project StorageClass parameter selects the project of a volume")
+		projectsSecret = flag.String("projects-secret", "", "Kubernetes Secret namespace/name mapping aliases of further Hetzner Cloud projects to their access tokens, one key per alias")
+		url            = flag.String("url", "https://api.hetzner.cloud/v1", "Hetzner Cloud API URL")
+		hostname       = flag.String("hostname", "", "Name of the current node, used to look up the server if the metadata service is not reachable")
+		clusterName    = flag.String("cluster-name", "", "Name of the cluster, added to the labels, name and log entries of created volumes")
+		nodeID         = flag.String("node-id", "", "ID of the hcloud server the driver runs on, required if the metadata service is blocked and the hostname differs from the server name")
+		config         = flag.String("config", "", "YAML file setting any of the other flags by name, flags on the command line take precedence")
+		name           = flag.String("driver-name", driver.DefaultDriverName, "CSI name of the driver, the default endpoint and data directory are derived from it")
+		version        = flag.Bool("version", false, "Print the version and exit.")
+		output         = flag.String("output", "text", "Format of the --version output: text or json")
+
+		topologyKey        = flag.String("topology-key", "location", "Topology segment the location of nodes and volumes is published under")
+		topologyAliases    = flag.String("topology-key-aliases", "", "Comma separated topology segments the location is published under as well, e.g. csi.hetzner.cloud/location")
+		socketMode         = flag.String("socket-mode", "", "Permissions of the unix domain socket in octal, e.g. 0660, empty keeps the default")
+		socketOwner        = flag.String("socket-owner", "", "Numeric owner of the unix domain socket, e.g. 1000 or 1000:1000, empty keeps the default")
+		shutdownTimeout    = flag.Duration("shutdown-timeout", 25*time.Second, "Maximum time to wait for in-flight requests on SIGTERM, should be lower than the termination grace period of the pod")
+		mode               = flag.String("mode", "all", "CSI services to run: all (alias monolith), controller or node")
+		logFormat          = flag.String("log-format", "text", "Format of the log output: text or json")
+		logSink            = flag.String("log-sink", "", "Also send the log to syslog or journald, the fields of entries are stored as journal fields")
+		logLevel           = flag.String("log-level", "info", "Minimum level of log entries: debug, info, warn or error")
+		logFile            = flag.String("log-file", "", "File to write the log to instead of stderr, it is rotated by size and age")
+		logMaxSize         = flag.Int("log-max-size", 100, "Size in megabytes after which the log file is rotated")
+		logMaxAge          = flag.Int("log-max-age", 7, "Days after which rotated log files are removed, 0 keeps them")
+		logMaxBackups      = flag.Int("log-max-backups", 5, "Number of rotated log files to keep, 0 keeps all")
+		hcloudProxy        = flag.String("hcloud-proxy", "", "URL of a proxy for requests to the Hetzner Cloud API, defaults to the HTTPS_PROXY environment variable")
+		hcloudCAFile       = flag.String("hcloud-ca-file", "", "PEM bundle of additional CAs to trust for requests to the Hetzner Cloud API")
+		fakeHCloud         = flag.String("fake-hcloud", "", "Serve a fake Hetzner Cloud API on the address, e.g. 'localhost:8081', and use it instead of the real one for end-to-end tests without a project, a server is added for the node")
+		fakeActionLatency  = flag.Duration("fake-hcloud-action-latency", time.Second, "Time actions of the fake Hetzner Cloud API are running before they succeed")
+		hcloudRecord       = flag.String("hcloud-record", "", "File to record the requests to and responses of the Hetzner Cloud API in, without the token, e.g. to reproduce an issue, empty disables it")
+		dryRun             = flag.Bool("dry-run", false, "Validate requests and log the volumes the controller would create, delete, attach or detach without changing them, the requests fail")
+		injectErrors       = flag.String("inject-errors", os.Getenv("HCLOUD_CSI_INJECT_ERRORS"), "Make requests to the hcloud API fail or respond slowly on purpose to test alerting and retries, comma separated operation:fault[:rate], e.g. 'attach:0.2,create:timeout,list:2s', defaults to HCLOUD_CSI_INJECT_ERRORS")
+		secondaryToken     = flag.String("secondary-token", "", "Hetzner Cloud access token used if the API rejects or rate limits the token, e.g. during a token rotation")
+		hcloudTimeout      = flag.Duration("hcloud-request-timeout", 30*time.Second, "Maximum time to wait for a response of the Hetzner Cloud API before the request is retried, 0 waits forever")
+		tlsCert            = flag.String("tls-cert", "", "Path of the TLS certificate to serve a tcp endpoint with, reloaded periodically")
+		tlsKey             = flag.String("tls-key", "", "Path of the key of the TLS certificate")
+		tlsClientCA        = flag.String("tls-client-ca", "", "Path of the CA client certificates are verified against, empty doesn't require client certificates")
+		rpcRateLimits      = flag.String("rpc-rate-limits", "", "Comma separated rate limits of RPCs of the form method=n/period, e.g. ListVolumes=1/30s,CreateVolume=20/1m, requests above the limit fail with ResourceExhausted")
+		maxOperations      = flag.Int("max-concurrent-operations", 0, "Maximum number of creates, deletes, attaches and detaches running at the same time, further requests wait for a free worker, 0 disables the limit")
+		slowRequest        = flag.Duration("slow-request-threshold", 30*time.Second, "Duration above which requests are logged at warn level with a breakdown of the API and action wait time, 0 disables it")
+		hcloudIdleConns    = flag.Int("hcloud-max-idle-conns", 10, "Number of idle connections to the Hetzner Cloud API kept open")
+		hcloudIdleTimeout  = flag.Duration("hcloud-idle-conn-timeout", 90*time.Second, "Time idle connections to the Hetzner Cloud API are kept open")
+		hcloudKeepAlive    = flag.Duration("hcloud-keep-alive", 30*time.Second, "TCP keep-alive interval of connections to the Hetzner Cloud API")
+		defaultVolumeSize  = flag.Int64("default-volume-size", 16, "Size in GB of volumes created without a requested capacity, the defaultSize StorageClass parameter takes precedence")
+		minVolumeSize      = flag.Int64("min-volume-size", 10, "Minimum size in GB of new volumes, defaults to the minimum of Hetzner Cloud")
+		roundUpSmall       = flag.Bool("round-up-small-requests", false, "Create volumes requested smaller than --min-volume-size with the minimum size instead of rejecting them")
+		listOnlyManaged    = flag.Bool("list-only-managed", false, "List only volumes created by the driver instead of all volumes of the project")
+		actionTimeout      = flag.Duration("action-timeout", time.Minute, "Maximum time to wait for hcloud actions like creating or attaching a volume to complete")
+		actionPollInterval = flag.Duration("action-poll-interval", time.Second, "Initial interval hcloud actions are polled in, doubled after every poll up to 10s")
+		actionLogEvery     = flag.Int("action-log-every", 10, "Log only the first and every n-th poll of a pending hcloud action besides its completion, 1 logs every poll")
+		fsckMode           = flag.String("fsck-mode", "off", "Check existing filesystems before mounting them: off, preen or force")
+		formatPolicy       = flag.String("format-policy", "safe", "Formatting of volumes with an existing filesystem: safe (never reformat) or reformat-mismatch (reformat if the filesystem type differs)")
+		formatOnStage      = flag.Bool("format-on-stage", true, "Format unformatted volumes when staging them, if disabled only volumes with an existing filesystem can be used")
+		deviceWaitTimeout  = flag.Duration("device-wait-timeout", 30*time.Second, "Maximum time to wait for the device of an attached volume to appear")
+		udevSettle         = flag.Bool("udev-settle", false, "Run 'udevadm settle' before waiting for the device of an attached volume")
+		fstrimInterval     = flag.Duration("fstrim-interval", 0, "Interval in which fstrim is run on all mounted volumes, 0 disables it")
+		dataDir            = flag.String("data-dir", "/var/lib/kubelet/plugins/de.apricote.hcloud.csi.volumes", "Directory to persist the state of staged volumes in, empty disables it")
+		removeTargetPaths  = flag.Bool("remove-target-paths", false, "Remove the directory of the target path after unpublishing a volume, as the CSI spec v1 requires, Kubernetes removes it itself")
+		remountStaged      = flag.Bool("remount-staged", false, "Mount staged volumes again whose staging mount disappeared while the device is present, needs --mount-health-interval")
+		reducedPrivileges  = flag.Bool("reduced-privileges", false, "Run the node service without privileged mode, it mounts with syscalls and needs only CAP_SYS_ADMIN and the /dev of the host")
+		mountHealth        = flag.Duration("mount-health-interval", time.Minute, "Interval in which staged volumes are checked for missing devices and read-only filesystems and their filesystem usage is exported as metrics, 0 disables it")
+		metricsAddress     = flag.String("metrics-address", "", "Address to serve Prometheus metrics and the /debug/loglevel endpoint on, e.g. ':9189', empty disables it")
+		inventoryInterval  = flag.Duration("inventory-interval", 5*time.Minute, "Interval the managed volumes are listed in for the inventory metrics, only used with --metrics-address")
+		costExporter       = flag.Bool("cost-exporter", false, "Export the estimated monthly cost of the managed volumes by StorageClass and namespace, only used with --metrics-address")
+		healthAddress      = flag.String("health-address", "", "Address to serve the /healthz and /readyz endpoints on, e.g. ':9808', they are served on the metrics address as well")
+		enablePprof        = flag.Bool("enable-pprof", false, "Serve the Go profiling endpoints under /debug/pprof/ on --pprof-address")
+		pprofAddress       = flag.String("pprof-address", "localhost:6060", "Address to serve the profiling endpoints on if --enable-pprof is set, it should only be reachable from the host")
+		grpcReflection     = flag.Bool("grpc-reflection", false, "Register the gRPC reflection service on the CSI endpoint for debugging with grpcurl")
+		kubeEvents         = flag.Bool("kube-events", false, "Post events on the PersistentVolume and claim of volumes that could not be attached or detached, needs to run in the cluster")
+		webhookURL         = flag.String("webhook-url", "", "URL to notify once creating or publishing a volume failed repeatedly, empty disables it")
+		webhookFormat      = flag.String("webhook-format", "json", "Payload of the webhook: json or slack (for Slack incoming webhooks)")
+		webhookThreshold   = flag.Int("webhook-threshold", 3, "Number of consecutive failures of an operation on the same volume after which the webhook is notified")
+		leaderElection     = flag.Bool("leader-election", false, "Elect a single controller replica to run the background loops, so the controller can run with multiple replicas, needs to run in the cluster")
+		leaderElectionNS   = flag.String("leader-election-namespace", "", "Namespace of the leader election ConfigMap, defaults to the namespace of the pod")
+		leaderElectionName = flag.String("leader-election-name", "", "Name of the leader election ConfigMap, defaults to the driver name")
+		reconcileInterval  = flag.Duration("reconcile-interval", 0, "Interval the volume attachments are compared with the VolumeAttachments of the cluster in to repair drift, 0 disables it, needs to run in the cluster")
+		embedded           = flag.Bool("embedded-controllers", false, "Provision and attach volumes from the claims and VolumeAttachments of the cluster, replacing the external-provisioner and external-attacher sidecars, needs to run in the cluster")
+		selfCheck          = flag.Bool("self-check", false, "Verify at startup that the token has write permission and the API version is supported, creates and deletes a labelled SSH key")
+		journalDir         = flag.String("journal-dir", "", "Directory to record in-flight controller operations in, so they are finished after a restart, it has to survive restarts, empty disables it")
+		orphanGracePeriod  = flag.Duration("orphan-grace-period", time.Hour, "Time after which volumes of interrupted creates are deleted if the CO doesn't ask for them again, only used with --journal-dir")
+		registrationDir    = flag.String("plugin-registration-dir", "", "Plugin registration directory of kubelet to register the node service in, e.g. '/var/lib/kubelet/plugins_registry', instead of a driver-registrar sidecar, empty disables it")
+		kubeletEndpoint    = flag.String("kubelet-registration-path", "", "Path of the CSI socket on the host, registered with kubelet, e.g. '/var/lib/kubelet/plugins/de.apricote.hcloud.csi.volumes/csi.sock'")
+		selfTestTimeout    = flag.Duration("selftest-timeout", 10*time.Minute, "Maximum time the selftest subcommand may take before it cleans up")
+		dockerPluginSocket = flag.String("docker-plugin-socket", "", "Unix socket to serve the Docker volume plugin API on for standalone Docker hosts, e.g. '/run/docker/plugins/hcloud.sock' for 'docker volume create -d hcloud', empty disables it")
+		dockerPluginDir    = flag.String("docker-plugin-dir", "/var/lib/hcloud-csi-driver/docker", "Directory the volumes of the Docker volume plugin are mounted in, it has to be visible to the Docker daemon")
+		hostRoot           = flag.String("host-root", "", "Path the root filesystem of the host is mounted at, e.g. '/host', to run its mount and mkfs utilities instead of the bundled ones")
 	)
 	flag.Parse()
 
+	if *config != "" {
+		if err := loadConfig(flag.CommandLine, *config); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// the default paths contain the driver name, so a driver with another
+	// name doesn't share them
+	if *name != driver.DefaultDriverName {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		for _, f := range []string{"endpoint", "data-dir"} {
+			if !set[f] {
+				flag.Set(f, strings.Replace(flag.Lookup(f).Value.String(), driver.DefaultDriverName, *name, 1))
+			}
+		}
+	}
+
 	if *version {
-		fmt.Printf("%s - %s (%s)\n", driver.GetVersion(), driver.GetCommit(), driver.GetTreeState())
+		switch *output {
+		case "json":
+			out, err := json.MarshalIndent(driver.GetBuildInfo(), "", "  ")
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println(string(out))
+		case "text":
+			fmt.Printf("%s - %s (%s)\n", driver.GetVersion(), driver.GetCommit(), driver.GetTreeState())
+		default:
+			log.Fatalf("invalid output %q, must be one of: text, json\n", *output)
+		}
 		os.Exit(0)
 	}
 
-	drv, err := driver.NewDriver(*endpoint, *token, *url, *hostname)
+	if *fakeHCloud != "" {
+		apiURL, err := serveFakeHCloud(*fakeHCloud, *fakeActionLatency, *nodeID, *hostname)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("serving fake Hetzner Cloud API on %s\n", apiURL)
 
+		*url = apiURL
+		if *token == "" {
+			*token = "fake-hcloud-token"
+		}
+	}
+
+	if !*enablePprof {
+		*pprofAddress = ""
+	}
+
+	opts := []driver.Option{
+		driver.WithEndpoint(*endpoint),
+		driver.WithToken(*token),
+		driver.WithHCloudURL(*url),
+		driver.WithHostname(*hostname),
+		driver.WithNodeID(*nodeID),
+		driver.WithClusterName(*clusterName),
+		driver.WithDriverName(*name),
+		driver.WithTopologyKey(*topologyKey),
+		driver.WithTopologyAliases(splitList(*topologyAliases)),
+		driver.WithSocketMode(*socketMode),
+		driver.WithSocketOwner(*socketOwner),
+		driver.WithMode(driver.Mode(*mode)),
+		driver.WithLogFormat(driver.LogFormat(*logFormat)),
+		driver.WithLogSink(driver.LogSink(*logSink)),
+		driver.WithLogLevel(*logLevel),
+		driver.WithLogFile(*logFile),
+		driver.WithLogRotation(*logMaxSize, *logMaxAge, *logMaxBackups),
+		driver.WithTokenFile(*tokenFile),
+		driver.WithTokenSecret(*tokenSecret),
+		driver.WithProjectsFile(*projectsFile),
+		driver.WithProjectsSecret(*projectsSecret),
+		driver.WithHCloudProxy(*hcloudProxy),
+		driver.WithHCloudCAFile(*hcloudCAFile),
+		driver.WithHCloudSecondaryToken(*secondaryToken),
+		driver.WithInjectedErrors(*injectErrors),
+		driver.WithDryRun(*dryRun),
+		driver.WithHCloudRecording(*hcloudRecord),
+		driver.WithHCloudRequestTimeout(*hcloudTimeout),
+		driver.WithSlowRequestThreshold(*slowRequest),
+		driver.WithMaxConcurrentOperations(*maxOperations),
+		driver.WithRPCRateLimits(*rpcRateLimits),
+		driver.WithTLS(*tlsCert, *tlsKey, *tlsClientCA),
+		driver.WithHCloudMaxIdleConns(*hcloudIdleConns),
+		driver.WithHCloudIdleConnTimeout(*hcloudIdleTimeout),
+		driver.WithHCloudKeepAlive(*hcloudKeepAlive),
+		driver.WithDefaultVolumeSize(*defaultVolumeSize),
+		driver.WithMinVolumeSize(*minVolumeSize),
+		driver.WithRoundUpSmallRequests(*roundUpSmall),
+		driver.WithListOnlyManaged(*listOnlyManaged),
+		driver.WithActionTimeout(*actionTimeout),
+		driver.WithActionPollInterval(*actionPollInterval),
+		driver.WithActionLogEvery(*actionLogEvery),
+		driver.WithFsckMode(driver.FsckMode(*fsckMode)),
+		driver.WithFormatPolicy(driver.FormatPolicy(*formatPolicy)),
+		driver.WithFormatOnStage(*formatOnStage),
+		driver.WithDeviceWaitTimeout(*deviceWaitTimeout),
+		driver.WithUdevSettle(*udevSettle),
+		driver.WithFstrimInterval(*fstrimInterval),
+		driver.WithDataDir(*dataDir),
+		driver.WithMountHealthInterval(*mountHealth),
+		driver.WithRemountStaged(*remountStaged),
+		driver.WithRemoveTargetPaths(*removeTargetPaths),
+		driver.WithReducedPrivileges(*reducedPrivileges),
+		driver.WithMetricsAddress(*metricsAddress),
+		driver.WithInventoryInterval(*inventoryInterval),
+		driver.WithCostExporter(*costExporter),
+		driver.WithHealthAddress(*healthAddress),
+		driver.WithPprofAddress(*pprofAddress),
+		driver.WithGRPCReflection(*grpcReflection),
+		driver.WithKubeEvents(*kubeEvents),
+		driver.WithWebhook(*webhookURL, driver.WebhookFormat(*webhookFormat), *webhookThreshold),
+		driver.WithLeaderElection(*leaderElection, *leaderElectionNS, *leaderElectionName),
+		driver.WithReconcileInterval(*reconcileInterval),
+		driver.WithEmbeddedControllers(*embedded),
+		driver.WithSelfCheck(*selfCheck),
+		driver.WithJournalDir(*journalDir, *orphanGracePeriod),
+		driver.WithPluginRegistration(*registrationDir, *kubeletEndpoint),
+		driver.WithDockerPlugin(*dockerPluginSocket, *dockerPluginDir),
+		driver.WithHostRoot(*hostRoot),
+	}
+
+	if command == "doctor" {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		err := driver.Doctor(ctx, os.Stdout, opts...)
+		cancel()
+		if err != nil {
+			log.Fatalln("doctor:", err)
+		}
+		os.Exit(0)
+	}
+
+	drv, err := driver.NewDriver(opts...)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	if command == "selftest" {
+		ctx, cancel := context.WithTimeout(context.Background(), *selfTestTimeout)
+
+		// an interrupted self test still deletes its volume
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+			<-sigs
+			cancel()
+		}()
+
+		err := drv.SelfTest(ctx, os.Stdout)
+		cancel()
+		if err != nil {
+			log.Fatalln("self test failed:", err)
+		}
+		fmt.Println("self test passed")
+		os.Exit(0)
+	}
+
+	// stop gracefully when the pod is terminated, so no volume is left
+	// half attached
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		<-sigs
+
+		drv.Shutdown(*shutdownTimeout)
+		close(stopped)
+	}()
+
 	if err := drv.Run(); err != nil {
 		log.Fatalln(err)
 	}
+	<-stopped
+}
+
+// serveFakeHCloud serves the fake API on the address in the background and
+// returns its URL. The server of the node is added in fsn1, its ID defaults
+// to 1 and its name to the hostname.
+func serveFakeHCloud(addr string, actionLatency time.Duration, nodeID, hostname string) (string, error) {
+	id := 1
+	if nodeID != "" {
+		var err error
+		if id, err = strconv.Atoi(nodeID); err != nil {
+			return "", fmt.Errorf("invalid node id %q for the fake hcloud API: %s", nodeID, err)
+		}
+	}
+
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	fake := fakehcloud.New()
+	fake.ActionLatency = actionLatency
+	fake.AddServer(id, hostname, "fsn1")
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("could not listen for the fake hcloud API: %s", err)
+	}
+
+	go func() {
+		if err := http.Serve(ln, fake); err != nil {
+			log.Println("serving the fake hcloud API failed:", err)
+		}
+	}()
+	return "http://" + ln.Addr().String(), nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
@@ -0,0 +1,258 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The benchmark runs against the fake hcloud API unless HCLOUD_BENCH_TOKEN
+// and HCLOUD_BENCH_SERVER are set, then it creates real volumes in the
+// project and attaches them to the server. HCLOUD_BENCH_PARALLEL sets the
+// number of parallel cycles, HCLOUD_BENCH_ACTION_LATENCY the run time of
+// the actions of the fake.
+const (
+	benchParallel      = 8
+	benchActionLatency = 50 * time.Millisecond
+)
+
+var benchPhases = []string{"create", "attach", "detach", "delete"}
+
+// benchTarget returns a driver talking to the hcloud API of the benchmark
+// and the node to attach the volumes to.
+func benchTarget(b *testing.B) (*Driver, string, func()) {
+	d := &Driver{
+		actionPollInterval: time.Second,
+		log:                logrus.New().WithField("bench", true),
+	}
+	d.log.Logger.SetLevel(logrus.WarnLevel)
+
+	token, server := os.Getenv("HCLOUD_BENCH_TOKEN"), os.Getenv("HCLOUD_BENCH_SERVER")
+	if token != "" && server != "" {
+		id, err := strconv.Atoi(server)
+		if err != nil {
+			b.Fatalf("invalid HCLOUD_BENCH_SERVER %q: %s", server, err)
+		}
+		d.hcloudClient = d.clientWithTransport(token, hcloud.Endpoint, http.DefaultTransport, d.rateLimit)
+
+		s, _, err := d.hcloudClient.Server.GetByID(context.Background(), id)
+		if err != nil || s == nil {
+			b.Fatalf("server %d not found: %v", id, err)
+		}
+		d.location = s.Datacenter.Location.Name
+		return d, server, func() {}
+	}
+
+	latency := benchActionLatency
+	if v := os.Getenv("HCLOUD_BENCH_ACTION_LATENCY"); v != "" {
+		var err error
+		if latency, err = time.ParseDuration(v); err != nil {
+			b.Fatalf("invalid HCLOUD_BENCH_ACTION_LATENCY %q: %s", v, err)
+		}
+	}
+
+	fake := fakehcloud.New()
+	fake.ActionLatency = latency
+	fake.AddServer(10, "node-10", "fsn1")
+	ts := httptest.NewServer(fake)
+
+	d.location = "fsn1"
+	d.actionPollInterval = latency / 5
+	d.hcloudClient = d.clientWithTransport("fake-hcloud-token", ts.URL, http.DefaultTransport, d.rateLimit)
+	return d, "10", ts.Close
+}
+
+// benchCall calls the controller like a CO, which retries requests that are
+// aborted because the volume or the server is locked.
+func benchCall(call func() error) (time.Duration, error) {
+	start := time.Now()
+	for {
+		err := call()
+		if status.Code(err) != codes.Aborted && status.Code(err) != codes.Unavailable {
+			return time.Since(start), err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// benchCycle creates, attaches, detaches and deletes a volume and returns
+// the latencies of the phases.
+func benchCycle(d *Driver, node, name string) ([]time.Duration, error) {
+	ctx := context.Background()
+	latencies := make([]time.Duration, len(benchPhases))
+
+	var volumeID string
+	var err error
+	latencies[0], err = benchCall(func() error {
+		resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * GB},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: supportedAccessMode,
+			}},
+		})
+		if err == nil {
+			volumeID = resp.Volume.Id
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	latencies[1], err = benchCall(func() error {
+		_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           node,
+			VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+		})
+		return err
+	})
+	if err == nil {
+		latencies[2], err = benchCall(func() error {
+			_, err := d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: node})
+			return err
+		})
+	}
+
+	// the volume is deleted even if attaching failed, a benchmark against a
+	// real project must not leave volumes behind
+	var deleteErr error
+	latencies[3], deleteErr = benchCall(func() error {
+		_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latencies, deleteErr
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	for p, want := range map[float64]time.Duration{
+		0.5:  50 * time.Millisecond,
+		0.99: 99 * time.Millisecond,
+		1:    100 * time.Millisecond,
+	} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile %v: got %s, want %s", p, got, want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("got %s for no durations", got)
+	}
+}
+
+// BenchmarkVolumeLifecycle runs b.N create-attach-detach-delete cycles in
+// parallel and reports the throughput and the latency percentiles of the
+// phases, e.g.
+//
+//	go test -run XXX -bench VolumeLifecycle -benchtime 200x ./driver/
+func BenchmarkVolumeLifecycle(b *testing.B) {
+	parallel := benchParallel
+	if v := os.Getenv("HCLOUD_BENCH_PARALLEL"); v != "" {
+		var err error
+		if parallel, err = strconv.Atoi(v); err != nil || parallel < 1 {
+			b.Fatalf("invalid HCLOUD_BENCH_PARALLEL %q", v)
+		}
+	}
+
+	d, node, done := benchTarget(b)
+	defer done()
+
+	var (
+		mu        sync.Mutex
+		latencies = make([][]time.Duration, len(benchPhases))
+		failed    int
+	)
+	cycles := make(chan int)
+	prefix := fmt.Sprintf("bench-%d", time.Now().Unix())
+
+	b.ResetTimer()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range cycles {
+				l, err := benchCycle(d, node, fmt.Sprintf("%s-%d", prefix, n))
+
+				mu.Lock()
+				if err != nil {
+					failed++
+					b.Logf("cycle %d failed: %s", n, err)
+				} else {
+					for phase := range benchPhases {
+						latencies[phase] = append(latencies[phase], l[phase])
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for n := 0; n < b.N; n++ {
+		cycles <- n
+	}
+	close(cycles)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.Logf("%d cycles, %d parallel, %d failed, %.2f cycles/s",
+		b.N, parallel, failed, float64(b.N-failed)/elapsed.Seconds())
+	for phase, name := range benchPhases {
+		l := latencies[phase]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		b.Logf("%-6s p50 %-12s p90 %-12s p99 %s", name, percentile(l, 0.5), percentile(l, 0.9), percentile(l, 0.99))
+	}
+	if failed > 0 {
+		b.Errorf("%d of %d cycles failed", failed, b.N)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+const (
+	// serverCacheTTL is the time servers are cached for. Attaching and
+	// detaching only needs to know that the server exists, which rarely
+	// changes.
+	serverCacheTTL = 5 * time.Minute
+
+	// volumeCacheTTL is the time volumes are cached for. Volumes are
+	// invalidated whenever the driver changes them, the short TTL bounds
+	// how long changes made outside of the driver go unnoticed.
+	volumeCacheTTL = 10 * time.Second
+)
+
+// serverCache caches servers looked up by their ID. The zero value is ready
+// to use.
+type serverCache struct {
+	mu      sync.Mutex
+	entries map[int]serverCacheEntry
+}
+
+type serverCacheEntry struct {
+	server  *hcloud.Server
+	expires time.Time
+}
+
+// get returns the cached server or nil if it isn't cached or expired.
+func (c *serverCache) get(id int) *hcloud.Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.server
+}
+
+// add caches the server.
+func (c *serverCache) add(server *hcloud.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[int]serverCacheEntry{}
+	}
+	c.entries[server.ID] = serverCacheEntry{
+		server:  server,
+		expires: time.Now().Add(serverCacheTTL),
+	}
+}
+
+// invalidate removes the server from the cache.
+func (c *serverCache) invalidate(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+}
+
+// getServer returns the server with the given ID from the cache or the
+// hcloud API. It returns nil if the server does not exist.
+func (d *Driver) getServer(ctx context.Context, id int) (*hcloud.Server, error) {
+	if server := d.servers.get(id); server != nil {
+		return server, nil
+	}
+
+	server, _, err := d.client(ctx).Server.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if server == nil {
+		d.servers.invalidate(id)
+		return nil, nil
+	}
+
+	d.servers.add(server)
+	return server, nil
+}
+
+// volumeCache caches volumes by their ID and, for volumes of the configured
+// project, by their name. The zero value is ready to use.
+type volumeCache struct {
+	mu      sync.Mutex
+	entries map[int]volumeCacheEntry
+	names   map[string]int
+}
+
+type volumeCacheEntry struct {
+	volume  *hcloud.Volume
+	expires time.Time
+}
+
+// get returns the cached volume or nil if it isn't cached or expired.
+func (c *volumeCache) get(id int) *hcloud.Volume {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lookup(id)
+}
+
+// getByName returns the volume cached with the given name or nil if it
+// isn't cached or expired.
+func (c *volumeCache) getByName(name string) *hcloud.Volume {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.names[name]
+	if !ok {
+		return nil
+	}
+
+	volume := c.lookup(id)
+	if volume == nil || volume.Name != name {
+		return nil
+	}
+	return volume
+}
+
+func (c *volumeCache) lookup(id int) *hcloud.Volume {
+	entry, ok := c.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.volume
+}
+
+// add caches the volume.
+func (c *volumeCache) add(volume *hcloud.Volume) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[int]volumeCacheEntry{}
+	}
+	c.entries[volume.ID] = volumeCacheEntry{
+		volume:  volume,
+		expires: time.Now().Add(volumeCacheTTL),
+	}
+}
+
+// addByName caches the volume and makes it available by its name. Names are
+// only unique within a project, so only volumes of one project may be added
+// by name.
+func (c *volumeCache) addByName(volume *hcloud.Volume) {
+	c.add(volume)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.names == nil {
+		c.names = map[string]int{}
+	}
+	c.names[volume.Name] = volume.ID
+}
+
+// invalidate removes the volume from the cache. It has to be called
+// whenever the volume is changed.
+func (c *volumeCache) invalidate(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+	for name, cached := range c.names {
+		if cached == id {
+			delete(c.names, name)
+		}
+	}
+}
+
+// invalidateName removes the volume with the given name from the cache. It
+// has to be called whenever a volume with the name is created.
+func (c *volumeCache) invalidateName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.names[name]; ok {
+		delete(c.entries, id)
+		delete(c.names, name)
+	}
+}
+
+// getVolume returns the volume with the given ID from the cache or the
+// hcloud API. It returns nil if the volume does not exist.
+func (d *Driver) getVolume(ctx context.Context, id int) (*hcloud.Volume, error) {
+	if volume := d.volumes.get(id); volume != nil {
+		return volume, nil
+	}
+
+	volume, _, err := d.client(ctx).Volume.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if volume == nil {
+		d.volumes.invalidate(id)
+		return nil, nil
+	}
+
+	d.volumes.add(volume)
+	return volume, nil
+}
+
+// getVolumeByName returns the volume with the given name from the cache or
+// the hcloud API. It returns nil if the volume does not exist. Only volumes
+// of the configured project are cached by name, the volumes of the token of
+// the secrets or of another project may have the same names.
+func (d *Driver) getVolumeByName(ctx context.Context, name string) (*hcloud.Volume, error) {
+	cached := !hasClient(ctx)
+	if cached {
+		if volume := d.volumes.getByName(name); volume != nil {
+			return volume, nil
+		}
+	}
+
+	volume, _, err := d.client(ctx).Volume.GetByName(ctx, name)
+	if err != nil || volume == nil {
+		return nil, err
+	}
+
+	if cached {
+		d.volumes.addByName(volume)
+	} else {
+		d.volumes.add(volume)
+	}
+	return volume, nil
+}
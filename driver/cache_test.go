@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestServerCache(t *testing.T) {
+	var c serverCache
+
+	if c.get(1) != nil {
+		t.Fatal("empty cache returned a server")
+	}
+
+	c.add(&hcloud.Server{ID: 1})
+	if server := c.get(1); server == nil || server.ID != 1 {
+		t.Errorf("got server %v, want server 1", server)
+	}
+
+	c.invalidate(1)
+	if c.get(1) != nil {
+		t.Error("invalidated server is still cached")
+	}
+
+	c.add(&hcloud.Server{ID: 2})
+	c.entries[2] = serverCacheEntry{server: c.entries[2].server, expires: time.Now().Add(-time.Second)}
+	if c.get(2) != nil {
+		t.Error("expired server is still cached")
+	}
+}
+
+func TestVolumeCache(t *testing.T) {
+	var c volumeCache
+
+	c.add(&hcloud.Volume{ID: 1, Name: "pvc-1"})
+	if volume := c.get(1); volume == nil || volume.Name != "pvc-1" {
+		t.Errorf("got volume %v, want pvc-1", volume)
+	}
+
+	c.invalidate(1)
+	if c.get(1) != nil {
+		t.Error("invalidated volume is still cached")
+	}
+
+	if c.getByName("pvc-2") != nil {
+		t.Fatal("empty cache returned a volume by name")
+	}
+
+	c.add(&hcloud.Volume{ID: 2, Name: "pvc-2"})
+	if c.getByName("pvc-2") != nil {
+		t.Error("volume added by ID is cached by name")
+	}
+
+	c.addByName(&hcloud.Volume{ID: 2, Name: "pvc-2"})
+	if volume := c.getByName("pvc-2"); volume == nil || volume.ID != 2 {
+		t.Errorf("got volume %v, want volume 2", volume)
+	}
+
+	c.invalidate(2)
+	if c.getByName("pvc-2") != nil {
+		t.Error("invalidated volume is still cached by name")
+	}
+
+	c.addByName(&hcloud.Volume{ID: 3, Name: "pvc-3"})
+	c.invalidateName("pvc-3")
+	if c.getByName("pvc-3") != nil || c.get(3) != nil {
+		t.Error("volume is still cached after invalidating its name")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// paramPVCName and paramPVCNamespace are passed by the external
+	// provisioner if it runs with --extra-create-metadata. They are kept as
+	// volume attributes, so every later operation on the volume can log the
+	// claim.
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
+	// labelPVCName and labelPVCNamespace are set on the hcloud volume, so the
+	// claim is known for operations without volume attributes.
+	labelPVCName      = "pvcName"
+	labelPVCNamespace = "pvcNamespace"
+)
+
+// labelValueRegexp matches valid values of hcloud labels.
+var labelValueRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([-_.a-zA-Z0-9]{0,61}[a-zA-Z0-9])?)?$`)
+
+// claimFields returns the log fields identifying the claim of a volume.
+// Empty values are left out.
+func claimFields(name, namespace string) logrus.Fields {
+	fields := logrus.Fields{}
+	if name != "" {
+		fields["pvc_name"] = name
+	}
+	if namespace != "" {
+		fields["pvc_namespace"] = namespace
+	}
+	return fields
+}
+
+// attributeClaimFields returns the log fields of the claim in the volume
+// attributes.
+func attributeClaimFields(attributes map[string]string) logrus.Fields {
+	return claimFields(attributes[paramPVCName], attributes[paramPVCNamespace])
+}
+
+// claimLabels returns the hcloud labels of the claim in the parameters of
+// CreateVolume. Values which are no valid label values are left out.
+func claimLabels(params map[string]string) map[string]string {
+	labels := map[string]string{}
+	if v := params[paramPVCName]; v != "" && labelValueRegexp.MatchString(v) {
+		labels[labelPVCName] = v
+	}
+	if v := params[paramPVCNamespace]; v != "" && labelValueRegexp.MatchString(v) {
+		labels[labelPVCNamespace] = v
+	}
+	return labels
+}
+
+// cachedClaimFields returns the log fields of the claim of a volume from
+// its labels, if the volume is cached. The claim is only logged on a best
+// effort basis, so no volume is looked up for it.
+func (d *Driver) cachedClaimFields(volumeID int) logrus.Fields {
+	volume := d.volumes.get(volumeID)
+	if volume == nil {
+		return logrus.Fields{}
+	}
+	return claimFields(volume.Labels[labelPVCName], volume.Labels[labelPVCNamespace])
+}
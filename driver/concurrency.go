@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// operationQueueFactor is the number of operations per worker that may
+	// wait for a free worker, further operations are rejected until the
+	// queue drained.
+	operationQueueFactor = 10
+)
+
+// limitedMethods are the expensive RPCs that call the hcloud API and wait
+// for its actions.
+var limitedMethods = map[string]bool{
+	"/csi.v0.Controller/CreateVolume":              true,
+	"/csi.v0.Controller/DeleteVolume":              true,
+	"/csi.v0.Controller/ControllerPublishVolume":   true,
+	"/csi.v0.Controller/ControllerUnpublishVolume": true,
+}
+
+// operationLimiter bounds the number of expensive operations running at
+// the same time and the number of operations waiting for a worker. The
+// waiting operations are served in the order they arrived.
+type operationLimiter struct {
+	workers chan struct{}
+
+	mu       sync.Mutex
+	queued   int
+	maxQueue int
+}
+
+// newOperationLimiter returns a limiter running at most max operations at
+// the same time.
+func newOperationLimiter(max int) *operationLimiter {
+	return &operationLimiter{
+		workers:  make(chan struct{}, max),
+		maxQueue: max * operationQueueFactor,
+	}
+}
+
+// acquire blocks until a worker is free. It returns ResourceExhausted if
+// the queue is full and the error of the context if it is done before.
+func (l *operationLimiter) acquire(ctx context.Context) error {
+	// fast path without queueing
+	select {
+	case l.workers <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return status.Errorf(codes.ResourceExhausted, "too many operations in progress, %d are queued", l.maxQueue)
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return status.Error(codes.DeadlineExceeded, "timed out waiting for a free worker")
+		}
+		return status.Error(codes.Canceled, "canceled while waiting for a free worker")
+	}
+}
+
+// release frees the worker of an operation.
+func (l *operationLimiter) release() {
+	<-l.workers
+}
+
+// running returns the number of operations in progress and waiting.
+func (l *operationLimiter) running() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.workers), l.queued
+}
+
+// concurrencyInterceptor runs the expensive RPCs on a bounded number of
+// workers, so a burst of requests, e.g. attaching the volumes of all pods
+// of a failed node, doesn't exhaust the API rate limit.
+func (d *Driver) concurrencyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if d.operationLimiter == nil || !limitedMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	if err := d.operationLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer d.operationLimiter.release()
+
+	return handler(ctx, req)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConcurrencyInterceptor(t *testing.T) {
+	d := &Driver{operationLimiter: newOperationLimiter(1)}
+	d.operationLimiter.maxQueue = 1
+
+	publish := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/ControllerPublishVolume"}
+	probe := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Identity/Probe"}
+
+	// occupy the only worker
+	started := make(chan struct{})
+	block := make(chan struct{})
+	go d.concurrencyInterceptor(context.Background(), nil, publish, func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(started)
+		<-block
+		return nil, nil
+	})
+	<-started
+
+	// cheap requests are not limited
+	if _, err := d.concurrencyInterceptor(context.Background(), nil, probe, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("expected the probe to run, got %v", err)
+	}
+
+	// the second operation waits in the queue
+	done := make(chan error)
+	go func() {
+		_, err := d.concurrencyInterceptor(context.Background(), nil, publish, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		done <- err
+	}()
+
+	for {
+		if _, queued := d.operationLimiter.running(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the third one is rejected, the queue is full
+	_, err := d.concurrencyInterceptor(context.Background(), nil, publish, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Error("expected the operation not to run")
+		return nil, nil
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for a full queue, got %v", err)
+	}
+
+	close(block)
+	if err := <-done; err != nil {
+		t.Errorf("expected the queued operation to run, got %v", err)
+	}
+}
+
+func TestOperationLimiterContextDone(t *testing.T) {
+	l := newOperationLimiter(1)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	l.release()
+	if running, queued := l.running(); running != 0 || queued != 0 {
+		t.Errorf("expected no operations, got %d running and %d queued", running, queued)
+	}
+}
@@ -43,7 +43,51 @@ const (
 	defaultVolumeSizeInGB = 16 * GB
 	minVolumeSizeInGB     = 10 * GB
 
+	// labelCreatedBy marks volumes created by the driver with
+	// createdByHCloud.
+	labelCreatedBy  = "createdBy"
 	createdByHCloud = "hcloud-csi-driver"
+
+	// commands of the hcloud actions started by the driver
+	commandCreateVolume = "create_volume"
+	commandAttachVolume = "attach_volume"
+	commandDetachVolume = "detach_volume"
+
+	// operations reported to the webhook
+	operationCreateVolume  = "create_volume"
+	operationPublishVolume = "publish_volume"
+
+	// labelCluster is set to the cluster name on all volumes created by the
+	// driver, if a cluster name is configured.
+	labelCluster = "cluster"
+
+	// defaultActionTimeout is the time waitAction waits for an action to
+	// complete if no timeout is configured.
+	defaultActionTimeout = time.Minute
+
+	// defaultActionPollInterval is the first interval waitAction polls an
+	// action in. It is doubled after every poll up to
+	// maxActionPollInterval.
+	defaultActionPollInterval = time.Second
+	maxActionPollInterval     = 10 * time.Second
+
+	// defaultActionLogEvery is the default sampling of the polls of an
+	// action that are logged.
+	defaultActionLogEvery = 10
+
+	// paramReservedBlocksPercent is the StorageClass parameter defining the
+	// percentage of filesystem blocks reserved for the super-user on ext
+	// filesystems. It is passed to the node as a volume attribute.
+	paramReservedBlocksPercent = "reservedBlocksPercent"
+
+	// paramFormatOnStage is the StorageClass parameter that disables
+	// formatting the volume in NodeStageVolume when set to "false". It is
+	// passed to the node as a volume attribute.
+	paramFormatOnStage = "formatOnStage"
+
+	// paramDefaultSize is the StorageClass parameter defining the size in
+	// GB of volumes created without a capacity range.
+	paramDefaultSize = "defaultSize"
 )
 
 var (
@@ -57,18 +101,28 @@ var (
 
 // CreateVolume creates a new volume from the given request. The function is
 // idempotent.
-func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
 	if req.Name == "" {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Name must be provided")
 	}
 
+	ctx, err = d.withSecrets(ctx, req.ControllerCreateSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err = d.withProject(ctx, req.Parameters[paramProject])
+	if err != nil {
+		return nil, err
+	}
+
 	if req.VolumeCapabilities == nil || len(req.VolumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
 	}
 
 	if req.AccessibilityRequirements != nil {
 		for _, t := range req.AccessibilityRequirements.Requisite {
-			location, ok := t.Segments["location"]
+			location, ok := d.topologyLocation(t)
 			if !ok {
 				continue // nothing to do
 			}
@@ -80,23 +134,49 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
-	size, err := extractStorage(req.CapacityRange)
+	defaultSize, err := d.defaultVolumeSizeFor(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	size, err := extractStorage(req.CapacityRange, defaultSize)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	volumeName := req.Name
+	// round small requests up to the minimum, unless a limit forbids it
+	minSize := d.minVolumeSizeBytes()
+	if size < minSize && d.roundUpSmallRequests && (req.CapacityRange == nil || req.CapacityRange.LimitBytes == 0) {
+		size = minSize
+	}
+
+	attributes, err := volumeAttributes(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volumeName := d.volumeName(req.Name)
 
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_name":             volumeName,
 		"storage_size_giga_bytes": size / GB,
 		"method":                  "create_volume",
 		"volume_capabilities":     req.VolumeCapabilities,
-	})
+	}).WithFields(attributeClaimFields(attributes))
 	ll.Info("create volume called")
 
+	createEntry := &journalEntry{Operation: journalCreate, VolumeName: volumeName}
+	defer func() {
+		d.trackFailure(operationCreateVolume, volumeName, err)
+
+		// the CO got the volume, it isn't orphaned anymore
+		if err == nil {
+			d.journalDone(createEntry.id())
+		}
+	}()
+
 	// get volume first, if it's created do nothing
-	volume, _, err := d.hcloudClient.Volume.GetByName(ctx, volumeName)
+	volume, err := d.getVolumeByName(ctx, volumeName)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -115,8 +195,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		ll.Info("volume already created")
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				Id:            volumeID,
-				CapacityBytes: volumeCapacityGigaBytes,
+				Id:                 volumeID,
+				CapacityBytes:      volumeCapacityGigaBytes,
+				Attributes:         attributes,
+				AccessibleTopology: d.volumeTopology(),
 			},
 		}, nil
 	}
@@ -127,9 +209,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		Location: &hcloud.Location{
 			Name: d.location,
 		},
-		Labels: map[string]string{
-			"createdBy": createdByHCloud,
-		},
+		Labels: d.volumeLabels(),
+	}
+	for k, v := range claimLabels(req.Parameters) {
+		volumeReq.Labels[k] = v
 	}
 
 	if !validateCapabilities(req.VolumeCapabilities) {
@@ -137,8 +220,8 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	ll.Info("verify volume size is allowed")
-	if size < minVolumeSizeInGB {
-		return nil, status.Errorf(codes.OutOfRange, "requested volume size %d GB is lower than supported minimum of %d GB", size/GB, minVolumeSizeInGB/GB)
+	if size < minSize {
+		return nil, status.Errorf(codes.OutOfRange, "requested volume size %d GB is lower than supported minimum of %d GB", size/GB, minSize/GB)
 	}
 
 	ll.Info("checking volume limit")
@@ -147,25 +230,39 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	ll.WithField("volume_req", volumeReq).Info("creating volume")
-	hcloudResp, _, err := d.hcloudClient.Volume.Create(ctx, *volumeReq)
+	d.journalStart(createEntry)
+	hcloudResp, _, err := d.client(ctx).Volume.Create(ctx, *volumeReq)
 	if err != nil {
+		d.metrics.actionFailed(commandCreateVolume, errorCode(err))
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	// TODO: wait until hcloudResp.action signals completion
+
+	d.volumes.invalidateName(volumeName)
+	d.volumeProjects.set(hcloudResp.Volume.ID, req.Parameters[paramProject])
+	createEntry.VolumeID = hcloudResp.Volume.ID
+	if hcloudResp.Action != nil {
+		createEntry.ActionID = hcloudResp.Action.ID
+	}
+	d.journalStart(createEntry)
+
+	if hcloudResp.Action != nil {
+		ll.Info("waiting until volume is created")
+		if err := d.waitAction(ctx, hcloudResp.Volume.ID, hcloudResp.Action.ID); err != nil {
+			if code := status.Code(err); code == codes.Canceled || code == codes.DeadlineExceeded {
+				return nil, err
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 
 	volumeID := strconv.Itoa(hcloudResp.Volume.ID)
 
-	resp := &csi.CreateVolumeResponse{
+	resp = &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			Id:            volumeID,
-			CapacityBytes: size,
-			AccessibleTopology: []*csi.Topology{
-				{
-					Segments: map[string]string{
-						"location": d.location,
-					},
-				},
-			},
+			Id:                 volumeID,
+			CapacityBytes:      size,
+			Attributes:         attributes,
+			AccessibleTopology: d.volumeTopology(),
 		},
 	}
 
@@ -192,8 +289,24 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		// volume is deleted (does not exist)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	ll = ll.WithFields(d.cachedClaimFields(volumeID))
+
+	ctx, err = d.withSecrets(ctx, req.ControllerDeleteSecrets)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := d.hcloudClient.Volume.Delete(ctx, &hcloud.Volume{
+	ctx, err = d.withVolumeProject(ctx, volumeID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer d.volumeProjects.forget(volumeID)
+
+	d.volumes.invalidate(volumeID)
+	journalID := d.journalStart(&journalEntry{Operation: journalDelete, VolumeID: volumeID})
+	defer d.journalDone(journalID)
+
+	resp, err := d.client(ctx).Volume.Delete(ctx, &hcloud.Volume{
 		ID: volumeID,
 	})
 	if err != nil {
@@ -213,7 +326,7 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 // ControllerPublishVolume attaches the given volume to the node
-func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (resp *csi.ControllerPublishVolumeResponse, err error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
@@ -226,6 +339,11 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
 	}
 
+	ctx, err = d.withSecrets(ctx, req.ControllerPublishSecrets)
+	if err != nil {
+		return nil, err
+	}
+
 	volumeID, err := strconv.Atoi(req.VolumeId)
 	if err != nil {
 		// don't return because the CSI tests passes ID's in non-integer format.
@@ -241,6 +359,11 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		d.log.WithField("node_id", req.NodeId).Warn("node ID cannot be converted to an integer")
 	}
 
+	ctx, err = d.withVolumeProject(ctx, volumeID, req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
 	if req.Readonly {
 		// TODO(arslan): we should return codes.InvalidArgument, but the CSI
 		// test fails, because according to the CSI Spec, this flag cannot be
@@ -254,70 +377,109 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		"node_id":   req.NodeId,
 		"server_id": serverID,
 		"method":    "controller_publish_volume",
-	})
+	}).WithFields(attributeClaimFields(req.VolumeAttributes))
 	ll.Info("controller publish volume called")
 
-	// check if volume exist before trying to attach it
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	start := time.Now()
+	defer func() {
+		d.metrics.observeOperation("attach", start, err)
+		d.trackFailure(operationPublishVolume, req.VolumeId, err)
+	}()
+
+	// attach the volume right away, the volume and server are only looked
+	// up to tell what went wrong if attaching fails
+	d.volumes.invalidate(volumeID)
+	action, _, err := d.client(ctx).Volume.Attach(ctx, &hcloud.Volume{ID: volumeID}, &hcloud.Server{ID: serverID})
 	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+			// the cached server might have been deleted in the meantime
+			d.servers.invalidate(serverID)
 		}
-		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
-		// return nil, err
+
+		d.metrics.actionFailed(commandAttachVolume, errorCode(err))
+		ll.WithError(err).Info("attaching volume failed, looking up volume and server")
+		return d.attachFailed(ctx, ll, volumeID, serverID, err)
 	}
 
-	// check if server exist before trying to attach the volume to the server
-	server, resp, err := d.hcloudClient.Server.GetByID(ctx, serverID)
-	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
+	if action != nil {
+		journalID := d.journalStart(&journalEntry{
+			Operation: journalAttach,
+			VolumeID:  volumeID,
+			ServerID:  serverID,
+			ActionID:  action.ID,
+		})
+
+		ll.Info("waiting until volume is attached")
+		err := d.waitAction(ctx, volumeID, action.ID)
+		d.journalDone(journalID)
+		if err != nil {
+			return nil, err
 		}
-		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
-		// return nil, err
 	}
 
-	attachedServer := vol.Server
-	var attachedID int
-	if attachedServer != nil {
-		attachedID = attachedServer.ID
-		if attachedID == serverID {
-			ll.Info("volume is already attached")
-			return &csi.ControllerPublishVolumeResponse{}, nil
-		}
+	ll.Info("volume is attached")
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// attachFailed looks up the volume and server after attaching the volume
+// failed, to return the matching error code. Attaching a volume that is
+// already attached to the server succeeds.
+func (d *Driver) attachFailed(ctx context.Context, ll *logrus.Entry, volumeID, serverID int, attachErr error) (*csi.ControllerPublishVolumeResponse, error) {
+	vol, err := d.getVolume(ctx, volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// volume is attached to a different server, return an error
-	if attachedID != 0 {
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"volume is attached to the wrong server(%q), dettach the volume to fix it", attachedID)
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %d not found", volumeID)
 	}
 
-	// attach the volume to the correct node
-	action, resp, err := d.hcloudClient.Volume.Attach(ctx, vol, server)
+	server, err := d.getServer(ctx, serverID)
 	if err != nil {
-		return nil, status.Errorf(codes.Aborted, "volume %q could not be attached to server %q: %s", vol.ID, server.ID, err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if action != nil {
-		ll.Info("waiting until volume is attached")
-		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
-			return nil, err
+	if server == nil {
+		return nil, status.Errorf(codes.NotFound, "server %d not found", serverID)
+	}
+
+	if vol.Server != nil {
+		if vol.Server.ID == serverID {
+			ll.Info("volume is already attached")
+			return &csi.ControllerPublishVolumeResponse{}, nil
 		}
+
+		// volume is attached to a different server, return an error
+		reason := reasonAttachedToOtherServer
+		message := fmt.Sprintf("volume is attached to server %d and can't be attached to server %d", vol.Server.ID, serverID)
+		if d.kubeEvents && d.kubeClient != nil {
+			if other, err := d.getServer(ctx, vol.Server.ID); err == nil && other == nil {
+				reason = reasonAttachedToDeletedServer
+				message = fmt.Sprintf("volume is still attached to server %d, which was deleted", vol.Server.ID)
+			}
+		}
+		d.volumeEvent(volumeID, reason, message)
+
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume is attached to the wrong server(%d), dettach the volume to fix it", vol.Server.ID)
 	}
 
-	ll.Info("volume is attached")
-	return &csi.ControllerPublishVolumeResponse{}, nil
+	d.volumeEvent(volumeID, eventReason(attachErr, reasonAttachFailed),
+		fmt.Sprintf("attaching volume to server %d failed: %s", serverID, attachErr))
+	return nil, status.Errorf(codes.Aborted, "volume %d could not be attached to server %d: %s", volumeID, serverID, attachErr)
 }
 
 // ControllerUnpublishVolume deattaches the given volume from the node
-func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (resp *csi.ControllerUnpublishVolumeResponse, err error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
 
+	ctx, err = d.withSecrets(ctx, req.ControllerUnpublishSecrets)
+	if err != nil {
+		return nil, err
+	}
+
 	volumeID, err := strconv.Atoi(req.VolumeId)
 	if err != nil {
 		// don't return because the CSI tests passes ID's in non-integer format.
@@ -333,41 +495,66 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		d.log.WithField("node_id", req.NodeId).Warn("node ID cannot be converted to an integer")
 	}
 
+	ctx, err = d.withVolumeProject(ctx, volumeID, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id": req.VolumeId,
 		"node_id":   req.NodeId,
 		"server_id": serverID,
 		"method":    "controller_unpublish_volume",
-	})
+	}).WithFields(d.cachedClaimFields(volumeID))
 	ll.Info("controller unpublish volume called")
 
+	start := time.Now()
+	defer func() {
+		d.metrics.observeOperation("detach", start, err)
+	}()
+
 	// check if volume exist before trying to detach it
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, err := d.getVolume(ctx, volumeID)
 	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			// assume it's detached
-			return &csi.ControllerUnpublishVolumeResponse{}, nil
-		}
 		return nil, err
 	}
 
+	if vol == nil {
+		// assume it's detached
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
 	// check if server exist before trying to attach the volume to the server
-	_, resp, err = d.hcloudClient.Server.GetByID(ctx, serverID)
+	server, err := d.getServer(ctx, serverID)
 	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
-		}
 		return nil, err
 	}
 
-	action, resp, err := d.hcloudClient.Volume.Detach(ctx, vol)
+	if server == nil {
+		return nil, status.Errorf(codes.NotFound, "server %d not found", serverID)
+	}
+
+	d.volumes.invalidate(vol.ID)
+	action, _, err := d.client(ctx).Volume.Detach(ctx, vol)
 	if err != nil {
+		d.metrics.actionFailed(commandDetachVolume, errorCode(err))
+		d.volumeEvent(vol.ID, eventReason(err, reasonDetachFailed),
+			fmt.Sprintf("detaching volume from server %d failed: %s", serverID, err))
 		return nil, status.Errorf(codes.Aborted, "volume %q could not be deattached from server %q: %s", vol.ID, serverID, err)
 	}
 
 	if action != nil {
+		journalID := d.journalStart(&journalEntry{
+			Operation: journalDetach,
+			VolumeID:  vol.ID,
+			ServerID:  serverID,
+			ActionID:  action.ID,
+		})
+
 		ll.Info("waiting until volume is detached")
-		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+		err := d.waitAction(ctx, vol.ID, action.ID)
+		d.journalDone(journalID)
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -395,6 +582,11 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 
 	}
 
+	ctx, err = d.withVolumeProject(ctx, volumeID, req.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id":              req.VolumeId,
 		"volume_capabilities":    req.VolumeCapabilities,
@@ -405,19 +597,18 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	ll.Info("validate volume capabilities called")
 
 	// check if volume exist before trying to validate it it
-	_, volResp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, err := d.getVolume(ctx, volumeID)
 	if err != nil {
-		if volResp != nil && volResp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
-		}
-		// TODO: replace with actual error handling
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if vol == nil {
 		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
-		// return nil, err
 	}
 
 	if req.AccessibleTopology != nil {
 		for _, t := range req.AccessibleTopology {
-			location, ok := t.Segments["location"]
+			location, ok := d.topologyLocation(t)
 			if !ok {
 				continue // nothing to do
 			}
@@ -459,6 +650,10 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 		},
 	}
 
+	if d.listOnlyManaged {
+		listOpts.LabelSelector = d.managedLabelSelector()
+	}
+
 	ll := d.log.WithFields(logrus.Fields{
 		"list_opts":          listOpts,
 		"req_starting_token": req.StartingToken,
@@ -466,26 +661,35 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	})
 	ll.Info("list volumes called")
 
-	var volumes []*hcloud.Volume
-	lastPage := 0
-	for {
-		vols, resp, err := d.hcloudClient.Volume.List(ctx, listOpts)
-		if err != nil {
-			return nil, err
-		}
+	// listing all volumes is expensive, leave the remaining budget to
+	// attaching and detaching volumes
+	if low, reset := d.rateLimit.Low(); low {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"hcloud API rate limit is almost exhausted, retry after %s", reset.Format(time.RFC3339))
+	}
 
-		volumes = append(volumes, vols...)
+	// further pages are held back if the rate limit gets low while listing
+	ctx = withPriority(ctx, priorityBackground)
 
-		pagination := resp.Meta.Pagination
+	volumes, lastPage, err := d.listProjectVolumes(ctx, "", listOpts)
+	if err != nil {
+		return nil, err
+	}
 
-		if pagination == nil || pagination.Page == pagination.LastPage {
-			if pagination != nil {
-				lastPage = pagination.Page
+	// the volumes of the other projects are all listed with the first page
+	if req.StartingToken == "" {
+		for _, alias := range d.projectAliases() {
+			projectCtx, err := d.withProject(ctx, alias)
+			if err != nil {
+				return nil, err
 			}
-			break
-		}
 
-		listOpts.ListOpts.Page = pagination.NextPage
+			vols, _, err := d.listProjectVolumes(projectCtx, alias, listOpts)
+			if err != nil {
+				return nil, err
+			}
+			volumes = append(volumes, vols...)
+		}
 	}
 
 	var entries []*csi.ListVolumesResponse_Entry
@@ -508,6 +712,37 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	return resp, nil
 }
 
+// listProjectVolumes lists the volumes of the project of the context from
+// the page of the options on. It returns the volumes and the last page.
+func (d *Driver) listProjectVolumes(ctx context.Context, alias string, listOpts hcloud.VolumeListOpts) ([]*hcloud.Volume, int, error) {
+	var volumes []*hcloud.Volume
+	for {
+		vols, resp, err := d.client(ctx).Volume.List(ctx, listOpts)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		volumes = append(volumes, vols...)
+		for _, vol := range vols {
+			d.volumes.add(vol)
+			if len(d.projects) > 0 {
+				d.volumeProjects.set(vol.ID, alias)
+			}
+		}
+
+		pagination := resp.Meta.Pagination
+
+		if pagination == nil || pagination.Page == pagination.LastPage {
+			if pagination != nil {
+				return volumes, pagination.Page, nil
+			}
+			return volumes, 0, nil
+		}
+
+		listOpts.ListOpts.Page = pagination.NextPage
+	}
+}
+
 // GetCapacity returns the capacity of the storage pool
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	// TODO(arslan): check if we can provide this information somehow
@@ -589,13 +824,13 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 // extractStorage extracts the storage size in GB from the given capacity
 // range. If the capacity range is not satisfied it returns the default volume
 // size.
-func extractStorage(capRange *csi.CapacityRange) (int64, error) {
+func extractStorage(capRange *csi.CapacityRange, defaultSize int64) (int64, error) {
 	if capRange == nil {
-		return defaultVolumeSizeInGB, nil
+		return defaultSize, nil
 	}
 
 	if capRange.RequiredBytes == 0 && capRange.LimitBytes == 0 {
-		return defaultVolumeSizeInGB, nil
+		return defaultSize, nil
 	}
 
 	minSize := capRange.RequiredBytes
@@ -613,41 +848,218 @@ func extractStorage(capRange *csi.CapacityRange) (int64, error) {
 	return 0, errors.New("requiredBytes and LimitBytes are not the same")
 }
 
-// waitAction waits until the given action for the volume is completed
-func (d *Driver) waitAction(ctx context.Context, volumeID int, actionID int) error {
+// minVolumeSizeBytes returns the minimum size in bytes of new volumes.
+func (d *Driver) minVolumeSizeBytes() int64 {
+	if d.minVolumeSize > 0 {
+		return d.minVolumeSize
+	}
+	return minVolumeSizeInGB
+}
+
+// defaultVolumeSizeFor returns the size in bytes of volumes created without
+// a capacity range. The defaultSize parameter of the StorageClass takes
+// precedence over the configured default size.
+func (d *Driver) defaultVolumeSizeFor(params map[string]string) (int64, error) {
+	if v, ok := params[paramDefaultSize]; ok {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("invalid %s %q: must be a size in GB", paramDefaultSize, v)
+		}
+		return size * GB, nil
+	}
+
+	if d.defaultVolumeSize > 0 {
+		return d.defaultVolumeSize, nil
+	}
+	return defaultVolumeSizeInGB, nil
+}
+
+// volumeAttributes validates the StorageClass parameters and returns the
+// ones that are needed by the node service as volume attributes.
+func volumeAttributes(params map[string]string) (map[string]string, error) {
+	attributes := map[string]string{}
+
+	if v, ok := params[paramReservedBlocksPercent]; ok {
+		if _, err := parseReservedBlocksPercent(v); err != nil {
+			return nil, err
+		}
+		attributes[paramReservedBlocksPercent] = v
+	}
+
+	if v, ok := params[paramFormatOnStage]; ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: must be true or false", paramFormatOnStage, v)
+		}
+		attributes[paramFormatOnStage] = v
+	}
+
+	for _, key := range []string{paramPVCName, paramPVCNamespace, paramProject} {
+		if v, ok := params[key]; ok {
+			attributes[key] = v
+		}
+	}
+
+	return attributes, nil
+}
+
+// parseReservedBlocksPercent parses the reservedBlocksPercent parameter,
+// which has to be a percentage between 0 and 50.
+func parseReservedBlocksPercent(v string) (float64, error) {
+	percent, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", paramReservedBlocksPercent, v, err)
+	}
+
+	if percent < 0 || percent > 50 {
+		return 0, fmt.Errorf("invalid %s %q: must be between 0 and 50", paramReservedBlocksPercent, v)
+	}
+
+	return percent, nil
+}
+
+// actionPollIntervals returns the first and the longest interval actions
+// are polled in.
+func (d *Driver) actionPollIntervals() (time.Duration, time.Duration) {
+	interval := d.actionPollInterval
+	if interval == 0 {
+		interval = defaultActionPollInterval
+	}
+
+	maxInterval := maxActionPollInterval
+	if interval > maxInterval {
+		maxInterval = interval
+	}
+	return interval, maxInterval
+}
+
+// nextActionPollInterval doubles the interval actions are polled in up to
+// the longest interval, which is used right away while the rate limit runs
+// low.
+func nextActionPollInterval(interval, maxInterval time.Duration, low bool) time.Duration {
+	interval *= 2
+	if low || interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// waitAction waits until the given action for the volume is completed. The
+// action is polled with an exponential backoff, so long running actions
+// don't exhaust the API rate limit.
+func (d *Driver) waitAction(ctx context.Context, volumeID int, actionID int) (err error) {
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id": volumeID,
 		"action_id": actionID,
 	})
 
-	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	// the command is only known once the action was received
+	start := time.Now()
+	command := "unknown"
+	defer func() {
+		d.metrics.observeActionWait(command, start, err)
+		timingFromContext(ctx).addActionWait(time.Since(start))
+	}()
+
+	timeout := d.actionTimeout
+	if timeout == 0 {
+		timeout = defaultActionTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	// TODO(arslan): use backoff in the future
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	interval, maxInterval := d.actionPollIntervals()
+
+	polls := 0
 	for {
 		select {
-		case <-ticker.C:
-			action, _, err := d.hcloudClient.Action.GetByID(ctx, actionID)
-			if err != nil {
-				ll.WithError(err).Info("waiting for volume errored")
-				continue
+		case <-time.After(interval):
+		case <-ctx.Done():
+			// the caller gave up, which is no timeout of the action
+			if ctx.Err() == context.Canceled {
+				d.metrics.actionFailed(command, "canceled")
+				return status.Errorf(codes.Canceled, "waiting for storage action of volume %d was canceled", volumeID)
 			}
-			ll.WithField("action_status", action.Status).Info("action received")
+			d.metrics.actionFailed(command, "timeout")
+			return status.Errorf(codes.DeadlineExceeded, "timeout occured waiting for storage action of volume: %d", volumeID)
+		}
 
-			if action.Status == hcloud.ActionStatusSuccess {
-				ll.Info("action completed")
-				return nil
-			}
+		low, _ := d.rateLimitOf(ctx).Low()
+		interval = nextActionPollInterval(interval, maxInterval, low)
+
+		// only some polls are logged, so many pending actions don't flood
+		// the log
+		polls++
+		logPoll := d.sampleActionPoll(polls)
 
-			if action.Status == hcloud.ActionStatusRunning {
-				continue
+		action, _, err := d.client(ctx).Action.GetByID(ctx, actionID)
+		if err != nil {
+			if logPoll {
+				ll.WithError(err).WithField("polls", polls).Info("waiting for volume errored")
 			}
-		case <-ctx.Done():
-			return fmt.Errorf("timeout occured waiting for storage action of volume: %q", volumeID)
+			continue
+		}
+
+		if action == nil {
+			return fmt.Errorf("action %d of volume %d not found", actionID, volumeID)
+		}
+		if action.Command != "" {
+			command = action.Command
 		}
+		if logPoll {
+			ll.WithFields(logrus.Fields{
+				"action_status":   action.Status,
+				"action_progress": action.Progress,
+				"polls":           polls,
+			}).Info("action received")
+		}
+
+		switch action.Status {
+		case hcloud.ActionStatusSuccess:
+			ll.WithField("polls", polls).Info("action completed")
+			return nil
+		case hcloud.ActionStatusError:
+			d.metrics.actionFailed(command, errorCode(action.Error()))
+			return fmt.Errorf("storage action of volume %d failed: %s", volumeID, action.Error())
+		}
+	}
+}
+
+// sampleActionPoll returns whether the given poll of an action is logged.
+// The first and every actionLogEvery-th poll are logged.
+func (d *Driver) sampleActionPoll(poll int) bool {
+	return d.actionLogEvery <= 1 || poll == 1 || poll%d.actionLogEvery == 0
+}
+
+// managedLabelSelector returns the label selector matching all volumes
+// created by the driver, in this cluster if a cluster name is configured.
+func (d *Driver) managedLabelSelector() string {
+	selector := labelCreatedBy + "=" + createdByHCloud
+	if d.clusterName != "" {
+		selector += "," + labelCluster + "=" + d.clusterName
+	}
+	return selector
+}
+
+// volumeLabels returns the labels of a new volume.
+func (d *Driver) volumeLabels() map[string]string {
+	labels := map[string]string{
+		labelCreatedBy: createdByHCloud,
+	}
+	if d.clusterName != "" {
+		labels[labelCluster] = d.clusterName
+	}
+	return labels
+}
+
+// volumeName returns the name of the hcloud volume for the requested name.
+// It is prefixed with the cluster name, so volumes of different clusters in
+// the same project can't collide.
+func (d *Driver) volumeName(name string) string {
+	if d.clusterName == "" {
+		return name
 	}
+	return d.clusterName + "-" + name
 }
 
 // checkLimit checks whether the user hit their volume limit to ensure.
@@ -0,0 +1,402 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListVolumesOnlyManaged(t *testing.T) {
+	fakeHCloud := &fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "managed", Labels: map[string]string{labelCreatedBy: createdByHCloud}},
+			2: {ID: 2, Name: "unrelated"},
+			3: {ID: 3, Name: "other-cluster", Labels: map[string]string{labelCreatedBy: createdByHCloud, labelCluster: "other"}},
+		},
+	}
+
+	ts := httptest.NewServer(fakeHCloud)
+	defer ts.Close()
+
+	d := &Driver{
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	for _, tc := range []struct {
+		onlyManaged bool
+		clusterName string
+		want        int
+	}{
+		{onlyManaged: false, want: 3},
+		{onlyManaged: true, want: 2},
+		{onlyManaged: true, clusterName: "other", want: 1},
+	} {
+		d.listOnlyManaged = tc.onlyManaged
+		d.clusterName = tc.clusterName
+
+		resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Entries) != tc.want {
+			t.Errorf("only managed %t: expected %d volumes, got %d", tc.onlyManaged, tc.want, len(resp.Entries))
+		}
+	}
+}
+
+func TestDefaultVolumeSizeFor(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		defaultSize int64
+		params      map[string]string
+		want        int64
+		wantErr     bool
+	}{
+		{name: "built-in default", want: defaultVolumeSizeInGB},
+		{name: "configured default", defaultSize: 20 * GB, want: 20 * GB},
+		{name: "parameter", defaultSize: 20 * GB, params: map[string]string{paramDefaultSize: "50"}, want: 50 * GB},
+		{name: "invalid parameter", params: map[string]string{paramDefaultSize: "50Gi"}, wantErr: true},
+		{name: "zero parameter", params: map[string]string{paramDefaultSize: "0"}, wantErr: true},
+	} {
+		d := &Driver{defaultVolumeSize: tc.defaultSize}
+
+		size, err := d.defaultVolumeSizeFor(tc.params)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+
+		if size != tc.want {
+			t.Errorf("%s: expected size %d, got %d", tc.name, tc.want, size)
+		}
+	}
+}
+
+func TestSampleActionPoll(t *testing.T) {
+	d := &Driver{actionLogEvery: 10}
+
+	var logged []int
+	for poll := 1; poll <= 30; poll++ {
+		if d.sampleActionPoll(poll) {
+			logged = append(logged, poll)
+		}
+	}
+
+	if want := []int{1, 10, 20, 30}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("expected polls %v to be logged, got %v", want, logged)
+	}
+
+	d.actionLogEvery = 1
+	if !d.sampleActionPoll(7) {
+		t.Error("expected every poll to be logged")
+	}
+}
+
+func TestCreateVolumeMinSize(t *testing.T) {
+	fakeHCloud := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+	}
+
+	ts := httptest.NewServer(fakeHCloud)
+	defer ts.Close()
+
+	caps := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+
+	for _, tc := range []struct {
+		name     string
+		roundUp  bool
+		capRange *csi.CapacityRange
+		wantCode codes.Code
+		wantSize int64
+	}{
+		{name: "too small", capRange: &csi.CapacityRange{RequiredBytes: GB}, wantCode: codes.OutOfRange},
+		{name: "rounded up", roundUp: true, capRange: &csi.CapacityRange{RequiredBytes: GB}, wantSize: 20 * GB},
+		{name: "limited", roundUp: true, capRange: &csi.CapacityRange{RequiredBytes: GB, LimitBytes: GB}, wantCode: codes.OutOfRange},
+		{name: "large enough", capRange: &csi.CapacityRange{RequiredBytes: 30 * GB}, wantSize: 30 * GB},
+	} {
+		d := &Driver{
+			location:             "fsn1",
+			hcloudClient:         hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+			minVolumeSize:        20 * GB,
+			roundUpSmallRequests: tc.roundUp,
+			log:                  logrus.New().WithField("test_enabled", true),
+		}
+
+		resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               strings.Replace(tc.name, " ", "-", -1),
+			CapacityRange:      tc.capRange,
+			VolumeCapabilities: caps,
+		})
+		if code := status.Code(err); code != tc.wantCode {
+			t.Errorf("%s: expected code %s, got %s (%v)", tc.name, tc.wantCode, code, err)
+			continue
+		}
+
+		if err == nil && resp.Volume.CapacityBytes != tc.wantSize {
+			t.Errorf("%s: expected size %d, got %d", tc.name, tc.wantSize, resp.Volume.CapacityBytes)
+		}
+	}
+}
+
+func TestCreateVolumeClusterName(t *testing.T) {
+	fakeHCloud := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+	}
+
+	ts := httptest.NewServer(fakeHCloud)
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		clusterName:  "prod",
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := strconv.Atoi(resp.Volume.Id)
+	vol := fakeHCloud.volumes[id]
+	if vol.Name != "prod-pvc-1234" {
+		t.Errorf("expected volume name prod-pvc-1234, got %q", vol.Name)
+	}
+	if vol.Labels[labelCluster] != "prod" {
+		t.Errorf("expected cluster label prod, got %q", vol.Labels[labelCluster])
+	}
+}
+
+func TestCreateVolumeClaim(t *testing.T) {
+	fakeHCloud := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+	}
+
+	ts := httptest.NewServer(fakeHCloud)
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		Parameters: map[string]string{
+			paramPVCName:      "data-postgres-0",
+			paramPVCNamespace: "db",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Volume.Attributes[paramPVCName] != "data-postgres-0" || resp.Volume.Attributes[paramPVCNamespace] != "db" {
+		t.Errorf("expected the claim in the volume attributes, got %v", resp.Volume.Attributes)
+	}
+
+	id, _ := strconv.Atoi(resp.Volume.Id)
+	vol := fakeHCloud.volumes[id]
+	if vol.Labels[labelPVCName] != "data-postgres-0" || vol.Labels[labelPVCNamespace] != "db" {
+		t.Errorf("expected the claim in the volume labels, got %v", vol.Labels)
+	}
+
+	fields := attributeClaimFields(resp.Volume.Attributes)
+	if fields["pvc_name"] != "data-postgres-0" || fields["pvc_namespace"] != "db" {
+		t.Errorf("unexpected claim log fields %v", fields)
+	}
+}
+
+func TestClaimLabels(t *testing.T) {
+	labels := claimLabels(map[string]string{
+		paramPVCName:      "-invalid",
+		paramPVCNamespace: "db",
+	})
+
+	if _, ok := labels[labelPVCName]; ok {
+		t.Errorf("expected invalid label value to be left out, got %v", labels)
+	}
+	if labels[labelPVCNamespace] != "db" {
+		t.Errorf("expected namespace label db, got %v", labels)
+	}
+}
+
+func TestControllerFakeHCloud(t *testing.T) {
+	fake := fakehcloud.New()
+	fake.ActionLatency = 20 * time.Millisecond
+	fake.AddServer(10, "node-10", "fsn1")
+	fake.InjectFault(fakehcloud.Fault{
+		Method: "POST",
+		Path:   "/volumes/*/actions/attach",
+		Status: http.StatusServiceUnavailable,
+		Code:   "unavailable",
+		Times:  1,
+	})
+
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	d := &Driver{
+		location:           "fsn1",
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		actionPollInterval: 5 * time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	created, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: supportedAccessMode,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: created.Volume.Id,
+		NodeId:   "10",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: supportedAccessMode,
+		},
+	}
+
+	// the first attach fails with the injected fault, the retry of the CO
+	// succeeds
+	if _, err := d.ControllerPublishVolume(ctx, publishReq); status.Code(err) != codes.Aborted {
+		t.Errorf("got %v, want the injected fault to abort the attach", err)
+	}
+	if _, err := d.ControllerPublishVolume(ctx, publishReq); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := strconv.Atoi(created.Volume.Id)
+	if vol, _ := fake.Volume(id); vol.Server == nil || *vol.Server != 10 {
+		t.Errorf("expected the volume to be attached to server 10, got %v", vol.Server)
+	}
+
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: created.Volume.Id, NodeId: "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Volume.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Volumes() != 0 {
+		t.Errorf("expected the volume to be deleted, %d volumes left", fake.Volumes())
+	}
+}
+
+func TestActionPollIntervals(t *testing.T) {
+	d := &Driver{actionPollInterval: time.Second}
+
+	interval, maxInterval := d.actionPollIntervals()
+	if interval != time.Second || maxInterval != maxActionPollInterval {
+		t.Fatalf("got intervals %s and %s, want %s and %s", interval, maxInterval, time.Second, maxActionPollInterval)
+	}
+
+	var got []time.Duration
+	for i := 0; i < 6; i++ {
+		interval = nextActionPollInterval(interval, maxInterval, false)
+		got = append(got, interval)
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, maxActionPollInterval, maxActionPollInterval, maxActionPollInterval}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v, want %v", got, want)
+	}
+
+	// a low rate limit polls with the longest interval right away
+	if interval := nextActionPollInterval(time.Second, maxInterval, true); interval != maxActionPollInterval {
+		t.Errorf("got interval %s with a low rate limit, want %s", interval, maxActionPollInterval)
+	}
+
+	// a configured interval above the maximum is kept
+	d.actionPollInterval = time.Minute
+	if interval, maxInterval := d.actionPollIntervals(); interval != time.Minute || maxInterval != time.Minute {
+		t.Errorf("got intervals %s and %s, want %s for both", interval, maxInterval, time.Minute)
+	}
+}
+
+func TestWaitActionCanceled(t *testing.T) {
+	// the action never finishes
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"action": {"id": 1, "command": "attach_volume", "status": "running"}}`))
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		actionPollInterval: time.Millisecond,
+		actionTimeout:      50 * time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.waitAction(context.Background(), 1234, 1); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded after the action timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.waitAction(ctx, 1234, 1); status.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled for a canceled context, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// volumePricing is the price of volume storage. hcloud-go doesn't parse
+// it from the pricing endpoint yet.
+type volumePricing struct {
+	Currency string `json:"currency"`
+	Volume   struct {
+		PricePerGBMonth struct {
+			Net   string `json:"net"`
+			Gross string `json:"gross"`
+		} `json:"price_per_gb_month"`
+	} `json:"volume"`
+}
+
+// costKey groups volumes in the cost metrics.
+type costKey struct {
+	location     string
+	storageClass string
+	namespace    string
+}
+
+// claimInfo is the StorageClass and namespace a volume was provisioned for.
+type claimInfo struct {
+	storageClass string
+	namespace    string
+}
+
+// getVolumePrice returns the currency and the gross price of a GB of volume
+// storage per month.
+func (d *Driver) getVolumePrice(ctx context.Context) (string, float64, error) {
+	// the pricing is not part of the hcloud services
+	if d.hcloudClient == nil {
+		return "", 0, fmt.Errorf("could not get pricing without an hcloud client")
+	}
+
+	req, err := d.hcloudClient.NewRequest(ctx, "GET", "/pricing", nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var body struct {
+		Pricing volumePricing `json:"pricing"`
+	}
+	if _, err := d.hcloudClient.Do(req, &body); err != nil {
+		return "", 0, fmt.Errorf("could not get pricing: %s", err)
+	}
+
+	price, err := strconv.ParseFloat(body.Pricing.Volume.PricePerGBMonth.Gross, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid volume price %q: %s", body.Pricing.Volume.PricePerGBMonth.Gross, err)
+	}
+	return body.Pricing.Currency, price, nil
+}
+
+// volumeClaims returns the StorageClass and namespace of the volumes by
+// the name of their PersistentVolume. It returns nil outside of a cluster.
+func (d *Driver) volumeClaims() (map[string]claimInfo, error) {
+	if d.kubeClient == nil {
+		return nil, nil
+	}
+
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list PersistentVolumes: %s", err)
+	}
+
+	claims := map[string]claimInfo{}
+	for _, pv := range pvs.Items {
+		info := claimInfo{storageClass: pv.Spec.StorageClassName}
+		if pv.Spec.ClaimRef != nil {
+			info.namespace = pv.Spec.ClaimRef.Namespace
+		}
+		claims[pv.Name] = info
+	}
+	return claims, nil
+}
+
+// updateVolumeCost sets the estimated monthly cost of the given volumes.
+func (d *Driver) updateVolumeCost(ctx context.Context, volumes []*hcloud.Volume) error {
+	currency, price, err := d.getVolumePrice(ctx)
+	if err != nil {
+		return err
+	}
+
+	claims, err := d.volumeClaims()
+	if err != nil {
+		return err
+	}
+
+	cost := map[costKey]float64{}
+	for _, vol := range volumes {
+		key := costKey{}
+		if vol.Location != nil {
+			key.location = vol.Location.Name
+		}
+
+		name := vol.Name
+		if d.clusterName != "" {
+			name = strings.TrimPrefix(name, d.clusterName+"-")
+		}
+		if claim, ok := claims[name]; ok {
+			key.storageClass = claim.storageClass
+			key.namespace = claim.namespace
+		}
+
+		cost[key] += float64(vol.Size) * price
+	}
+
+	d.metrics.volumePrice.Reset()
+	d.metrics.volumePrice.WithLabelValues(currency).Set(price)
+
+	d.metrics.volumeCost.Reset()
+	for key, value := range cost {
+		d.metrics.volumeCost.WithLabelValues(key.location, key.storageClass, key.namespace, currency).Set(value)
+	}
+	return nil
+}
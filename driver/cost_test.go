@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestUpdateVolumeCost(t *testing.T) {
+	managed := map[string]string{labelCreatedBy: createdByHCloud}
+
+	tsHCloud := httptest.NewServer(&fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "pvc-1234", Size: 100, Labels: managed, Location: schema.Location{Name: "fsn1"}},
+			2: {ID: 2, Name: "manual", Size: 20, Labels: managed, Location: schema.Location{Name: "fsn1"}},
+		},
+	})
+	defer tsHCloud.Close()
+
+	tsKube := httptest.NewServer(&fakeKubeAPI{
+		t: t,
+		pv: &v1.PersistentVolume{
+			TypeMeta:   metav1.TypeMeta{Kind: "PersistentVolume", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+			Spec: v1.PersistentVolumeSpec{
+				StorageClassName: "hcloud-volumes",
+				ClaimRef:         &v1.ObjectReference{Namespace: "app", Name: "data"},
+			},
+		},
+	})
+	defer tsKube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: tsKube.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		kubeClient:   kubeClient,
+		costExporter: true,
+		metrics:      newMetrics(),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.updateVolumeInventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := scrape(t, d.metrics)
+	for _, want := range []string{
+		`hcloud_csi_controller_volume_price_per_gb_month{currency="EUR"} 0.05`,
+		`hcloud_csi_controller_volume_monthly_cost{currency="EUR",location="fsn1",namespace="app",storage_class="hcloud-volumes"} 5`,
+		`hcloud_csi_controller_volume_monthly_cost{currency="EUR",location="fsn1",namespace="",storage_class=""} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q:\n%s", want, body)
+		}
+	}
+}
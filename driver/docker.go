@@ -0,0 +1,376 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+)
+
+// dockerPluginContentType is the content type of the Docker plugin API.
+const dockerPluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+// dockerRequest is the body of the requests of the Docker volume plugin API,
+// see https://docs.docker.com/engine/extend/plugins_volume/.
+type dockerRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type dockerVolume struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type dockerCapabilities struct {
+	Scope string
+}
+
+// dockerResponse is the body of the responses, Err is set if the request
+// failed.
+type dockerResponse struct {
+	Err          string
+	Implements   []string            `json:",omitempty"`
+	Mountpoint   string              `json:",omitempty"`
+	Volume       *dockerVolume       `json:",omitempty"`
+	Volumes      []dockerVolume      `json:",omitempty"`
+	Capabilities *dockerCapabilities `json:",omitempty"`
+}
+
+// dockerPlugin serves the legacy Docker volume plugin API on top of the
+// controller and the node service, so standalone Docker hosts can use
+// volumes with "docker volume create -d hcloud". Volumes are staged and
+// mounted below dir and attached to the local server while a container
+// uses them.
+type dockerPlugin struct {
+	d   *Driver
+	dir string
+
+	// mounts are the IDs of the mounts of each volume, the volume is
+	// detached when the last one is unmounted
+	mu     sync.Mutex
+	mounts map[string]map[string]bool
+}
+
+func newDockerPlugin(d *Driver, dir string) *dockerPlugin {
+	return &dockerPlugin{
+		d:      d,
+		dir:    dir,
+		mounts: map[string]map[string]bool{},
+	}
+}
+
+// serveDockerPlugin serves the Docker volume plugin API on the socket until
+// the driver is stopped.
+func (d *Driver) serveDockerPlugin() {
+	ll := d.log.WithField("socket", d.dockerPluginSocket)
+
+	if err := d.removeStaleSocket(d.dockerPluginSocket); err != nil {
+		ll.WithError(err).Error("serving Docker volume plugin failed")
+		return
+	}
+
+	listener, err := net.Listen("unix", d.dockerPluginSocket)
+	if err != nil {
+		ll.WithError(err).Error("serving Docker volume plugin failed")
+		return
+	}
+
+	srv := &http.Server{Handler: newDockerPlugin(d, d.dockerPluginDir).handler()}
+	go func() {
+		<-d.stopCh
+		srv.Close()
+		os.Remove(d.dockerPluginSocket)
+	}()
+
+	ll.Info("serving Docker volume plugin")
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		ll.WithError(err).Error("serving Docker volume plugin failed")
+	}
+}
+
+// handler returns the handler of the endpoints of the plugin API.
+func (p *dockerPlugin) handler() http.Handler {
+	endpoints := map[string]func(ctx context.Context, req dockerRequest) (dockerResponse, error){
+		"/Plugin.Activate": func(context.Context, dockerRequest) (dockerResponse, error) {
+			return dockerResponse{Implements: []string{"VolumeDriver"}}, nil
+		},
+		"/VolumeDriver.Capabilities": func(context.Context, dockerRequest) (dockerResponse, error) {
+			// volumes can be used on every server of the project
+			return dockerResponse{Capabilities: &dockerCapabilities{Scope: "global"}}, nil
+		},
+		"/VolumeDriver.Create":  p.create,
+		"/VolumeDriver.Remove":  p.remove,
+		"/VolumeDriver.Mount":   p.mount,
+		"/VolumeDriver.Unmount": p.unmount,
+		"/VolumeDriver.Path":    p.path,
+		"/VolumeDriver.Get":     p.get,
+		"/VolumeDriver.List":    p.list,
+	}
+
+	mux := http.NewServeMux()
+	for path, endpoint := range endpoints {
+		endpoint := endpoint
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			var req dockerRequest
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			ll := p.d.log.WithFields(logrus.Fields{
+				"method": "docker" + strings.Replace(r.URL.Path, "/", "_", -1),
+				"volume": req.Name,
+			})
+
+			resp, err := endpoint(r.Context(), req)
+			if err != nil {
+				ll.WithError(err).Error("Docker volume plugin request failed")
+				resp = dockerResponse{Err: errorMessage(err)}
+			}
+
+			w.Header().Set("Content-Type", dockerPluginContentType)
+			json.NewEncoder(w).Encode(resp)
+		})
+	}
+	return mux
+}
+
+// errorMessage returns the message of gRPC status errors without the code.
+func errorMessage(err error) string {
+	if s, ok := status.FromError(err); ok {
+		return s.Message()
+	}
+	return err.Error()
+}
+
+var dockerCapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+	AccessMode: supportedAccessMode,
+}
+
+func (p *dockerPlugin) create(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	createReq := &csi.CreateVolumeRequest{
+		Name:               req.Name,
+		VolumeCapabilities: []*csi.VolumeCapability{dockerCapability},
+	}
+
+	for key, value := range req.Opts {
+		if key != "size" {
+			return dockerResponse{}, fmt.Errorf("unsupported option %q, only size is supported", key)
+		}
+
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 1 {
+			return dockerResponse{}, fmt.Errorf("invalid size %q, must be in GB", value)
+		}
+		createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: size * GB}
+	}
+
+	_, err := p.d.CreateVolume(ctx, createReq)
+	return dockerResponse{}, err
+}
+
+// volume returns the hcloud volume of the Docker volume.
+func (p *dockerPlugin) volume(ctx context.Context, name string) (*hcloud.Volume, error) {
+	volume, err := p.d.getVolumeByName(ctx, p.d.volumeName(name))
+	if err != nil {
+		return nil, err
+	}
+	if volume == nil {
+		return nil, fmt.Errorf("volume %q not found", name)
+	}
+	return volume, nil
+}
+
+func (p *dockerPlugin) remove(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.mounts[req.Name]) > 0 {
+		return dockerResponse{}, fmt.Errorf("volume %q is in use", req.Name)
+	}
+
+	volume, err := p.volume(ctx, req.Name)
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	_, err = p.d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: strconv.Itoa(volume.ID)})
+	return dockerResponse{}, err
+}
+
+// paths returns the staging path and the mount point of a volume.
+func (p *dockerPlugin) paths(name string) (string, string) {
+	return filepath.Join(p.dir, "staging", name), filepath.Join(p.dir, "volumes", name)
+}
+
+// mount attaches, stages and mounts the volume for the first mount, further
+// mounts reuse it. The CSI calls are idempotent, a failed mount is
+// continued by the retry of Docker.
+func (p *dockerPlugin) mount(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stagingPath, mountpoint := p.paths(req.Name)
+	if len(p.mounts[req.Name]) > 0 {
+		p.mounts[req.Name][req.ID] = true
+		return dockerResponse{Mountpoint: mountpoint}, nil
+	}
+
+	volume, err := p.volume(ctx, req.Name)
+	if err != nil {
+		return dockerResponse{}, err
+	}
+	volumeID := strconv.Itoa(volume.ID)
+
+	published, err := p.d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           p.d.nodeID,
+		VolumeCapability: dockerCapability,
+	})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return dockerResponse{}, err
+	}
+
+	_, err = p.d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		PublishInfo:       published.PublishInfo,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  dockerCapability,
+	})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	_, err = p.d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		PublishInfo:       published.PublishInfo,
+		StagingTargetPath: stagingPath,
+		TargetPath:        mountpoint,
+		VolumeCapability:  dockerCapability,
+	})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	p.mounts[req.Name] = map[string]bool{req.ID: true}
+	return dockerResponse{Mountpoint: mountpoint}, nil
+}
+
+// unmount unmounts, unstages and detaches the volume after its last mount.
+// The mounts are not known after a restart of the driver, a volume without
+// known mounts is unmounted right away.
+func (p *dockerPlugin) unmount(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.mounts[req.Name], req.ID)
+	if len(p.mounts[req.Name]) > 0 {
+		return dockerResponse{}, nil
+	}
+
+	volume, err := p.volume(ctx, req.Name)
+	if err != nil {
+		return dockerResponse{}, err
+	}
+	volumeID := strconv.Itoa(volume.ID)
+	stagingPath, mountpoint := p.paths(req.Name)
+
+	_, err = p.d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: mountpoint})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	_, err = p.d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	// the volume is detached, so it can be mounted on another server
+	_, err = p.d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: p.d.nodeID})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	delete(p.mounts, req.Name)
+	return dockerResponse{}, nil
+}
+
+// mountpoint returns the mount point of the volume if it is mounted.
+func (p *dockerPlugin) mountpoint(name string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.mounts[name]) == 0 {
+		return ""
+	}
+	_, mountpoint := p.paths(name)
+	return mountpoint
+}
+
+func (p *dockerPlugin) path(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	return dockerResponse{Mountpoint: p.mountpoint(req.Name)}, nil
+}
+
+func (p *dockerPlugin) get(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	if _, err := p.volume(ctx, req.Name); err != nil {
+		return dockerResponse{}, err
+	}
+	return dockerResponse{Volume: &dockerVolume{Name: req.Name, Mountpoint: p.mountpoint(req.Name)}}, nil
+}
+
+// list returns the volumes managed by the driver, named without the
+// cluster prefix.
+func (p *dockerPlugin) list(ctx context.Context, req dockerRequest) (dockerResponse, error) {
+	volumes, err := p.d.client(ctx).Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: p.d.managedLabelSelector()},
+	})
+	if err != nil {
+		return dockerResponse{}, err
+	}
+
+	resp := dockerResponse{Volumes: []dockerVolume{}}
+	for _, volume := range volumes {
+		name := volume.Name
+		if p.d.clusterName != "" {
+			name = strings.TrimPrefix(name, p.d.clusterName+"-")
+		}
+		resp.Volumes = append(resp.Volumes, dockerVolume{Name: name, Mountpoint: p.mountpoint(name)})
+	}
+	return resp, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func (f *fakeServices) volumeByName(name string) *hcloud.Volume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, vol := range f.volumes {
+		if vol.Name == name {
+			return vol
+		}
+	}
+	return nil
+}
+
+func TestDockerPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := newFakeServices(10)
+	d := newFakeServicesDriver(f)
+	d.nodeID = "10"
+	d.clusterName = "docker"
+	d.mounter = &fakeMounter{}
+
+	ts := httptest.NewServer(newDockerPlugin(d, dir).handler())
+	defer ts.Close()
+
+	call := func(endpoint string, req dockerRequest) dockerResponse {
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(ts.URL+endpoint, dockerPluginContentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var r dockerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("%s: %s", endpoint, err)
+		}
+		return r
+	}
+
+	if resp := call("/Plugin.Activate", dockerRequest{}); len(resp.Implements) != 1 || resp.Implements[0] != "VolumeDriver" {
+		t.Errorf("unexpected activation %+v", resp)
+	}
+
+	if resp := call("/VolumeDriver.Create", dockerRequest{Name: "data", Opts: map[string]string{"fstype": "xfs"}}); !strings.Contains(resp.Err, "unsupported option") {
+		t.Errorf("expected the option to be rejected, got %+v", resp)
+	}
+	if resp := call("/VolumeDriver.Create", dockerRequest{Name: "data", Opts: map[string]string{"size": "20"}}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+
+	vol := f.volumeByName("docker-data")
+	if vol == nil || vol.Size != 20 {
+		t.Fatalf("expected a 20 GB volume with the cluster prefix, got %+v", vol)
+	}
+
+	if resp := call("/VolumeDriver.List", dockerRequest{}); len(resp.Volumes) != 1 || resp.Volumes[0].Name != "data" {
+		t.Errorf("expected the volume without the cluster prefix, got %+v", resp.Volumes)
+	}
+
+	// two containers use the volume, it's attached once
+	mountpoint := filepath.Join(dir, "volumes", "data")
+	for _, id := range []string{"c1", "c2"} {
+		if resp := call("/VolumeDriver.Mount", dockerRequest{Name: "data", ID: id}); resp.Err != "" || resp.Mountpoint != mountpoint {
+			t.Fatalf("mount %s: %+v", id, resp)
+		}
+	}
+	if vol := f.volumeByName("docker-data"); f.calls["Volume.Attach"] != 1 || vol.Server == nil || vol.Server.ID != 10 {
+		t.Errorf("expected the volume to be attached once to server 10, got %d attaches", f.calls["Volume.Attach"])
+	}
+	if resp := call("/VolumeDriver.Path", dockerRequest{Name: "data"}); resp.Mountpoint != mountpoint {
+		t.Errorf("got mount point %q, want %q", resp.Mountpoint, mountpoint)
+	}
+	if resp := call("/VolumeDriver.Remove", dockerRequest{Name: "data"}); !strings.Contains(resp.Err, "in use") {
+		t.Errorf("expected removing a mounted volume to fail, got %+v", resp)
+	}
+
+	// the volume is detached after the last container stopped
+	call("/VolumeDriver.Unmount", dockerRequest{Name: "data", ID: "c1"})
+	if vol := f.volumeByName("docker-data"); vol.Server == nil {
+		t.Error("expected the volume to stay attached while it is in use")
+	}
+	if resp := call("/VolumeDriver.Unmount", dockerRequest{Name: "data", ID: "c2"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if vol := f.volumeByName("docker-data"); vol.Server != nil {
+		t.Error("expected the volume to be detached")
+	}
+	if resp := call("/VolumeDriver.Get", dockerRequest{Name: "data"}); resp.Volume == nil || resp.Volume.Mountpoint != "" {
+		t.Errorf("expected the unmounted volume, got %+v", resp.Volume)
+	}
+
+	if resp := call("/VolumeDriver.Remove", dockerRequest{Name: "data"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	if resp := call("/VolumeDriver.Get", dockerRequest{Name: "data"}); !strings.Contains(resp.Err, "not found") {
+		t.Errorf("expected the volume to be removed, got %+v", resp)
+	}
+}
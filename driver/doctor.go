@@ -0,0 +1,316 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// procFilesystemsPath lists the filesystems supported by the kernel
+	procFilesystemsPath = "/proc/filesystems"
+
+	// virtioSCSIModulePath exists if the virtio-scsi driver volumes are
+	// attached with is loaded
+	virtioSCSIModulePath = "/sys/module/virtio_scsi"
+
+	// accessWrite is W_OK of access(2)
+	accessWrite = 2
+)
+
+// doctorReport writes the results of the checks of the doctor.
+type doctorReport struct {
+	out    io.Writer
+	failed int
+}
+
+func (r *doctorReport) ok(check, format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "ok   %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) warn(check, format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "WARN %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) fail(check, format string, args ...interface{}) {
+	r.failed++
+	fmt.Fprintf(r.out, "FAIL %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// Doctor checks the configuration of the options and the host for the
+// usual problems of installations and writes a report to out: the token,
+// the hcloud API, the metadata service, the server of the node, the host
+// utilities, the kernel and the socket. Unlike NewDriver it doesn't stop at
+// the first problem. It returns an error if a check failed.
+func Doctor(ctx context.Context, out io.Writer, opts ...Option) error {
+	d := newDriver(opts...)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	d.log = logrus.NewEntry(logger)
+
+	r := &doctorReport{out: out}
+	d.doctorHCloud(ctx, r)
+	d.doctorNode(ctx, r)
+	if d.runsNode() {
+		d.doctorUtilities(r)
+		d.doctorKernel(r)
+	}
+	d.doctorSocket(r)
+
+	if r.failed > 0 {
+		return fmt.Errorf("%d checks failed", r.failed)
+	}
+	return nil
+}
+
+// doctorHCloud checks that the token is accepted by the hcloud API. The
+// client is kept for the other checks.
+func (d *Driver) doctorHCloud(ctx context.Context, r *doctorReport) {
+	token, source, err := d.hcloudToken, "--token", error(nil)
+	switch {
+	case d.tokenFile != "":
+		source = "token file " + d.tokenFile
+		token, err = readTokenFile(d.tokenFile)
+	case d.tokenSecret != "":
+		source = "secret " + d.tokenSecret
+		if _, _, err = parseTokenSecret(d.tokenSecret); err == nil && d.kubeClient == nil {
+			d.kubeClient, err = newKubeClient()
+		}
+		if err == nil {
+			token, err = d.readTokenSecret()
+		}
+	}
+	if err != nil {
+		r.fail("token", "reading the token from %s failed: %s", source, err)
+		return
+	}
+
+	if token == "" {
+		switch d.mode {
+		case ModeNode:
+			r.ok("token", "none configured, the node service doesn't need one")
+		case ModeController:
+			r.fail("token", "none configured, the controller service needs one")
+		default:
+			r.warn("token", "none configured, only the node service runs")
+		}
+		return
+	}
+
+	client, err := d.newHCloudClient(token, d.hcloudURL)
+	if err != nil {
+		r.fail("hcloud API", "%s", err)
+		return
+	}
+
+	if _, err := client.Location.All(ctx); err != nil {
+		if hcloud.IsError(err, errorCodeUnauthorized) {
+			r.fail("token", "the token from %s is rejected by the hcloud API, create a new one with read and write permission", source)
+			return
+		}
+		r.fail("hcloud API", "%s is not reachable: %s", d.hcloudURL, err)
+		return
+	}
+
+	r.ok("token", "the token from %s is accepted", source)
+	r.ok("hcloud API", "%s is reachable", d.hcloudURL)
+	d.hcloudClient = client
+	d.services = servicesOf(client)
+}
+
+// doctorNode checks that the metadata service is reachable and the server
+// of the node and its location are found.
+func (d *Driver) doctorNode(ctx context.Context, r *doctorReport) {
+	md := newMetadataClient(d.metadataEndpoint)
+	if _, err := md.InstanceID(ctx); err != nil {
+		if d.hasHCloud() && (d.nodeID != "" || d.hostname != "") {
+			r.warn("metadata service", "%s, the server is looked up with the hcloud API", err)
+		} else {
+			r.fail("metadata service", "%s, configure a token and the node id or hostname if it is blocked", err)
+		}
+	} else {
+		r.ok("metadata service", "%s is reachable", d.metadataEndpoint)
+	}
+
+	if err := d.discoverNode(ctx, d.log); err != nil {
+		r.fail("server", "%s", err)
+		return
+	}
+	r.ok("server", "%s in %s", d.nodeID, d.location)
+
+	if d.hcloudClient != nil {
+		if err := d.checkHCloud(ctx); err != nil {
+			r.fail("location", "%s", err)
+		}
+	}
+}
+
+// doctorUtilities checks that the utilities the node service runs are
+// installed, in the host root if one is configured.
+func (d *Driver) doctorUtilities(r *doctorReport) {
+	required := []string{"mkfs.ext4", "blkid", "findmnt"}
+	if !d.reducedPrivileges {
+		required = append(required, "mount", "umount")
+	}
+	optional := map[string]string{
+		"e2fsck":     "checking ext4 filesystems with --fsck-mode",
+		"resize2fs":  "expanding ext4 filesystems",
+		"dumpe2fs":   "expanding ext4 filesystems",
+		"blockdev":   "expanding filesystems",
+		"mkfs.xfs":   "xfs volumes",
+		"xfs_repair": "checking xfs filesystems with --fsck-mode",
+		"fstrim":     "--fstrim-interval",
+		"udevadm":    "--udev-settle",
+	}
+
+	where := "PATH"
+	if d.hostRoot != "" {
+		where = "the host root " + d.hostRoot
+	}
+
+	m := newMounter(d.log, d.hostRoot)
+	var missing []string
+	for _, name := range required {
+		if _, err := m.lookPath(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		r.fail("utilities", "%s not found in %s", strings.Join(missing, ", "), where)
+	} else {
+		r.ok("utilities", "%s found in %s", strings.Join(required, ", "), where)
+	}
+
+	var names []string
+	for name := range optional {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := m.lookPath(name); err != nil {
+			r.warn("utilities", "%s not found in %s, it is needed for %s", name, where, optional[name])
+		}
+	}
+}
+
+// doctorKernel checks that the kernel supports the filesystems and sees the
+// volumes.
+func (d *Driver) doctorKernel(r *doctorReport) {
+	f, err := os.Open(procFilesystemsPath)
+	if err != nil {
+		r.fail("kernel", "reading the supported filesystems failed: %s", err)
+	} else {
+		filesystems, err := parseFilesystems(f)
+		f.Close()
+
+		switch {
+		case err != nil:
+			r.fail("kernel", "reading the supported filesystems failed: %s", err)
+		case !filesystems["ext4"]:
+			r.fail("kernel", "ext4 is not supported, load the ext4 module")
+		case !filesystems["xfs"]:
+			r.ok("kernel", "ext4 is supported")
+			r.warn("kernel", "xfs is not supported, load the xfs module for xfs volumes")
+		default:
+			r.ok("kernel", "ext4 and xfs are supported")
+		}
+	}
+
+	if _, err := os.Stat(virtioSCSIModulePath); err != nil {
+		r.warn("kernel", "the virtio_scsi module is not loaded, volumes are attached with it")
+	}
+
+	if _, err := os.Stat(filepath.Dir(diskIDPrefix)); err != nil {
+		r.fail("devices", "%s is missing, /dev of the host has to be mounted", filepath.Dir(diskIDPrefix))
+	} else {
+		r.ok("devices", "%s exists", filepath.Dir(diskIDPrefix))
+	}
+}
+
+// parseFilesystems returns the filesystems listed in /proc/filesystems.
+func parseFilesystems(r io.Reader) (map[string]bool, error) {
+	filesystems := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			filesystems[fields[len(fields)-1]] = true
+		}
+	}
+	return filesystems, scanner.Err()
+}
+
+// doctorSocket checks that the socket of the endpoint can be created.
+func (d *Driver) doctorSocket(r *doctorReport) {
+	u, err := url.Parse(d.endpoint)
+	if err != nil {
+		r.fail("socket", "invalid endpoint %q: %s", d.endpoint, err)
+		return
+	}
+
+	switch u.Scheme {
+	case "systemd":
+		r.ok("socket", "passed by systemd")
+		return
+	case "tcp":
+		r.ok("socket", "listening on %s", u.Host)
+		return
+	case "unix":
+	default:
+		r.fail("socket", "unsupported endpoint scheme %q, must be one of: unix, tcp, systemd", u.Scheme)
+		return
+	}
+
+	socket := path.Join(u.Host, filepath.FromSlash(u.Path))
+	dir := filepath.Dir(socket)
+	if _, err := os.Stat(dir); err != nil {
+		r.fail("socket", "the directory of %s is missing, mount the plugin directory of the kubelet: %s", socket, err)
+		return
+	}
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		r.fail("socket", "the directory of %s is not writable: %s", socket, err)
+		return
+	}
+
+	if _, err := os.Lstat(socket); err != nil {
+		r.ok("socket", "%s can be created", socket)
+		return
+	}
+	conn, err := net.DialTimeout("unix", socket, staleSocketTimeout)
+	if err != nil {
+		r.warn("socket", "%s is stale, it is removed at startup", socket)
+		return
+	}
+	conn.Close()
+	r.ok("socket", "a driver is listening on %s", socket)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
+)
+
+func TestParseFilesystems(t *testing.T) {
+	filesystems, err := parseFilesystems(strings.NewReader("nodev\tsysfs\nnodev\ttmpfs\n\text4\n\txfs\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fs, want := range map[string]bool{"ext4": true, "xfs": true, "tmpfs": true, "nodev": false, "btrfs": false} {
+		if filesystems[fs] != want {
+			t.Errorf("%s: got %t, want %t", fs, filesystems[fs], want)
+		}
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	fake := fakehcloud.New()
+	fake.AddServer(10, "node-10", "fsn1")
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/instance-id":
+			fmt.Fprint(w, "10")
+		case "/availability-zone":
+			fmt.Fprint(w, "fsn1-dc14")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer md.Close()
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the required utilities are installed in the host root
+	hostRoot := filepath.Join(dir, "host")
+	if err := os.MkdirAll(filepath.Join(hostRoot, "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mkfs.ext4", "blkid", "findmnt", "mount", "umount"} {
+		if err := ioutil.WriteFile(filepath.Join(hostRoot, "sbin", name), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	Doctor(context.Background(), &out,
+		WithEndpoint("unix://"+filepath.Join(dir, "csi.sock")),
+		WithToken("fake-hcloud-token"),
+		WithHCloudURL(ts.URL),
+		WithHostRoot(hostRoot),
+		func(d *Driver) { d.metadataEndpoint = md.URL },
+	)
+
+	// the kernel and the devices depend on the host running the test
+	for _, want := range []string{
+		"ok   token: the token from --token is accepted",
+		"ok   hcloud API: " + ts.URL + " is reachable",
+		"ok   metadata service: ",
+		"ok   server: 10 in fsn1",
+		"ok   utilities: mkfs.ext4, blkid, findmnt, mount, umount found in the host root",
+		"WARN utilities: fstrim not found",
+		"ok   socket: " + filepath.Join(dir, "csi.sock") + " can be created",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the report:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDoctorRejectedToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"code": "unauthorized", "message": "unable to authenticate"}}`)
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	err := Doctor(context.Background(), &out,
+		WithEndpoint("tcp://localhost:10000"),
+		WithMode(ModeController),
+		WithToken("invalid"),
+		WithHCloudURL(ts.URL),
+		func(d *Driver) { d.metadataEndpoint = ts.URL },
+	)
+	if err == nil {
+		t.Error("expected the doctor to fail")
+	}
+	if !strings.Contains(out.String(), "FAIL token: the token from --token is rejected") {
+		t.Errorf("expected the token to be rejected:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "utilities") {
+		t.Errorf("expected no node checks for the controller:\n%s", out.String())
+	}
+}
@@ -19,29 +19,68 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/url"
 	"os"
-	"path"
-	"path/filepath"
-	"strconv"
+	"regexp"
 	"sync"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	driverName = "de.apricote.hcloud.csi.volumes"
+	// DefaultDriverName is the CSI name of the driver, unless another name
+	// is configured.
+	DefaultDriverName = "de.apricote.hcloud.csi.volumes"
 )
 
+// Mode defines which CSI services the driver runs.
+type Mode string
+
+const (
+	// ModeAll runs the controller and the node service. The controller
+	// service is only available if a token is configured.
+	ModeAll Mode = "all"
+
+	// ModeController runs the controller service only, e.g. in a
+	// Deployment.
+	ModeController Mode = "controller"
+
+	// ModeNode runs the node service only, e.g. in a DaemonSet on every
+	// node.
+	ModeNode Mode = "node"
+
+	// ModeMonolith is an alias of ModeAll, the name of plugins with both
+	// services in CSI v1 orchestrators.
+	ModeMonolith Mode = "monolith"
+)
+
+func (m Mode) validate() error {
+	switch m {
+	case ModeAll, ModeController, ModeNode:
+		return nil
+	}
+	return fmt.Errorf("invalid mode %q, must be one of: %s, %s, %s, %s", m, ModeAll, ModeMonolith, ModeController, ModeNode)
+}
+
 var (
 	gitTreeState = "not a git tree"
 	commit       string
 	version      string
+	buildDate    string
+
+	// clusterNameRegexp matches cluster names that are valid label values
+	// and volume name prefixes.
+	clusterNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
 )
 
 // Driver implements the following CSI interfaces:
@@ -53,85 +92,1332 @@ var (
 type Driver struct {
 	endpoint string
 	nodeID   string
-	hostname string
-	location string
+
+	// clusterName is added to the labels, name and log entries of all
+	// volumes created by the driver.
+	clusterName string
+	hostname    string
+	location    string
+
+	// name is the CSI name of the driver, StorageClasses refer to it as
+	// provisioner. An empty name uses DefaultDriverName.
+	name string
+
+	// topologyKey is the topology segment holding the location, an empty
+	// key uses "location". The location is published under all
+	// topologyAliases as well, e.g. the keys of other hcloud drivers.
+	topologyKey     string
+	topologyAliases []string
+
+	// socketMode and socketOwner are applied to the unix domain socket of
+	// the endpoint, e.g. "0660" and "1000:1000". Empty values keep the
+	// defaults.
+	socketMode  string
+	socketOwner string
+
+	// mode defines which CSI services are run, an empty mode runs all
+	// of them.
+	mode Mode
+
+	// logFormat defines how log entries are written, by default as text.
+	logFormat LogFormat
+
+	// logSink is an additional destination of all log entries, e.g. the
+	// systemd journal.
+	logSink LogSink
+
+	// logFile is written instead of stderr if set. It is rotated after
+	// logMaxSize megabytes, rotated files are removed after logMaxAge days
+	// or when there are more than logMaxBackups of them. Zero values use
+	// the defaults of lumberjack.
+	logFile       string
+	logMaxSize    int
+	logMaxAge     int
+	logMaxBackups int
+
+	// logLevel is the minimum level of log entries that are written, by
+	// default info.
+	logLevel string
+
+	// socket is the path of the unix domain socket the server listens
+	// on, it is removed on shutdown.
+	socket string
+
+	// addr is the address the gRPC server listens on, the liveness check
+	// probes the driver through it.
+	addr net.Addr
 
 	srv          *grpc.Server
 	hcloudClient *hcloud.Client
-	mounter      Mounter
-	log          *logrus.Entry
+	rateLimit    *rateLimit
+
+	// services are the volume, server and action endpoints used by the
+	// controller and node logic, they default to those of hcloudClient.
+	services *hcloudServices
+
+	// injectErrors are the faults injected into the services, see
+	// parseFaults, faults injects them.
+	injectErrors string
+	faults       *faultInjector
+
+	// dryRun logs the changes to volumes instead of making them.
+	dryRun bool
+
+	// hcloudRecordFile is the file the requests to and responses of the
+	// hcloud API are recorded in, recorder records them.
+	hcloudRecordFile string
+	recorder         *recorder
+
+	// hcloudToken and hcloudURL are used to create hcloudClient, unless a
+	// client is passed with WithHCloudClient.
+	hcloudToken string
+	hcloudURL   string
+
+	// servers caches the servers volumes are attached to and detached from.
+	servers serverCache
+
+	// volumes caches volumes for bursts of calls about the same volume.
+	volumes volumeCache
+	mounter Mounter
+	log     *logrus.Entry
+
+	// logger replaces the logger configured by the log options, e.g. if
+	// the driver is embedded into another program.
+	logger *logrus.Logger
+
+	// hcloudProxy is the URL of the proxy requests to the hcloud API are
+	// sent through. Empty uses the HTTPS_PROXY environment variable.
+	hcloudProxy string
+
+	// hcloudCAFile is a PEM bundle of additional CAs trusted for requests to
+	// the hcloud API, e.g. of a TLS intercepting proxy.
+	hcloudCAFile string
+
+	// tokenFile is read for the token and watched for changes, so the
+	// token can be rotated without restarting the driver.
+	tokenFile string
+
+	// tokenSecret is the namespace/name of a Secret the token is read from
+	// and watched for changes in.
+	tokenSecret string
+
+	// tokens authenticates the requests of hcloudClient if the token can
+	// change, i.e. with a secondary token, a token file or a token secret.
+	tokens *tokenTransport
+
+	// hcloudSecondaryToken is used if the hcloud API rejects the token,
+	// e.g. after it was revoked during a rotation.
+	hcloudSecondaryToken string
+
+	// hcloudRequestTimeout bounds the time waited for a response of the
+	// hcloud API per attempt. Zero waits forever.
+	hcloudRequestTimeout time.Duration
+
+	// hcloudMaxIdleConns, hcloudIdleConnTimeout and hcloudKeepAlive tune
+	// the connection pool to the hcloud API. Zero uses the defaults.
+	hcloudMaxIdleConns    int
+	hcloudIdleConnTimeout time.Duration
+	hcloudKeepAlive       time.Duration
+
+	// defaultVolumeSize is the size in bytes of volumes created without a
+	// capacity range. Zero uses defaultVolumeSizeInGB.
+	defaultVolumeSize int64
+
+	// minVolumeSize is the minimum size in bytes of new volumes. Zero uses
+	// minVolumeSizeInGB, the minimum of hcloud.
+	minVolumeSize int64
+
+	// roundUpSmallRequests creates volumes smaller than minVolumeSize with
+	// the minimum size instead of rejecting them.
+	roundUpSmallRequests bool
+
+	// listOnlyManaged restricts ListVolumes to volumes created by the
+	// driver, other volumes in the project are never returned.
+	listOnlyManaged bool
+
+	// actionTimeout defines how long to wait for hcloud actions, e.g.
+	// attaching a volume, to complete.
+	actionTimeout time.Duration
+
+	// actionPollInterval is the first interval an hcloud action is polled
+	// in. It is doubled after every poll.
+	actionPollInterval time.Duration
+
+	// actionLogEvery defines that only the first and every n-th poll of an
+	// hcloud action are logged. 1 logs every poll.
+	actionLogEvery int
+
+	// metadataEndpoint is the URL of the metadata service used to discover
+	// the node ID and location.
+	metadataEndpoint string
+
+	// fsckMode defines whether existing filesystems are checked before they
+	// are mounted to the staging path.
+	fsckMode FsckMode
+
+	// formatPolicy defines whether volumes with an existing filesystem of a
+	// different type may be reformatted.
+	formatPolicy FormatPolicy
+
+	// disableFormat prevents NodeStageVolume from formatting any volume,
+	// only volumes with an existing filesystem can be staged.
+	disableFormat bool
+
+	// deviceWaitTimeout defines how long NodeStageVolume waits for the
+	// device of a volume to appear.
+	deviceWaitTimeout time.Duration
+
+	// udevSettle defines whether NodeStageVolume runs `udevadm settle`
+	// before waiting for the device of a volume.
+	udevSettle bool
+
+	// fstrimInterval defines how often mounted volumes are trimmed. Zero
+	// disables trimming.
+	fstrimInterval time.Duration
+
+	// dataDir is the directory the node service persists the state of
+	// staged volumes in. Empty disables persisting the state.
+	dataDir string
+
+	// mountHealthInterval defines how often the staged volumes are checked
+	// for abnormal conditions. Zero disables the checks.
+	mountHealthInterval time.Duration
+
+	// remountStaged mounts staged volumes again whose staging mount
+	// disappeared, which the mount health check detected.
+	remountStaged bool
+
+	// removeTargetPaths removes the directory of the target path after
+	// unpublishing a volume, instead of leaving it to the CO.
+	removeTargetPaths bool
+
+	// metricsAddress is the address the Prometheus metrics are served on.
+	// Empty disables serving them.
+	metricsAddress string
+	metrics        *metrics
+
+	// inventoryInterval is the interval the managed volumes are listed in
+	// for the inventory metrics, zero uses defaultInventoryInterval.
+	inventoryInterval time.Duration
+
+	// healthAddress is the address /healthz and /readyz are served on, they
+	// are served on the metrics address as well. Empty disables serving
+	// them separately.
+	healthAddress string
+	apiCheck      apiCheck
+
+	// pprofAddress is the address the Go profiling endpoints are served
+	// on. Empty disables them.
+	pprofAddress string
+
+	// slowRequestThreshold is the duration above which requests are logged
+	// as slow. Zero disables logging them.
+	slowRequestThreshold time.Duration
+
+	// maxConcurrentOperations bounds the number of creates, deletes,
+	// attaches and detaches running at the same time, 0 is unbounded.
+	maxConcurrentOperations int
+	operationLimiter        *operationLimiter
+
+	// rpcRateLimit limits how often each RPC is served, e.g.
+	// "ListVolumes=1/30s". rpcRateLimits are the parsed limits by RPC name.
+	rpcRateLimit  string
+	rpcRateLimits map[string]*tokenBucket
+
+	// secretClients are the hcloud clients of the tokens passed in the
+	// secrets of requests.
+	secretClients secretClients
+
+	// projectsFile and projectsSecret map aliases of further hcloud
+	// projects to their tokens, the project StorageClass parameter selects
+	// one of them. projects is the loaded mapping, volumeProjects caches
+	// the project volumes were found in.
+	projectsFile   string
+	projectsSecret string
+	projects       map[string]string
+	volumeProjects volumeProjects
+
+	// tls serves a tcp endpoint with TLS, nil serves it in plaintext.
+	tls *tlsFiles
+
+	// grpcReflection registers the gRPC reflection service for debugging
+	// with grpcurl.
+	grpcReflection bool
+
+	// kubeEvents enables posting events on the PersistentVolumes and claims
+	// of failed operations with kubeClient.
+	kubeEvents bool
+	kubeClient kubernetes.Interface
+
+	// leaderElection elects a single controller replica to run the
+	// background loops, with a lock in leaderElectionNamespace named
+	// leaderElectionName.
+	leaderElection          bool
+	leaderElectionNamespace string
+	leaderElectionName      string
+	leaderElector           *leaderElector
+
+	// journalDir holds the records of in-flight controller operations,
+	// which are finished after a restart. Volumes of interrupted creates
+	// are deleted after orphanGracePeriod.
+	journalDir        string
+	orphanGracePeriod time.Duration
+
+	// registrationDir is the plugin registration directory of kubelet,
+	// the driver registers itself there with kubeletEndpoint, the path of
+	// the CSI socket on the host.
+	registrationDir string
+	kubeletEndpoint string
+
+	// dockerPluginSocket is the socket the Docker volume plugin API is
+	// served on, the volumes are mounted below dockerPluginDir. Empty
+	// disables it.
+	dockerPluginSocket string
+	dockerPluginDir    string
+
+	// selfCheck verifies at startup that the token can write and the API
+	// version is supported.
+	selfCheck bool
+
+	// reconcileInterval is the interval the attachments of the volumes are
+	// compared with the VolumeAttachments in, 0 disables it.
+	// attachmentStrays are the volumes attached without a VolumeAttachment
+	// in the last run.
+	reconcileInterval time.Duration
+	attachmentStrays  map[int]bool
+
+	// embeddedControllers provisions and attaches volumes from the claims
+	// and VolumeAttachments of the cluster, replacing the
+	// external-provisioner and external-attacher sidecars.
+	embeddedControllers bool
+
+	// costExporter exports the estimated monthly cost of the managed
+	// volumes with the inventory metrics.
+	costExporter bool
+
+	// webhookURL is notified in webhookFormat once an operation on a volume
+	// failed webhookThreshold times in a row.
+	webhookURL       string
+	webhookFormat    WebhookFormat
+	webhookThreshold int
+	failures         failureTracker
+
+	// reducedPrivileges runs the node service without privileged mode, it
+	// only needs CAP_SYS_ADMIN and the devices of the host.
+	reducedPrivileges bool
+
+	// hostRoot is the path the root filesystem of the host is mounted at.
+	// If set, the mount and filesystem utilities of the host are used.
+	hostRoot string
+
+	// volumeLocks prevents concurrent node operations on the same volume.
+	volumeLocks volumeLocks
+
+	// stopCh is closed when the driver is stopped to terminate background
+	// loops. stopOnce closes it only once, Stop and Shutdown may both be
+	// called.
+	stopCh   chan struct{}
+	stopOnce sync.Once
 
 	// ready defines whether the driver is ready to function. This value will
 	// be used by the `Identity` service via the `Probe()` method.
-	readyMu sync.Mutex // protects ready
+	readyMu sync.Mutex // protects ready, srv, socket and addr
 	ready   bool
 }
 
+// Option configures the Driver.
+type Option func(*Driver)
+
+// WithEndpoint sets the CSI endpoint the driver listens on, e.g.
+// unix:///csi/csi.sock.
+func WithEndpoint(ep string) Option {
+	return func(d *Driver) {
+		d.endpoint = ep
+	}
+}
+
+// WithToken sets the Hetzner Cloud access token. Without a token only the
+// node service is available.
+func WithToken(token string) Option {
+	return func(d *Driver) {
+		d.hcloudToken = token
+	}
+}
+
+// WithHCloudURL sets the URL of the hcloud API.
+func WithHCloudURL(url string) Option {
+	return func(d *Driver) {
+		d.hcloudURL = url
+	}
+}
+
+// WithHCloudClient uses the given client for all requests to the hcloud
+// API instead of creating one from the token. The options configuring the
+// HTTP transport have no effect then.
+func WithHCloudClient(client *hcloud.Client) Option {
+	return func(d *Driver) {
+		d.hcloudClient = client
+	}
+}
+
+// WithHCloudServices uses the given services for the volume, server and
+// action requests instead of those of the hcloud client, e.g. fakes in
+// tests.
+func WithHCloudServices(volumes VolumeService, servers ServerService, actions ActionService) Option {
+	return func(d *Driver) {
+		d.services = &hcloudServices{
+			Volume: volumes,
+			Server: servers,
+			Action: actions,
+		}
+	}
+}
+
+// WithInjectedErrors makes requests to the hcloud API fail or respond
+// slowly on purpose, to test the alerting and the retries of the CO. The
+// faults are comma separated operation:fault[:rate] entries, e.g.
+// "attach:0.2,create:timeout", an empty string disables it.
+func WithInjectedErrors(spec string) Option {
+	return func(d *Driver) {
+		d.injectErrors = spec
+	}
+}
+
+// WithDryRun makes the controller validate requests and log the volumes it
+// would create, delete, attach or detach without changing them. The
+// requests fail with the skipped call, the node service is not affected.
+func WithDryRun(enabled bool) Option {
+	return func(d *Driver) {
+		d.dryRun = enabled
+	}
+}
+
+// WithHCloudRecording records the requests to and responses of the hcloud
+// API in the given file, without the token. The recordings serve as
+// fixtures of regression tests and help to reproduce issues. An empty path
+// disables it.
+func WithHCloudRecording(path string) Option {
+	return func(d *Driver) {
+		d.hcloudRecordFile = path
+	}
+}
+
+// WithHostname sets the name of the node, it is used to look up the server
+// if the metadata service is not reachable.
+func WithHostname(hostname string) Option {
+	return func(d *Driver) {
+		d.hostname = hostname
+	}
+}
+
+// WithLogger uses the given logger instead of creating one from the log
+// options.
+func WithLogger(logger *logrus.Logger) Option {
+	return func(d *Driver) {
+		d.logger = logger
+	}
+}
+
+// WithHCloudProxy sends all requests to the hcloud API through the proxy
+// with the given URL.
+func WithHCloudProxy(proxyURL string) Option {
+	return func(d *Driver) {
+		d.hcloudProxy = proxyURL
+	}
+}
+
+// WithHCloudCAFile trusts the CAs of the given PEM bundle for requests to the
+// hcloud API in addition to the system CAs.
+func WithHCloudCAFile(path string) Option {
+	return func(d *Driver) {
+		d.hcloudCAFile = path
+	}
+}
+
+// WithDriverName sets the CSI name of the driver, so multiple versions can run
+// side by side.
+func WithDriverName(name string) Option {
+	return func(d *Driver) {
+		d.name = name
+	}
+}
+
+// WithTopologyKey sets the topology segment holding the location of nodes
+// and volumes.
+func WithTopologyKey(key string) Option {
+	return func(d *Driver) {
+		d.topologyKey = key
+	}
+}
+
+// WithTopologyAliases sets additional topology segments the location is
+// published under, e.g. to stay compatible with another driver.
+func WithTopologyAliases(keys []string) Option {
+	return func(d *Driver) {
+		d.topologyAliases = keys
+	}
+}
+
+// WithSocketMode sets the octal permissions of the unix domain socket, e.g.
+// "0660".
+func WithSocketMode(mode string) Option {
+	return func(d *Driver) {
+		d.socketMode = mode
+	}
+}
+
+// WithSocketOwner sets the numeric owner of the unix domain socket, e.g.
+// "1000" or "1000:1000".
+func WithSocketOwner(owner string) Option {
+	return func(d *Driver) {
+		d.socketOwner = owner
+	}
+}
+
+// WithMode sets which CSI services the driver runs.
+func WithMode(mode Mode) Option {
+	return func(d *Driver) {
+		if mode == ModeMonolith {
+			mode = ModeAll
+		}
+		d.mode = mode
+	}
+}
+
+// WithClusterName sets the name of the cluster the driver runs in.
+func WithClusterName(name string) Option {
+	return func(d *Driver) {
+		d.clusterName = name
+	}
+}
+
+// WithLogSink sends all log entries to the given sink in addition to
+// stderr or the log file.
+func WithLogSink(sink LogSink) Option {
+	return func(d *Driver) {
+		d.logSink = sink
+	}
+}
+
+// WithLogFormat sets how log entries are written.
+func WithLogFormat(format LogFormat) Option {
+	return func(d *Driver) {
+		d.logFormat = format
+	}
+}
+
+// WithLogFile writes the log to the given file instead of stderr.
+func WithLogFile(path string) Option {
+	return func(d *Driver) {
+		d.logFile = path
+	}
+}
+
+// WithLogRotation sets when the log file is rotated and how many rotated
+// files are kept.
+func WithLogRotation(maxSizeMB, maxAgeDays, maxBackups int) Option {
+	return func(d *Driver) {
+		d.logMaxSize = maxSizeMB
+		d.logMaxAge = maxAgeDays
+		d.logMaxBackups = maxBackups
+	}
+}
+
+// WithLogLevel sets the minimum level of log entries that are written, i.e.
+// debug, info, warn or error.
+func WithLogLevel(level string) Option {
+	return func(d *Driver) {
+		d.logLevel = level
+	}
+}
+
+// WithTokenFile reads the hcloud token from the given file and switches to
+// the new token whenever the file changes.
+func WithTokenFile(path string) Option {
+	return func(d *Driver) {
+		d.tokenFile = path
+	}
+}
+
+// WithTokenSecret reads the hcloud token from the Secret namespace/name
+// and switches to the new token as soon as the Secret changes. The driver
+// must run in a Kubernetes cluster.
+func WithTokenSecret(ref string) Option {
+	return func(d *Driver) {
+		d.tokenSecret = ref
+	}
+}
+
+// WithProjectsFile reads a YAML file mapping aliases of further hcloud
+// projects to their tokens. The project StorageClass parameter selects
+// the project a volume is created in by its alias.
+func WithProjectsFile(path string) Option {
+	return func(d *Driver) {
+		d.projectsFile = path
+	}
+}
+
+// WithProjectsSecret reads the aliases of further hcloud projects and their
+// tokens from the keys of the Secret namespace/name. The driver must run in
+// a Kubernetes cluster.
+func WithProjectsSecret(ref string) Option {
+	return func(d *Driver) {
+		d.projectsSecret = ref
+	}
+}
+
+// WithHCloudSecondaryToken sets a token the hcloud client switches to if the
+// API rejects or rate limits the token in use.
+func WithHCloudSecondaryToken(token string) Option {
+	return func(d *Driver) {
+		d.hcloudSecondaryToken = token
+	}
+}
+
+// WithHCloudRequestTimeout bounds the time waited for a response of the
+// hcloud API. Requests timing out are retried.
+func WithHCloudRequestTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.hcloudRequestTimeout = timeout
+	}
+}
+
+// WithHCloudMaxIdleConns sets the number of idle connections to the hcloud
+// API that are kept open.
+func WithHCloudMaxIdleConns(n int) Option {
+	return func(d *Driver) {
+		d.hcloudMaxIdleConns = n
+	}
+}
+
+// WithHCloudIdleConnTimeout sets how long idle connections to the hcloud API
+// are kept open.
+func WithHCloudIdleConnTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.hcloudIdleConnTimeout = timeout
+	}
+}
+
+// WithHCloudKeepAlive sets the TCP keep-alive interval of connections to the
+// hcloud API.
+func WithHCloudKeepAlive(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.hcloudKeepAlive = interval
+	}
+}
+
+// WithDefaultVolumeSize sets the size in GB of volumes created without a
+// capacity range.
+func WithDefaultVolumeSize(sizeGB int64) Option {
+	return func(d *Driver) {
+		d.defaultVolumeSize = sizeGB * GB
+	}
+}
+
+// WithMinVolumeSize sets the minimum size in GB of new volumes.
+func WithMinVolumeSize(sizeGB int64) Option {
+	return func(d *Driver) {
+		d.minVolumeSize = sizeGB * GB
+	}
+}
+
+// WithRoundUpSmallRequests creates volumes requested smaller than the minimum
+// size with the minimum size, instead of rejecting them.
+func WithRoundUpSmallRequests(enabled bool) Option {
+	return func(d *Driver) {
+		d.roundUpSmallRequests = enabled
+	}
+}
+
+// WithListOnlyManaged restricts ListVolumes to volumes created by the
+// driver.
+func WithListOnlyManaged(enabled bool) Option {
+	return func(d *Driver) {
+		d.listOnlyManaged = enabled
+	}
+}
+
+// WithActionTimeout sets how long the controller waits for hcloud actions,
+// e.g. attaching a volume, to complete.
+func WithActionTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.actionTimeout = timeout
+	}
+}
+
+// WithActionPollInterval sets the first interval hcloud actions are polled
+// in. The interval is doubled after every poll.
+func WithActionPollInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.actionPollInterval = interval
+	}
+}
+
+// WithActionLogEvery logs only the first and every n-th poll of an hcloud
+// action, besides its completion. 1 logs every poll.
+func WithActionLogEvery(n int) Option {
+	return func(d *Driver) {
+		d.actionLogEvery = n
+	}
+}
+
+// WithFsckMode sets the policy for checking existing filesystems before they
+// are mounted in NodeStageVolume.
+func WithFsckMode(mode FsckMode) Option {
+	return func(d *Driver) {
+		d.fsckMode = mode
+	}
+}
+
+// WithFormatPolicy sets whether NodeStageVolume may reformat volumes that
+// contain a filesystem of a different type than requested.
+func WithFormatPolicy(policy FormatPolicy) Option {
+	return func(d *Driver) {
+		d.formatPolicy = policy
+	}
+}
+
+// WithFormatOnStage sets whether NodeStageVolume may format volumes. If
+// disabled, only volumes with an existing filesystem can be staged.
+func WithFormatOnStage(enabled bool) Option {
+	return func(d *Driver) {
+		d.disableFormat = !enabled
+	}
+}
+
+// WithDeviceWaitTimeout sets how long NodeStageVolume waits for udev to
+// create the device of an attached volume.
+func WithDeviceWaitTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.deviceWaitTimeout = timeout
+	}
+}
+
+// WithUdevSettle enables running `udevadm settle` in NodeStageVolume before
+// waiting for the device of an attached volume.
+func WithUdevSettle(enabled bool) Option {
+	return func(d *Driver) {
+		d.udevSettle = enabled
+	}
+}
+
+// WithFstrimInterval enables periodically running fstrim on all volumes
+// mounted on the node.
+func WithFstrimInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.fstrimInterval = interval
+	}
+}
+
+// WithDataDir sets the directory the node service persists the state of
+// staged volumes in, so it can recover after a restart.
+func WithDataDir(dir string) Option {
+	return func(d *Driver) {
+		d.dataDir = dir
+	}
+}
+
+// WithMountHealthInterval enables periodically checking the staged volumes
+// for disappeared devices and filesystems remounted read-only.
+func WithMountHealthInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.mountHealthInterval = interval
+	}
+}
+
+// WithRemountStaged mounts staged volumes again if the mount health check
+// finds their staging mount gone or broken while the device is present,
+// e.g. after a transient detach. It needs the mount health checks.
+func WithRemountStaged(enabled bool) Option {
+	return func(d *Driver) {
+		d.remountStaged = enabled
+	}
+}
+
+// WithRemoveTargetPaths removes the directory of the target path after
+// unpublishing a filesystem volume, as the CSI spec v1 requires of plugins.
+// Kubernetes removes the directory itself.
+func WithRemoveTargetPaths(enabled bool) Option {
+	return func(d *Driver) {
+		d.removeTargetPaths = enabled
+	}
+}
+
+// WithInventoryInterval sets the interval the managed volumes are listed in
+// for the inventory metrics.
+func WithInventoryInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.inventoryInterval = interval
+	}
+}
+
+// WithHealthAddress sets the address the HTTP health endpoints are served
+// on.
+func WithHealthAddress(addr string) Option {
+	return func(d *Driver) {
+		d.healthAddress = addr
+	}
+}
+
+// WithPprofAddress serves the Go profiling endpoints on the given address,
+// e.g. localhost:6060.
+func WithPprofAddress(addr string) Option {
+	return func(d *Driver) {
+		d.pprofAddress = addr
+	}
+}
+
+// WithSlowRequestThreshold logs requests that take longer than the
+// threshold at warn level with a breakdown of their timing.
+func WithSlowRequestThreshold(threshold time.Duration) Option {
+	return func(d *Driver) {
+		d.slowRequestThreshold = threshold
+	}
+}
+
+// WithMaxConcurrentOperations runs at most n creates, deletes, attaches
+// and detaches at the same time, further requests wait for a free worker.
+// Zero doesn't limit them.
+func WithMaxConcurrentOperations(n int) Option {
+	return func(d *Driver) {
+		d.maxConcurrentOperations = n
+	}
+}
+
+// WithRPCRateLimits limits how often each RPC is served. The limits are
+// comma separated of the form method=n/period, e.g.
+// "ListVolumes=1/30s,CreateVolume=20/1m". Requests above the limit fail
+// with ResourceExhausted.
+func WithRPCRateLimits(limits string) Option {
+	return func(d *Driver) {
+		d.rpcRateLimit = limits
+	}
+}
+
+// WithTLS serves a tcp endpoint with the certificate and key. If a CA is
+// given, clients have to present a certificate signed by it. The files are
+// reloaded periodically, so they can be rotated.
+func WithTLS(certFile, keyFile, clientCAFile string) Option {
+	return func(d *Driver) {
+		if certFile == "" && keyFile == "" && clientCAFile == "" {
+			return
+		}
+		d.tls = &tlsFiles{
+			certFile: certFile,
+			keyFile:  keyFile,
+			caFile:   clientCAFile,
+		}
+	}
+}
+
+// WithGRPCReflection registers the gRPC reflection service, so the CSI
+// services can be explored and called with grpcurl.
+func WithGRPCReflection(enabled bool) Option {
+	return func(d *Driver) {
+		d.grpcReflection = enabled
+	}
+}
+
+// WithKubeEvents posts events on the PersistentVolume and claim of volumes
+// whose operations failed. The driver must run in a Kubernetes cluster.
+func WithKubeEvents(enabled bool) Option {
+	return func(d *Driver) {
+		d.kubeEvents = enabled
+	}
+}
+
+// WithLeaderElection elects a single controller replica to run the
+// background loops like the volume inventory, so the controller can run
+// with multiple replicas. The lock is a ConfigMap with the given name in the
+// given namespace, which default to the driver name and the namespace of
+// the pod. The driver must run in a Kubernetes cluster.
+func WithLeaderElection(enabled bool, namespace, name string) Option {
+	return func(d *Driver) {
+		d.leaderElection = enabled
+		d.leaderElectionNamespace = namespace
+		d.leaderElectionName = name
+	}
+}
+
+// WithJournalDir records the in-flight operations of the controller in the
+// given directory, so they are finished after a restart. Volumes whose
+// creation was interrupted are deleted if the CO doesn't ask for them again
+// within the grace period. The directory has to survive restarts of the
+// controller.
+func WithJournalDir(dir string, orphanGracePeriod time.Duration) Option {
+	return func(d *Driver) {
+		d.journalDir = dir
+		d.orphanGracePeriod = orphanGracePeriod
+	}
+}
+
+// WithPluginRegistration registers the node service with kubelet through
+// the plugin registration directory of kubelet, usually
+// /var/lib/kubelet/plugins_registry, instead of a driver-registrar sidecar.
+// The endpoint is the path of the CSI socket on the host.
+func WithPluginRegistration(dir, kubeletEndpoint string) Option {
+	return func(d *Driver) {
+		d.registrationDir = dir
+		d.kubeletEndpoint = kubeletEndpoint
+	}
+}
+
+// WithDockerPlugin serves the legacy Docker volume plugin API on the unix
+// socket, e.g. /run/docker/plugins/hcloud.sock for "docker volume create
+// -d hcloud". The volumes are mounted below dir.
+func WithDockerPlugin(socket, dir string) Option {
+	return func(d *Driver) {
+		d.dockerPluginSocket = socket
+		d.dockerPluginDir = dir
+	}
+}
+
+// WithSelfCheck verifies at startup that the location exists, volumes can
+// be listed, the token has write permission and the API version is
+// supported. The write permission is tested by creating and deleting an
+// SSH key.
+func WithSelfCheck(enabled bool) Option {
+	return func(d *Driver) {
+		d.selfCheck = enabled
+	}
+}
+
+// WithReconcileInterval compares the attachments of the managed volumes
+// with the VolumeAttachments of the cluster in the given interval and
+// repairs drift. The driver must run in a Kubernetes cluster.
+func WithReconcileInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.reconcileInterval = interval
+	}
+}
+
+// WithEmbeddedControllers provisions, deletes, attaches and detaches
+// volumes by watching the claims, volumes and VolumeAttachments of the
+// cluster, so the controller runs without the external-provisioner and
+// external-attacher sidecars. The driver must run in a Kubernetes cluster.
+func WithEmbeddedControllers(enabled bool) Option {
+	return func(d *Driver) {
+		d.embeddedControllers = enabled
+	}
+}
+
+// WithKubeClient sets the client used for events and the cost exporter,
+// instead of a client for the cluster the driver runs in.
+func WithKubeClient(client kubernetes.Interface) Option {
+	return func(d *Driver) {
+		d.kubeClient = client
+	}
+}
+
+// WithCostExporter exports the estimated monthly cost of the managed
+// volumes based on the current hcloud pricing. If the driver runs in a
+// Kubernetes cluster, the cost is broken down by StorageClass and namespace.
+func WithCostExporter(enabled bool) Option {
+	return func(d *Driver) {
+		d.costExporter = enabled
+	}
+}
+
+// WithWebhook notifies the given URL once creating or publishing a volume
+// failed threshold times in a row. The payload is either generic JSON or a
+// Slack message, depending on the format.
+func WithWebhook(url string, format WebhookFormat, threshold int) Option {
+	return func(d *Driver) {
+		d.webhookURL = url
+		d.webhookFormat = format
+		d.webhookThreshold = threshold
+	}
+}
+
+// WithMetricsAddress sets the address the Prometheus metrics are served on.
+func WithMetricsAddress(addr string) Option {
+	return func(d *Driver) {
+		d.metricsAddress = addr
+	}
+}
+
+// WithReducedPrivileges runs the node service in an unprivileged container
+// with only CAP_SYS_ADMIN. Volumes are mounted with the mount syscalls
+// instead of the mount utilities, the capabilities are verified at startup
+// and staging fails if the mounts would not propagate to the host.
+func WithReducedPrivileges(enabled bool) Option {
+	return func(d *Driver) {
+		d.reducedPrivileges = enabled
+	}
+}
+
+// WithHostRoot makes the default Mounter execute the mount and filesystem
+// utilities of the host, whose root filesystem is mounted at the given path.
+func WithHostRoot(path string) Option {
+	return func(d *Driver) {
+		d.hostRoot = path
+	}
+}
+
+// WithMounter replaces the default Mounter, which shells out to the mount
+// and mkfs utilities, with the given implementation.
+func WithMounter(m Mounter) Option {
+	return func(d *Driver) {
+		d.mounter = m
+	}
+}
+
+// WithNodeID overrides the node ID, which is otherwise the ID of the
+// server as reported by the metadata service.
+func WithNodeID(nodeID string) Option {
+	return func(d *Driver) {
+		d.nodeID = nodeID
+	}
+}
+
+// newDriver returns a driver with the defaults and the given options
+// applied, without validating or connecting anything.
+func newDriver(opts ...Option) *Driver {
+	d := &Driver{
+		hcloudURL: hcloud.Endpoint,
+		mode:      ModeAll,
+		logFormat: LogFormatText,
+		rateLimit: &rateLimit{},
+
+		actionTimeout:      defaultActionTimeout,
+		actionPollInterval: defaultActionPollInterval,
+		actionLogEvery:     defaultActionLogEvery,
+		metadataEndpoint:   defaultMetadataEndpoint,
+		fsckMode:           FsckModeOff,
+		formatPolicy:       FormatPolicySafe,
+		deviceWaitTimeout:  defaultDeviceWaitTimeout,
+
+		slowRequestThreshold: defaultSlowRequestThreshold,
+		orphanGracePeriod:    defaultOrphanGracePeriod,
+		webhookFormat:        WebhookFormatJSON,
+		webhookThreshold:     defaultWebhookThreshold,
+
+		metrics: newMetrics(),
+		stopCh:  make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
 // NewDriver returns a CSI plugin that contains the necessary gRPC
 // interfaces to interact with Kubernetes over unix domain sockets for
-// managaing Hetzner Cloud Volumes
-func NewDriver(ep, token, url, hostname string) (*Driver, error) {
+// managaing Hetzner Cloud Volumes. At least an endpoint must be configured
+// with WithEndpoint.
+func NewDriver(opts ...Option) (*Driver, error) {
+	d := newDriver(opts...)
+
+	if d.endpoint == "" {
+		return nil, errors.New("an endpoint is required")
+	}
+
+	if err := d.mode.validate(); err != nil {
+		return nil, err
+	}
 
-	hcloudClient := hcloud.NewClient(
-		hcloud.WithToken(token),
-		hcloud.WithApplication("hcloud-csi-driver", version),
-		hcloud.WithEndpoint(url))
+	if err := d.logFormat.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := d.logSink.validate(); err != nil {
+		return nil, err
+	}
+
+	if d.clusterName != "" && !clusterNameRegexp.MatchString(d.clusterName) {
+		return nil, fmt.Errorf("invalid cluster name %q, must consist of at most 32 lower case letters, digits and '-'", d.clusterName)
+	}
+
+	if d.socketMode != "" {
+		if _, err := parseSocketMode(d.socketMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.socketOwner != "" {
+		if _, _, err := parseSocketOwner(d.socketOwner); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.tokenFile != "" {
+		if d.hcloudToken != "" {
+			return nil, errors.New("a token and a token file can't be configured at the same time")
+		}
+
+		var err error
+		d.hcloudToken, err = readTokenFile(d.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.tokenSecret != "" {
+		if d.tokenFile != "" {
+			return nil, errors.New("a token file and a token secret can't be configured at the same time")
+		}
+
+		if d.hcloudToken != "" {
+			return nil, errors.New("a token and a token secret can't be configured at the same time")
+		}
+
+		if _, _, err := parseTokenSecret(d.tokenSecret); err != nil {
+			return nil, err
+		}
+
+		if d.kubeClient == nil {
+			kubeClient, err := newKubeClient()
+			if err != nil {
+				return nil, err
+			}
+			d.kubeClient = kubeClient
+		}
+
+		var err error
+		d.hcloudToken, err = d.readTokenSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.projectsSecret != "" && d.kubeClient == nil {
+		kubeClient, err := newKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		d.kubeClient = kubeClient
+	}
+
+	if err := d.loadProjects(); err != nil {
+		return nil, err
+	}
+
+	if d.hcloudRecordFile != "" {
+		d.recorder = &recorder{path: d.hcloudRecordFile}
+	}
+
+	// without a token only the node service is available, it doesn't need
+	// to talk to the hcloud API
+	if d.hcloudClient == nil && d.hcloudToken != "" {
+		hcloudClient, err := d.newHCloudClient(d.hcloudToken, d.hcloudURL)
+		if err != nil {
+			return nil, err
+		}
+		d.hcloudClient = hcloudClient
+	}
+
+	if d.services == nil {
+		d.services = servicesOf(d.hcloudClient)
+	}
+
+	if d.mode == ModeController && !d.hasHCloud() {
+		return nil, errors.New("the controller service needs a token")
+	}
+
+	if d.kubeEvents && d.kubeClient == nil {
+		kubeClient, err := newKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		d.kubeClient = kubeClient
+	}
+
+	if (d.reconcileInterval > 0 || d.embeddedControllers) && d.runsController() && d.kubeClient == nil {
+		kubeClient, err := newKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		d.kubeClient = kubeClient
+	}
+
+	if d.leaderElection && d.runsController() {
+		if d.kubeClient == nil {
+			kubeClient, err := newKubeClient()
+			if err != nil {
+				return nil, err
+			}
+			d.kubeClient = kubeClient
+		}
+
+		// the hostname of a pod is its name, unlike the configured
+		// hostname, which is usually the node name
+		identity, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get identity for leader election: %s", err)
+		}
+
+		d.leaderElector = &leaderElector{
+			namespace: d.leaderElectionNamespace,
+			name:      d.leaderElectionName,
+			identity:  identity,
+		}
+		if d.leaderElector.namespace == "" {
+			d.leaderElector.namespace = podNamespace()
+		}
+		if d.leaderElector.name == "" {
+			d.leaderElector.name = d.driverName()
+		}
+	}
 
-	server, _, err := hcloudClient.Server.GetByName(context.TODO(), hostname)
+	// the cost is only broken down by StorageClass and namespace in a
+	// cluster
+	if d.costExporter && d.kubeClient == nil {
+		if kubeClient, err := newKubeClient(); err == nil {
+			d.kubeClient = kubeClient
+		}
+	}
+
+	d.metrics.registerRateLimit(d.rateLimit)
+
+	if err := d.fsckMode.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := d.formatPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	if d.registrationDir != "" && d.kubeletEndpoint == "" {
+		return nil, errors.New("plugin registration needs the path of the CSI socket on the host")
+	}
+
+	if d.dockerPluginSocket != "" {
+		if !d.runsController() || !d.runsNode() {
+			return nil, errors.New("the Docker volume plugin needs a token and runs the controller and the node service")
+		}
+		if d.dockerPluginDir == "" {
+			return nil, errors.New("the Docker volume plugin needs a directory to mount the volumes in")
+		}
+	}
+
+	if d.maxConcurrentOperations < 0 {
+		return nil, fmt.Errorf("invalid number of concurrent operations %d, must not be negative", d.maxConcurrentOperations)
+	}
+
+	if d.maxConcurrentOperations > 0 {
+		d.operationLimiter = newOperationLimiter(d.maxConcurrentOperations)
+		d.metrics.registerOperationLimiter(d.operationLimiter)
+	}
+
+	if err := d.validateTLS(); err != nil {
+		return nil, err
+	}
+
+	rpcRateLimits, err := parseRPCRateLimits(d.rpcRateLimit)
 	if err != nil {
-		return nil, fmt.Errorf("could not get hcloud server by hostname: %s", err)
+		return nil, err
+	}
+	d.rpcRateLimits = rpcRateLimits
+
+	if d.actionLogEvery < 1 {
+		return nil, fmt.Errorf("invalid action log sampling %d, must be at least 1", d.actionLogEvery)
+	}
+
+	if d.webhookURL != "" {
+		if err := d.webhookFormat.validate(); err != nil {
+			return nil, err
+		}
+
+		if d.webhookThreshold < 1 {
+			return nil, fmt.Errorf("invalid webhook threshold %d, must be at least 1", d.webhookThreshold)
+		}
 	}
 
-	location := server.Datacenter.Location.Name
-	nodeID := strconv.Itoa(server.ID)
+	logger := d.logger
+	if logger == nil {
+		var err error
+		logger, err = d.newLogger()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	log := logrus.New().WithFields(logrus.Fields{
-		"location": location,
-		"hostname": hostname,
+	log := logger.WithFields(logrus.Fields{
+		"hostname": d.hostname,
 		"version":  version,
 	})
+	if d.clusterName != "" {
+		log = log.WithField("cluster", d.clusterName)
+	}
 
-	return &Driver{
-		endpoint:     ep,
-		hostname:     hostname,
-		nodeID:       nodeID,
-		location:     location,
-		hcloudClient: hcloudClient,
-		mounter:      newMounter(log),
-		log:          log,
-	}, nil
-}
+	if err := d.discoverNode(context.TODO(), log); err != nil {
+		return nil, err
+	}
 
-// Run starts the CSI plugin by communication over the given endpoint
-func (d *Driver) Run() error {
-	u, err := url.Parse(d.endpoint)
-	if err != nil {
-		return fmt.Errorf("unable to parse address: %q", err)
+	if d.hcloudClient != nil {
+		if err := d.checkHCloud(context.TODO()); err != nil {
+			return nil, err
+		}
 	}
 
-	addr := path.Join(u.Host, filepath.FromSlash(u.Path))
-	if u.Host == "" {
-		addr = filepath.FromSlash(u.Path)
+	d.log = log.WithField("location", d.location)
+	if d.selfCheck && d.hcloudClient != nil {
+		if err := d.verifySetup(context.TODO()); err != nil {
+			return nil, fmt.Errorf("self-check failed: %s", err)
+		}
+		d.log.Info("self-check passed")
 	}
+	if d.injectErrors != "" {
+		faults, err := parseFaults(d.injectErrors)
+		if err != nil {
+			return nil, err
+		}
 
-	// CSI plugins talk only over UNIX sockets currently
-	if u.Scheme != "unix" {
-		return fmt.Errorf("currently only unix domain sockets are supported, have: %s", u.Scheme)
-	} else {
-		// remove the socket if it's already there. This can happen if we
-		// deploy a new version and the socket was created from the old running
-		// plugin.
-		d.log.WithField("socket", addr).Info("removing socket")
-		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove unix domain socket file %s, error: %s", addr, err)
+		d.faults = &faultInjector{
+			faults:  faults,
+			timeout: d.hcloudRequestTimeout,
+			log:     d.log,
+			rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
 		}
+		d.log.WithField("faults", d.injectErrors).Warn("fault injection is enabled, requests to the hcloud API fail on purpose")
 	}
 
-	listener, err := net.Listen(u.Scheme, addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+	if d.dryRun {
+		d.log.Warn("dry run is enabled, volumes are not created, deleted, attached or detached")
+	}
+
+	if d.reducedPrivileges && d.runsNode() {
+		if err := d.checkPrivileges(); err != nil {
+			return nil, fmt.Errorf("reduced privileges: %s", err)
+		}
+	}
+
+	if d.mounter == nil {
+		m := newMounter(d.log, d.hostRoot)
+		m.syscalls = d.reducedPrivileges
+		d.mounter = m
+	}
+
+	if d.mode == ModeAll && !d.hasHCloud() {
+		d.log.Info("no token configured, running the node service only")
+	}
+
+	d.log.WithFields(d.configSummary()).Info("driver configured")
+
+	return d, nil
+}
+
+// driverName returns the CSI name of the driver.
+func (d *Driver) driverName() string {
+	if d.name != "" {
+		return d.name
 	}
+	return DefaultDriverName
+}
+
+// runsController returns whether the driver runs the controller service.
+func (d *Driver) runsController() bool {
+	return d.mode != ModeNode && d.hasHCloud()
+}
+
+// runsNode returns whether the driver runs the node service.
+func (d *Driver) runsNode() bool {
+	return d.mode != ModeController
+}
 
+// Run starts the CSI plugin by communication over the given endpoint
+func (d *Driver) Run() error {
 	// log response errors for better observability
 	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		resp, err := handler(ctx, req)
@@ -147,24 +1433,182 @@ func (d *Driver) Run() error {
 		d.log.WithError(err).Warn("CSI plugin will not function correctly, please resolve volume limit")
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	// grpc only supports a single interceptor, record the metrics around
+	// the logging, which sees the errors of recovered panics
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return d.metrics.unaryInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return errHandler(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return d.slowRequestInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return d.rateLimitInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+						return d.concurrencyInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+							return d.recoverInterceptor(ctx, req, info, handler)
+						})
+					})
+				})
+			})
+		})
+	}
+
+	serverOpts := []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)}
+	if d.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(d.tls.config())))
+		go d.watchTLSFiles()
+	}
 
+	srv := grpc.NewServer(serverOpts...)
+	csi.RegisterIdentityServer(srv, d)
+	if d.runsController() {
+		csi.RegisterControllerServer(srv, d)
+	}
+	if d.runsNode() {
+		csi.RegisterNodeServer(srv, d)
+	}
+	if d.grpcReflection {
+		reflection.Register(srv)
+	}
+
+	listener, err := d.listen()
+	if err != nil {
+		return err
+	}
+
+	d.readyMu.Lock()
+	d.srv = srv
+	d.addr = listener.Addr()
+	if listener.Addr().Network() == "unix" && !d.socketActivated() {
+		d.socket = listener.Addr().String()
+	}
 	d.ready = true // we're now ready to go!
-	d.log.WithField("addr", addr).Info("server started")
-	return d.srv.Serve(listener)
+	d.readyMu.Unlock()
+
+	if d.runsNode() && d.registrationDir != "" {
+		go d.servePluginRegistration()
+	}
+
+	if d.dockerPluginSocket != "" {
+		go d.serveDockerPlugin()
+	}
+
+	if d.runsNode() && d.fstrimInterval > 0 {
+		go d.runFstrim()
+	}
+
+	if d.runsNode() && d.mountHealthInterval > 0 {
+		if d.dataDir == "" {
+			d.log.Warn("mount health checks need a data directory, disabling them")
+		} else {
+			go d.runMountHealthCheck()
+		}
+	} else if d.runsNode() && d.remountStaged {
+		d.log.Warn("remounting staged volumes needs the mount health checks, disabling it")
+	}
+
+	if d.healthAddress != "" {
+		go d.serveHealth(d.healthAddress)
+	}
+
+	if d.pprofAddress != "" {
+		go d.servePprof(d.pprofAddress)
+	}
+
+	if d.leaderElector != nil {
+		go d.runLeaderElection()
+	}
+
+	if d.runsController() && d.journalDir != "" {
+		d.resumeOperations()
+	}
+
+	if d.runsController() && d.reconcileInterval > 0 {
+		go d.runAttachmentReconciliation()
+	}
+
+	if d.runsController() && d.embeddedControllers {
+		go d.runEmbeddedControllers()
+	}
+
+	if d.metricsAddress != "" {
+		go d.serveMetrics(d.metricsAddress)
+
+		if d.runsController() {
+			go d.runVolumeInventory()
+		}
+	}
+
+	if d.tokenFile != "" && d.tokens != nil {
+		go d.watchTokenFile()
+	}
+
+	if d.tokenSecret != "" && d.tokens != nil {
+		go d.watchTokenSecret()
+	}
+
+	d.log.WithField("addr", listener.Addr().String()).Info("server started")
+	return srv.Serve(listener)
 }
 
 // Stop stops the plugin
 func (d *Driver) Stop() {
 	d.readyMu.Lock()
 	d.ready = false
+	srv := d.srv
 	d.readyMu.Unlock()
 
+	d.closeStopCh()
+
 	d.log.Info("server stopped")
-	d.srv.Stop()
+	if srv != nil {
+		srv.Stop()
+	}
+}
+
+// Shutdown stops the plugin gracefully. New RPCs are rejected while in-flight
+// RPCs, e.g. waiting for a volume to be attached, may finish until the
+// timeout is reached. Afterwards they are canceled and the socket is removed.
+func (d *Driver) Shutdown(timeout time.Duration) {
+	d.readyMu.Lock()
+	d.ready = false
+	srv, socket := d.srv, d.socket
+	d.readyMu.Unlock()
+
+	d.log.WithField("timeout", timeout).Info("shutting down, waiting for in-flight requests")
+
+	stopped := make(chan struct{})
+	go func() {
+		if srv != nil {
+			srv.GracefulStop()
+		}
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		d.log.Warn("in-flight requests didn't finish in time, canceling them")
+		if srv != nil {
+			srv.Stop()
+		}
+		<-stopped
+	}
+
+	d.closeStopCh()
+
+	if socket != "" {
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			d.log.WithError(err).Warn("could not remove socket")
+		}
+	}
+
+	d.log.Info("server stopped")
+}
+
+// closeStopCh terminates the background loops.
+func (d *Driver) closeStopCh() {
+	d.stopOnce.Do(func() {
+		if d.stopCh != nil {
+			close(d.stopCh)
+		}
+	})
 }
 
 // GetVersion returns the current release version, as inserted at build time.
@@ -186,3 +1630,9 @@ func GetCommit() string {
 func GetTreeState() string {
 	return gitTreeState
 }
+
+// GetBuildDate returns the time the binary was built, as inserted at build
+// time.
+func GetBuildDate() string {
+	return buildDate
+}
@@ -32,6 +32,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
 	"github.com/kubernetes-csi/csi-test/pkg/sanity"
 	"github.com/sirupsen/logrus"
 )
@@ -40,60 +41,109 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// TestDriverSuite runs the csi-test sanity suite against the driver, which
+// talks to the fake hcloud API and serves on a temporary unix socket.
 func TestDriverSuite(t *testing.T) {
-	socket := "/tmp/csi.sock"
-	endpoint := "unix://" + socket
-	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
-		t.Fatalf("failed to remove unix domain socket file %s, error: %s", socket, err)
+	dir, err := ioutil.TempDir("", "csi-sanity")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
 
 	serverID := 1234567
-	fakeHCloud := &fakeAPI{
-		t:       t,
-		volumes: map[int]*schema.Volume{},
-		servers: map[int]*schema.Server{
-			serverID: {
-				ID: serverID,
-			},
-		},
-	}
+	fake := fakehcloud.New()
+	fake.AddServer(serverID, "node", "fsn1")
 
-	tsHCloud := httptest.NewServer(fakeHCloud)
+	tsHCloud := httptest.NewServer(fake)
 	defer tsHCloud.Close()
 
-	hcloudClient := hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL))
-
 	driver := &Driver{
-		endpoint:     endpoint,
-		nodeID:       strconv.Itoa(serverID),
-		location:     "fsn1",
-		hcloudClient: hcloudClient,
-		mounter:      &fakeMounter{},
-		log:          logrus.New().WithField("test_enabled", true),
+		endpoint:           endpoint,
+		nodeID:             strconv.Itoa(serverID),
+		location:           "fsn1",
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		actionPollInterval: 10 * time.Millisecond,
+		mounter:            &fakeMounter{},
+		log:                logrus.New().WithField("test_enabled", true),
 	}
 	defer driver.Stop()
 
 	go driver.Run()
 
-	mntDir, err := ioutil.TempDir("", "mnt")
+	cfg := &sanity.Config{
+		StagingPath: filepath.Join(dir, "mnt-stage"),
+		TargetPath:  filepath.Join(dir, "mnt"),
+		Address:     endpoint,
+	}
+
+	sanity.Test(t, cfg)
+
+	if n := fake.Volumes(); n != 0 {
+		t.Errorf("expected the suite to clean up its volumes, %d left", n)
+	}
+}
+
+func TestNewDriverEmbedded(t *testing.T) {
+	// a blocked metadata service
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer md.Close()
+
+	serverID := 1234567
+	tsHCloud := httptest.NewServer(&fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+		servers: map[int]*schema.Server{
+			serverID: {
+				ID: serverID,
+				Datacenter: schema.Datacenter{
+					Location: schema.Location{Name: "nbg1"},
+				},
+			},
+		},
+	})
+	defer tsHCloud.Close()
+
+	dir, err := ioutil.TempDir("", "csi-embedded")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(mntDir)
-
-	mntStageDir, err := ioutil.TempDir("", "mnt-stage")
+	defer os.RemoveAll(dir)
+
+	mounter := &fakeMounter{}
+	logger := logrus.New()
+
+	d, err := NewDriver(
+		WithEndpoint("unix://"+filepath.Join(dir, "csi.sock")),
+		WithNodeID(strconv.Itoa(serverID)),
+		WithHCloudClient(hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL))),
+		WithMounter(mounter),
+		WithLogger(logger),
+		func(d *Driver) { d.metadataEndpoint = md.URL },
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(mntStageDir)
 
-	cfg := &sanity.Config{
-		StagingPath: mntStageDir,
-		TargetPath:  mntDir,
-		Address:     endpoint,
+	if d.location != "nbg1" {
+		t.Errorf("expected location nbg1, got %q", d.location)
+	}
+	if d.mounter != mounter {
+		t.Error("expected the given mounter to be used")
+	}
+	if d.log.Logger != logger {
+		t.Error("expected the given logger to be used")
+	}
+	if !d.runsController() {
+		t.Error("expected the controller service to run with the given client")
 	}
 
-	sanity.Test(t, cfg)
+	if _, err := NewDriver(WithNodeID(strconv.Itoa(serverID))); err == nil {
+		t.Error("expected an error without an endpoint")
+	}
 }
 
 // fakeAPI implements a fake, cached Hetzner Cloud API
@@ -111,18 +161,7 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		id, _ := strconv.Atoi(filepath.Base(r.URL.Path))
 		server, ok := f.servers[id]
 		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-
-			errResp := &schema.ErrorResponse{
-				Error: schema.Error{
-					Code: string(hcloud.ErrorCodeNotFound),
-				},
-			}
-
-			err := json.NewEncoder(w).Encode(&errResp)
-			if err != nil {
-				f.t.Fatalf("error: %s", err)
-			}
+			f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
 			return
 		}
 		resp.Server = *server
@@ -134,6 +173,26 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// volumes cost 0.05 EUR per GB and month
+	if r.URL.Path == "/pricing" {
+		w.Write([]byte(`{"pricing": {"currency": "EUR", "volume": {"price_per_gb_month": {"net": "0.04", "gross": "0.05"}}}}`))
+		return
+	}
+
+	// all locations exist
+	if strings.HasPrefix(r.URL.Path, "/locations") {
+		resp := &schema.LocationListResponse{Locations: []schema.Location{}}
+		if name := r.URL.Query().Get("name"); name != "" {
+			resp.Locations = append(resp.Locations, schema.Location{ID: 1, Name: name})
+		}
+
+		err := json.NewEncoder(w).Encode(&resp)
+		if err != nil {
+			f.t.Fatalf("error: %s", err)
+		}
+		return
+	}
+
 	// actions always succeeded instantly
 	if strings.HasPrefix(r.URL.Path, "/actions/") {
 		// for now we only do a GET, so we assume it's a GET and don't check
@@ -159,16 +218,16 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// A list call
 		if strings.HasPrefix(r.URL.String(), "/volumes?") {
 			volumes := []schema.Volume{}
-			if name := r.URL.Query().Get("name"); name != "" {
-				for _, vol := range f.volumes {
-					if vol.Name == name {
-						volumes = append(volumes, *vol)
-					}
+			name := r.URL.Query().Get("name")
+			selector := r.URL.Query().Get("label_selector")
+			for _, vol := range f.volumes {
+				if name != "" && vol.Name != name {
+					continue
 				}
-			} else {
-				for _, vol := range f.volumes {
-					volumes = append(volumes, *vol)
+				if !matchesLabels(vol.Labels, selector) {
+					continue
 				}
+				volumes = append(volumes, *vol)
 			}
 
 			resp := new(schema.VolumeListResponse)
@@ -186,16 +245,26 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			id, _ := strconv.Atoi(filepath.Base(r.URL.Path))
 			vol, ok := f.volumes[id]
 			if !ok {
-				w.WriteHeader(http.StatusNotFound)
-			} else {
-				resp.Volume = *vol
+				f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
+				return
 			}
 
+			resp.Volume = *vol
 			_ = json.NewEncoder(w).Encode(&resp)
 			return
 		}
 
 	case "POST":
+		if strings.HasSuffix(r.URL.Path, "/actions/attach") {
+			f.attach(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/actions/detach") {
+			f.detach(w, r)
+			return
+		}
+
 		v := new(schema.VolumeCreateRequest)
 		err := json.NewDecoder(r.Body).Decode(v)
 		if err != nil {
@@ -209,6 +278,9 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Size:    v.Size,
 			Created: time.Now().UTC(),
 		}
+		if v.Labels != nil {
+			vol.Labels = *v.Labels
+		}
 
 		f.volumes[id] = vol
 
@@ -226,9 +298,101 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// attach attaches a volume to a server, like the real API it fails if the
+// volume is already attached.
+func (f *fakeAPI) attach(w http.ResponseWriter, r *http.Request) {
+	v := new(schema.VolumeActionAttachVolumeRequest)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		f.t.Fatal(err)
+	}
+
+	id, _ := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(r.URL.Path))))
+	vol, ok := f.volumes[id]
+	if !ok {
+		f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
+		return
+	}
+
+	if _, ok := f.servers[v.Server]; !ok {
+		f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
+		return
+	}
+
+	if vol.Server != nil {
+		f.error(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput)
+		return
+	}
+
+	server := v.Server
+	vol.Server = &server
+
+	resp := &schema.VolumeActionAttachVolumeResponse{
+		Action: schema.Action{
+			ID:     rand.Int(),
+			Status: string(hcloud.ActionStatusRunning),
+		},
+	}
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// detach detaches a volume from its server.
+func (f *fakeAPI) detach(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(r.URL.Path))))
+	vol, ok := f.volumes[id]
+	if !ok {
+		f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
+		return
+	}
+	vol.Server = nil
+
+	resp := &schema.VolumeActionDetachVolumeResponse{
+		Action: schema.Action{
+			ID:     rand.Int(),
+			Status: string(hcloud.ActionStatusRunning),
+		},
+	}
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// matchesLabels returns whether the labels match a selector of
+// comma-separated k=v pairs.
+func matchesLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// error writes a JSON error response, hcloud-go only parses those.
+func (f *fakeAPI) error(w http.ResponseWriter, status int, code hcloud.ErrorCode) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(&schema.ErrorResponse{
+		Error: schema.Error{
+			Code: string(code),
+		},
+	})
+	if err != nil {
+		f.t.Fatalf("error: %s", err)
+	}
+}
+
 type fakeMounter struct{}
 
-func (f *fakeMounter) Format(source string, fsType string) error {
+func (f *fakeMounter) Format(source string, fsType string, opts FormatOptions) error {
 	return nil
 }
 
@@ -236,13 +400,65 @@ func (f *fakeMounter) Mount(source string, target string, fsType string, options
 	return nil
 }
 
+func (f *fakeMounter) MountBlock(source string, target string, options ...string) error {
+	return nil
+}
+
 func (f *fakeMounter) Unmount(target string) error {
 	return nil
 }
 
-func (f *fakeMounter) IsFormatted(source string) (bool, error) {
-	return true, nil
+func (f *fakeMounter) ForceUnmount(target string) error {
+	return nil
+}
+
+func (f *fakeMounter) IsCorruptedMount(target string) bool {
+	return false
+}
+
+func (f *fakeMounter) Check(source string, fsType string, force bool) error {
+	return nil
+}
+
+func (f *fakeMounter) NeedsResize(source string, fsType string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeMounter) Resize(source string, fsType string) error {
+	return nil
+}
+
+func (f *fakeMounter) SettleUdev(timeout time.Duration) error {
+	return nil
+}
+
+func (f *fakeMounter) WaitForDevice(device string, timeout time.Duration) error {
+	return nil
+}
+
+func (f *fakeMounter) GetFsType(source string) (string, error) {
+	return "ext4", nil
 }
 func (f *fakeMounter) IsMounted(target string) (bool, error) {
 	return true, nil
 }
+
+func (f *fakeMounter) IsMountedFrom(source string, target string, options ...string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeMounter) Trim(target string) error {
+	return nil
+}
+
+func (f *fakeMounter) GetStatistics(volumePath string) (VolumeStatistics, error) {
+	return VolumeStatistics{}, nil
+}
+
+func TestWithModeMonolith(t *testing.T) {
+	d := &Driver{}
+	WithMode(ModeMonolith)(d)
+	if d.mode != ModeAll {
+		t.Errorf("got mode %q, want %q", d.mode, ModeAll)
+	}
+}
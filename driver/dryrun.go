@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// errorCodeDryRun is the code of the errors returned instead of
+	// changing volumes in dry-run mode.
+	errorCodeDryRun hcloud.ErrorCode = "dry_run"
+)
+
+// dryRunVolumes passes reading requests on and logs the changing ones
+// instead of sending them. They fail with a dry_run error naming the call,
+// so the CO reports what would have happened, e.g. in the events of a
+// claim.
+type dryRunVolumes struct {
+	VolumeService
+
+	log *logrus.Entry
+}
+
+// withDryRun returns the services without changes to volumes.
+func withDryRun(services *hcloudServices, log *logrus.Entry) *hcloudServices {
+	if services == nil {
+		return nil
+	}
+	return &hcloudServices{
+		Volume: dryRunVolumes{VolumeService: services.Volume, log: log},
+		Server: services.Server,
+		Action: services.Action,
+	}
+}
+
+// skip logs the call and returns the error of the skipped call.
+func (v dryRunVolumes) skip(fields logrus.Fields, format string, args ...interface{}) error {
+	call := fmt.Sprintf(format, args...)
+	v.log.WithFields(fields).Info("dry run: would " + call)
+	return hcloud.Error{
+		Code:    errorCodeDryRun,
+		Message: "dry run: would " + call,
+	}
+}
+
+func (v dryRunVolumes) Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	if err := opts.Validate(); err != nil {
+		return hcloud.VolumeCreateResult{}, nil, err
+	}
+
+	var where string
+	if opts.Location != nil {
+		where = "in " + opts.Location.Name
+	} else if opts.Server != nil {
+		where = fmt.Sprintf("on server %d", opts.Server.ID)
+	}
+
+	err := v.skip(logrus.Fields{
+		"volume_name": opts.Name,
+		"size_gb":     opts.Size,
+		"labels":      opts.Labels,
+	}, "create volume %q of %d GB %s", opts.Name, opts.Size, where)
+	return hcloud.VolumeCreateResult{}, nil, err
+}
+
+func (v dryRunVolumes) Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error) {
+	return nil, v.skip(logrus.Fields{"volume_id": volume.ID}, "delete volume %d", volume.ID)
+}
+
+func (v dryRunVolumes) Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	err := v.skip(logrus.Fields{
+		"volume_id": volume.ID,
+		"server_id": server.ID,
+	}, "attach volume %d to server %d", volume.ID, server.ID)
+	return nil, nil, err
+}
+
+func (v dryRunVolumes) Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	fields := logrus.Fields{"volume_id": volume.ID}
+	if volume.Server != nil {
+		fields["server_id"] = volume.Server.ID
+		return nil, nil, v.skip(fields, "detach volume %d from server %d", volume.ID, volume.Server.ID)
+	}
+	return nil, nil, v.skip(fields, "detach volume %d", volume.ID)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestDryRun(t *testing.T) {
+	f := newFakeServices(10)
+	f.volumes[1] = &hcloud.Volume{ID: 1, Name: "existing", Size: 10}
+	d := newFakeServicesDriver(f)
+	d.dryRun = true
+	ctx := context.Background()
+
+	caps := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: supportedAccessMode,
+	}}
+
+	_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1234",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 50 * GB},
+		VolumeCapabilities: caps,
+	})
+	if err == nil || !strings.Contains(err.Error(), `dry run: would create volume "pvc-1234" of 50 GB in fsn1`) {
+		t.Errorf("expected the skipped create in the error, got %v", err)
+	}
+
+	// reading requests are still sent
+	if _, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "existing", CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * GB}, VolumeCapabilities: caps}); err != nil {
+		t.Errorf("expected the existing volume to be returned, got %v", err)
+	}
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "1",
+		NodeId:           "10",
+		VolumeCapability: caps[0],
+	})
+	if err == nil || !strings.Contains(err.Error(), "dry run: would attach volume 1 to server 10") {
+		t.Errorf("expected the skipped attach in the error, got %v", err)
+	}
+
+	if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "1"}); err == nil {
+		t.Error("expected the delete to be skipped")
+	}
+
+	for _, method := range []string{"Volume.Create", "Volume.Attach", "Volume.Delete"} {
+		if f.calls[method] != 0 {
+			t.Errorf("expected %s not to be called in a dry run", method)
+		}
+	}
+	if len(f.volumes) != 1 || f.volumes[1].Server != nil {
+		t.Error("expected the volumes not to change")
+	}
+}
@@ -0,0 +1,539 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// embeddedSyncInterval is the interval the embedded controllers list
+	// the claims, volumes and attachments of the cluster in.
+	embeddedSyncInterval = 10 * time.Second
+
+	// embeddedTimeout bounds a single provisioning, deletion, attach or
+	// detach of the embedded controllers.
+	embeddedTimeout = 5 * time.Minute
+
+	// annotations set by Kubernetes and the external sidecars, the
+	// embedded controllers use the same, so they can replace the sidecars
+	annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
+	annStorageClass       = "volume.beta.kubernetes.io/storage-class"
+	annProvisionedBy      = "pv.kubernetes.io/provisioned-by"
+	annSelectedNode       = "volume.kubernetes.io/selected-node"
+
+	// paramFsType is the StorageClass parameter of the external
+	// provisioner defining the filesystem of new volumes.
+	paramFsType   = "fsType"
+	defaultFsType = "ext4"
+)
+
+// errClaimProvisioned is returned by provisionClaim if the
+// PersistentVolume of the claim already exists.
+var errClaimProvisioned = errors.New("claim is already provisioned")
+
+// runEmbeddedControllers provisions, deletes, attaches and detaches
+// volumes like the external-provisioner and external-attacher sidecars
+// until the driver is stopped.
+func (d *Driver) runEmbeddedControllers() {
+	ticker := time.NewTicker(embeddedSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if d.isLeader() {
+			d.syncEmbeddedControllers()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// syncEmbeddedControllers runs a single pass of all embedded controllers.
+func (d *Driver) syncEmbeddedControllers() {
+	// detaches go first, so released volumes can be deleted in the same
+	// pass
+	if err := d.syncVolumeAttachments(); err != nil {
+		d.log.WithError(err).Warn("could not sync VolumeAttachments")
+	}
+	if err := d.provisionClaims(); err != nil {
+		d.log.WithError(err).Warn("could not provision claims")
+	}
+	if err := d.deleteReleasedVolumes(); err != nil {
+		d.log.WithError(err).Warn("could not delete released volumes")
+	}
+}
+
+// attacherFinalizer protects VolumeAttachments from being removed before
+// the volume was detached. It is the finalizer of the external-attacher.
+func (d *Driver) attacherFinalizer() string {
+	return "external-attacher/" + strings.Replace(d.driverName(), "/", "-", -1)
+}
+
+// provisionClaims creates a volume and a bound PersistentVolume for every
+// pending claim of a StorageClass of the driver.
+func (d *Driver) provisionClaims() error {
+	claims, err := d.kubeClient.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list PersistentVolumeClaims: %s", err)
+	}
+
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		if claim.Spec.VolumeName != "" || claim.Status.Phase != v1.ClaimPending {
+			continue
+		}
+
+		className := claimStorageClass(claim)
+		if className == "" {
+			continue
+		}
+
+		class, err := d.kubeClient.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+		if err != nil || class.Provisioner != d.driverName() {
+			continue
+		}
+
+		ll := d.log.WithFields(logrus.Fields{
+			"pvc_name":      claim.Name,
+			"pvc_namespace": claim.Namespace,
+			"method":        "embedded_provision",
+		})
+
+		// like the external-provisioner, claims selecting a volume are
+		// left to the volumes created by an administrator
+		if claim.Spec.Selector != nil {
+			ll.Warn("claims with a selector are not provisioned")
+			continue
+		}
+
+		// the volume has to be created in the location of the node the
+		// scheduler selected for the first pod using the claim
+		var requirements *csi.TopologyRequirement
+		if class.VolumeBindingMode != nil && *class.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+			nodeName := claim.Annotations[annSelectedNode]
+			if nodeName == "" {
+				continue
+			}
+
+			requirements, err = d.nodeTopologyRequirement(nodeName)
+			if err != nil {
+				ll.WithError(err).Warn("could not provision claim")
+				continue
+			}
+		}
+
+		err = d.provisionClaim(claim, class, requirements)
+		if err == errClaimProvisioned {
+			continue
+		}
+		if err != nil {
+			ll.WithError(err).Warn("could not provision claim")
+			continue
+		}
+		ll.Info("claim provisioned")
+	}
+	return nil
+}
+
+// claimStorageClass returns the StorageClass of a claim.
+func claimStorageClass(claim *v1.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[annStorageClass]; ok {
+		return class
+	}
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return ""
+}
+
+// nodeTopologyRequirement returns the topology of the node as requirement
+// of a new volume, taken from the labels of the topology keys.
+func (d *Driver) nodeTopologyRequirement(nodeName string) (*csi.TopologyRequirement, error) {
+	node, err := d.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get selected Node %q: %s", nodeName, err)
+	}
+
+	segments := map[string]string{}
+	for _, key := range d.topologyKeys() {
+		if value, ok := node.Labels[key]; ok {
+			segments[key] = value
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("selected Node %q has none of the topology labels %s", nodeName, strings.Join(d.topologyKeys(), ", "))
+	}
+
+	topology := &csi.Topology{Segments: segments}
+	return &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{topology},
+		Preferred: []*csi.Topology{topology},
+	}, nil
+}
+
+// volumeNodeAffinity returns the node affinity of a PersistentVolume that
+// restricts it to the nodes of the topologies, nil for no topologies.
+func volumeNodeAffinity(topologies []*csi.Topology) *v1.VolumeNodeAffinity {
+	var terms []v1.NodeSelectorTerm
+	for _, t := range topologies {
+		keys := make([]string, 0, len(t.Segments))
+		for key := range t.Segments {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var expressions []v1.NodeSelectorRequirement
+		for _, key := range keys {
+			expressions = append(expressions, v1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{t.Segments[key]},
+			})
+		}
+		terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: expressions})
+	}
+
+	if len(terms) == 0 {
+		return nil
+	}
+	return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: terms}}
+}
+
+// isBlockMode returns whether the volume mode of a claim or a
+// PersistentVolume is raw block.
+func isBlockMode(mode *v1.PersistentVolumeMode) bool {
+	return mode != nil && *mode == v1.PersistentVolumeBlock
+}
+
+// volumeCapability returns the capability of a raw block volume or of a
+// volume with a filesystem of the given type.
+func volumeCapability(block bool, fsType string, mountOptions []string) *csi.VolumeCapability {
+	if block {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: supportedAccessMode,
+		}
+	}
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: mountOptions}},
+		AccessMode: supportedAccessMode,
+	}
+}
+
+// provisionClaim creates the volume of a claim and the PersistentVolume
+// bound to it. The PersistentVolume is named like by the external
+// provisioner, so CreateVolume stays idempotent across both.
+func (d *Driver) provisionClaim(claim *v1.PersistentVolumeClaim, class *storagev1.StorageClass, requirements *csi.TopologyRequirement) error {
+	name := "pvc-" + string(claim.UID)
+
+	// the claim stays pending until Kubernetes bound it to the volume
+	if _, err := d.kubeClient.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{}); err == nil {
+		return errClaimProvisioned
+	}
+
+	fsType := defaultFsType
+	params := map[string]string{}
+	for k, v := range class.Parameters {
+		if strings.EqualFold(k, paramFsType) {
+			fsType = v
+			continue
+		}
+		params[k] = v
+	}
+	params[paramPVCName] = claim.Name
+	params[paramPVCNamespace] = claim.Namespace
+
+	block := isBlockMode(claim.Spec.VolumeMode)
+	capability := volumeCapability(block, fsType, class.MountOptions)
+
+	size := claim.Spec.Resources.Requests[v1.ResourceStorage]
+
+	ctx, cancel := context.WithTimeout(context.Background(), embeddedTimeout)
+	defer cancel()
+
+	resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size.Value()},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         params,
+
+		AccessibilityRequirements: requirements,
+	})
+	if err != nil {
+		return err
+	}
+
+	policy := v1.PersistentVolumeReclaimDelete
+	if class.ReclaimPolicy != nil {
+		policy = *class.ReclaimPolicy
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annProvisionedBy: d.driverName()},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(resp.Volume.CapacityBytes, resource.BinarySI),
+			},
+			AccessModes:                   claim.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: policy,
+			StorageClassName:              claimStorageClass(claim),
+			MountOptions:                  class.MountOptions,
+			NodeAffinity:                  volumeNodeAffinity(resp.Volume.AccessibleTopology),
+			ClaimRef: &v1.ObjectReference{
+				Kind:            "PersistentVolumeClaim",
+				Namespace:       claim.Namespace,
+				Name:            claim.Name,
+				UID:             claim.UID,
+				ResourceVersion: claim.ResourceVersion,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           d.driverName(),
+					VolumeHandle:     resp.Volume.Id,
+					VolumeAttributes: resp.Volume.Attributes,
+				},
+			},
+		},
+	}
+	if !block {
+		pv.Spec.CSI.FSType = fsType
+	}
+	if claim.Spec.VolumeMode != nil {
+		pv.Spec.VolumeMode = claim.Spec.VolumeMode
+	}
+
+	_, err = d.kubeClient.CoreV1().PersistentVolumes().Create(pv)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("could not create PersistentVolume %q: %s", name, err)
+	}
+	return nil
+}
+
+// deleteReleasedVolumes deletes the volumes and PersistentVolumes of the
+// driver whose claim was deleted and whose reclaim policy is Delete.
+func (d *Driver) deleteReleasedVolumes() error {
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list PersistentVolumes: %s", err)
+	}
+
+	for _, pv := range pvs.Items {
+		if pv.Annotations[annProvisionedBy] != d.driverName() || pv.Spec.CSI == nil {
+			continue
+		}
+		if pv.Status.Phase != v1.VolumeReleased || pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+			continue
+		}
+
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id": pv.Spec.CSI.VolumeHandle,
+			"pv_name":   pv.Name,
+			"method":    "embedded_delete",
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), embeddedTimeout)
+		_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: pv.Spec.CSI.VolumeHandle})
+		cancel()
+		if err != nil {
+			ll.WithError(err).Warn("could not delete released volume")
+			continue
+		}
+
+		err = d.kubeClient.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			ll.WithError(err).Warn("could not delete PersistentVolume")
+			continue
+		}
+		ll.Info("released volume deleted")
+	}
+	return nil
+}
+
+// syncVolumeAttachments attaches the volumes of new VolumeAttachments of
+// the driver and detaches the volumes of deleted ones.
+func (d *Driver) syncVolumeAttachments() error {
+	attachments, err := d.kubeClient.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list VolumeAttachments: %s", err)
+	}
+
+	for i := range attachments.Items {
+		va := &attachments.Items[i]
+		if va.Spec.Attacher != d.driverName() || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_attachment": va.Name,
+			"node":              va.Spec.NodeName,
+			"method":            "embedded_attach",
+		})
+
+		switch {
+		case va.DeletionTimestamp != nil && hasFinalizer(va.Finalizers, d.attacherFinalizer()):
+			if err := d.detachVolumeAttachment(va); err != nil {
+				ll.WithError(err).Warn("could not detach volume")
+				continue
+			}
+			ll.Info("volume detached")
+
+		case va.DeletionTimestamp == nil && !va.Status.Attached:
+			if err := d.attachVolumeAttachment(va); err != nil {
+				ll.WithError(err).Warn("could not attach volume")
+				continue
+			}
+			ll.Info("volume attached")
+		}
+	}
+	return nil
+}
+
+// attachVolumeAttachment attaches the volume of the VolumeAttachment and
+// marks it attached, or records the error in its status.
+func (d *Driver) attachVolumeAttachment(va *storagev1beta1.VolumeAttachment) error {
+	// the finalizer makes sure the volume is detached before the
+	// VolumeAttachment is gone
+	if !hasFinalizer(va.Finalizers, d.attacherFinalizer()) {
+		va.Finalizers = append(va.Finalizers, d.attacherFinalizer())
+		updated, err := d.kubeClient.StorageV1beta1().VolumeAttachments().Update(va)
+		if err != nil {
+			return err
+		}
+		va = updated
+	}
+
+	pv, serverID, err := d.resolveVolumeAttachment(va)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), embeddedTimeout)
+		_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         pv.Spec.CSI.VolumeHandle,
+			NodeId:           serverID,
+			VolumeAttributes: pv.Spec.CSI.VolumeAttributes,
+			VolumeCapability: volumeCapability(isBlockMode(pv.Spec.VolumeMode), pv.Spec.CSI.FSType, pv.Spec.MountOptions),
+		})
+		cancel()
+	}
+
+	if err != nil {
+		va.Status.AttachError = &storagev1beta1.VolumeError{Time: metav1.Now(), Message: err.Error()}
+	} else {
+		va.Status.Attached = true
+		va.Status.AttachError = nil
+	}
+
+	if updateErr := d.updateVolumeAttachmentStatus(va); updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+// detachVolumeAttachment detaches the volume of a deleted VolumeAttachment
+// and removes the finalizer, so the VolumeAttachment is gone.
+func (d *Driver) detachVolumeAttachment(va *storagev1beta1.VolumeAttachment) error {
+	pv, serverID, err := d.resolveVolumeAttachment(va)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), embeddedTimeout)
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: pv.Spec.CSI.VolumeHandle,
+		NodeId:   serverID,
+	})
+	cancel()
+	if err != nil {
+		va.Status.DetachError = &storagev1beta1.VolumeError{Time: metav1.Now(), Message: err.Error()}
+		if updateErr := d.updateVolumeAttachmentStatus(va); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	var finalizers []string
+	for _, f := range va.Finalizers {
+		if f != d.attacherFinalizer() {
+			finalizers = append(finalizers, f)
+		}
+	}
+	va.Finalizers = finalizers
+	_, err = d.kubeClient.StorageV1beta1().VolumeAttachments().Update(va)
+	return err
+}
+
+// resolveVolumeAttachment returns the CSI PersistentVolume and the server
+// ID of a VolumeAttachment.
+func (d *Driver) resolveVolumeAttachment(va *storagev1beta1.VolumeAttachment) (*v1.PersistentVolume, string, error) {
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get PersistentVolume: %s", err)
+	}
+	if pv.Spec.CSI == nil {
+		return nil, "", fmt.Errorf("PersistentVolume %q is no CSI volume", pv.Name)
+	}
+
+	node, err := d.kubeClient.CoreV1().Nodes().Get(va.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get Node: %s", err)
+	}
+
+	serverID, err := d.nodeServerID(node)
+	if err != nil {
+		return nil, "", err
+	}
+	return pv, fmt.Sprint(serverID), nil
+}
+
+// updateVolumeAttachmentStatus writes the status of a VolumeAttachment,
+// through the status subresource if the cluster has it.
+func (d *Driver) updateVolumeAttachmentStatus(va *storagev1beta1.VolumeAttachment) error {
+	_, err := d.kubeClient.StorageV1beta1().VolumeAttachments().UpdateStatus(va)
+	if apierrors.IsNotFound(err) {
+		_, err = d.kubeClient.StorageV1beta1().VolumeAttachments().Update(va)
+	}
+	return err
+}
+
+// hasFinalizer returns whether the finalizer is in the list.
+func hasFinalizer(finalizers []string, finalizer string) bool {
+	for _, f := range finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
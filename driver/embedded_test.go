@@ -0,0 +1,363 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeEmbeddedAPI serves the claims, StorageClasses, PersistentVolumes,
+// Nodes and VolumeAttachments the embedded controllers work on.
+type fakeEmbeddedAPI struct {
+	mu          sync.Mutex
+	claims      []v1.PersistentVolumeClaim
+	classes     map[string]*storagev1.StorageClass
+	pvs         map[string]*v1.PersistentVolume
+	nodes       map[string]*v1.Node
+	attachments map[string]*storagev1beta1.VolumeAttachment
+}
+
+func (f *fakeEmbeddedAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	const (
+		classesPath     = "/apis/storage.k8s.io/v1/storageclasses/"
+		pvsPath         = "/api/v1/persistentvolumes"
+		nodesPath       = "/api/v1/nodes/"
+		attachmentsPath = "/apis/storage.k8s.io/v1beta1/volumeattachments"
+	)
+
+	path := r.URL.Path
+	switch {
+	case path == "/api/v1/persistentvolumeclaims":
+		json.NewEncoder(w).Encode(&v1.PersistentVolumeClaimList{
+			TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeClaimList", APIVersion: "v1"},
+			Items:    f.claims,
+		})
+
+	case strings.HasPrefix(path, classesPath):
+		f.write(w, f.classes[strings.TrimPrefix(path, classesPath)])
+
+	case strings.HasPrefix(path, nodesPath):
+		f.write(w, f.nodes[strings.TrimPrefix(path, nodesPath)])
+
+	case path == pvsPath && r.Method == http.MethodGet:
+		list := &v1.PersistentVolumeList{TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeList", APIVersion: "v1"}}
+		for _, pv := range f.pvs {
+			list.Items = append(list.Items, *pv)
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case path == pvsPath && r.Method == http.MethodPost:
+		pv := &v1.PersistentVolume{}
+		json.NewDecoder(r.Body).Decode(pv)
+		if f.pvs[pv.Name] != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonAlreadyExists, Code: http.StatusConflict})
+			return
+		}
+		f.pvs[pv.Name] = pv
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pv)
+
+	case strings.HasPrefix(path, pvsPath+"/") && r.Method == http.MethodDelete:
+		delete(f.pvs, strings.TrimPrefix(path, pvsPath+"/"))
+		json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusSuccess})
+
+	case strings.HasPrefix(path, pvsPath+"/"):
+		f.write(w, f.pvs[strings.TrimPrefix(path, pvsPath+"/")])
+
+	case path == attachmentsPath:
+		list := &storagev1beta1.VolumeAttachmentList{TypeMeta: metav1.TypeMeta{Kind: "VolumeAttachmentList", APIVersion: "storage.k8s.io/v1beta1"}}
+		for _, va := range f.attachments {
+			list.Items = append(list.Items, *va)
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case strings.HasPrefix(path, attachmentsPath+"/") && r.Method == http.MethodPut:
+		va := &storagev1beta1.VolumeAttachment{}
+		json.NewDecoder(r.Body).Decode(va)
+		f.attachments[va.Name] = va
+		json.NewEncoder(w).Encode(va)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeEmbeddedAPI) write(w http.ResponseWriter, obj interface{}) {
+	switch o := obj.(type) {
+	case *storagev1.StorageClass:
+		if o != nil {
+			json.NewEncoder(w).Encode(o)
+			return
+		}
+	case *v1.Node:
+		if o != nil {
+			json.NewEncoder(w).Encode(o)
+			return
+		}
+	case *v1.PersistentVolume:
+		if o != nil {
+			json.NewEncoder(w).Encode(o)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+}
+
+func TestEmbeddedControllers(t *testing.T) {
+	fakeHCloud := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+		servers: map[int]*schema.Server{
+			10: {ID: 10},
+		},
+	}
+	tsHCloud := httptest.NewServer(fakeHCloud)
+	defer tsHCloud.Close()
+
+	className := "hcloud-volumes"
+	otherClass := "other"
+	claim := func(name, class string) v1.PersistentVolumeClaim {
+		return v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &class,
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+				},
+			},
+			Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+		}
+	}
+
+	fakeKube := &fakeEmbeddedAPI{
+		claims: []v1.PersistentVolumeClaim{claim("data", className), claim("foreign", otherClass)},
+		classes: map[string]*storagev1.StorageClass{
+			className:  {ObjectMeta: metav1.ObjectMeta{Name: className}, Provisioner: DefaultDriverName, Parameters: map[string]string{"fsType": "xfs"}},
+			otherClass: {ObjectMeta: metav1.ObjectMeta{Name: otherClass}, Provisioner: "example.com/other"},
+		},
+		pvs: map[string]*v1.PersistentVolume{},
+		nodes: map[string]*v1.Node{
+			"node-1": {ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Spec: v1.NodeSpec{ProviderID: "hcloud://10"}},
+		},
+		attachments: map[string]*storagev1beta1.VolumeAttachment{},
+	}
+	tsKube := httptest.NewServer(fakeKube)
+	defer tsKube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: tsKube.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		location:           "fsn1",
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		kubeClient:         kubeClient,
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+
+	d.syncEmbeddedControllers()
+
+	pv := fakeKube.pvs["pvc-uid-data"]
+	if pv == nil || len(fakeKube.pvs) != 1 {
+		t.Fatalf("expected a single PersistentVolume for the claim of the driver, got %v", fakeKube.pvs)
+	}
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name != "data" || pv.Spec.CSI.FSType != "xfs" {
+		t.Errorf("expected a bound xfs PersistentVolume, got %+v", pv.Spec)
+	}
+	if len(fakeHCloud.volumes) != 1 {
+		t.Fatalf("expected a single volume to be created, got %d", len(fakeHCloud.volumes))
+	}
+	if affinity := pv.Spec.NodeAffinity; affinity == nil || affinity.Required == nil ||
+		len(affinity.Required.NodeSelectorTerms) != 1 ||
+		affinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Key != defaultTopologyKey ||
+		affinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values[0] != "fsn1" {
+		t.Errorf("expected the PersistentVolume to be restricted to the nodes in fsn1, got %+v", pv.Spec.NodeAffinity)
+	}
+
+	pvName := pv.Name
+	fakeKube.attachments["va-1"] = &storagev1beta1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storagev1beta1.VolumeAttachmentSpec{
+			Attacher: DefaultDriverName,
+			Source:   storagev1beta1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			NodeName: "node-1",
+		},
+	}
+
+	d.syncEmbeddedControllers()
+
+	va := fakeKube.attachments["va-1"]
+	if !va.Status.Attached || !hasFinalizer(va.Finalizers, d.attacherFinalizer()) {
+		t.Errorf("expected the VolumeAttachment to be attached with a finalizer, got %+v", va)
+	}
+	for _, vol := range fakeHCloud.volumes {
+		if vol.Server == nil || *vol.Server != 10 {
+			t.Errorf("expected the volume to be attached to server 10, got %v", vol.Server)
+		}
+	}
+
+	now := metav1.Now()
+	va.DeletionTimestamp = &now
+	pv.Status.Phase = v1.VolumeReleased
+
+	d.syncEmbeddedControllers()
+
+	if hasFinalizer(fakeKube.attachments["va-1"].Finalizers, d.attacherFinalizer()) {
+		t.Error("expected the finalizer to be removed after the detach")
+	}
+	if len(fakeHCloud.volumes) != 0 || len(fakeKube.pvs) != 0 {
+		t.Errorf("expected the released volume to be deleted, got %d volumes and %d PersistentVolumes", len(fakeHCloud.volumes), len(fakeKube.pvs))
+	}
+}
+
+func TestEmbeddedProvisionWaitForFirstConsumer(t *testing.T) {
+	fakeHCloud := &fakeAPI{t: t, volumes: map[int]*schema.Volume{}}
+	tsHCloud := httptest.NewServer(fakeHCloud)
+	defer tsHCloud.Close()
+
+	className := "hcloud-volumes"
+	mode := storagev1.VolumeBindingWaitForFirstConsumer
+	claim := func(name, node string, selector *metav1.LabelSelector) v1.PersistentVolumeClaim {
+		claim := v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &className,
+				Selector:         selector,
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+				},
+			},
+			Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+		}
+		if node != "" {
+			claim.Annotations = map[string]string{annSelectedNode: node}
+		}
+		return claim
+	}
+	node := func(name, location string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{defaultTopologyKey: location}}}
+	}
+
+	fakeKube := &fakeEmbeddedAPI{
+		claims: []v1.PersistentVolumeClaim{
+			claim("unscheduled", "", nil),
+			claim("scheduled", "node-fsn1", nil),
+			claim("elsewhere", "node-nbg1", nil),
+			claim("selector", "node-fsn1", &metav1.LabelSelector{MatchLabels: map[string]string{"disk": "fast"}}),
+		},
+		classes: map[string]*storagev1.StorageClass{
+			className: {ObjectMeta: metav1.ObjectMeta{Name: className}, Provisioner: DefaultDriverName, VolumeBindingMode: &mode},
+		},
+		pvs: map[string]*v1.PersistentVolume{},
+		nodes: map[string]*v1.Node{
+			"node-fsn1": node("node-fsn1", "fsn1"),
+			"node-nbg1": node("node-nbg1", "nbg1"),
+		},
+		attachments: map[string]*storagev1beta1.VolumeAttachment{},
+	}
+	tsKube := httptest.NewServer(fakeKube)
+	defer tsKube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: tsKube.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		location:           "fsn1",
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		kubeClient:         kubeClient,
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.provisionClaims(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the claim of a pod scheduled to a node in the location of the
+	// driver is provisioned
+	if len(fakeKube.pvs) != 1 || fakeKube.pvs["pvc-uid-scheduled"] == nil {
+		t.Errorf("expected only the scheduled claim to be provisioned, got %v", fakeKube.pvs)
+	}
+	if len(fakeHCloud.volumes) != 1 {
+		t.Errorf("expected a single volume to be created, got %d", len(fakeHCloud.volumes))
+	}
+}
+
+func TestVolumeCapability(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	filesystem := v1.PersistentVolumeFilesystem
+
+	tests := []struct {
+		name  string
+		mode  *v1.PersistentVolumeMode
+		block bool
+	}{
+		{"default", nil, false},
+		{"filesystem", &filesystem, false},
+		{"block", &block, true},
+	}
+
+	for _, tt := range tests {
+		capability := volumeCapability(isBlockMode(tt.mode), "xfs", []string{"noatime"})
+		if capability.AccessMode != supportedAccessMode {
+			t.Errorf("%s: got access mode %v", tt.name, capability.AccessMode)
+		}
+
+		if tt.block {
+			if capability.GetBlock() == nil {
+				t.Errorf("%s: expected a block capability, got %v", tt.name, capability)
+			}
+			continue
+		}
+
+		mount := capability.GetMount()
+		if mount == nil || mount.FsType != "xfs" || len(mount.MountFlags) != 1 {
+			t.Errorf("%s: expected an xfs mount capability, got %v", tt.name, capability)
+		}
+	}
+}
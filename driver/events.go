@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// eventTimeout bounds posting the events of a single failure.
+	eventTimeout = 10 * time.Second
+
+	// eventNamespace holds the events of PersistentVolumes, which are not
+	// namespaced themselves.
+	eventNamespace = metav1.NamespaceDefault
+)
+
+// Reasons of the events posted for failed volume operations.
+const (
+	reasonAttachFailed            = "AttachFailed"
+	reasonDetachFailed            = "DetachFailed"
+	reasonVolumeLocked            = "VolumeLocked"
+	reasonQuotaExceeded           = "QuotaExceeded"
+	reasonRateLimitExceeded       = "RateLimitExceeded"
+	reasonAttachedToOtherServer   = "AttachedToOtherServer"
+	reasonAttachedToDeletedServer = "AttachedToDeletedServer"
+	reasonVolumeRemounted         = "VolumeRemounted"
+)
+
+// newKubeClient returns a client for the cluster the driver runs in.
+func newKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("the Kubernetes integration needs to run in a cluster: %s", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// eventReason returns the reason of an event for the hcloud error, or the
+// fallback if the error has no specific reason.
+func eventReason(err error, fallback string) string {
+	switch {
+	case hcloud.IsError(err, errorCodeLocked):
+		return reasonVolumeLocked
+	case hcloud.IsError(err, errorCodeResourceLimitExceeded):
+		return reasonQuotaExceeded
+	case hcloud.IsError(err, hcloud.ErrorCodeRateLimitExceeded):
+		return reasonRateLimitExceeded
+	}
+	return fallback
+}
+
+// volumeEvent posts a warning event on the PersistentVolume of the volume
+// and its claim in the background. It does nothing if events are disabled.
+func (d *Driver) volumeEvent(volumeID int, reason, message string) {
+	// the PersistentVolume is looked up by the name of the volume
+	if !d.kubeEvents || d.kubeClient == nil || !d.hasHCloud() {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(withPriority(context.Background(), priorityBackground), eventTimeout)
+		defer cancel()
+
+		if err := d.recordVolumeEvent(ctx, volumeID, reason, message); err != nil {
+			d.log.WithError(err).WithFields(logrus.Fields{
+				"volume_id": volumeID,
+				"reason":    reason,
+			}).Warn("could not post event")
+		}
+	}()
+}
+
+// recordVolumeEvent posts a warning event on the PersistentVolume of the
+// volume and its claim. The PersistentVolume has the name the volume was
+// created with.
+func (d *Driver) recordVolumeEvent(ctx context.Context, volumeID int, reason, message string) error {
+	vol, err := d.getVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+
+	if vol == nil {
+		return fmt.Errorf("volume %d not found", volumeID)
+	}
+
+	name := vol.Name
+	if d.clusterName != "" {
+		name = strings.TrimPrefix(name, d.clusterName+"-")
+	}
+
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get PersistentVolume %q: %s", name, err)
+	}
+
+	refs := []v1.ObjectReference{{
+		APIVersion: "v1",
+		Kind:       "PersistentVolume",
+		Name:       pv.Name,
+		UID:        pv.UID,
+	}}
+	if pv.Spec.ClaimRef != nil {
+		refs = append(refs, v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Namespace:  pv.Spec.ClaimRef.Namespace,
+			Name:       pv.Spec.ClaimRef.Name,
+			UID:        pv.Spec.ClaimRef.UID,
+		})
+	}
+
+	now := metav1.Now()
+	for _, ref := range refs {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = eventNamespace
+		}
+
+		_, err := d.kubeClient.CoreV1().Events(namespace).Create(&v1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: ref.Name + ".",
+				Namespace:    namespace,
+			},
+			InvolvedObject: ref,
+			Reason:         reason,
+			Message:        message,
+			Type:           v1.EventTypeWarning,
+			Source: v1.EventSource{
+				Component: d.driverName(),
+			},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+		})
+		if err != nil {
+			return fmt.Errorf("could not post event on %s %q: %s", ref.Kind, ref.Name, err)
+		}
+	}
+	return nil
+}
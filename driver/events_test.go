@@ -0,0 +1,166 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKubeAPI serves a single PersistentVolume and records the events
+// posted.
+type fakeKubeAPI struct {
+	t  *testing.T
+	pv *v1.PersistentVolume
+
+	mu     sync.Mutex
+	events []v1.Event
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumes/"+f.pv.Name:
+		json.NewEncoder(w).Encode(f.pv)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumes":
+		json.NewEncoder(w).Encode(&v1.PersistentVolumeList{
+			TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeList", APIVersion: "v1"},
+			Items:    []v1.PersistentVolume{*f.pv},
+		})
+	case r.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+
+		event := v1.Event{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			f.t.Fatal(err)
+		}
+
+		f.mu.Lock()
+		f.events = append(f.events, event)
+		f.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+}
+
+func TestRecordVolumeEvent(t *testing.T) {
+	tsHCloud := httptest.NewServer(&fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "prod-pvc-1234"},
+		},
+	})
+	defer tsHCloud.Close()
+
+	kube := &fakeKubeAPI{
+		t: t,
+		pv: &v1.PersistentVolume{
+			TypeMeta:   metav1.TypeMeta{Kind: "PersistentVolume", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", UID: "pv-uid"},
+			Spec: v1.PersistentVolumeSpec{
+				ClaimRef: &v1.ObjectReference{Namespace: "app", Name: "data", UID: "pvc-uid"},
+			},
+		},
+	}
+	tsKube := httptest.NewServer(kube)
+	defer tsKube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: tsKube.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		clusterName:  "prod",
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		kubeClient:   kubeClient,
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.recordVolumeEvent(context.Background(), 1, reasonVolumeLocked, "volume is locked"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kube.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(kube.events))
+	}
+
+	for i, want := range []struct {
+		kind      string
+		namespace string
+		name      string
+	}{
+		{kind: "PersistentVolume", namespace: "default", name: "pvc-1234"},
+		{kind: "PersistentVolumeClaim", namespace: "app", name: "data"},
+	} {
+		event := kube.events[i]
+		if event.InvolvedObject.Kind != want.kind || event.InvolvedObject.Name != want.name || event.Namespace != want.namespace {
+			t.Errorf("event %d: expected %s %s/%s, got %s %s/%s", i, want.kind, want.namespace, want.name,
+				event.InvolvedObject.Kind, event.Namespace, event.InvolvedObject.Name)
+		}
+		if event.Reason != reasonVolumeLocked || event.Type != v1.EventTypeWarning {
+			t.Errorf("event %d: unexpected reason %q or type %q", i, event.Reason, event.Type)
+		}
+	}
+
+	if err := d.recordVolumeEvent(context.Background(), 2, reasonAttachFailed, "attach failed"); err == nil {
+		t.Error("expected an error for an unknown volume")
+	}
+}
+
+func TestEventReason(t *testing.T) {
+	for _, tc := range []struct {
+		code hcloud.ErrorCode
+		want string
+	}{
+		{code: errorCodeLocked, want: reasonVolumeLocked},
+		{code: errorCodeResourceLimitExceeded, want: reasonQuotaExceeded},
+		{code: hcloud.ErrorCodeRateLimitExceeded, want: reasonRateLimitExceeded},
+		{code: hcloud.ErrorCodeServiceError, want: reasonAttachFailed},
+	} {
+		err := hcloud.Error{Code: tc.code}
+		if got := eventReason(err, reasonAttachFailed); got != tc.want {
+			t.Errorf("%s: expected reason %q, got %q", tc.code, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,708 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakehcloud implements an in-memory fake of the volume, server and
+// action endpoints of the Hetzner Cloud API. The driver can be tested end
+// to end against it without a Hetzner Cloud project.
+package fakehcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+)
+
+const (
+	// defaultPerPage and maxPerPage are the page sizes of the real API
+	defaultPerPage = 25
+	maxPerPage     = 50
+
+	// minVolumeSize and maxVolumeSize are the volume sizes in GB the real
+	// API accepts
+	minVolumeSize = 10
+	maxVolumeSize = 10240
+)
+
+// Locations are the locations volumes can be created in.
+var Locations = []schema.Location{
+	{ID: 1, Name: "fsn1", Description: "Falkenstein DC Park 1", Country: "DE", City: "Falkenstein"},
+	{ID: 2, Name: "nbg1", Description: "Nuremberg DC Park 1", Country: "DE", City: "Nuremberg"},
+	{ID: 3, Name: "hel1", Description: "Helsinki DC Park 1", Country: "FI", City: "Helsinki"},
+}
+
+// Fault makes requests to the fake fail or respond slowly.
+type Fault struct {
+	// Method and Path select the requests, Path is a pattern of path.Match
+	// like "/volumes/*/actions/attach". An empty method matches all.
+	Method string
+	Path   string
+
+	// Status and Code are the HTTP status and hcloud error code returned,
+	// a zero Status only delays the requests.
+	Status int
+	Code   string
+
+	// Latency delays the responses to the requests.
+	Latency time.Duration
+
+	// Rate is the probability a request fails, zero fails all.
+	Rate float64
+
+	// Times is the number of requests failed, zero fails them forever.
+	Times int
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	if f.Method != "" && f.Method != r.Method {
+		return false
+	}
+	ok, _ := path.Match(f.Path, r.URL.Path)
+	return ok
+}
+
+// action is an action, it runs until done.
+type action struct {
+	schema.Action
+	done time.Time
+}
+
+// Server is the fake API, it implements http.Handler.
+type Server struct {
+	// ActionLatency is the time actions are running before they succeed.
+	ActionLatency time.Duration
+
+	mu      sync.Mutex
+	volumes map[int]*schema.Volume
+	servers map[int]*schema.Server
+	actions map[int]*action
+	faults  []*Fault
+	lastID  int
+}
+
+// New returns a fake API without volumes and servers.
+func New() *Server {
+	return &Server{
+		volumes: map[int]*schema.Volume{},
+		servers: map[int]*schema.Server{},
+		actions: map[int]*action{},
+	}
+}
+
+// AddServer adds a server in the given location.
+func (s *Server) AddServer(id int, name, location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, _ := findLocation(location)
+	s.servers[id] = &schema.Server{
+		ID:      id,
+		Name:    name,
+		Status:  "running",
+		Created: time.Now().UTC(),
+		Datacenter: schema.Datacenter{
+			ID:       loc.ID,
+			Name:     loc.Name + "-dc1",
+			Location: loc,
+		},
+		Labels: map[string]string{},
+	}
+}
+
+// Volume returns a copy of the volume with the given ID.
+func (s *Server) Volume(id int) (schema.Volume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vol, ok := s.volumes[id]
+	if !ok {
+		return schema.Volume{}, false
+	}
+	return *vol, true
+}
+
+// Volumes returns the number of volumes.
+func (s *Server) Volumes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.volumes)
+}
+
+// InjectFault adds a fault, the first matching fault of a request applies.
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault returns the fault applying to the request.
+func (s *Server) fault(r *http.Request) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.faults {
+		if !f.matches(r) {
+			continue
+		}
+		if f.Rate > 0 && rand.Float64() >= f.Rate {
+			return nil
+		}
+
+		fault := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &fault
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f := s.fault(r); f != nil {
+		time.Sleep(f.Latency)
+		if f.Status != 0 {
+			writeError(w, f.Status, f.Code, "injected fault")
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "volumes":
+		s.listVolumes(w, r)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "volumes":
+		s.createVolume(w, r)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "volumes":
+		s.getVolume(w, parts[1])
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "volumes":
+		s.deleteVolume(w, parts[1])
+	case r.Method == "POST" && len(parts) == 4 && parts[0] == "volumes" && parts[2] == "actions":
+		s.volumeAction(w, r, parts[1], parts[3])
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "actions":
+		s.getAction(w, parts[1])
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "servers":
+		s.listServers(w, r)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "servers":
+		s.getServer(w, parts[1])
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "locations":
+		listLocations(w, r)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "pricing":
+		// volumes cost 0.04 EUR per GB and month
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"pricing": {"currency": "EUR", "vat_rate": "19.00", "volume": {"price_per_gb_month": {"net": "0.0400000000", "gross": "0.0476000000000000"}}}}`))
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "no route for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) listVolumes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.URL.Query().Get("name")
+	selector := r.URL.Query().Get("label_selector")
+
+	var ids []int
+	for id, vol := range s.volumes {
+		if name != "" && vol.Name != name {
+			continue
+		}
+		if !matchesLabels(vol.Labels, selector) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	page, meta, ok := paginate(w, r, len(ids))
+	if !ok {
+		return
+	}
+
+	resp := struct {
+		schema.VolumeListResponse
+		schema.MetaResponse
+	}{}
+	resp.Volumes = []schema.Volume{}
+	for _, id := range ids[page.start:page.end] {
+		resp.Volumes = append(resp.Volumes, *s.volumes[id])
+	}
+	resp.Meta = meta
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) createVolume(w http.ResponseWriter, r *http.Request) {
+	var req schema.VolumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "json_error", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Name == "" {
+		writeInvalidInput(w, "name", "missing name")
+		return
+	}
+	if req.Size < minVolumeSize || req.Size > maxVolumeSize {
+		writeInvalidInput(w, "size", fmt.Sprintf("size must be between %d and %d", minVolumeSize, maxVolumeSize))
+		return
+	}
+	for _, vol := range s.volumes {
+		if vol.Name == req.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", "name is already used")
+			return
+		}
+	}
+
+	var server *schema.Server
+	var loc schema.Location
+	switch {
+	case req.Server != nil:
+		server = s.servers[*req.Server]
+		if server == nil {
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %d not found", *req.Server))
+			return
+		}
+		loc = server.Datacenter.Location
+	case req.Location != nil:
+		var ok bool
+		if loc, ok = findLocation(fmt.Sprint(req.Location)); !ok {
+			writeInvalidInput(w, "location", fmt.Sprintf("location %v not found", req.Location))
+			return
+		}
+	default:
+		writeInvalidInput(w, "location", "either server or location must be given")
+		return
+	}
+
+	vol := &schema.Volume{
+		ID:       s.nextID(),
+		Name:     req.Name,
+		Size:     req.Size,
+		Location: loc,
+		Labels:   map[string]string{},
+		Created:  time.Now().UTC(),
+	}
+	if req.Labels != nil {
+		vol.Labels = *req.Labels
+	}
+	vol.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", vol.ID)
+	if server != nil {
+		vol.Server = &server.ID
+	}
+	s.volumes[vol.ID] = vol
+
+	created := s.startAction("create_volume", vol.ID)
+	writeJSON(w, http.StatusCreated, schema.VolumeCreateResponse{
+		Volume: *vol,
+		Action: &created,
+	})
+}
+
+func (s *Server) getVolume(w http.ResponseWriter, idParam string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vol, ok := s.volume(w, idParam)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, schema.VolumeGetResponse{Volume: *vol})
+}
+
+func (s *Server) deleteVolume(w http.ResponseWriter, idParam string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vol, ok := s.volume(w, idParam)
+	if !ok {
+		return
+	}
+	if vol.Server != nil {
+		writeError(w, http.StatusLocked, "locked", fmt.Sprintf("volume %d is attached to server %d", vol.ID, *vol.Server))
+		return
+	}
+	if s.locked(vol.ID) {
+		writeError(w, http.StatusLocked, "locked", fmt.Sprintf("volume %d is locked by a running action", vol.ID))
+		return
+	}
+
+	delete(s.volumes, vol.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) volumeAction(w http.ResponseWriter, r *http.Request, idParam, command string) {
+	var req schema.VolumeActionAttachVolumeRequest
+	if command == "attach" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "json_error", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vol, ok := s.volume(w, idParam)
+	if !ok {
+		return
+	}
+	if s.locked(vol.ID) {
+		writeError(w, http.StatusLocked, "locked", fmt.Sprintf("volume %d is locked by a running action", vol.ID))
+		return
+	}
+
+	switch command {
+	case "attach":
+		server, ok := s.servers[req.Server]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %d not found", req.Server))
+			return
+		}
+		if vol.Server != nil {
+			writeInvalidInput(w, "server", fmt.Sprintf("volume %d is already attached to server %d", vol.ID, *vol.Server))
+			return
+		}
+		if server.Datacenter.Location.Name != vol.Location.Name {
+			writeInvalidInput(w, "server", fmt.Sprintf("server %d is not in location %s of the volume", server.ID, vol.Location.Name))
+			return
+		}
+
+		id := server.ID
+		vol.Server = &id
+		writeJSON(w, http.StatusCreated, schema.VolumeActionAttachVolumeResponse{
+			Action: s.startAction("attach_volume", vol.ID),
+		})
+	case "detach":
+		vol.Server = nil
+		writeJSON(w, http.StatusCreated, schema.VolumeActionDetachVolumeResponse{
+			Action: s.startAction("detach_volume", vol.ID),
+		})
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "unknown action "+command)
+	}
+}
+
+func (s *Server) getAction(w http.ResponseWriter, idParam string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeInvalidInput(w, "id", "invalid id")
+		return
+	}
+
+	a, ok := s.actions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("action %d not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, schema.ActionGetResponse{Action: a.state(time.Now())})
+}
+
+func (s *Server) listServers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.URL.Query().Get("name")
+
+	var ids []int
+	for id, server := range s.servers {
+		if name == "" || server.Name == name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	page, meta, ok := paginate(w, r, len(ids))
+	if !ok {
+		return
+	}
+
+	resp := struct {
+		schema.ServerListResponse
+		schema.MetaResponse
+	}{}
+	resp.Servers = []schema.Server{}
+	for _, id := range ids[page.start:page.end] {
+		resp.Servers = append(resp.Servers, s.server(id))
+	}
+	resp.Meta = meta
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getServer(w http.ResponseWriter, idParam string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeInvalidInput(w, "id", "invalid id")
+		return
+	}
+
+	if _, ok := s.servers[id]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %d not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, schema.ServerGetResponse{Server: s.server(id)})
+}
+
+// server returns the server with the IDs of its attached volumes.
+func (s *Server) server(id int) schema.Server {
+	server := *s.servers[id]
+	server.Volumes = []int{}
+	for _, vol := range s.volumes {
+		if vol.Server != nil && *vol.Server == id {
+			server.Volumes = append(server.Volumes, vol.ID)
+		}
+	}
+	sort.Ints(server.Volumes)
+	return server
+}
+
+func listLocations(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	resp := struct {
+		schema.LocationListResponse
+		schema.MetaResponse
+	}{}
+	resp.Locations = []schema.Location{}
+	for _, loc := range Locations {
+		if name == "" || loc.Name == name {
+			resp.Locations = append(resp.Locations, loc)
+		}
+	}
+	resp.Meta.Pagination = &schema.MetaPagination{
+		Page:         1,
+		PerPage:      maxPerPage,
+		LastPage:     1,
+		TotalEntries: len(resp.Locations),
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// volume returns the volume of the ID parameter or writes an error. The
+// lock is held by the caller.
+func (s *Server) volume(w http.ResponseWriter, idParam string) (*schema.Volume, bool) {
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeInvalidInput(w, "id", "invalid id")
+		return nil, false
+	}
+
+	vol, ok := s.volumes[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume %d not found", id))
+		return nil, false
+	}
+	return vol, true
+}
+
+// locked returns whether an action of the volume is running, the real API
+// rejects further actions until it is done.
+func (s *Server) locked(volumeID int) bool {
+	now := time.Now()
+	for _, a := range s.actions {
+		if now.Before(a.done) && len(a.Resources) > 0 && a.Resources[0].ID == volumeID {
+			return true
+		}
+	}
+	return false
+}
+
+// startAction starts an action on the volume, it runs for ActionLatency.
+func (s *Server) startAction(command string, volumeID int) schema.Action {
+	now := time.Now()
+	a := &action{
+		Action: schema.Action{
+			ID:      s.nextID(),
+			Command: command,
+			Started: now.UTC(),
+			Resources: []schema.ActionResourceReference{
+				{ID: volumeID, Type: "volume"},
+			},
+		},
+		done: now.Add(s.ActionLatency),
+	}
+	s.actions[a.ID] = a
+	return a.state(now)
+}
+
+// state returns the action as seen at the given time.
+func (a *action) state(now time.Time) schema.Action {
+	state := a.Action
+	if now.Before(a.done) {
+		state.Status = "running"
+		total := a.done.Sub(a.Started)
+		state.Progress = int(100 * now.Sub(a.Started) / total)
+		return state
+	}
+
+	finished := a.done.UTC()
+	state.Status = "success"
+	state.Progress = 100
+	state.Finished = &finished
+	return state
+}
+
+func (s *Server) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// pageRange are the indexes of the entries of a page.
+type pageRange struct {
+	start, end int
+}
+
+// paginate returns the entries of the requested page like the real API,
+// it writes an error for invalid parameters.
+func paginate(w http.ResponseWriter, r *http.Request, total int) (pageRange, schema.Meta, bool) {
+	page, perPage := 1, defaultPerPage
+	if v := r.URL.Query().Get("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			writeInvalidInput(w, "page", "page must be a positive number")
+			return pageRange{}, schema.Meta{}, false
+		}
+		page = p
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			writeInvalidInput(w, "per_page", "per_page must be a positive number")
+			return pageRange{}, schema.Meta{}, false
+		}
+		// larger pages are silently limited
+		if p > maxPerPage {
+			p = maxPerPage
+		}
+		perPage = p
+	}
+
+	lastPage := (total + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	pagination := &schema.MetaPagination{
+		Page:         page,
+		PerPage:      perPage,
+		LastPage:     lastPage,
+		TotalEntries: total,
+	}
+	if page > 1 {
+		pagination.PreviousPage = page - 1
+	}
+	if page < lastPage {
+		pagination.NextPage = page + 1
+	}
+
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return pageRange{start: start, end: end}, schema.Meta{Pagination: pagination}, true
+}
+
+// matchesLabels returns whether the labels match a selector of
+// comma-separated k=v pairs.
+func matchesLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// findLocation returns the location with the given name or ID, the first
+// location if there is none.
+func findLocation(nameOrID string) (schema.Location, bool) {
+	for _, loc := range Locations {
+		if loc.Name == nameOrID || strconv.Itoa(loc.ID) == nameOrID {
+			return loc, true
+		}
+	}
+	return Locations[0], false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error response, hcloud-go only parses JSON ones.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"details": map[string]interface{}{},
+		},
+	})
+}
+
+// writeInvalidInput writes an invalid_input error for the field, its
+// details are parsed by hcloud-go.
+func writeInvalidInput(w http.ResponseWriter, field, message string) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    "invalid_input",
+			"message": message,
+			"details": map[string]interface{}{
+				"fields": []map[string]interface{}{
+					{"name": field, "messages": []string{message}},
+				},
+			},
+		},
+	})
+}
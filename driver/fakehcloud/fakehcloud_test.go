@@ -0,0 +1,202 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakehcloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+)
+
+func newClient(s *Server) (*hcloud.Client, func()) {
+	ts := httptest.NewServer(s)
+	return hcloud.NewClient(hcloud.WithEndpoint(ts.URL), hcloud.WithToken("fake")), ts.Close
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	s := New()
+	s.AddServer(1, "node-1", "fsn1")
+	s.AddServer(2, "node-2", "nbg1")
+	client, stop := newClient(s)
+	defer stop()
+	ctx := context.Background()
+
+	result, _, err := client.Volume.Create(ctx, hcloud.VolumeCreateOpts{
+		Name:     "volume",
+		Size:     10,
+		Location: &hcloud.Location{Name: "fsn1"},
+		Labels:   map[string]string{"app": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Volume.Location.Name != "fsn1" || result.Action.Status != hcloud.ActionStatusSuccess {
+		t.Errorf("got volume in %s with action %s, want fsn1 and success", result.Volume.Location.Name, result.Action.Status)
+	}
+
+	_, _, err = client.Volume.Create(ctx, hcloud.VolumeCreateOpts{Name: "volume", Size: 10, Location: &hcloud.Location{Name: "fsn1"}})
+	if !hcloud.IsError(err, "uniqueness_error") {
+		t.Errorf("expected a uniqueness error for a duplicate name, got %v", err)
+	}
+
+	_, _, err = client.Volume.Create(ctx, hcloud.VolumeCreateOpts{Name: "small", Size: 5, Location: &hcloud.Location{Name: "fsn1"}})
+	if !hcloud.IsError(err, hcloud.ErrorCodeInvalidInput) {
+		t.Errorf("expected invalid input for a too small volume, got %v", err)
+	}
+
+	vol := result.Volume
+	if _, _, err := client.Volume.Attach(ctx, vol, &hcloud.Server{ID: 2}); !hcloud.IsError(err, hcloud.ErrorCodeInvalidInput) {
+		t.Errorf("expected invalid input for a server in another location, got %v", err)
+	}
+
+	if _, _, err := client.Volume.Attach(ctx, vol, &hcloud.Server{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	server, _, err := client.Server.GetByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Volumes) != 1 || server.Volumes[0].ID != vol.ID {
+		t.Errorf("expected the volume to be attached to the server, got %v", server.Volumes)
+	}
+
+	if _, err := client.Volume.Delete(ctx, vol); !hcloud.IsError(err, "locked") {
+		t.Errorf("expected attached volume to be locked, got %v", err)
+	}
+
+	if _, _, err := client.Volume.Detach(ctx, vol); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Volume.Delete(ctx, vol); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := client.Volume.GetByID(ctx, vol.ID)
+	if err != nil || got != nil {
+		t.Errorf("expected deleted volume not to be found, got %v, %v", got, err)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	s := New()
+	for i := 0; i < 60; i++ {
+		s.volumes[i+1] = volumeFixture(i + 1)
+	}
+	client, stop := newClient(s)
+	defer stop()
+
+	vols, resp, err := client.Volume.List(context.Background(), hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{Page: 2, PerPage: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pages are limited to 50 entries
+	p := resp.Meta.Pagination
+	if len(vols) != 10 || p.PerPage != 50 || p.LastPage != 2 || p.NextPage != 0 || p.TotalEntries != 60 {
+		t.Errorf("got %d volumes and pagination %+v", len(vols), p)
+	}
+
+	all, err := client.Volume.AllWithOpts(context.Background(), hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: "even=true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 30 {
+		t.Errorf("got %d volumes matching the selector, want 30", len(all))
+	}
+}
+
+func TestActionLatency(t *testing.T) {
+	s := New()
+	s.ActionLatency = 50 * time.Millisecond
+	s.AddServer(1, "node-1", "fsn1")
+	client, stop := newClient(s)
+	defer stop()
+	ctx := context.Background()
+
+	result, _, err := client.Volume.Create(ctx, hcloud.VolumeCreateOpts{Name: "volume", Size: 10, Server: &hcloud.Server{ID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Action.Status != hcloud.ActionStatusRunning {
+		t.Errorf("got action status %s, want running", result.Action.Status)
+	}
+
+	// the volume is locked until the action is done
+	if _, _, err := client.Volume.Detach(ctx, result.Volume); !hcloud.IsError(err, "locked") {
+		t.Errorf("expected the volume to be locked, got %v", err)
+	}
+
+	time.Sleep(s.ActionLatency)
+	action, _, err := client.Action.GetByID(ctx, result.Action.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Status != hcloud.ActionStatusSuccess || action.Progress != 100 {
+		t.Errorf("got action status %s at %d%%, want success", action.Status, action.Progress)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := New()
+	s.AddServer(1, "node-1", "fsn1")
+	s.InjectFault(Fault{
+		Method: "GET",
+		Path:   "/servers/*",
+		Status: http.StatusServiceUnavailable,
+		Code:   "unavailable",
+		Times:  2,
+	})
+	client, stop := newClient(s)
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		_, _, err := client.Server.GetByID(context.Background(), 1)
+		if failed := hcloud.IsError(err, "unavailable"); failed != (i < 2) {
+			t.Errorf("request %d: got error %v", i, err)
+		}
+	}
+
+	s.InjectFault(Fault{Path: "/servers/*", Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if _, _, err := client.Server.GetByID(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("expected the request to be delayed, took %s", took)
+	}
+}
+
+// volumeFixture returns a detached volume, even IDs are labelled.
+func volumeFixture(id int) *schema.Volume {
+	return &schema.Volume{
+		ID:       id,
+		Name:     fmt.Sprintf("volume-%d", id),
+		Location: Locations[0],
+		Labels:   map[string]string{"even": fmt.Sprint(id%2 == 0)},
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// faultTimeout is the fallback of an injected timeout if neither the
+	// request nor the hcloud requests have a timeout.
+	faultTimeout = 30 * time.Second
+)
+
+// faultOperations are the operations faults can be injected into, "*"
+// matches all of them.
+var faultOperations = map[string]bool{
+	"create": true,
+	"delete": true,
+	"attach": true,
+	"detach": true,
+	"get":    true,
+	"list":   true,
+	"server": true,
+	"action": true,
+	"*":      true,
+}
+
+// faultStatus are the HTTP status codes the hcloud API responds with for
+// the error codes, they are passed along with injected errors.
+var faultStatus = map[hcloud.ErrorCode]int{
+	hcloud.ErrorCodeNotFound:          http.StatusNotFound,
+	hcloud.ErrorCodeRateLimitExceeded: http.StatusTooManyRequests,
+	hcloud.ErrorCodeInvalidInput:      http.StatusUnprocessableEntity,
+	hcloud.ErrorCodeServiceError:      http.StatusInternalServerError,
+	"locked":                          http.StatusLocked,
+	"conflict":                        http.StatusConflict,
+	"uniqueness_error":                http.StatusConflict,
+	"unavailable":                     http.StatusServiceUnavailable,
+}
+
+// fault is an error or latency injected into an operation.
+type fault struct {
+	// code is the hcloud error code returned, empty if only latency is
+	// added.
+	code hcloud.ErrorCode
+
+	// timeout makes the operation hang until its context or the hcloud
+	// request timeout ends.
+	timeout bool
+
+	// latency delays the operation before it is sent.
+	latency time.Duration
+
+	// rate is the probability the fault is injected.
+	rate float64
+}
+
+func (f fault) String() string {
+	switch {
+	case f.timeout:
+		return "timeout"
+	case f.code != "":
+		return string(f.code)
+	}
+	return f.latency.String()
+}
+
+// parseFaults parses comma separated faults of the form
+// operation:fault[:rate]. The fault is an hcloud error code like locked,
+// timeout, a latency like 2s or just a rate for service errors, e.g.
+// "attach:0.2,create:timeout,list:500ms:0.5".
+func parseFaults(spec string) (map[string][]fault, error) {
+	faults := map[string][]fault{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid fault %q, must be operation:fault[:rate]", entry)
+		}
+
+		op := parts[0]
+		if !faultOperations[op] {
+			return nil, fmt.Errorf("invalid fault %q, unknown operation %q", entry, op)
+		}
+
+		f := fault{rate: 1}
+		if rate, err := strconv.ParseFloat(parts[1], 64); err == nil {
+			if len(parts) == 3 {
+				return nil, fmt.Errorf("invalid fault %q, the rate is given twice", entry)
+			}
+			f.code = hcloud.ErrorCodeServiceError
+			f.rate = rate
+		} else if latency, err := time.ParseDuration(parts[1]); err == nil {
+			f.latency = latency
+		} else if parts[1] == "timeout" {
+			f.timeout = true
+		} else if _, ok := faultStatus[hcloud.ErrorCode(parts[1])]; ok {
+			f.code = hcloud.ErrorCode(parts[1])
+		} else {
+			return nil, fmt.Errorf("invalid fault %q, %q is neither a rate, latency, timeout nor a known error code", entry, parts[1])
+		}
+
+		if len(parts) == 3 {
+			rate, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate of fault %q: %s", entry, err)
+			}
+			f.rate = rate
+		}
+
+		if f.rate <= 0 || f.rate > 1 {
+			return nil, fmt.Errorf("invalid rate of fault %q, must be between 0 and 1", entry)
+		}
+
+		faults[op] = append(faults[op], f)
+	}
+	return faults, nil
+}
+
+// faultInjector injects faults into the operations of the hcloud services,
+// so the alerting and the retries of the CO can be tested.
+type faultInjector struct {
+	faults  map[string][]fault
+	timeout time.Duration
+	log     *logrus.Entry
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// inject applies the faults of the operation. It returns the injected
+// error and its response, or nil if the operation should be sent.
+func (i *faultInjector) inject(ctx context.Context, op string) (*hcloud.Response, error) {
+	for _, f := range append(i.faults[op], i.faults["*"]...) {
+		i.mu.Lock()
+		hit := i.rand.Float64() < f.rate
+		i.mu.Unlock()
+		if !hit {
+			continue
+		}
+
+		i.log.WithFields(logrus.Fields{
+			"operation": op,
+			"fault":     f.String(),
+		}).Warn("injecting fault")
+
+		switch {
+		case f.timeout:
+			timeout := i.timeout
+			if timeout == 0 {
+				timeout = faultTimeout
+			}
+
+			select {
+			case <-time.After(timeout):
+			case <-ctx.Done():
+			}
+			return nil, fmt.Errorf("injected fault: timeout awaiting response headers of %s", op)
+		case f.code != "":
+			resp := &hcloud.Response{Response: &http.Response{StatusCode: faultStatus[f.code]}}
+			return resp, hcloud.Error{Code: f.code, Message: "injected fault"}
+		default:
+			select {
+			case <-time.After(f.latency):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return nil, nil
+}
+
+// wrap returns the services with the faults injected.
+func (i *faultInjector) wrap(services *hcloudServices) *hcloudServices {
+	if services == nil {
+		return nil
+	}
+	return &hcloudServices{
+		Volume: faultyVolumes{next: services.Volume, faults: i},
+		Server: faultyServers{next: services.Server, faults: i},
+		Action: faultyActions{next: services.Action, faults: i},
+	}
+}
+
+// isNotFound reports whether the injected error is a not_found error, which
+// the get methods of hcloud-go return as nil without error.
+func isNotFound(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeNotFound)
+}
+
+type faultyVolumes struct {
+	next   VolumeService
+	faults *faultInjector
+}
+
+func (v faultyVolumes) GetByID(ctx context.Context, id int) (*hcloud.Volume, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "get"); err != nil {
+		if isNotFound(err) {
+			return nil, resp, nil
+		}
+		return nil, resp, err
+	}
+	return v.next.GetByID(ctx, id)
+}
+
+func (v faultyVolumes) GetByName(ctx context.Context, name string) (*hcloud.Volume, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "get"); err != nil {
+		if isNotFound(err) {
+			return nil, resp, nil
+		}
+		return nil, resp, err
+	}
+	return v.next.GetByName(ctx, name)
+}
+
+func (v faultyVolumes) List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "list"); err != nil {
+		return nil, resp, err
+	}
+	return v.next.List(ctx, opts)
+}
+
+func (v faultyVolumes) AllWithOpts(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, error) {
+	if _, err := v.faults.inject(ctx, "list"); err != nil {
+		return nil, err
+	}
+	return v.next.AllWithOpts(ctx, opts)
+}
+
+func (v faultyVolumes) Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "create"); err != nil {
+		return hcloud.VolumeCreateResult{}, resp, err
+	}
+	return v.next.Create(ctx, opts)
+}
+
+func (v faultyVolumes) Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "delete"); err != nil {
+		return resp, err
+	}
+	return v.next.Delete(ctx, volume)
+}
+
+func (v faultyVolumes) Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "attach"); err != nil {
+		return nil, resp, err
+	}
+	return v.next.Attach(ctx, volume, server)
+}
+
+func (v faultyVolumes) Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	if resp, err := v.faults.inject(ctx, "detach"); err != nil {
+		return nil, resp, err
+	}
+	return v.next.Detach(ctx, volume)
+}
+
+type faultyServers struct {
+	next   ServerService
+	faults *faultInjector
+}
+
+func (s faultyServers) GetByID(ctx context.Context, id int) (*hcloud.Server, *hcloud.Response, error) {
+	if resp, err := s.faults.inject(ctx, "server"); err != nil {
+		if isNotFound(err) {
+			return nil, resp, nil
+		}
+		return nil, resp, err
+	}
+	return s.next.GetByID(ctx, id)
+}
+
+func (s faultyServers) GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error) {
+	if resp, err := s.faults.inject(ctx, "server"); err != nil {
+		if isNotFound(err) {
+			return nil, resp, nil
+		}
+		return nil, resp, err
+	}
+	return s.next.GetByName(ctx, name)
+}
+
+type faultyActions struct {
+	next   ActionService
+	faults *faultInjector
+}
+
+func (a faultyActions) GetByID(ctx context.Context, id int) (*hcloud.Action, *hcloud.Response, error) {
+	if resp, err := a.faults.inject(ctx, "action"); err != nil {
+		if isNotFound(err) {
+			return nil, resp, nil
+		}
+		return nil, resp, err
+	}
+	return a.next.GetByID(ctx, id)
+}
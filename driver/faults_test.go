@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFaults(t *testing.T) {
+	faults, err := parseFaults("attach:0.2, create:timeout,list:500ms:0.5,detach:locked,*:rate_limit_exceeded:0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]fault{
+		"attach": {code: hcloud.ErrorCodeServiceError, rate: 0.2},
+		"create": {timeout: true, rate: 1},
+		"list":   {latency: 500 * time.Millisecond, rate: 0.5},
+		"detach": {code: "locked", rate: 1},
+		"*":      {code: hcloud.ErrorCodeRateLimitExceeded, rate: 0.1},
+	}
+	for op, f := range want {
+		if len(faults[op]) != 1 || faults[op][0] != f {
+			t.Errorf("%s: got %+v, want %+v", op, faults[op], f)
+		}
+	}
+
+	for _, spec := range []string{
+		"attach",
+		"resize:0.5",
+		"attach:sometimes",
+		"attach:1.5",
+		"attach:0.5:0.5",
+		"attach:locked:x",
+	} {
+		if _, err := parseFaults(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	f := newFakeServices(10)
+	f.volumes[1] = &hcloud.Volume{ID: 1, Name: "volume"}
+
+	faults, err := parseFaults("attach:locked,get:not_found,detach:timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newFakeServicesDriver(f)
+	d.faults = &faultInjector{
+		faults:  faults,
+		timeout: 10 * time.Millisecond,
+		log:     d.log,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+	ctx := context.Background()
+
+	// the injected error is returned like one of the API
+	_, resp, err := d.client(ctx).Volume.Attach(ctx, f.volumes[1], f.servers[10])
+	if !hcloud.IsError(err, "locked") || resp.StatusCode != http.StatusLocked {
+		t.Errorf("got %v, want an injected locked error", err)
+	}
+	if f.calls["Volume.Attach"] != 0 {
+		t.Error("expected the attach not to be sent")
+	}
+
+	// like hcloud-go, a volume that is not found is returned as nil
+	vol, _, err := d.client(ctx).Volume.GetByID(ctx, 1)
+	if vol != nil || err != nil {
+		t.Errorf("got %v, %v, want the volume not to be found", vol, err)
+	}
+
+	start := time.Now()
+	if _, _, err := d.client(ctx).Volume.Detach(ctx, f.volumes[1]); err == nil {
+		t.Error("expected an injected timeout")
+	}
+	if took := time.Since(start); took < 10*time.Millisecond {
+		t.Errorf("expected the timeout to wait for the request timeout, took %s", took)
+	}
+
+	// faults reach the CO through the controller
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "10",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: supportedAccessMode,
+		},
+	})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("got code %s, want %s for the volume that is not found (error: %v)", code, codes.NotFound, err)
+	}
+}
+
+func TestInjectedFaultsRate(t *testing.T) {
+	faults, err := parseFaults("list:0.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inj := &faultInjector{
+		faults: faults,
+		log:    logrus.New().WithField("test_enabled", true),
+		rand:   rand.New(rand.NewSource(1)),
+	}
+	inj.log.Logger.SetLevel(logrus.ErrorLevel)
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := inj.inject(context.Background(), "list"); err != nil {
+			failed++
+		}
+	}
+	if failed < 200 || failed > 300 {
+		t.Errorf("expected about a quarter of the operations to fail, %d of 1000 failed", failed)
+	}
+
+	if _, err := inj.inject(context.Background(), "create"); err != nil {
+		t.Errorf("expected other operations not to fail, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runFstrim trims all volumes mounted on the node in the configured
+// interval until the driver is stopped.
+func (d *Driver) runFstrim() {
+	d.log.WithField("interval", d.fstrimInterval).Info("starting periodic fstrim")
+
+	ticker := time.NewTicker(d.fstrimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.trimVolumes()
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// trimVolumes runs fstrim on every volume mounted on the node. Failures are
+// only logged, the volumes are trimmed again in the next run.
+func (d *Driver) trimVolumes() {
+	mounts, err := volumeMounts()
+	if err != nil {
+		d.log.WithError(err).Warn("could not list mounted volumes for fstrim")
+		return
+	}
+
+	for volumeID, target := range mounts {
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id": volumeID,
+			"target":    target,
+			"method":    "fstrim",
+		})
+
+		if err := d.mounter.Trim(target); err != nil {
+			ll.WithError(err).Warn("trimming volume failed")
+			continue
+		}
+
+		ll.Info("volume trimmed")
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaults of the transport to the hcloud API. All requests go to the
+	// same host, so all idle connections may be kept for it.
+	defaultHCloudKeepAlive       = 30 * time.Second
+	defaultHCloudMaxIdleConns    = 10
+	defaultHCloudIdleConnTimeout = 90 * time.Second
+)
+
+// Error codes of the hcloud API that hcloud-go doesn't define.
+const (
+	// errorCodeUnauthorized is returned for an invalid token.
+	errorCodeUnauthorized hcloud.ErrorCode = "unauthorized"
+
+	// errorCodeForbidden is returned for writes with a read-only token.
+	errorCodeForbidden hcloud.ErrorCode = "forbidden"
+
+	// errorCodeLocked is returned if another action is running on the
+	// resource.
+	errorCodeLocked hcloud.ErrorCode = "locked"
+
+	// errorCodeResourceLimitExceeded is returned if the project hit a
+	// limit, e.g. the number of volumes.
+	errorCodeResourceLimitExceeded hcloud.ErrorCode = "resource_limit_exceeded"
+
+	// errorCodeResourceUnavailable is returned if the location is out of
+	// capacity.
+	errorCodeResourceUnavailable hcloud.ErrorCode = "resource_unavailable"
+)
+
+// newHCloudClient returns an hcloud client for the given token and API URL,
+// which sends its requests through the configured transport.
+func (d *Driver) newHCloudClient(token, apiURL string) (*hcloud.Client, error) {
+	next, err := d.instrumentedTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	// the token transport is only needed if the token can change
+	if d.hcloudSecondaryToken != "" || d.tokenFile != "" || d.tokenSecret != "" {
+		tokens := []string{token}
+		if d.hcloudSecondaryToken != "" {
+			tokens = append(tokens, d.hcloudSecondaryToken)
+		}
+
+		d.tokens = &tokenTransport{
+			next:       next,
+			tokens:     tokens,
+			onFailover: d.tokenFailover,
+		}
+		next = d.tokens
+	}
+
+	return d.clientWithTransport(token, apiURL, next, d.rateLimit), nil
+}
+
+// instrumentedTransport returns the transport to the hcloud API, which
+// records the metrics and the rate limit of the requests.
+func (d *Driver) instrumentedTransport() (http.RoundTripper, error) {
+	transport, err := d.hcloudTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitTransport{
+		next: &metricsTransport{
+			next:    d.recorded(transport),
+			metrics: d.metrics,
+		},
+		rateLimit: d.rateLimit,
+	}, nil
+}
+
+// clientWithTransport returns an hcloud client sending its requests
+// through next, retrying failed ones and holding back background requests
+// while the rate limit of its project is low.
+func (d *Driver) clientWithTransport(token, apiURL string, next http.RoundTripper, limit *rateLimit) *hcloud.Client {
+	return hcloud.NewClient(
+		hcloud.WithToken(token),
+		hcloud.WithApplication("hcloud-csi-driver", version),
+		hcloud.WithEndpoint(apiURL),
+		hcloud.WithHTTPClient(&http.Client{
+			Transport: &priorityTransport{
+				next:      newRetryTransport(next),
+				rateLimit: limit,
+			},
+		}),
+	)
+}
+
+// checkHCloud verifies that the token is accepted by the hcloud API and the
+// location of the node exists, so a misconfiguration fails at startup
+// instead of at the first CreateVolume.
+func (d *Driver) checkHCloud(ctx context.Context) error {
+	location, _, err := d.hcloudClient.Location.GetByName(ctx, d.location)
+	if err != nil {
+		if hcloud.IsError(err, errorCodeUnauthorized) {
+			return errors.New("invalid token: the hcloud API rejected the configured token")
+		}
+		return fmt.Errorf("could not reach the hcloud API: %s", err)
+	}
+
+	if location == nil {
+		return fmt.Errorf("unknown location %q", d.location)
+	}
+	return nil
+}
+
+// tokenFailover records that the hcloud client switched to another token.
+func (d *Driver) tokenFailover(from, to int, status int) {
+	names := []string{"primary", "secondary"}
+
+	d.metrics.tokenFailovers.Inc()
+	if d.log != nil {
+		d.log.WithFields(logrus.Fields{
+			"from":   names[from],
+			"to":     names[to],
+			"status": status,
+		}).Warn("hcloud API rejected the token, switched to the other token")
+	}
+}
+
+// hcloudTransport returns the transport for requests to the hcloud API. It
+// uses the configured proxy and CA bundle, by default the proxy is taken
+// from the HTTPS_PROXY environment variable.
+func (d *Driver) hcloudTransport() (*http.Transport, error) {
+	keepAlive := d.hcloudKeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultHCloudKeepAlive
+	}
+
+	maxIdleConns := d.hcloudMaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultHCloudMaxIdleConns
+	}
+
+	idleConnTimeout := d.hcloudIdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = defaultHCloudIdleConnTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+
+		// bounds every attempt, so a hanging API is retried instead of
+		// blocking the RPC until the CO gives up
+		ResponseHeaderTimeout: d.hcloudRequestTimeout,
+	}
+
+	if d.hcloudProxy != "" {
+		proxyURL, err := url.Parse(d.hcloudProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hcloud proxy URL %q: %s", d.hcloudProxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if d.hcloudCAFile != "" {
+		pem, err := ioutil.ReadFile(d.hcloudCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading hcloud CA bundle failed: %s", err)
+		}
+
+		// the bundle is added to the system certificates, so a proxy
+		// intercepting only some connections keeps working
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("hcloud CA bundle %q contains no certificates", d.hcloudCAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+
+	return transport, nil
+}
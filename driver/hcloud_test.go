@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+)
+
+func TestHCloudTransportCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{}
+	transport, err := d.hcloudTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&http.Client{Transport: transport}).Get(ts.URL); err == nil {
+		t.Error("expected an error for an untrusted certificate")
+	}
+
+	d.hcloudCAFile = caFile
+	transport, err = d.hcloudTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	d.hcloudCAFile = filepath.Join(dir, "missing.pem")
+	if _, err := d.hcloudTransport(); err == nil {
+		t.Error("expected an error for a missing CA bundle")
+	}
+}
+
+func TestHCloudTransportRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	d := &Driver{hcloudRequestTimeout: 50 * time.Millisecond}
+	transport, err := d.hcloudTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transport.MaxIdleConnsPerHost != defaultHCloudMaxIdleConns {
+		t.Errorf("expected %d idle connections per host, got %d", defaultHCloudMaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+
+	if _, err := (&http.Client{Transport: transport}).Get(ts.URL); err == nil {
+		t.Error("expected an error for a request timing out")
+	}
+}
+
+func TestCheckHCloud(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(&schema.ErrorResponse{
+				Error: schema.Error{Code: string(errorCodeUnauthorized)},
+			})
+			return
+		}
+
+		resp := &schema.LocationListResponse{Locations: []schema.Location{}}
+		if name := r.URL.Query().Get("name"); name == "fsn1" {
+			resp.Locations = append(resp.Locations, schema.Location{ID: 1, Name: name})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		token    string
+		location string
+		wantErr  string
+	}{
+		{token: "valid", location: "fsn1"},
+		{token: "invalid", location: "fsn1", wantErr: "invalid token"},
+		{token: "valid", location: "xyz1", wantErr: "unknown location"},
+	} {
+		d := &Driver{
+			location:     tc.location,
+			hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL), hcloud.WithToken(tc.token)),
+		}
+
+		err := d.checkHCloud(context.Background())
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("token %q, location %q: unexpected error: %s", tc.token, tc.location, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("token %q, location %q: expected error %q, got %v", tc.token, tc.location, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons for a staged volume to be in an abnormal condition.
+const (
+	conditionDeviceMissing = "device_missing"
+	conditionNotMounted    = "not_mounted"
+	conditionCorrupted     = "corrupted"
+	conditionReadOnly      = "read_only"
+)
+
+// runMountHealthCheck inspects the staged volumes in the configured interval
+// until the driver is stopped.
+func (d *Driver) runMountHealthCheck() {
+	d.log.WithField("interval", d.mountHealthInterval).Info("starting mount health checks")
+
+	ticker := time.NewTicker(d.mountHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.checkMountHealth()
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// checkMountHealth inspects all staged volumes and reports abnormal ones in
+// the logs and the volume_abnormal metric. The filesystem usage of the
+// healthy ones is recorded in the volume_filesystem metrics, CSI v0.3 has
+// no RPC to report it.
+func (d *Driver) checkMountHealth() {
+	states, err := d.listStagingStates()
+	if err != nil {
+		d.log.WithError(err).Warn("could not list staged volumes for the mount health check")
+		return
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		d.log.WithError(err).Warn("could not read mounts for the mount health check")
+		return
+	}
+
+	d.metrics.volumeAbnormal.Reset()
+	d.metrics.resetVolumeStatistics()
+	for _, state := range states {
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id":           state.VolumeID,
+			"staging_target_path": state.StagingTargetPath,
+			"method":              "mount_health_check",
+		})
+
+		condition := d.mountCondition(state, mounts)
+		if condition == "" {
+			d.recordVolumeStatistics(ll, state)
+			continue
+		}
+
+		d.metrics.volumeAbnormal.WithLabelValues(state.VolumeID, condition).Set(1)
+		ll.WithField("condition", condition).Warn("staged volume is abnormal")
+
+		if d.remountStaged && (condition == conditionNotMounted || condition == conditionCorrupted) {
+			err := d.remountStagedVolume(state, condition)
+			d.metrics.remounted(err)
+			if err != nil {
+				ll.WithError(err).Warn("could not mount staged volume again")
+				continue
+			}
+			ll.Info("staged volume mounted again")
+		}
+	}
+}
+
+// recordVolumeStatistics records the filesystem usage of a healthy staged
+// volume. Raw block volumes have no filesystem the driver knows about.
+func (d *Driver) recordVolumeStatistics(ll *logrus.Entry, state *stagingState) {
+	if state.Block {
+		return
+	}
+
+	stats, err := d.mounter.GetStatistics(state.StagingTargetPath)
+	if err != nil {
+		ll.WithError(err).Warn("could not get the filesystem statistics of the staged volume")
+		return
+	}
+	d.metrics.volumeStatistics(state.VolumeID, stats)
+}
+
+// remountStagedVolume mounts a staged volume again whose staging mount
+// disappeared or broke, e.g. because the device vanished for a moment or
+// the mount namespace of the plugin was replaced. Mounts of the pods
+// published before still point to the old mount, the pods have to be
+// restarted to see the volume again.
+func (d *Driver) remountStagedVolume(state *stagingState, condition string) error {
+	// NodeUnstageVolume might be removing the volume just now
+	if !d.volumeLocks.TryAcquire(state.VolumeID) {
+		return fmt.Errorf("an operation for volume %q is in progress", state.VolumeID)
+	}
+	defer d.volumeLocks.Release(state.VolumeID)
+
+	current, err := d.loadStagingState(state.VolumeID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		// unstaged in the meantime
+		return nil
+	}
+
+	if _, err := os.Stat(current.StagingTargetPath); err != nil {
+		return fmt.Errorf("staging target path is gone: %s", err)
+	}
+
+	if condition == conditionCorrupted {
+		if err := d.mounter.ForceUnmount(current.StagingTargetPath); err != nil {
+			return err
+		}
+	}
+
+	if d.fsckMode != "" && d.fsckMode != FsckModeOff {
+		if err := d.mounter.Check(current.Device, current.FsType, d.fsckMode == FsckModeForce); err != nil {
+			return err
+		}
+	}
+
+	if err := d.mounter.Mount(current.Device, current.StagingTargetPath, current.FsType, current.MountOptions...); err != nil {
+		return err
+	}
+
+	if id, err := strconv.Atoi(current.VolumeID); err == nil {
+		d.volumeEvent(id, reasonVolumeRemounted, fmt.Sprintf("The staging mount of the volume was %s and has been mounted again, pods using the volume might need a restart", strings.Replace(condition, "_", " ", -1)))
+	}
+	return nil
+}
+
+// mountCondition returns why the staged volume is abnormal or an empty
+// string if it is healthy.
+func (d *Driver) mountCondition(state *stagingState, mounts []mountInfo) string {
+	if _, err := os.Stat(state.Device); err != nil {
+		return conditionDeviceMissing
+	}
+
+	// raw block volumes are not mounted to the staging path
+	if state.Block {
+		return ""
+	}
+
+	if d.mounter.IsCorruptedMount(state.StagingTargetPath) {
+		return conditionCorrupted
+	}
+
+	mnt := findMountInfo(mounts, state.StagingTargetPath)
+	if mnt == nil {
+		return conditionNotMounted
+	}
+
+	// ext filesystems mounted with errors=remount-ro only turn the
+	// filesystem read-only, the mount itself stays writable
+	if !hasOption(state.MountOptions, "ro") && (hasOption(mnt.Options, "ro") || hasOption(mnt.SuperOptions, "ro")) {
+		return conditionReadOnly
+	}
+
+	return ""
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMountCondition(t *testing.T) {
+	device, err := ioutil.TempFile("", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Close()
+	defer os.Remove(device.Name())
+
+	mounts := []mountInfo{
+		{MountPoint: "/stage/healthy", Options: []string{"rw"}, SuperOptions: []string{"rw"}},
+		{MountPoint: "/stage/remounted", Options: []string{"rw"}, SuperOptions: []string{"ro", "errors=remount-ro"}},
+		{MountPoint: "/stage/readonly", Options: []string{"ro"}, SuperOptions: []string{"ro"}},
+	}
+
+	tests := []struct {
+		name  string
+		state *stagingState
+		want  string
+	}{
+		{"healthy", &stagingState{StagingTargetPath: "/stage/healthy", Device: device.Name()}, ""},
+		{"remounted read-only", &stagingState{StagingTargetPath: "/stage/remounted", Device: device.Name()}, conditionReadOnly},
+		{"requested read-only", &stagingState{StagingTargetPath: "/stage/readonly", Device: device.Name(), MountOptions: []string{"ro"}}, ""},
+		{"not mounted", &stagingState{StagingTargetPath: "/stage/missing", Device: device.Name()}, conditionNotMounted},
+		{"device missing", &stagingState{StagingTargetPath: "/stage/healthy", Device: device.Name() + "-missing"}, conditionDeviceMissing},
+		{"block", &stagingState{StagingTargetPath: "/stage/block", Device: device.Name(), Block: true}, ""},
+	}
+
+	d := &Driver{mounter: &fakeMounter{}}
+	for _, tt := range tests {
+		if got := d.mountCondition(tt.state, mounts); got != tt.want {
+			t.Errorf("%s: got condition %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// remountMounter records the mounts and forced unmounts.
+type remountMounter struct {
+	fakeMounter
+
+	mounted   []string
+	unmounted []string
+}
+
+func (m *remountMounter) Mount(source, target, fsType string, options ...string) error {
+	m.mounted = append(m.mounted, source+" "+target+" "+fsType)
+	return nil
+}
+
+func (m *remountMounter) ForceUnmount(target string) error {
+	m.unmounted = append(m.unmounted, target)
+	return nil
+}
+
+func TestRemountStagedVolume(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	mounter := &remountMounter{}
+	d := &Driver{dataDir: dataDir, mounter: mounter}
+
+	state := &stagingState{VolumeID: "1", StagingTargetPath: dataDir, Device: "/dev/sdb", FsType: "ext4"}
+	if err := d.saveStagingState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.remountStagedVolume(state, conditionCorrupted); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mounter.unmounted, []string{dataDir}) {
+		t.Errorf("expected the broken mount to be unmounted, got %v", mounter.unmounted)
+	}
+	if want := []string{"/dev/sdb " + dataDir + " ext4"}; !reflect.DeepEqual(mounter.mounted, want) {
+		t.Errorf("expected mounts %v, got %v", want, mounter.mounted)
+	}
+
+	// a volume in use by another operation is left alone
+	d.volumeLocks.TryAcquire("1")
+	if err := d.remountStagedVolume(state, conditionNotMounted); err == nil {
+		t.Error("expected an error for a locked volume")
+	}
+	d.volumeLocks.Release("1")
+
+	// an unstaged volume isn't mounted again
+	if err := d.removeStagingState("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.remountStagedVolume(state, conditionNotMounted); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounter.mounted) != 1 {
+		t.Errorf("expected no mount for an unstaged volume, got %v", mounter.mounted)
+	}
+}
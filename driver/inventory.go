@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// defaultInventoryInterval is the interval the managed volumes are listed
+// in for the inventory metrics. Listing is expensive for projects with many
+// volumes, so it's done rarely.
+const defaultInventoryInterval = 5 * time.Minute
+
+// inventoryKey groups volumes in the inventory metrics.
+type inventoryKey struct {
+	location string
+	state    string
+}
+
+// runVolumeInventory updates the inventory metrics periodically until the
+// driver is stopped.
+func (d *Driver) runVolumeInventory() {
+	interval := d.inventoryInterval
+	if interval == 0 {
+		interval = defaultInventoryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// only the leader exports the inventory, so it isn't counted once
+		// per replica
+		if d.isLeader() {
+			if err := d.updateVolumeInventory(); err != nil {
+				d.log.WithError(err).Warn("could not update volume inventory")
+			}
+		} else {
+			d.metrics.resetInventory()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// updateVolumeInventory sets the number and capacity of the managed volumes
+// by location and whether they are attached.
+func (d *Driver) updateVolumeInventory() error {
+	ctx := withPriority(context.Background(), priorityBackground)
+
+	volumes, err := d.client(ctx).Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage:       50,
+			LabelSelector: d.managedLabelSelector(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if d.costExporter {
+		if err := d.updateVolumeCost(ctx, volumes); err != nil {
+			d.log.WithError(err).Warn("could not update volume cost")
+		}
+	}
+
+	counts := map[inventoryKey]int{}
+	capacity := map[inventoryKey]int64{}
+	for _, vol := range volumes {
+		key := inventoryKey{state: "detached"}
+		if vol.Location != nil {
+			key.location = vol.Location.Name
+		}
+		if vol.Server != nil {
+			key.state = "attached"
+		}
+
+		counts[key]++
+		capacity[key] += int64(vol.Size) * GB
+	}
+
+	// volumes of a location might all be gone
+	d.metrics.volumes.Reset()
+	d.metrics.volumeCapacity.Reset()
+	for key, count := range counts {
+		d.metrics.volumes.WithLabelValues(key.location, key.state).Set(float64(count))
+		d.metrics.volumeCapacity.WithLabelValues(key.location, key.state).Set(float64(capacity[key]))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestUpdateVolumeInventory(t *testing.T) {
+	managed := map[string]string{labelCreatedBy: createdByHCloud}
+	server := 1
+
+	ts := httptest.NewServer(&fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Size: 10, Labels: managed, Location: schema.Location{Name: "fsn1"}, Server: &server},
+			2: {ID: 2, Size: 20, Labels: managed, Location: schema.Location{Name: "fsn1"}, Server: &server},
+			3: {ID: 3, Size: 50, Labels: managed, Location: schema.Location{Name: "nbg1"}},
+			4: {ID: 4, Size: 100, Location: schema.Location{Name: "nbg1"}},
+		},
+	})
+	defer ts.Close()
+
+	d := &Driver{
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		metrics:      newMetrics(),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.updateVolumeInventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unmanaged volume 4 is not counted
+	body := scrape(t, d.metrics)
+	for _, want := range []string{
+		`hcloud_csi_controller_volumes{location="fsn1",state="attached"} 2`,
+		`hcloud_csi_controller_volumes{location="nbg1",state="detached"} 1`,
+		`hcloud_csi_controller_volume_capacity_bytes{location="fsn1",state="attached"} 3.221225472e+10`,
+		`hcloud_csi_controller_volume_capacity_bytes{location="nbg1",state="detached"} 5.36870912e+10`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the journal.
+const (
+	journalCreate = "create"
+	journalDelete = "delete"
+	journalAttach = "attach"
+	journalDetach = "detach"
+)
+
+// defaultOrphanGracePeriod is the time the CO has to retry CreateVolume
+// after the controller crashed while creating a volume. Volumes it doesn't
+// ask for again are deleted as orphans.
+const defaultOrphanGracePeriod = time.Hour
+
+// journalEntry records an operation of the controller that is in flight,
+// so it can be finished after the controller crashed.
+type journalEntry struct {
+	Operation  string    `json:"operation"`
+	VolumeName string    `json:"volume_name,omitempty"`
+	VolumeID   int       `json:"volume_id,omitempty"`
+	ServerID   int       `json:"server_id,omitempty"`
+	ActionID   int       `json:"action_id,omitempty"`
+	Started    time.Time `json:"started"`
+}
+
+// id returns the name of the journal record of the entry. A volume has at
+// most one operation of every kind in flight.
+func (e *journalEntry) id() string {
+	if e.Operation == journalCreate {
+		// the name is chosen by the CO, it is hashed so the record can't
+		// end up outside of the journal directory
+		sum := sha256.Sum256([]byte(e.VolumeName))
+		return e.Operation + "-" + hex.EncodeToString(sum[:])
+	}
+	return e.Operation + "-" + strconv.Itoa(e.VolumeID)
+}
+
+// journalPath returns the path of the journal record with the given ID.
+func (d *Driver) journalPath(id string) string {
+	return filepath.Join(d.journalDir, id+".json")
+}
+
+// journalStart records an operation before or while it runs and returns
+// the ID of its record. It does nothing if no journal directory is
+// configured. A failing journal doesn't fail the operation.
+func (d *Driver) journalStart(entry *journalEntry) string {
+	if d.journalDir == "" {
+		return ""
+	}
+
+	if entry.Started.IsZero() {
+		entry.Started = time.Now()
+	}
+
+	if err := d.writeJournalEntry(entry); err != nil {
+		d.log.WithError(err).WithField("operation", entry.id()).Warn("could not record operation in journal")
+	}
+	return entry.id()
+}
+
+// journalDone removes the record of a finished operation.
+func (d *Driver) journalDone(id string) {
+	if d.journalDir == "" || id == "" {
+		return
+	}
+
+	if err := os.Remove(d.journalPath(id)); err != nil && !os.IsNotExist(err) {
+		d.log.WithError(err).WithField("operation", id).Warn("could not remove operation from journal")
+	}
+}
+
+func (d *Driver) writeJournalEntry(entry *journalEntry) error {
+	if err := os.MkdirAll(d.journalDir, 0750); err != nil {
+		return fmt.Errorf("creating journal directory failed: %s", err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a partial
+	// record behind
+	path := d.journalPath(entry.id())
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("writing journal entry failed: %s", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing journal entry failed: %s", err)
+	}
+	return nil
+}
+
+// journalEntries returns all operations in the journal.
+func (d *Driver) journalEntries() ([]*journalEntry, error) {
+	if d.journalDir == "" {
+		return nil, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(d.journalDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*journalEntry
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading journal entry failed: %s", err)
+		}
+
+		entry := &journalEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("journal entry %q is corrupted: %s", filepath.Base(path), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// resumeOperations finishes the operations the controller was running
+// before it was restarted. Actions still running are waited for, deletes
+// are repeated and volumes whose creation was interrupted are deleted if
+// the CO doesn't ask for them again within the grace period.
+func (d *Driver) resumeOperations() {
+	entries, err := d.journalEntries()
+	if err != nil {
+		d.log.WithError(err).Warn("could not read operation journal")
+		return
+	}
+
+	for _, entry := range entries {
+		entry := entry
+		ll := d.log.WithFields(logrus.Fields{
+			"operation":   entry.Operation,
+			"volume_id":   entry.VolumeID,
+			"volume_name": entry.VolumeName,
+			"server_id":   entry.ServerID,
+			"action_id":   entry.ActionID,
+			"method":      "resume_operations",
+		})
+		ll.Info("resuming interrupted operation")
+
+		go d.resumeOperation(ll, entry)
+	}
+}
+
+// resumeOperation finishes a single interrupted operation.
+func (d *Driver) resumeOperation(ll *logrus.Entry, entry *journalEntry) {
+	ctx := withPriority(context.Background(), priorityBackground)
+
+	if entry.ActionID != 0 {
+		if err := d.waitAction(ctx, entry.VolumeID, entry.ActionID); err != nil {
+			ll.WithError(err).Warn("interrupted action did not complete")
+		} else {
+			ll.Info("interrupted action completed")
+		}
+	}
+
+	switch entry.Operation {
+	case journalCreate:
+		d.finalizeCreate(ctx, ll, entry)
+		return
+
+	case journalDelete:
+		d.volumes.invalidate(entry.VolumeID)
+		_, err := d.client(ctx).Volume.Delete(ctx, &hcloud.Volume{ID: entry.VolumeID})
+		if err != nil && !hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+			// the CO retries the delete, the record is kept for the next
+			// start otherwise
+			ll.WithError(err).Warn("could not finish interrupted delete")
+			return
+		}
+		ll.Info("interrupted delete finished")
+	}
+
+	// attaches and detaches are retried by the CO
+	d.journalDone(entry.id())
+}
+
+// finalizeCreate deletes the volume of an interrupted create, unless
+// CreateVolume was called for it again within the grace period. Attached
+// volumes are in use and kept.
+func (d *Driver) finalizeCreate(ctx context.Context, ll *logrus.Entry, entry *journalEntry) {
+	wait := d.orphanGracePeriod - time.Since(entry.Started)
+	select {
+	case <-time.After(wait):
+	case <-d.stopCh:
+		return
+	}
+
+	// a successful CreateVolume removes the record
+	if _, err := os.Stat(d.journalPath(entry.id())); os.IsNotExist(err) {
+		return
+	}
+
+	if !d.isLeader() {
+		return
+	}
+
+	vol, _, err := d.client(ctx).Volume.GetByName(ctx, entry.VolumeName)
+	if err != nil {
+		ll.WithError(err).Warn("could not look up volume of interrupted create")
+		return
+	}
+
+	switch {
+	case vol == nil:
+		ll.Info("interrupted create left no volume behind")
+	case vol.Server != nil:
+		ll.Warn("volume of interrupted create is attached, keeping it")
+	case vol.Labels[labelCreatedBy] != createdByHCloud:
+		ll.Warn("volume of interrupted create was not created by the driver, keeping it")
+	default:
+		d.volumes.invalidate(vol.ID)
+		if _, err := d.client(ctx).Volume.Delete(ctx, vol); err != nil {
+			ll.WithError(err).Warn("could not delete orphaned volume")
+			return
+		}
+		ll.WithField("volume_id", vol.ID).Warn("deleted orphaned volume of interrupted create")
+	}
+
+	d.journalDone(entry.id())
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestResumeOperations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	managed := map[string]string{labelCreatedBy: createdByHCloud}
+	server := 10
+	fakeHCloud := &fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "pvc-orphan", Labels: managed},
+			2: {ID: 2, Name: "pvc-attached", Labels: managed, Server: &server},
+			3: {ID: 3, Name: "pvc-deleted", Labels: managed},
+		},
+	}
+	ts := httptest.NewServer(fakeHCloud)
+	defer ts.Close()
+
+	d := &Driver{
+		journalDir:         dir,
+		actionPollInterval: time.Millisecond,
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:                logrus.New().WithField("test_enabled", true),
+		stopCh:             make(chan struct{}),
+	}
+
+	entries := []*journalEntry{
+		{Operation: journalCreate, VolumeName: "pvc-orphan", VolumeID: 1, ActionID: 100},
+		{Operation: journalCreate, VolumeName: "pvc-attached", VolumeID: 2},
+		{Operation: journalCreate, VolumeName: "pvc-never-created"},
+		{Operation: journalDelete, VolumeID: 3},
+		{Operation: journalAttach, VolumeID: 2, ServerID: 10, ActionID: 101},
+	}
+	for _, entry := range entries {
+		d.journalStart(entry)
+	}
+
+	recorded, err := d.journalEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != len(entries) {
+		t.Fatalf("expected %d journal entries, got %d", len(entries), len(recorded))
+	}
+
+	for _, entry := range recorded {
+		d.resumeOperation(d.log, entry)
+	}
+
+	if _, ok := fakeHCloud.volumes[1]; ok {
+		t.Error("expected the orphaned volume to be deleted")
+	}
+	if _, ok := fakeHCloud.volumes[2]; !ok {
+		t.Error("expected the attached volume to be kept")
+	}
+	if _, ok := fakeHCloud.volumes[3]; ok {
+		t.Error("expected the interrupted delete to be finished")
+	}
+
+	recorded, err = d.journalEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 0 {
+		t.Errorf("expected all operations to be finished, got %+v", recorded)
+	}
+}
+
+func TestCreateVolumeJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(&fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+	})
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		journalDir:   dir,
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	_, err = d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.journalEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the finished create to be removed from the journal, got %+v", entries)
+	}
+}
+
+func TestJournalEntryID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journalDir := filepath.Join(dir, "journal")
+	d := &Driver{
+		journalDir: journalDir,
+		log:        logrus.New().WithField("test_enabled", true),
+	}
+
+	for _, name := range []string{"../../pvc-1234", "pvc/1234", ".."} {
+		id := d.journalStart(&journalEntry{Operation: journalCreate, VolumeName: name})
+		if filepath.Dir(d.journalPath(id)) != journalDir {
+			t.Errorf("%q: expected the record in the journal directory, got %q", name, d.journalPath(id))
+		}
+	}
+
+	entries, err := d.journalEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected 3 records in the journal, got %d", len(entries))
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected only the journal directory, got %d files", len(files))
+	}
+}
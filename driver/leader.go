@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// leaderAnnotation holds the leader election record on the ConfigMap,
+	// the same as for the ConfigMap lock of client-go.
+	leaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+	// leaseDuration is the time other replicas wait after the last renewal
+	// of the leader before they take over.
+	leaseDuration = 15 * time.Second
+
+	// renewDeadline is the time the leader tries to renew the lease before
+	// it steps down. It must be shorter than leaseDuration, so the leader
+	// stops its background work before another replica takes over.
+	renewDeadline = 10 * time.Second
+
+	// leaderRetryPeriod is the interval the lease is acquired or renewed in.
+	leaderRetryPeriod = 2 * time.Second
+
+	// serviceAccountNamespacePath holds the namespace of the pod.
+	serviceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// leaderElectionRecord is stored in the leaderAnnotation of the lock. It
+// is compatible with the record of client-go.
+type leaderElectionRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+// leaderElector elects a single controller replica to run the background
+// loops. The lease is a ConfigMap, because the cluster API the driver is
+// built against has no Lease objects yet.
+type leaderElector struct {
+	namespace string
+	name      string
+	identity  string
+
+	mu           sync.Mutex
+	renewed      time.Time // last successful renewal as leader
+	observed     string    // last observed record
+	observedTime time.Time // local time the record was observed at
+}
+
+// podNamespace returns the namespace the driver runs in, or kube-system if
+// it doesn't run in a pod.
+func podNamespace() string {
+	data, err := ioutil.ReadFile(serviceAccountNamespacePath)
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return metav1.NamespaceSystem
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// isLeader returns whether the driver should run the controller background
+// loops. Without leader election every driver is the leader.
+func (d *Driver) isLeader() bool {
+	if d.leaderElector == nil {
+		return true
+	}
+
+	d.leaderElector.mu.Lock()
+	defer d.leaderElector.mu.Unlock()
+	return time.Since(d.leaderElector.renewed) < renewDeadline
+}
+
+// runLeaderElection acquires and renews the lease until the driver is
+// stopped. The lease is released on stop, so another replica can take
+// over right away.
+func (d *Driver) runLeaderElection() {
+	ticker := time.NewTicker(leaderRetryPeriod)
+	defer ticker.Stop()
+
+	ll := d.log.WithFields(logrus.Fields{
+		"lock":     d.leaderElector.namespace + "/" + d.leaderElector.name,
+		"identity": d.leaderElector.identity,
+	})
+
+	leader := false
+	for {
+		if err := d.tryAcquireOrRenew(time.Now()); err != nil {
+			ll.WithError(err).Warn("could not acquire or renew leader lease")
+		}
+
+		if isLeader := d.isLeader(); isLeader != leader {
+			leader = isLeader
+			d.metrics.setLeader(leader)
+			if leader {
+				ll.Info("became leader, running controller background loops")
+			} else {
+				ll.Warn("lost leadership, pausing controller background loops")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			if leader {
+				if err := d.releaseLease(); err != nil {
+					ll.WithError(err).Warn("could not release leader lease")
+				}
+			}
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew takes the lease if it is free or expired, or renews it
+// if the driver already holds it. Conflicting updates of other replicas are
+// detected by the resource version of the ConfigMap.
+func (d *Driver) tryAcquireOrRenew(now time.Time) error {
+	le := d.leaderElector
+	configMaps := d.kubeClient.CoreV1().ConfigMaps(le.namespace)
+
+	record := leaderElectionRecord{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(leaseDuration / time.Second),
+		AcquireTime:          metav1.NewTime(now),
+		RenewTime:            metav1.NewTime(now),
+	}
+
+	cm, err := configMaps.Get(le.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		_, err = configMaps.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   le.namespace,
+				Name:        le.name,
+				Annotations: map[string]string{leaderAnnotation: string(data)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		le.setRenewed(now, string(data))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	raw := cm.Annotations[leaderAnnotation]
+	var old leaderElectionRecord
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &old); err != nil {
+			return fmt.Errorf("invalid leader election record %q: %s", raw, err)
+		}
+	}
+
+	// the expiry is measured with the local clock since the record was
+	// last seen changing, so skewed clocks of the replicas don't matter
+	le.mu.Lock()
+	if raw != le.observed {
+		le.observed = raw
+		le.observedTime = now
+	}
+	expired := now.Sub(le.observedTime) > leaseDuration
+	held := old.HolderIdentity != "" && old.HolderIdentity != le.identity && !expired
+	if held {
+		// another replica took over, e.g. after a network partition
+		le.renewed = time.Time{}
+	}
+	le.mu.Unlock()
+
+	if held {
+		return nil
+	}
+
+	if old.HolderIdentity == le.identity {
+		record.AcquireTime = old.AcquireTime
+		record.LeaderTransitions = old.LeaderTransitions
+	} else {
+		record.LeaderTransitions = old.LeaderTransitions + 1
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[leaderAnnotation] = string(data)
+	if _, err := configMaps.Update(cm); err != nil {
+		return err
+	}
+	le.setRenewed(now, string(data))
+	return nil
+}
+
+// releaseLease gives up the lease by clearing the holder.
+func (d *Driver) releaseLease() error {
+	le := d.leaderElector
+	configMaps := d.kubeClient.CoreV1().ConfigMaps(le.namespace)
+
+	cm, err := configMaps.Get(le.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var record leaderElectionRecord
+	if err := json.Unmarshal([]byte(cm.Annotations[leaderAnnotation]), &record); err != nil {
+		return err
+	}
+
+	if record.HolderIdentity != le.identity {
+		return nil
+	}
+
+	le.mu.Lock()
+	le.renewed = time.Time{}
+	le.mu.Unlock()
+
+	record.HolderIdentity = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	cm.Annotations[leaderAnnotation] = string(data)
+	_, err = configMaps.Update(cm)
+	return err
+}
+
+func (le *leaderElector) setRenewed(now time.Time, record string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.renewed = now
+	le.observed = record
+	le.observedTime = now
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeConfigMapAPI serves a single ConfigMap and rejects updates with a
+// stale resource version.
+type fakeConfigMapAPI struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	cm      *v1.ConfigMap
+	version int
+}
+
+func (f *fakeConfigMapAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	status := func(code int, reason metav1.StatusReason) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(&metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   reason,
+			Code:     int32(code),
+		})
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.cm == nil {
+			status(http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.cm)
+	case http.MethodPost, http.MethodPut:
+		cm := &v1.ConfigMap{}
+		if err := json.NewDecoder(r.Body).Decode(cm); err != nil {
+			f.t.Fatal(err)
+		}
+
+		if r.Method == http.MethodPost && f.cm != nil {
+			status(http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		}
+		if r.Method == http.MethodPut && cm.ResourceVersion != f.cm.ResourceVersion {
+			status(http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+
+		f.version++
+		cm.TypeMeta = metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"}
+		cm.ResourceVersion = strconv.Itoa(f.version)
+		f.cm = cm
+		json.NewEncoder(w).Encode(cm)
+	default:
+		status(http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+func (f *fakeConfigMapAPI) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var record leaderElectionRecord
+	if f.cm != nil {
+		json.Unmarshal([]byte(f.cm.Annotations[leaderAnnotation]), &record)
+	}
+	return record.HolderIdentity
+}
+
+func TestLeaderElection(t *testing.T) {
+	kube := &fakeConfigMapAPI{t: t}
+	ts := httptest.NewServer(kube)
+	defer ts.Close()
+
+	// the default client side rate limit would slow the test down
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: ts.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newReplica := func(identity string) *Driver {
+		return &Driver{
+			kubeClient: kubeClient,
+			leaderElector: &leaderElector{
+				namespace: "kube-system",
+				name:      "hcloud-csi",
+				identity:  identity,
+			},
+		}
+	}
+	a, b := newReplica("a"), newReplica("b")
+
+	now := time.Now()
+	if err := a.tryAcquireOrRenew(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.tryAcquireOrRenew(now); err != nil {
+		t.Fatal(err)
+	}
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("expected a to be the leader, a: %t, b: %t", a.isLeader(), b.isLeader())
+	}
+
+	// a renews the lease, so it never expires for b
+	for i := 1; i <= 10; i++ {
+		now := now.Add(time.Duration(i) * leaderRetryPeriod)
+		if err := a.tryAcquireOrRenew(now); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.tryAcquireOrRenew(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kube.holder() != "a" || b.isLeader() {
+		t.Fatalf("expected a to keep the lease, holder is %q", kube.holder())
+	}
+
+	// a stops renewing, b takes over once the lease expired
+	later := now.Add(10*leaderRetryPeriod + leaseDuration + time.Second)
+	if err := b.tryAcquireOrRenew(later); err != nil {
+		t.Fatal(err)
+	}
+	if kube.holder() != "b" || !b.isLeader() {
+		t.Fatalf("expected b to take over, holder is %q", kube.holder())
+	}
+
+	if err := a.tryAcquireOrRenew(later); err != nil {
+		t.Fatal(err)
+	}
+	if a.isLeader() {
+		t.Error("expected a to step down")
+	}
+
+	// a released lease is free right away
+	if err := b.releaseLease(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.tryAcquireOrRenew(later); err != nil {
+		t.Fatal(err)
+	}
+	if kube.holder() != "a" {
+		t.Errorf("expected a to take the released lease, holder is %q", kube.holder())
+	}
+}
+
+func TestIsLeaderWithoutElection(t *testing.T) {
+	d := &Driver{}
+	if !d.isLeader() {
+		t.Error("expected a driver without leader election to be the leader")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// staleSocketTimeout bounds connecting to an existing socket to check
+	// whether another process still listens on it.
+	staleSocketTimeout = time.Second
+
+	// listenFdsStart is the first file descriptor passed by systemd socket
+	// activation.
+	listenFdsStart = 3
+)
+
+// listen creates the listener of the gRPC server for the endpoint. The
+// endpoint is either a unix domain socket, e.g. unix:///csi/csi.sock, a
+// TCP address, e.g. tcp://0.0.0.0:10000, or systemd:// to use the socket
+// passed by systemd socket activation.
+func (d *Driver) listen() (net.Listener, error) {
+	u, err := url.Parse(d.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse address: %q", err)
+	}
+
+	var addr string
+	switch u.Scheme {
+	case "systemd":
+		return systemdListener()
+	case "unix":
+		addr = path.Join(u.Host, filepath.FromSlash(u.Path))
+		if u.Host == "" {
+			addr = filepath.FromSlash(u.Path)
+		}
+
+		if err := d.removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	case "tcp":
+		addr = u.Host
+		if addr == "" {
+			return nil, fmt.Errorf("tcp endpoint %q has no address", d.endpoint)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported endpoint scheme %q, must be one of: unix, tcp, systemd", u.Scheme)
+	}
+
+	listener, err := net.Listen(u.Scheme, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	if u.Scheme == "unix" {
+		if err := d.setSocketPermissions(addr); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// socketActivated returns whether the listener is passed by systemd, which
+// owns the socket then.
+func (d *Driver) socketActivated() bool {
+	return strings.HasPrefix(d.endpoint, "systemd:")
+}
+
+// systemdListener returns the listener passed by systemd socket activation,
+// see sd_listen_fds(3). Exactly one socket has to be passed.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("systemd endpoint configured, but no socket was passed by systemd")
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds != 1 {
+		return nil, fmt.Errorf("systemd passed %q sockets, expected exactly one", os.Getenv("LISTEN_FDS"))
+	}
+
+	// the variables must not be inherited by child processes, e.g. mkfs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFdsStart)
+	f := os.NewFile(uintptr(listenFdsStart), "systemd-socket")
+	defer f.Close()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using the socket passed by systemd failed: %s", err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket if it's already there. This can
+// happen if we deploy a new version and the socket was created from the old
+// running plugin, or the plugin crashed. A socket another process still
+// listens on is never removed.
+func (d *Driver) removeStaleSocket(socket string) error {
+	fi, err := os.Lstat(socket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check unix domain socket file %s, error: %s", socket, err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix domain socket, refusing to remove it", socket)
+	}
+
+	conn, err := net.DialTimeout("unix", socket, staleSocketTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is listening on %s", socket)
+	}
+
+	d.log.WithField("socket", socket).Info("removing stale socket")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove unix domain socket file %s, error: %s", socket, err)
+	}
+	return nil
+}
+
+// setSocketPermissions applies the configured mode and owner to the socket,
+// so sidecars not running as root can connect to it.
+func (d *Driver) setSocketPermissions(socket string) error {
+	if d.socketMode != "" {
+		mode, err := parseSocketMode(d.socketMode)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chmod(socket, mode); err != nil {
+			return fmt.Errorf("changing mode of socket %s failed: %s", socket, err)
+		}
+	}
+
+	if d.socketOwner != "" {
+		uid, gid, err := parseSocketOwner(d.socketOwner)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chown(socket, uid, gid); err != nil {
+			return fmt.Errorf("changing owner of socket %s failed: %s", socket, err)
+		}
+	}
+
+	return nil
+}
+
+// parseSocketMode parses an octal file mode, e.g. "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid socket mode %q, must be octal permissions like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseSocketOwner parses a numeric owner of the form "uid" or "uid:gid". A
+// missing group is returned as -1, which keeps the group unchanged.
+func parseSocketOwner(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid socket owner %q, must be a numeric uid or uid:gid", s)
+	}
+
+	gid := -1
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("invalid socket owner %q, must be a numeric uid or uid:gid", s)
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: "unix://" + filepath.Join(dir, "csi.sock")},
+		{endpoint: "tcp://127.0.0.1:0"},
+		{endpoint: "tcp://", wantErr: true},
+		{endpoint: "http://127.0.0.1:0", wantErr: true},
+	} {
+		d := &Driver{
+			endpoint: tc.endpoint,
+			log:      logrus.New().WithField("test_enabled", true),
+		}
+
+		listener, err := d.listen()
+		if tc.wantErr {
+			if err == nil {
+				listener.Close()
+				t.Errorf("%s: expected an error", tc.endpoint)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.endpoint, err)
+			continue
+		}
+		listener.Close()
+	}
+}
+
+func TestListenSocketPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	d := &Driver{
+		endpoint:    "unix://" + socket,
+		socketMode:  "0660",
+		socketOwner: strconv.Itoa(os.Getuid()),
+		log:         logrus.New().WithField("test_enabled", true),
+	}
+
+	listener, err := d.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Errorf("expected socket mode %o, got %o", 0660, perm)
+	}
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	for _, tc := range []struct {
+		owner   string
+		uid     int
+		gid     int
+		wantErr bool
+	}{
+		{owner: "1000", uid: 1000, gid: -1},
+		{owner: "1000:2000", uid: 1000, gid: 2000},
+		{owner: "csi", wantErr: true},
+		{owner: "1000:", wantErr: true},
+		{owner: "-1", wantErr: true},
+	} {
+		uid, gid, err := parseSocketOwner(tc.owner)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.owner)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.owner, err)
+			continue
+		}
+
+		if uid != tc.uid || gid != tc.gid {
+			t.Errorf("%q: expected %d:%d, got %d:%d", tc.owner, tc.uid, tc.gid, uid, gid)
+		}
+	}
+}
+
+func TestShutdownRemovesSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	d := &Driver{
+		endpoint: "unix://" + socket,
+		mounter:  &fakeMounter{},
+		log:      logrus.New().WithField("test_enabled", true),
+		stopCh:   make(chan struct{}),
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- d.Run()
+	}()
+
+	// wait for the server to listen
+	for i := 0; ; i++ {
+		d.readyMu.Lock()
+		ready := d.ready
+		d.readyMu.Unlock()
+		if ready {
+			break
+		}
+		if i == 100 {
+			t.Fatal("server didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.Shutdown(time.Second)
+
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed, got %v", err)
+	}
+}
+
+func TestGRPCReflection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	d := &Driver{
+		endpoint:       "unix://" + socket,
+		mode:           ModeNode,
+		mounter:        &fakeMounter{},
+		grpcReflection: true,
+		log:            logrus.New().WithField("test_enabled", true),
+		stopCh:         make(chan struct{}),
+	}
+	go d.Run()
+	defer d.Shutdown(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, socket,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", target, timeout)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services := map[string]bool{}
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		services[service.Name] = true
+	}
+	if !services["csi.v0.Identity"] || !services["csi.v0.Node"] {
+		t.Errorf("expected the CSI services to be listed, got %v", services)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	d := &Driver{
+		log:    logrus.New().WithField("test_enabled", true),
+		stopCh: make(chan struct{}),
+	}
+
+	// neither a server that never started nor stopping twice panics
+	d.Shutdown(0)
+	d.Stop()
+
+	select {
+	case <-d.stopCh:
+	default:
+		t.Error("expected the background loops to be stopped")
+	}
+}
+
+func TestListenStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	d := &Driver{
+		endpoint: "unix://" + socket,
+		log:      logrus.New().WithField("test_enabled", true),
+	}
+
+	live, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.listen(); err == nil {
+		t.Error("expected an error for a socket another process listens on")
+	}
+
+	// leave the socket file behind, like a crashed process
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+
+	listener, err := d.listen()
+	if err != nil {
+		t.Fatalf("expected the stale socket to be removed: %s", err)
+	}
+	listener.Close()
+
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.listen(); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+}
+
+func TestListenSystemdNotActivated(t *testing.T) {
+	d := &Driver{
+		endpoint: "systemd://",
+		log:      logrus.New().WithField("test_enabled", true),
+	}
+
+	if _, err := d.listen(); err == nil {
+		t.Error("expected an error without a socket passed by systemd")
+	}
+}
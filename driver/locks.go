@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+)
+
+// volumeLocks serializes operations on the same volume. The zero value is
+// ready to use.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]struct{}
+}
+
+// TryAcquire locks the volume. It returns false if an operation on the
+// volume is already in progress.
+func (l *volumeLocks) TryAcquire(volumeID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = map[string]struct{}{}
+	}
+
+	if _, ok := l.locks[volumeID]; ok {
+		return false
+	}
+	l.locks[volumeID] = struct{}{}
+	return true
+}
+
+// Release unlocks the volume.
+func (l *volumeLocks) Release(volumeID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locks, volumeID)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	var l volumeLocks
+
+	if !l.TryAcquire("1") {
+		t.Fatal("could not lock unlocked volume")
+	}
+
+	if l.TryAcquire("1") {
+		t.Error("locked volume could be locked again")
+	}
+
+	if !l.TryAcquire("2") {
+		t.Error("could not lock a different volume")
+	}
+
+	l.Release("1")
+	if !l.TryAcquire("1") {
+		t.Error("could not lock released volume")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogFormat defines how log entries are written.
+type LogFormat string
+
+const (
+	// LogFormatText writes human readable key=value lines.
+	LogFormatText LogFormat = "text"
+
+	// LogFormatJSON writes a JSON object per line, as expected by most log
+	// pipelines.
+	LogFormatJSON LogFormat = "json"
+)
+
+func (f LogFormat) validate() error {
+	switch f {
+	case LogFormatText, LogFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q, must be one of: %s, %s", f, LogFormatText, LogFormatJSON)
+}
+
+// newLogger returns the logger of the driver. An empty level logs at info
+// level.
+func (d *Driver) newLogger() (*logrus.Logger, error) {
+	logger := logrus.New()
+	if d.logFormat == LogFormatJSON {
+		logger.Formatter = &logrus.JSONFormatter{}
+	}
+
+	// outside of Kubernetes nobody collects stderr, write to a file that
+	// is rotated once it gets too big or too old
+	if d.logFile != "" {
+		logger.Out = &lumberjack.Logger{
+			Filename:   d.logFile,
+			MaxSize:    d.logMaxSize,
+			MaxAge:     d.logMaxAge,
+			MaxBackups: d.logMaxBackups,
+		}
+	}
+
+	hook, err := newLogSinkHook(d.logSink)
+	if err != nil {
+		return nil, err
+	}
+	if hook != nil {
+		logger.AddHook(&redactHook{next: hook, tokens: d.knownTokens})
+	}
+
+	// no token must end up in the logs, not even in a dumped request
+	logger.Formatter = &redactFormatter{next: logger.Formatter, tokens: d.knownTokens}
+
+	if d.logLevel != "" {
+		level, err := logrus.ParseLevel(d.logLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q, must be one of: debug, info, warn, error", d.logLevel)
+		}
+		logger.SetLevel(level)
+	}
+
+	return logger, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logLevelHandler reports the log level of the driver on GET and changes it
+// on PUT, e.g.
+//
+//	curl -X PUT -d debug http://localhost:9189/debug/loglevel
+//
+// The level is reset when the driver is restarted.
+func (d *Driver) logLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := d.log.Logger
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			level, err := logrus.ParseLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			previous := logLevel(logger)
+			logger.SetLevel(level)
+			d.log.WithFields(logrus.Fields{
+				"previous_level": previous.String(),
+				"level":          level.String(),
+			}).Warn("log level changed")
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintln(w, logLevel(logger))
+	})
+}
+
+// logLevel returns the level of the logger, it may be changed concurrently.
+func logLevel(logger *logrus.Logger) logrus.Level {
+	return logrus.Level(atomic.LoadUint32((*uint32)(&logger.Level)))
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	logger := logrus.New()
+	d := &Driver{log: logger.WithField("test_enabled", true)}
+	handler := d.logLevelHandler()
+
+	for _, tc := range []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantLevel  logrus.Level
+	}{
+		{method: http.MethodGet, wantStatus: http.StatusOK, wantLevel: logrus.InfoLevel},
+		{method: http.MethodPut, body: "debug\n", wantStatus: http.StatusOK, wantLevel: logrus.DebugLevel},
+		{method: http.MethodPut, body: "verbose", wantStatus: http.StatusBadRequest, wantLevel: logrus.DebugLevel},
+		{method: http.MethodPost, body: "info", wantStatus: http.StatusMethodNotAllowed, wantLevel: logrus.DebugLevel},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, "/debug/loglevel", strings.NewReader(tc.body)))
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %q: expected status %d, got %d", tc.method, tc.body, tc.wantStatus, w.Code)
+		}
+
+		if level := logLevel(logger); level != tc.wantLevel {
+			t.Errorf("%s %q: expected level %s, got %s", tc.method, tc.body, tc.wantLevel, level)
+		}
+	}
+}
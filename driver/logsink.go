@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogSink defines an additional destination for log entries besides stderr
+// or the log file.
+type LogSink string
+
+const (
+	// LogSinkNone only writes to stderr or the log file.
+	LogSinkNone LogSink = ""
+
+	// LogSinkSyslog sends every entry to the local syslog daemon.
+	LogSinkSyslog LogSink = "syslog"
+
+	// LogSinkJournald sends every entry to the systemd journal, the fields of
+	// the entry are stored as journal fields.
+	LogSinkJournald LogSink = "journald"
+)
+
+const (
+	// logIdentifier is the syslog tag and journal identifier of the driver
+	logIdentifier = "hcloud-csi-driver"
+
+	// journalSocket is the socket of the native journal protocol
+	journalSocket = "/run/systemd/journal/socket"
+)
+
+func (s LogSink) validate() error {
+	switch s {
+	case LogSinkNone, LogSinkSyslog, LogSinkJournald:
+		return nil
+	}
+	return fmt.Errorf("invalid log sink %q, must be one of: %s, %s", s, LogSinkSyslog, LogSinkJournald)
+}
+
+// newLogSinkHook returns a hook sending all entries to the given sink.
+func newLogSinkHook(sink LogSink) (logrus.Hook, error) {
+	switch sink {
+	case LogSinkSyslog:
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to syslog failed: %s", err)
+		}
+		return &syslogHook{
+			writer: w,
+			formatter: &logrus.TextFormatter{
+				DisableColors:    true,
+				DisableTimestamp: true,
+			},
+		}, nil
+	case LogSinkJournald:
+		conn, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the journal failed: %s", err)
+		}
+		return &journalHook{conn: conn}, nil
+	}
+	return nil, nil
+}
+
+// syslogHook writes entries as key=value lines to syslog. Syslog adds its
+// own timestamp, so the formatter must not add one.
+type syslogHook struct {
+	writer    *syslog.Writer
+	formatter logrus.Formatter
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(string(line), "\n")
+
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.writer.Crit(msg)
+	case logrus.ErrorLevel:
+		return h.writer.Err(msg)
+	case logrus.WarnLevel:
+		return h.writer.Warning(msg)
+	case logrus.InfoLevel:
+		return h.writer.Info(msg)
+	default:
+		return h.writer.Debug(msg)
+	}
+}
+
+// journalHook writes entries with the native journal protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journalHook struct {
+	conn net.Conn
+}
+
+func (h *journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journalHook) Fire(entry *logrus.Entry) error {
+	_, err := h.conn.Write(journalMessage(entry))
+	return err
+}
+
+// journalMessage encodes an entry as datagram of the native journal
+// protocol.
+func journalMessage(entry *logrus.Entry) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", entry.Message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(journalPriority(entry.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", logIdentifier)
+
+	for key, value := range entry.Data {
+		name := journalFieldName(key)
+		if name == "" {
+			continue
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJournalField(&buf, name, fmt.Sprint(value))
+	}
+	return buf.Bytes()
+}
+
+// writeJournalField appends a single field. Values containing a newline
+// are prefixed with their length instead of being terminated by one.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts a log field to a journal field name, which may
+// only contain upper case letters, digits and underscores and must not
+// start with an underscore or digit. Fields that can't be converted return
+// an empty name.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	// these are set for every entry and must not be overwritten
+	switch name {
+	case "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER":
+		return ""
+	}
+	return name
+}
+
+// journalPriority maps a level to the syslog priority used by the journal.
+func journalPriority(level logrus.Level) syslog.Priority {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return syslog.LOG_CRIT
+	case logrus.ErrorLevel:
+		return syslog.LOG_ERR
+	case logrus.WarnLevel:
+		return syslog.LOG_WARNING
+	case logrus.InfoLevel:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
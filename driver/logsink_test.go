@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "volume_id", want: "VOLUME_ID"},
+		{key: "node-id", want: "NODE_ID"},
+		{key: "_internal", want: "INTERNAL"},
+		{key: "1st", want: "ST"},
+		{key: "message", want: ""},
+		{key: "___", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := journalFieldName(tt.key); got != tt.want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestJournalMessage(t *testing.T) {
+	entry := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+		"volume_id": 1234,
+		"error":     errors.New("line one\nline two"),
+	})
+	entry.Message = "attaching volume failed"
+	entry.Level = logrus.ErrorLevel
+
+	msg := string(journalMessage(entry))
+
+	for _, want := range []string{
+		"MESSAGE=attaching volume failed\n",
+		"PRIORITY=3\n",
+		"SYSLOG_IDENTIFIER=hcloud-csi-driver\n",
+		"VOLUME_ID=1234\n",
+		"ERROR\n\x11\x00\x00\x00\x00\x00\x00\x00line one\nline two\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("journal message %q does not contain %q", msg, want)
+		}
+	}
+}
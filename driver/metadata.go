@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMetadataEndpoint is the Hetzner Cloud metadata service, which is
+	// reachable from every server.
+	defaultMetadataEndpoint = "http://169.254.169.254/hetzner/v1/metadata"
+
+	// metadataTimeout bounds every request to the metadata service, so a
+	// blocked service doesn't delay the startup for too long.
+	metadataTimeout = 5 * time.Second
+)
+
+// metadataClient queries the Hetzner Cloud metadata service for information
+// about the server the driver is running on.
+type metadataClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newMetadataClient returns a new metadata client for the given endpoint.
+func newMetadataClient(endpoint string) *metadataClient {
+	return &metadataClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client: &http.Client{
+			Timeout: metadataTimeout,
+		},
+	}
+}
+
+// InstanceID returns the ID of the server.
+func (m *metadataClient) InstanceID(ctx context.Context) (int, error) {
+	body, err := m.get(ctx, "/instance-id")
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.Atoi(body)
+	if err != nil {
+		return 0, fmt.Errorf("metadata service returned invalid instance id %q: %s", body, err)
+	}
+	return id, nil
+}
+
+// Location returns the name of the location the server is running in, e.g.
+// "fsn1".
+func (m *metadataClient) Location(ctx context.Context) (string, error) {
+	body, err := m.get(ctx, "/availability-zone")
+	if err != nil {
+		return "", err
+	}
+
+	// the availability zone is the datacenter name, e.g. "fsn1-dc14"
+	parts := strings.SplitN(body, "-", 2)
+	if parts[0] == "" {
+		return "", fmt.Errorf("metadata service returned invalid availability zone %q", body)
+	}
+	return parts[0], nil
+}
+
+func (m *metadataClient) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, m.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("querying metadata service failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading metadata response failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service returned status %d for %s: %q", resp.StatusCode, path, string(body))
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// discoverNode sets the node ID and location of the driver from the
+// metadata service. A node ID that was already configured takes precedence
+// over the one of the metadata service. If the metadata service can't be
+// reached the server is looked up with the hcloud API, by the configured
+// node ID or otherwise by its hostname.
+func (d *Driver) discoverNode(ctx context.Context, log *logrus.Entry) error {
+	if d.nodeID != "" {
+		if _, err := strconv.Atoi(d.nodeID); err != nil {
+			return fmt.Errorf("invalid node id %q, must be the ID of the hcloud server", d.nodeID)
+		}
+	}
+
+	md := newMetadataClient(d.metadataEndpoint)
+
+	location, err := md.Location(ctx)
+	if err == nil && d.nodeID == "" {
+		var id int
+		id, err = md.InstanceID(ctx)
+		if err == nil {
+			d.nodeID = strconv.Itoa(id)
+		}
+	}
+
+	if err == nil {
+		d.location = location
+		log.WithFields(logrus.Fields{
+			"node_id":  d.nodeID,
+			"location": d.location,
+		}).Info("discovered node from metadata service")
+		return nil
+	}
+
+	if !d.hasHCloud() {
+		return fmt.Errorf("could not query metadata service and no token is configured to look up the server: %s", err)
+	}
+
+	var server *hcloud.Server
+	if d.nodeID != "" {
+		log.WithError(err).Warn("could not query metadata service, looking up server by node id")
+
+		id, _ := strconv.Atoi(d.nodeID)
+		server, _, err = d.client(ctx).Server.GetByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("could not get hcloud server by node id: %s", err)
+		}
+
+		if server == nil {
+			return fmt.Errorf("could not find hcloud server with id %s", d.nodeID)
+		}
+	} else {
+		log.WithError(err).Warn("could not query metadata service, looking up server by hostname")
+
+		server, _, err = d.client(ctx).Server.GetByName(ctx, d.hostname)
+		if err != nil {
+			return fmt.Errorf("could not get hcloud server by hostname: %s", err)
+		}
+
+		if server == nil {
+			return fmt.Errorf("could not find hcloud server with name %q", d.hostname)
+		}
+		d.nodeID = strconv.Itoa(server.ID)
+	}
+
+	d.location = server.Datacenter.Location.Name
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMetadataClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instance-id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1234567\n"))
+	})
+	mux.HandleFunc("/availability-zone", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fsn1-dc14"))
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	md := newMetadataClient(ts.URL)
+
+	id, err := md.InstanceID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1234567 {
+		t.Errorf("instance id = %d, want 1234567", id)
+	}
+
+	location, err := md.Location(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != "fsn1" {
+		t.Errorf("location = %q, want fsn1", location)
+	}
+
+	if _, err := newMetadataClient(ts.URL + "/unknown").InstanceID(context.Background()); err == nil {
+		t.Error("expected an error for a failed request")
+	}
+}
+
+func TestDiscoverNodeByID(t *testing.T) {
+	// a blocked metadata service
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer md.Close()
+
+	api := httptest.NewServer(&fakeAPI{
+		t: t,
+		servers: map[int]*schema.Server{
+			1234567: {
+				ID:   1234567,
+				Name: "other-name",
+				Datacenter: schema.Datacenter{
+					Location: schema.Location{Name: "nbg1"},
+				},
+			},
+		},
+	})
+	defer api.Close()
+
+	d := &Driver{
+		nodeID:           "1234567",
+		hostname:         "node-1",
+		metadataEndpoint: md.URL,
+		hcloudClient:     hcloud.NewClient(hcloud.WithEndpoint(api.URL)),
+	}
+
+	if err := d.discoverNode(context.Background(), logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatal(err)
+	}
+	if d.location != "nbg1" {
+		t.Errorf("location = %q, want nbg1", d.location)
+	}
+
+	d.nodeID = "7654321"
+	if err := d.discoverNode(context.Background(), logrus.NewEntry(logrus.New())); err == nil {
+		t.Error("expected an error for an unknown server")
+	}
+
+	d.nodeID = "node-1"
+	if err := d.discoverNode(context.Background(), logrus.NewEntry(logrus.New())); err == nil {
+		t.Error("expected an error for an invalid node id")
+	}
+}
@@ -0,0 +1,470 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metricsNamespace prefixes all metrics of the driver.
+const metricsNamespace = "hcloud_csi"
+
+// attachBuckets covers the seconds attaching a volume usually takes up to
+// the action timeout.
+var attachBuckets = []float64{1, 2, 3, 5, 7.5, 10, 15, 20, 30, 45, 60, 90, 120}
+
+// apiPathIDRegexp matches the IDs in hcloud API paths, they are replaced to
+// keep the number of label values small.
+var apiPathIDRegexp = regexp.MustCompile(`/[0-9]+(/|$)`)
+
+// metrics holds the Prometheus metrics of the driver. Every driver has its
+// own registry, so multiple drivers in one process (e.g. in tests) don't
+// collide.
+type metrics struct {
+	registry *prometheus.Registry
+
+	volumeAbnormal *prometheus.GaugeVec
+	tokenFailovers prometheus.Counter
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	panics          *prometheus.CounterVec
+
+	apiRequests        *prometheus.CounterVec
+	apiRequestDuration *prometheus.HistogramVec
+
+	volumes        *prometheus.GaugeVec
+	volumeCapacity *prometheus.GaugeVec
+	volumeCost     *prometheus.GaugeVec
+	volumePrice    *prometheus.GaugeVec
+
+	operationDuration  *prometheus.HistogramVec
+	actionWaitDuration *prometheus.HistogramVec
+	actionFailures     *prometheus.CounterVec
+
+	leader            prometheus.Gauge
+	attachmentRepairs *prometheus.CounterVec
+
+	remounts *prometheus.CounterVec
+
+	volumeBytes  *prometheus.GaugeVec
+	volumeInodes *prometheus.GaugeVec
+}
+
+// newMetrics creates and registers all metrics of the driver.
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		volumeAbnormal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "volume_abnormal",
+			Help:      "Whether a staged volume is in an abnormal condition, labelled by the reason.",
+		}, []string{"volume_id", "reason"}),
+
+		tokenFailovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "token_failovers_total",
+			Help:      "Number of times the hcloud API rejected the token in use and the driver switched to the other token.",
+		}),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "requests_total",
+			Help:      "Number of CSI requests, labelled by the method and the gRPC status code.",
+		}, []string{"method", "code"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of CSI requests, labelled by the method.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"method"}),
+
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "rpc",
+			Name:      "panics_total",
+			Help:      "Number of panics recovered in CSI request handlers, labelled by the method.",
+		}, []string{"method"}),
+
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "requests_total",
+			Help:      "Number of requests to the hcloud API, labelled by the HTTP method, path and status code.",
+		}, []string{"method", "path", "code"}),
+
+		apiRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests to the hcloud API, labelled by the HTTP method and path.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "path"}),
+
+		volumes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "volumes",
+			Help:      "Number of volumes managed by the driver, labelled by the location and whether they are attached.",
+		}, []string{"location", "state"}),
+
+		volumeCapacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "volume_capacity_bytes",
+			Help:      "Total capacity of the volumes managed by the driver, labelled by the location and whether they are attached.",
+		}, []string{"location", "state"}),
+
+		volumeCost: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "volume_monthly_cost",
+			Help:      "Estimated monthly cost including VAT of the volumes managed by the driver, labelled by the location, StorageClass, namespace and currency.",
+		}, []string{"location", "storage_class", "namespace", "currency"}),
+
+		volumePrice: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "volume_price_per_gb_month",
+			Help:      "Current price including VAT of a GB of volume storage per month, labelled by the currency.",
+		}, []string{"currency"}),
+
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "operation_duration_seconds",
+			Help:      "End-to-end duration of attaching and detaching volumes, labelled by the operation and whether it succeeded.",
+			Buckets:   attachBuckets,
+		}, []string{"operation", "result"}),
+
+		actionWaitDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "action_wait_duration_seconds",
+			Help:      "Time spent waiting for hcloud actions to complete, labelled by the action command and whether it succeeded.",
+			Buckets:   attachBuckets,
+		}, []string{"command", "result"}),
+
+		actionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "action_failures_total",
+			Help:      "Number of hcloud actions that could not be started or failed, labelled by the action command and the hcloud error code.",
+		}, []string{"command", "code"}),
+
+		leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "leader",
+			Help:      "Whether the controller is the elected leader running the background loops.",
+		}),
+
+		attachmentRepairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "attachment_repairs_total",
+			Help:      "Number of volumes attached or detached by the reconciliation with the VolumeAttachments, labelled by the operation and whether it succeeded.",
+		}, []string{"operation", "result"}),
+
+		remounts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "volume_remounts_total",
+			Help:      "Number of staged volumes mounted again after their staging mount disappeared, labelled by whether it succeeded.",
+		}, []string{"result"}),
+
+		volumeBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "volume_filesystem_bytes",
+			Help:      "Capacity of the filesystems of the staged volumes, labelled by the volume and whether the bytes are used, available or the total.",
+		}, []string{"volume_id", "type"}),
+
+		volumeInodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "volume_filesystem_inodes",
+			Help:      "Inodes of the filesystems of the staged volumes, labelled by the volume and whether the inodes are used, available or the total.",
+		}, []string{"volume_id", "type"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		m.volumeAbnormal,
+		m.tokenFailovers,
+		m.requests,
+		m.requestDuration,
+		m.panics,
+		m.apiRequests,
+		m.apiRequestDuration,
+		m.volumes,
+		m.volumeCapacity,
+		m.volumeCost,
+		m.volumePrice,
+		m.operationDuration,
+		m.actionWaitDuration,
+		m.actionFailures,
+		m.leader,
+		m.attachmentRepairs,
+		m.remounts,
+		m.volumeBytes,
+		m.volumeInodes,
+	)
+
+	return m
+}
+
+// registerRateLimit exports the hcloud API budget, so alerts can fire
+// before it is exhausted.
+func (m *metrics) registerRateLimit(r *rateLimit) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "rate_limit_remaining",
+			Help:      "Remaining requests of the hcloud API rate limit, -1 if unknown.",
+		}, r.Remaining),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "rate_limit_limit",
+			Help:      "Requests per hour allowed by the hcloud API rate limit, -1 if unknown.",
+		}, r.Limit),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "rate_limit_reset_timestamp_seconds",
+			Help:      "Unix time the hcloud API rate limit is fully restored at, -1 if unknown.",
+		}, r.Reset),
+	)
+}
+
+// registerOperationLimiter exports the operations running on the workers
+// and waiting for one.
+func (m *metrics) registerOperationLimiter(l *operationLimiter) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "operations_running",
+			Help:      "Number of create, delete, attach and detach operations running.",
+		}, func() float64 {
+			running, _ := l.running()
+			return float64(running)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "controller",
+			Name:      "operations_queued",
+			Help:      "Number of create, delete, attach and detach operations waiting for a free worker.",
+		}, func() float64 {
+			_, queued := l.running()
+			return float64(queued)
+		}),
+	)
+}
+
+// unaryInterceptor records the count and duration of all CSI requests.
+func (m *metrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if m != nil {
+		m.requests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		m.requestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	}
+	return resp, err
+}
+
+// panicked counts a recovered panic in a handler.
+func (m *metrics) panicked(method string) {
+	if m == nil {
+		return
+	}
+	m.panics.WithLabelValues(method).Inc()
+}
+
+// observeOperation records the duration of attaching or detaching a volume.
+func (m *metrics) observeOperation(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.operationDuration.WithLabelValues(operation, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeActionWait records how long waiting for an action took.
+func (m *metrics) observeActionWait(command string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.actionWaitDuration.WithLabelValues(command, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// actionFailed counts a failed action by its hcloud error code.
+func (m *metrics) actionFailed(command, code string) {
+	if m == nil {
+		return
+	}
+	m.actionFailures.WithLabelValues(command, code).Inc()
+}
+
+// setLeader records whether the controller is the leader.
+func (m *metrics) setLeader(leader bool) {
+	if m == nil {
+		return
+	}
+	if leader {
+		m.leader.Set(1)
+	} else {
+		m.leader.Set(0)
+	}
+}
+
+// attachmentRepaired counts an attach or detach of the reconciliation.
+func (m *metrics) attachmentRepaired(operation string, err error) {
+	if m == nil {
+		return
+	}
+	m.attachmentRepairs.WithLabelValues(operation, result(err)).Inc()
+}
+
+// remounted counts a staged volume mounted again by the mount health check.
+func (m *metrics) remounted(err error) {
+	if m == nil {
+		return
+	}
+	m.remounts.WithLabelValues(result(err)).Inc()
+}
+
+// resetInventory removes the inventory metrics, e.g. if another replica
+// exports them.
+func (m *metrics) resetInventory() {
+	if m == nil {
+		return
+	}
+	m.volumes.Reset()
+	m.volumeCapacity.Reset()
+	m.volumeCost.Reset()
+}
+
+// errorCode returns the hcloud error code of an error, e.g. locked, or
+// unknown if the error didn't come from the hcloud API.
+func errorCode(err error) string {
+	if herr, ok := err.(hcloud.Error); ok && herr.Code != "" {
+		return string(herr.Code)
+	}
+	return "unknown"
+}
+
+// result returns the result label of an operation.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// handler returns the HTTP handler serving the metrics.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// serveMetrics serves the metrics, health and debug endpoints on the given
+// address until the driver is stopped.
+func (d *Driver) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics.handler())
+	mux.Handle("/debug/loglevel", d.logLevelHandler())
+	d.registerHealthHandlers(mux)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-d.stopCh
+		srv.Close()
+	}()
+
+	d.log.WithField("addr", addr).Info("serving metrics")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		d.log.WithError(err).Error("serving metrics failed")
+	}
+}
+
+// metricsTransport records the count and duration of all requests to the
+// hcloud API, including retries. The duration is added to the timing of the
+// CSI request as well.
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	timingFromContext(req.Context()).addAPICall(time.Since(start))
+	if t.metrics == nil {
+		return resp, err
+	}
+
+	path := apiPathIDRegexp.ReplaceAllString(req.URL.Path, "/{id}$1")
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.apiRequests.WithLabelValues(req.Method, path, code).Inc()
+	t.metrics.apiRequestDuration.WithLabelValues(req.Method, path).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// resetVolumeStatistics removes the statistics of all volumes, e.g. before
+// recording the ones of the volumes staged right now.
+func (m *metrics) resetVolumeStatistics() {
+	if m == nil {
+		return
+	}
+	m.volumeBytes.Reset()
+	m.volumeInodes.Reset()
+}
+
+// volumeStatistics records the capacity and inode usage of the filesystem
+// of a staged volume.
+func (m *metrics) volumeStatistics(volumeID string, stats VolumeStatistics) {
+	if m == nil {
+		return
+	}
+	m.volumeBytes.WithLabelValues(volumeID, "used").Set(float64(stats.UsedBytes))
+	m.volumeBytes.WithLabelValues(volumeID, "available").Set(float64(stats.AvailableBytes))
+	m.volumeBytes.WithLabelValues(volumeID, "total").Set(float64(stats.TotalBytes))
+	m.volumeInodes.WithLabelValues(volumeID, "used").Set(float64(stats.UsedInodes))
+	m.volumeInodes.WithLabelValues(volumeID, "available").Set(float64(stats.AvailableInodes))
+	m.volumeInodes.WithLabelValues(volumeID, "total").Set(float64(stats.TotalInodes))
+}
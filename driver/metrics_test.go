@@ -0,0 +1,196 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scrape returns the metrics in the text exposition format.
+func scrape(t *testing.T, m *metrics) string {
+	rec := httptest.NewRecorder()
+	m.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	m := newMetrics()
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/CreateVolume"}
+
+	m.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	m.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.OutOfRange, "too small")
+	})
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`hcloud_csi_rpc_requests_total{code="OK",method="/csi.v0.Controller/CreateVolume"} 1`,
+		`hcloud_csi_rpc_requests_total{code="OutOfRange",method="/csi.v0.Controller/CreateVolume"} 1`,
+		`hcloud_csi_rpc_request_duration_seconds_count{method="/csi.v0.Controller/CreateVolume"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q:\n%s", want, body)
+		}
+	}
+
+	// drivers without metrics, e.g. in tests, must still work
+	var nilMetrics *metrics
+	if _, err := nilMetrics.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	m := newMetrics()
+	client := &http.Client{
+		Transport: &metricsTransport{
+			next:    http.DefaultTransport,
+			metrics: m,
+		},
+	}
+
+	for _, path := range []string{"/volumes/1234/actions/attach", "/volumes/5678/actions/attach"} {
+		resp, err := client.Post(ts.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	body := scrape(t, m)
+	want := `hcloud_csi_api_requests_total{code="201",method="POST",path="/volumes/{id}/actions/attach"} 2`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected metrics to contain %q:\n%s", want, body)
+	}
+}
+
+func TestAttachMetrics(t *testing.T) {
+	ts := httptest.NewServer(&fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "volume"},
+		},
+		servers: map[int]*schema.Server{
+			2: {ID: 2},
+		},
+	})
+	defer ts.Close()
+
+	d := &Driver{
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		actionPollInterval: time.Millisecond,
+		metrics:            newMetrics(),
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "2",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	if _, err := d.ControllerPublishVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	req.NodeId = "3"
+	if _, err := d.ControllerPublishVolume(context.Background(), req); err == nil {
+		t.Fatal("expected an error for an unknown server")
+	}
+
+	body := scrape(t, d.metrics)
+	for _, want := range []string{
+		`hcloud_csi_controller_operation_duration_seconds_count{operation="attach",result="success"} 1`,
+		`hcloud_csi_controller_operation_duration_seconds_count{operation="attach",result="error"} 1`,
+		`hcloud_csi_api_action_wait_duration_seconds_count{command="unknown",result="success"} 1`,
+		`hcloud_csi_api_action_failures_total{code="not_found",command="attach_volume"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := errorCode(hcloud.Error{Code: errorCodeLocked}); code != "locked" {
+		t.Errorf("expected code locked, got %q", code)
+	}
+	if code := errorCode(context.DeadlineExceeded); code != "unknown" {
+		t.Errorf("expected code unknown, got %q", code)
+	}
+}
+
+func TestVolumeStatisticsMetrics(t *testing.T) {
+	m := newMetrics()
+	m.volumeStatistics("1234", VolumeStatistics{
+		AvailableBytes:  6 * GB,
+		TotalBytes:      10 * GB,
+		UsedBytes:       4 * GB,
+		AvailableInodes: 600,
+		TotalInodes:     1000,
+		UsedInodes:      400,
+	})
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`hcloud_csi_node_volume_filesystem_bytes{type="available",volume_id="1234"} 6.442450944e+09`,
+		`hcloud_csi_node_volume_filesystem_bytes{type="total",volume_id="1234"} 1.073741824e+10`,
+		`hcloud_csi_node_volume_filesystem_bytes{type="used",volume_id="1234"} 4.294967296e+09`,
+		`hcloud_csi_node_volume_filesystem_inodes{type="available",volume_id="1234"} 600`,
+		`hcloud_csi_node_volume_filesystem_inodes{type="total",volume_id="1234"} 1000`,
+		`hcloud_csi_node_volume_filesystem_inodes{type="used",volume_id="1234"} 400`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q:\n%s", want, body)
+		}
+	}
+
+	// unstaged volumes disappear
+	m.resetVolumeStatistics()
+	if body := scrape(t, m); strings.Contains(body, `volume_id="1234"`) {
+		t.Errorf("expected no statistics after a reset:\n%s", body)
+	}
+}
@@ -22,11 +22,37 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// devicePollInterval is the interval in which WaitForDevice checks if
+	// udev created the device path.
+	devicePollInterval = 200 * time.Millisecond
+)
+
+var (
+	// hostPath are the directories utilities are searched in when they are
+	// executed from the host root.
+	hostPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+	// maxLabelLength is the maximum length of a filesystem label for the
+	// filesystem types that support setting a label with `mkfs -L`.
+	maxLabelLength = map[string]int{
+		"ext2":  16,
+		"ext3":  16,
+		"ext4":  16,
+		"xfs":   12,
+		"btrfs": 255,
+	}
+)
+
 type findmntResponse struct {
 	FileSystems []fileSystem `json:"filesystems"`
 }
@@ -41,22 +67,99 @@ type fileSystem struct {
 // Mounter is responsible for formatting and mounting volumes
 type Mounter interface {
 	// Format formats the source with the given filesystem type
-	Format(source, fsType string) error
+	Format(source, fsType string, opts FormatOptions) error
 
 	// Mount mounts source to target with the given fstype and options.
 	Mount(source, target, fsType string, options ...string) error
 
+	// MountBlock bind mounts the source block device to the target file,
+	// which is created if it doesn't exist.
+	MountBlock(source, target string, options ...string) error
+
 	// Unmount unmounts the given target
 	Unmount(target string) error
 
-	// IsFormatted checks whether the source device is formatted or not. It
-	// returns true if the source device is already formatted.
-	IsFormatted(source string) (bool, error)
+	// ForceUnmount lazily unmounts the given target. It should only be used
+	// for mounts that can't be unmounted the usual way, i.e. stale mounts.
+	ForceUnmount(target string) error
+
+	// IsCorruptedMount checks whether the target path is a broken mount,
+	// i.e. the underlying device vanished or a previous unmount was
+	// interrupted.
+	IsCorruptedMount(target string) bool
+
+	// Check runs a filesystem check on the source device and repairs
+	// problems that can be fixed safely. If force is true the check is
+	// performed even if the filesystem is marked as clean. An error is
+	// returned if the filesystem has errors that could not be fixed.
+	Check(source, fsType string, force bool) error
+
+	// NeedsResize checks whether the filesystem on the source device is
+	// smaller than the device itself. It returns true if the filesystem
+	// should be grown to use the whole device.
+	NeedsResize(source, fsType string) (bool, error)
+
+	// Resize grows the unmounted filesystem on the source device to the size
+	// of the device.
+	Resize(source, fsType string) error
+
+	// SettleUdev waits until the udev event queue is empty, so devices of
+	// freshly attached volumes are fully set up.
+	SettleUdev(timeout time.Duration) error
+
+	// WaitForDevice waits until the given device path exists. It returns an
+	// error if the device did not appear within the timeout.
+	WaitForDevice(device string, timeout time.Duration) error
+
+	// GetFsType returns the type of the filesystem on the source device. It
+	// returns an empty string if the device is not formatted. An error is
+	// returned if the device contains something else than a filesystem,
+	// e.g. a partition table.
+	GetFsType(source string) (string, error)
 
 	// IsMounted checks whether the target path is a correct mount (i.e:
 	// propagated). It returns true if it's mounted. An error is returned in
 	// case of system errors or if it's mounted incorrectly.
 	IsMounted(target string) (bool, error)
+
+	// Trim discards unused blocks of the filesystem mounted at the target
+	// path.
+	Trim(target string) error
+
+	// GetStatistics returns capacity and inode usage of the filesystem
+	// mounted at the given path.
+	GetStatistics(volumePath string) (VolumeStatistics, error)
+
+	// IsMountedFrom checks whether the source is mounted to the target path
+	// with the given options. It returns false if nothing is mounted at the
+	// target. A *MountMismatchError is returned if the target is mounted
+	// from a different source or in a different read only mode.
+	IsMountedFrom(source, target string, options ...string) (bool, error)
+}
+
+// FormatOptions contains optional settings for formatting a volume.
+type FormatOptions struct {
+	// Label is the filesystem label. It is skipped if it is longer than
+	// the filesystem type supports, a truncated label could name another
+	// volume.
+	Label string
+
+	// ReservedBlocksPercent is the percentage of blocks reserved for the
+	// super-user. It is only supported for ext filesystems, nil keeps the
+	// default of mkfs.
+	ReservedBlocksPercent *float64
+}
+
+// VolumeStatistics contains the capacity and inode usage of a mounted
+// filesystem. All sizes are in bytes.
+type VolumeStatistics struct {
+	AvailableBytes int64
+	TotalBytes     int64
+	UsedBytes      int64
+
+	AvailableInodes int64
+	TotalInodes     int64
+	UsedInodes      int64
 }
 
 // TODO(arslan): this is Linux only for now. Refactor this into a package with
@@ -64,19 +167,55 @@ type Mounter interface {
 // mounter_linux.go, etc..
 type mounter struct {
 	log *logrus.Entry
+
+	// hostRoot is the path the root filesystem of the host is mounted at.
+	// If set, all utilities are executed from the host with chroot instead
+	// of the ones bundled with the driver.
+	hostRoot string
+
+	// syscalls mounts and unmounts with the syscalls instead of executing
+	// mount and umount, so the driver needs less privileges.
+	syscalls bool
 }
 
 // newMounter returns a new mounter instance
-func newMounter(log *logrus.Entry) *mounter {
+func newMounter(log *logrus.Entry, hostRoot string) *mounter {
 	return &mounter{
-		log: log,
+		log:      log,
+		hostRoot: hostRoot,
+	}
+}
+
+// lookPath searches for the executable of the given utility, in the host
+// root if one is configured.
+func (m *mounter) lookPath(file string) (string, error) {
+	if m.hostRoot == "" {
+		return exec.LookPath(file)
+	}
+
+	for _, dir := range hostPath {
+		path := filepath.Join(dir, file)
+		info, err := os.Stat(filepath.Join(m.hostRoot, path))
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
 	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
 }
 
-func (m *mounter) Format(source, fsType string) error {
+// command returns the command to execute the given utility, which is run in
+// the host root if one is configured.
+func (m *mounter) command(name string, args ...string) *exec.Cmd {
+	if m.hostRoot == "" {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("chroot", append([]string{m.hostRoot, name}, args...)...)
+}
+
+func (m *mounter) Format(source, fsType string, opts FormatOptions) error {
 	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
 
-	_, err := exec.LookPath(mkfsCmd)
+	_, err := m.lookPath(mkfsCmd)
 	if err != nil {
 		if err == exec.ErrNotFound {
 			return fmt.Errorf("%q executable not found in $PATH", mkfsCmd)
@@ -94,17 +233,40 @@ func (m *mounter) Format(source, fsType string) error {
 		return errors.New("source is not specified for formatting the volume")
 	}
 
-	mkfsArgs = append(mkfsArgs, source)
 	if fsType == "ext4" || fsType == "ext3" {
-		mkfsArgs = []string{"-F", source}
+		mkfsArgs = append(mkfsArgs, "-F")
+	}
+
+	if opts.ReservedBlocksPercent != nil {
+		switch fsType {
+		case "ext2", "ext3", "ext4":
+			mkfsArgs = append(mkfsArgs, "-m", strconv.FormatFloat(*opts.ReservedBlocksPercent, 'f', -1, 64))
+		default:
+			m.log.WithField("fsType", fsType).Warn("reserved blocks are not supported for this filesystem type, skipping")
+		}
+	}
+
+	if opts.Label != "" {
+		if maxLen, ok := maxLabelLength[fsType]; !ok {
+			m.log.WithField("fsType", fsType).Warn("filesystem labels are not supported for this filesystem type, skipping")
+		} else if len(opts.Label) > maxLen {
+			m.log.WithFields(logrus.Fields{
+				"fsType": fsType,
+				"label":  opts.Label,
+			}).Warn("filesystem label is too long for this filesystem type, skipping")
+		} else {
+			mkfsArgs = append(mkfsArgs, "-L", opts.Label)
+		}
 	}
 
+	mkfsArgs = append(mkfsArgs, source)
+
 	m.log.WithFields(logrus.Fields{
 		"cmd":  mkfsCmd,
 		"args": mkfsArgs,
 	}).Info("executing format command")
 
-	out, err := exec.Command(mkfsCmd, mkfsArgs...).CombinedOutput()
+	out, err := m.command(mkfsCmd, mkfsArgs...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
 			err, mkfsCmd, strings.Join(mkfsArgs, " "), string(out))
@@ -144,26 +306,117 @@ func (m *mounter) Mount(source, target, fsType string, opts ...string) error {
 		return err
 	}
 
+	if m.syscalls {
+		return m.mountSyscall(source, target, fsType, opts)
+	}
+
 	m.log.WithFields(logrus.Fields{
 		"cmd":  mountCmd,
 		"args": mountArgs,
 	}).Info("executing mount command")
 
-	out, err := exec.Command(mountCmd, mountArgs...).CombinedOutput()
+	out, err := m.command(mountCmd, mountArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mounting failed: %v cmd: '%s %s' output: %q",
+			err, mountCmd, strings.Join(mountArgs, " "), string(out))
+	}
+
+	// the kernel ignores the read only flag when creating a bind mount, it
+	// has to be applied with a separate remount
+	if hasOption(opts, "bind") && hasOption(opts, "ro") {
+		return m.remountReadOnly(target)
+	}
+
+	return nil
+}
+
+func (m *mounter) MountBlock(source, target string, opts ...string) error {
+	mountCmd := "mount"
+
+	if source == "" {
+		return errors.New("source is not specified for mounting the block device")
+	}
+
+	if target == "" {
+		return errors.New("target is not specified for mounting the block device")
+	}
+
+	opts = append([]string{"bind"}, opts...)
+	mountArgs := []string{"-o", strings.Join(opts, ","), source, target}
+
+	// the target of a block device bind mount has to be a file
+	err := os.MkdirAll(filepath.Dir(target), 0750)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE, 0660)
+	if err != nil {
+		return fmt.Errorf("creating target file %q failed: %s", target, err)
+	}
+	f.Close()
+
+	if m.syscalls {
+		return m.mountSyscall(source, target, "", opts)
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  mountCmd,
+		"args": mountArgs,
+	}).Info("executing block device mount command")
+
+	out, err := m.command(mountCmd, mountArgs...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("mounting failed: %v cmd: '%s %s' output: %q",
 			err, mountCmd, strings.Join(mountArgs, " "), string(out))
 	}
 
+	if hasOption(opts, "ro") {
+		return m.remountReadOnly(target)
+	}
+
 	return nil
 }
 
+// remountReadOnly makes the bind mount at target read only.
+func (m *mounter) remountReadOnly(target string) error {
+	mountCmd := "mount"
+	remountArgs := []string{"-o", "remount,bind,ro", target}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  mountCmd,
+		"args": remountArgs,
+	}).Info("executing read only remount command")
+
+	out, err := m.command(mountCmd, remountArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remounting read only failed: %v cmd: '%s %s' output: %q",
+			err, mountCmd, strings.Join(remountArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+// hasOption returns true if the option is part of the given mount options.
+func hasOption(opts []string, option string) bool {
+	for _, o := range opts {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *mounter) Unmount(target string) error {
 	umountCmd := "umount"
 	if target == "" {
 		return errors.New("target is not specified for unmounting the volume")
 	}
 
+	if m.syscalls {
+		return m.unmountSyscall(target, false)
+	}
+
 	umountArgs := []string{target}
 
 	m.log.WithFields(logrus.Fields{
@@ -171,7 +424,7 @@ func (m *mounter) Unmount(target string) error {
 		"args": umountArgs,
 	}).Info("executing umount command")
 
-	out, err := exec.Command(umountCmd, umountArgs...).CombinedOutput()
+	out, err := m.command(umountCmd, umountArgs...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("unmounting failed: %v cmd: '%s %s' output: %q",
 			err, umountCmd, target, string(out))
@@ -180,38 +433,362 @@ func (m *mounter) Unmount(target string) error {
 	return nil
 }
 
-func (m *mounter) IsFormatted(source string) (bool, error) {
+func (m *mounter) ForceUnmount(target string) error {
+	umountCmd := "umount"
+	if target == "" {
+		return errors.New("target is not specified for unmounting the volume")
+	}
+
+	if m.syscalls {
+		return m.unmountSyscall(target, true)
+	}
+
+	umountArgs := []string{"-f", "-l", target}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  umountCmd,
+		"args": umountArgs,
+	}).Info("executing forced umount command")
+
+	out, err := m.command(umountCmd, umountArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("forced unmounting failed: %v cmd: '%s %s' output: %q",
+			err, umountCmd, strings.Join(umountArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+func (m *mounter) IsCorruptedMount(target string) bool {
+	_, err := os.Stat(target)
+	if err == nil {
+		return false
+	}
+
+	pathErr, ok := err.(*os.PathError)
+	if !ok {
+		return false
+	}
+
+	switch pathErr.Err {
+	case syscall.ENOTCONN, syscall.ESTALE, syscall.EIO:
+		return true
+	}
+	return false
+}
+
+func (m *mounter) Check(source, fsType string, force bool) error {
 	if source == "" {
-		return false, errors.New("source is not specified")
+		return errors.New("source is not specified for checking the volume")
 	}
 
-	blkidCmd := "blkid"
-	_, err := exec.LookPath(blkidCmd)
+	var fsckCmd string
+	var fsckArgs []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		fsckCmd = "e2fsck"
+		fsckArgs = []string{"-p"}
+		if force {
+			fsckArgs = append(fsckArgs, "-f")
+		}
+	case "xfs":
+		// xfs_repair has no safe automatic repair mode, only report problems
+		fsckCmd = "xfs_repair"
+		fsckArgs = []string{"-n"}
+	default:
+		m.log.WithField("fsType", fsType).Warn("filesystem check is not supported for this filesystem type, skipping")
+		return nil
+	}
+	fsckArgs = append(fsckArgs, source)
+
+	_, err := m.lookPath(fsckCmd)
 	if err != nil {
 		if err == exec.ErrNotFound {
-			return false, fmt.Errorf("%q executable not found in $PATH", blkidCmd)
+			return fmt.Errorf("%q executable not found in $PATH", fsckCmd)
+		}
+		return err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  fsckCmd,
+		"args": fsckArgs,
+	}).Info("executing filesystem check command")
+
+	out, err := m.command(fsckCmd, fsckArgs...).CombinedOutput()
+	if err != nil {
+		// e2fsck exits with 1 if errors were corrected and with 2 if errors
+		// were corrected and the system should be rebooted. Both are fine for
+		// a device that is not mounted yet.
+		if exitErr, ok := err.(*exec.ExitError); ok && fsckCmd == "e2fsck" {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() < 4 {
+				m.log.WithField("output", string(out)).Warn("filesystem errors were corrected")
+				return nil
+			}
 		}
+
+		return fmt.Errorf("checking filesystem failed: %v cmd: '%s %s' output: %q",
+			err, fsckCmd, strings.Join(fsckArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+func (m *mounter) NeedsResize(source, fsType string) (bool, error) {
+	if source == "" {
+		return false, errors.New("source is not specified for checking the filesystem size")
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+	default:
+		m.log.WithField("fsType", fsType).Warn("offline resizing is not supported for this filesystem type, skipping")
+		return false, nil
+	}
+
+	for _, cmd := range []string{"blockdev", "dumpe2fs"} {
+		_, err := m.lookPath(cmd)
+		if err != nil {
+			if err == exec.ErrNotFound {
+				return false, fmt.Errorf("%q executable not found in $PATH", cmd)
+			}
+			return false, err
+		}
+	}
+
+	blockdevArgs := []string{"--getsize64", source}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  "blockdev",
+		"args": blockdevArgs,
+	}).Info("checking size of the source device")
+
+	out, err := m.command("blockdev", blockdevArgs...).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("checking device size failed: %v cmd: '%s %s' output: %q",
+			err, "blockdev", strings.Join(blockdevArgs, " "), string(out))
+	}
+
+	deviceSize, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse device size %q: %s", string(out), err)
+	}
+
+	dumpe2fsArgs := []string{"-h", source}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  "dumpe2fs",
+		"args": dumpe2fsArgs,
+	}).Info("checking size of the filesystem")
+
+	// dumpe2fs prints its version to stderr, only parse stdout
+	out, err = m.command("dumpe2fs", dumpe2fsArgs...).Output()
+	if err != nil {
+		return false, fmt.Errorf("checking filesystem size failed: %v cmd: '%s %s' output: %q",
+			err, "dumpe2fs", strings.Join(dumpe2fsArgs, " "), string(out))
+	}
+
+	fsSize, err := parseExtFilesystemSize(string(out))
+	if err != nil {
 		return false, err
 	}
 
-	blkidArgs := []string{source}
+	m.log.WithFields(logrus.Fields{
+		"device_size":     deviceSize,
+		"filesystem_size": fsSize,
+	}).Info("compared device and filesystem size")
+
+	return fsSize < deviceSize, nil
+}
+
+func (m *mounter) Resize(source, fsType string) error {
+	if source == "" {
+		return errors.New("source is not specified for resizing the volume")
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+	default:
+		return fmt.Errorf("offline resizing is not supported for filesystem type %q", fsType)
+	}
+
+	// resize2fs refuses to resize an unmounted filesystem that was not
+	// checked right before
+	if err := m.Check(source, fsType, true); err != nil {
+		return err
+	}
+
+	resizeCmd := "resize2fs"
+	_, err := m.lookPath(resizeCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return fmt.Errorf("%q executable not found in $PATH", resizeCmd)
+		}
+		return err
+	}
+
+	resizeArgs := []string{source}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  resizeCmd,
+		"args": resizeArgs,
+	}).Info("executing resize command")
+
+	out, err := m.command(resizeCmd, resizeArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resizing filesystem failed: %v cmd: '%s %s' output: %q",
+			err, resizeCmd, strings.Join(resizeArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+// parseExtFilesystemSize returns the size in bytes of an ext filesystem
+// from the superblock information printed by `dumpe2fs -h`.
+func parseExtFilesystemSize(out string) (int64, error) {
+	var blockCount, blockSize int64
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var dst *int64
+		switch strings.TrimSpace(parts[0]) {
+		case "Block count":
+			dst = &blockCount
+		case "Block size":
+			dst = &blockSize
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't parse %q: %s", line, err)
+		}
+		*dst = v
+	}
+
+	if blockCount == 0 || blockSize == 0 {
+		return 0, fmt.Errorf("block count or block size not found in output: %q", out)
+	}
+
+	return blockCount * blockSize, nil
+}
+
+func (m *mounter) SettleUdev(timeout time.Duration) error {
+	udevadmCmd := "udevadm"
+	_, err := m.lookPath(udevadmCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return fmt.Errorf("%q executable not found in $PATH", udevadmCmd)
+		}
+		return err
+	}
+
+	udevadmArgs := []string{"settle", fmt.Sprintf("--timeout=%d", int(timeout.Seconds()))}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  udevadmCmd,
+		"args": udevadmArgs,
+	}).Info("executing udevadm settle command")
+
+	out, err := m.command(udevadmCmd, udevadmArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("udevadm settle failed: %v cmd: '%s %s' output: %q",
+			err, udevadmCmd, strings.Join(udevadmArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+func (m *mounter) WaitForDevice(device string, timeout time.Duration) error {
+	if device == "" {
+		return errors.New("device is not specified for waiting")
+	}
+
+	ll := m.log.WithFields(logrus.Fields{
+		"device":  device,
+		"timeout": timeout,
+	})
+	ll.Info("waiting for device to appear")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(device)
+		if err == nil {
+			ll.Info("device is available")
+			return nil
+		}
+
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("checking device %q failed: %s", device, err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %q did not appear within %s", device, timeout)
+		}
+
+		time.Sleep(devicePollInterval)
+	}
+}
+
+func (m *mounter) GetFsType(source string) (string, error) {
+	if source == "" {
+		return "", errors.New("source is not specified")
+	}
+
+	blkidCmd := "blkid"
+	_, err := m.lookPath(blkidCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return "", fmt.Errorf("%q executable not found in $PATH", blkidCmd)
+		}
+		return "", err
+	}
+
+	// probe the device directly instead of relying on the blkid cache
+	blkidArgs := []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", source}
 
 	m.log.WithFields(logrus.Fields{
 		"cmd":  blkidCmd,
 		"args": blkidArgs,
-	}).Info("checking if source is formatted")
+	}).Info("checking filesystem of source")
 
-	out, err := exec.Command(blkidCmd, blkidArgs...).CombinedOutput()
+	out, err := m.command(blkidCmd, blkidArgs...).CombinedOutput()
 	if err != nil {
-		return false, fmt.Errorf("checking formatting failed: %v cmd: %q output: %q",
-			err, blkidCmd, string(out))
+		// blkid exits with 2 if no known signature was found on the device
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+				return "", nil
+			}
+		}
+
+		return "", fmt.Errorf("checking formatting failed: %v cmd: '%s %s' output: %q",
+			err, blkidCmd, strings.Join(blkidArgs, " "), string(out))
 	}
 
-	if strings.TrimSpace(string(out)) == "" {
-		return false, nil
+	var fsType, ptType string
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "TYPE":
+			fsType = parts[1]
+		case "PTTYPE":
+			ptType = parts[1]
+		}
 	}
 
-	return true, nil
+	// never treat a partitioned device as unformatted
+	if fsType == "" && ptType != "" {
+		return "", fmt.Errorf("source %q contains a %s partition table instead of a filesystem", source, ptType)
+	}
+
+	return fsType, nil
 }
 
 func (m *mounter) IsMounted(target string) (bool, error) {
@@ -220,7 +797,7 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 	}
 
 	findmntCmd := "findmnt"
-	_, err := exec.LookPath(findmntCmd)
+	_, err := m.lookPath(findmntCmd)
 	if err != nil {
 		if err == exec.ErrNotFound {
 			return false, fmt.Errorf("%q executable not found in $PATH", findmntCmd)
@@ -235,7 +812,7 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 		"args": findmntArgs,
 	}).Info("checking if target is mounted")
 
-	out, err := exec.Command(findmntCmd, findmntArgs...).CombinedOutput()
+	out, err := m.command(findmntCmd, findmntArgs...).CombinedOutput()
 	if err != nil {
 		// findmnt exits with non zero exit status if it couldn't find anything
 		if strings.TrimSpace(string(out)) == "" {
@@ -272,3 +849,113 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 
 	return targetFound, nil
 }
+
+func (m *mounter) IsMountedFrom(source, target string, options ...string) (bool, error) {
+	if source == "" {
+		return false, errors.New("source is not specified for checking the mount")
+	}
+
+	if target == "" {
+		return false, errors.New("target is not specified for checking the mount")
+	}
+
+	source = filepath.Clean(source)
+	target = filepath.Clean(target)
+
+	m.log.WithFields(logrus.Fields{
+		"source": source,
+		"target": target,
+	}).Info("checking if source is mounted to target")
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, fmt.Errorf("reading mountinfo failed: %s", err)
+	}
+
+	mnt := findMountInfo(mounts, target)
+	if mnt == nil {
+		return false, nil
+	}
+
+	// the source is either a mount point we bind mount from (publishing) or
+	// the block device of the volume (staging)
+	var major, minor uint32
+	var root string
+	if srcMnt := findMountInfo(mounts, source); srcMnt != nil {
+		major, minor, root = srcMnt.Major, srcMnt.Minor, srcMnt.Root
+	} else {
+		major, minor, err = deviceNumbers(source)
+		if err != nil {
+			return true, fmt.Errorf("checking source %q failed: %s", source, err)
+		}
+	}
+
+	if mnt.Major != major || mnt.Minor != minor || (root != "" && mnt.Root != root) {
+		return true, &MountMismatchError{
+			Target: target,
+			Reason: fmt.Sprintf("mounted from device %d:%d (%s), expected %d:%d (%s)",
+				mnt.Major, mnt.Minor, mnt.Source, major, minor, source),
+		}
+	}
+
+	if hasOption(mnt.Options, "ro") != hasOption(options, "ro") {
+		return true, &MountMismatchError{
+			Target: target,
+			Reason: fmt.Sprintf("mounted with options %q, requested %q",
+				strings.Join(mnt.Options, ","), strings.Join(options, ",")),
+		}
+	}
+
+	return true, nil
+}
+
+func (m *mounter) Trim(target string) error {
+	if target == "" {
+		return errors.New("target is not specified for trimming the volume")
+	}
+
+	fstrimCmd := "fstrim"
+	_, err := m.lookPath(fstrimCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return fmt.Errorf("%q executable not found in $PATH", fstrimCmd)
+		}
+		return err
+	}
+
+	fstrimArgs := []string{target}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  fstrimCmd,
+		"args": fstrimArgs,
+	}).Info("executing fstrim command")
+
+	out, err := m.command(fstrimCmd, fstrimArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("trimming failed: %v cmd: '%s %s' output: %q",
+			err, fstrimCmd, strings.Join(fstrimArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+func (m *mounter) GetStatistics(volumePath string) (VolumeStatistics, error) {
+	if volumePath == "" {
+		return VolumeStatistics{}, errors.New("volume path is not specified for getting statistics")
+	}
+
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &statfs); err != nil {
+		return VolumeStatistics{}, fmt.Errorf("statfs on %q failed: %s", volumePath, err)
+	}
+
+	return VolumeStatistics{
+		AvailableBytes: int64(statfs.Bavail) * int64(statfs.Bsize),
+		TotalBytes:     int64(statfs.Blocks) * int64(statfs.Bsize),
+		UsedBytes:      (int64(statfs.Blocks) - int64(statfs.Bfree)) * int64(statfs.Bsize),
+
+		AvailableInodes: int64(statfs.Ffree),
+		TotalInodes:     int64(statfs.Files),
+		UsedInodes:      int64(statfs.Files) - int64(statfs.Ffree),
+	}, nil
+}
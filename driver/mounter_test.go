@@ -0,0 +1,266 @@
+/*
+Copyright 2018 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseExtFilesystemSize(t *testing.T) {
+	out := `Filesystem volume name:   <none>
+Filesystem UUID:          0b8b1c9c-0d3b-4c0e-9e0b-1f5e2c7b1a2d
+Inode count:              655360
+Block count:              2621440
+Reserved block count:     131072
+Free blocks:              2554687
+Block size:               4096
+Fragment size:            4096
+`
+
+	size, err := parseExtFilesystemSize(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := int64(10 * GB); size != want {
+		t.Errorf("size = %d, want %d", size, want)
+	}
+
+	if _, err := parseExtFilesystemSize("Filesystem volume name:   <none>\n"); err == nil {
+		t.Error("expected an error for output without block information")
+	}
+}
+
+func TestGetStatistics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newMounter(logrus.New().WithField("test_enabled", true), "")
+	stats, err := m.GetStatistics(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.TotalBytes <= 0 || stats.UsedBytes+stats.AvailableBytes > stats.TotalBytes {
+		t.Errorf("invalid byte statistics: %+v", stats)
+	}
+
+	if stats.UsedInodes+stats.AvailableInodes != stats.TotalInodes {
+		t.Errorf("invalid inode statistics: %+v", stats)
+	}
+}
+
+func TestMounterHostRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sbin", "mkfs.ext4"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMounter(logrus.New().WithField("test_enabled", true), root)
+
+	path, err := m.lookPath("mkfs.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/sbin/mkfs.ext4" {
+		t.Errorf("path = %q, want /sbin/mkfs.ext4", path)
+	}
+
+	if _, err := m.lookPath("mkfs.xfs"); err == nil {
+		t.Error("expected an error for a utility missing on the host")
+	}
+
+	cmd := m.command("mkfs.ext4", "/dev/sdb")
+	if want := []string{"chroot", root, "mkfs.ext4", "/dev/sdb"}; strings.Join(cmd.Args, " ") != strings.Join(want, " ") {
+		t.Errorf("args = %v, want %v", cmd.Args, want)
+	}
+}
+
+// fakeUtilities puts scripts with the names of the given utilities first in
+// PATH, they record their invocations in the returned log file. restore
+// resets PATH.
+func fakeUtilities(t *testing.T, dir string, names ...string) (log string, restore func()) {
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	log = filepath.Join(dir, "utilities.log")
+	for _, name := range names {
+		script := "#!/bin/sh\necho \"$(basename \"$0\") $*\" >> " + log + "\n"
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return log, func() { os.Setenv("PATH", path) }
+}
+
+// invocations returns the recorded invocations of the fake utilities.
+func invocations(t *testing.T, log string) []string {
+	data, err := ioutil.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestHasOption(t *testing.T) {
+	tests := []struct {
+		opts   []string
+		option string
+		want   bool
+	}{
+		{nil, "ro", false},
+		{[]string{"bind"}, "ro", false},
+		{[]string{"bind", "ro"}, "ro", true},
+		{[]string{"rw"}, "ro", false},
+		{[]string{"ro=1"}, "ro", false},
+	}
+
+	for _, tt := range tests {
+		if got := hasOption(tt.opts, tt.option); got != tt.want {
+			t.Errorf("hasOption(%v, %q) = %t, want %t", tt.opts, tt.option, got, tt.want)
+		}
+	}
+}
+
+func TestMountReadOnlyRemount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, restore := fakeUtilities(t, dir, "mount")
+	defer restore()
+
+	target := filepath.Join(dir, "target")
+	device := filepath.Join(dir, "device")
+
+	tests := []struct {
+		name  string
+		mount func(m *mounter) error
+		want  []string
+	}{
+		{
+			name:  "filesystem",
+			mount: func(m *mounter) error { return m.Mount("/dev/sdb", target, "ext4", "ro") },
+			want:  []string{"mount -t ext4 -o ro /dev/sdb " + target},
+		},
+		{
+			name:  "bind",
+			mount: func(m *mounter) error { return m.Mount("/stage", target, "ext4", "bind") },
+			want:  []string{"mount -t ext4 -o bind /stage " + target},
+		},
+		{
+			name:  "read only bind",
+			mount: func(m *mounter) error { return m.Mount("/stage", target, "ext4", "bind", "ro") },
+			want: []string{
+				"mount -t ext4 -o bind,ro /stage " + target,
+				"mount -o remount,bind,ro " + target,
+			},
+		},
+		{
+			name:  "block",
+			mount: func(m *mounter) error { return m.MountBlock("/dev/sdb", device) },
+			want:  []string{"mount -o bind /dev/sdb " + device},
+		},
+		{
+			name:  "read only block",
+			mount: func(m *mounter) error { return m.MountBlock("/dev/sdb", device, "ro") },
+			want: []string{
+				"mount -o bind,ro /dev/sdb " + device,
+				"mount -o remount,bind,ro " + device,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		os.Remove(log)
+
+		m := newMounter(logrus.New().WithField("test_enabled", true), "")
+		if err := tt.mount(m); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if got := invocations(t, log); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatArguments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, restore := fakeUtilities(t, dir, "mkfs.ext4", "mkfs.xfs")
+	defer restore()
+
+	reserved := 1.5
+	tests := []struct {
+		name   string
+		fsType string
+		opts   FormatOptions
+		want   string
+	}{
+		{"ext4", "ext4", FormatOptions{}, "mkfs.ext4 -F /dev/sdb"},
+		{"ext4 label", "ext4", FormatOptions{Label: volumeLabel(101234567)}, "mkfs.ext4 -F -L vol-101234567 /dev/sdb"},
+		{"ext4 reserved blocks", "ext4", FormatOptions{ReservedBlocksPercent: &reserved}, "mkfs.ext4 -F -m 1.5 /dev/sdb"},
+		{"xfs label", "xfs", FormatOptions{Label: volumeLabel(1234567)}, "mkfs.xfs -L vol-1234567 /dev/sdb"},
+		{"xfs label too long", "xfs", FormatOptions{Label: volumeLabel(101234567)}, "mkfs.xfs /dev/sdb"},
+		{"xfs reserved blocks", "xfs", FormatOptions{ReservedBlocksPercent: &reserved}, "mkfs.xfs /dev/sdb"},
+	}
+
+	for _, tt := range tests {
+		os.Remove(log)
+
+		m := newMounter(logrus.New().WithField("test_enabled", true), "")
+		if err := m.Format("/dev/sdb", tt.fsType, tt.opts); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if got := invocations(t, log); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
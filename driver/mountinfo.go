@@ -0,0 +1,247 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// mountInfoPath lists all mounts visible to the driver
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// mountInfo is a single entry of /proc/self/mountinfo. See proc(5) for a
+// description of the fields.
+type mountInfo struct {
+	MountID    int
+	ParentID   int
+	Major      uint32
+	Minor      uint32
+	Root       string
+	MountPoint string
+	Options    []string
+	FsType     string
+	Source     string
+
+	// SuperOptions are the options of the filesystem itself. A filesystem
+	// remounted read-only after an error only shows up here.
+	SuperOptions []string
+
+	// Shared is set if the mount propagates mounts to its peer group,
+	// e.g. from the container to the host.
+	Shared bool
+}
+
+// MountMismatchError is returned by Mounter.IsMountedFrom if the target is
+// already mounted, but from a different source or with different options.
+type MountMismatchError struct {
+	Target string
+	Reason string
+}
+
+func (e *MountMismatchError) Error() string {
+	return fmt.Sprintf("target %q is already mounted: %s", e.Target, e.Reason)
+}
+
+// readMountInfo reads and parses the mountinfo file of the driver process.
+func readMountInfo() ([]mountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses the content of a mountinfo file.
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(line)
+
+		// the optional fields are terminated by a single hyphen
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || len(fields) < sep+4 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+
+		mountID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mount id in mountinfo line %q: %s", line, err)
+		}
+
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed parent id in mountinfo line %q: %s", line, err)
+		}
+
+		devParts := strings.SplitN(fields[2], ":", 2)
+		if len(devParts) != 2 {
+			return nil, fmt.Errorf("malformed device in mountinfo line: %q", line)
+		}
+
+		major, err := strconv.ParseUint(devParts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed major device number in mountinfo line %q: %s", line, err)
+		}
+
+		minor, err := strconv.ParseUint(devParts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed minor device number in mountinfo line %q: %s", line, err)
+		}
+
+		shared := false
+		for _, opt := range fields[6:sep] {
+			if strings.HasPrefix(opt, "shared:") {
+				shared = true
+			}
+		}
+
+		mounts = append(mounts, mountInfo{
+			MountID:    mountID,
+			ParentID:   parentID,
+			Major:      uint32(major),
+			Minor:      uint32(minor),
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    strings.Split(fields[5], ","),
+			FsType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+
+			SuperOptions: strings.Split(fields[sep+3], ","),
+			Shared:       shared,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// findMountInfo returns the topmost mount at the given mount point or nil
+// if nothing is mounted there.
+func findMountInfo(mounts []mountInfo, mountPoint string) *mountInfo {
+	var found *mountInfo
+	for i := range mounts {
+		// later entries are mounted on top of earlier ones
+		if mounts[i].MountPoint == mountPoint {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
+
+// volumeMounts returns a writable mount point of every Hetzner Cloud Volume
+// that is mounted on this node, keyed by the volume ID.
+func volumeMounts() (map[int]string, error) {
+	links, err := filepath.Glob(diskIDPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := map[int]string{}
+	for _, link := range links {
+		// skips partitions, e.g. scsi-0HC_Volume_1234-part1
+		id, err := strconv.Atoi(strings.TrimPrefix(link, diskIDPrefix))
+		if err != nil {
+			continue
+		}
+
+		major, minor, err := deviceNumbers(link)
+		if err != nil {
+			continue
+		}
+
+		for _, mnt := range mounts {
+			if mnt.Major == major && mnt.Minor == minor && mnt.Root == "/" && !hasOption(mnt.Options, "ro") {
+				volumes[id] = mnt.MountPoint
+				break
+			}
+		}
+	}
+
+	return volumes, nil
+}
+
+// unescapeMountInfo replaces the octal escape sequences the kernel uses for
+// space, tab, newline and backslash in mountinfo paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// deviceNumbers returns the major and minor number of the given device
+// file.
+func deviceNumbers(device string) (uint32, uint32, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return 0, 0, err
+	}
+
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return 0, 0, fmt.Errorf("%q is not a block device", device)
+	}
+
+	dev := uint64(st.Rdev)
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor, nil
+}
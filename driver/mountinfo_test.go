@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	in := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+120 22 8:16 / /var/lib/kubelet/plugins/stage rw,relatime shared:60 - ext4 /dev/sdb rw,data=ordered
+130 22 8:16 / /var/lib/kubelet/pods/my\040pod/mount ro,relatime shared:60 master:2 - ext4 /dev/sdb rw,data=ordered
+140 22 8:32 / /var/lib/kubelet/plugins/stage-2 rw,relatime shared:70 - ext4 /dev/sdc ro,errors=remount-ro
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mounts) != 4 {
+		t.Fatalf("got %d mounts, want 4", len(mounts))
+	}
+
+	mnt := findMountInfo(mounts, "/var/lib/kubelet/pods/my pod/mount")
+	if mnt == nil {
+		t.Fatal("mount with escaped path not found")
+	}
+
+	if mnt.Major != 8 || mnt.Minor != 16 {
+		t.Errorf("device = %d:%d, want 8:16", mnt.Major, mnt.Minor)
+	}
+
+	if mnt.FsType != "ext4" || mnt.Source != "/dev/sdb" {
+		t.Errorf("fstype/source = %s/%s, want ext4//dev/sdb", mnt.FsType, mnt.Source)
+	}
+
+	if !hasOption(mnt.Options, "ro") {
+		t.Errorf("options %v should contain ro", mnt.Options)
+	}
+
+	mnt = findMountInfo(mounts, "/var/lib/kubelet/plugins/stage-2")
+	if mnt == nil {
+		t.Fatal("mount of remounted filesystem not found")
+	}
+
+	if hasOption(mnt.Options, "ro") || !hasOption(mnt.SuperOptions, "ro") {
+		t.Errorf("options %v / super options %v, want only the filesystem to be read-only", mnt.Options, mnt.SuperOptions)
+	}
+
+	if findMountInfo(mounts, "/var/lib/kubelet") != nil {
+		t.Error("found mount for path that is not a mount point")
+	}
+
+	if _, err := parseMountInfo(strings.NewReader("22 1 8:1 / / rw\n")); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mountFlags are the mount options the kernel takes as flags, all other
+// options are passed to the filesystem.
+var mountFlags = map[string]uintptr{
+	"ro":          syscall.MS_RDONLY,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"remount":     syscall.MS_REMOUNT,
+	"mand":        syscall.MS_MANDLOCK,
+	"dirsync":     syscall.MS_DIRSYNC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"bind":        syscall.MS_BIND,
+	"rbind":       syscall.MS_BIND | syscall.MS_REC,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// defaultMountOptions are the defaults mount(8) accepts, they set no flag.
+var defaultMountOptions = map[string]bool{
+	"rw":       true,
+	"defaults": true,
+	"async":    true,
+	"suid":     true,
+	"dev":      true,
+	"exec":     true,
+	"atime":    true,
+	"diratime": true,
+	"nomand":   true,
+}
+
+// parseMountOptions splits mount options into the flags of mount(2) and
+// the data passed to the filesystem.
+func parseMountOptions(opts []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, opt := range opts {
+		if flag, ok := mountFlags[opt]; ok {
+			flags |= flag
+			continue
+		}
+		if defaultMountOptions[opt] || opt == "" {
+			continue
+		}
+		data = append(data, opt)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// mountSyscall mounts with mount(2) instead of executing mount(8), which
+// only needs CAP_SYS_ADMIN and neither the utilities of the host nor
+// chroot. The read only flag of a bind mount is applied with a remount,
+// the kernel ignores it when creating the bind mount.
+func (m *mounter) mountSyscall(source, target, fsType string, opts []string) error {
+	flags, data := parseMountOptions(opts)
+
+	m.log.WithFields(logrus.Fields{
+		"source": source,
+		"target": target,
+		"fsType": fsType,
+		"flags":  fmt.Sprintf("%#x", flags),
+		"data":   data,
+	}).Info("mounting with mount syscall")
+
+	if err := syscall.Mount(source, target, fsType, flags, data); err != nil {
+		return fmt.Errorf("mounting %q to %q failed: %s", source, target, err)
+	}
+
+	if flags&syscall.MS_BIND != 0 && flags&syscall.MS_RDONLY != 0 {
+		if err := syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("remounting %q read only failed: %s", target, err)
+		}
+	}
+	return nil
+}
+
+// unmountSyscall unmounts with umount2(2), lazily if force is set.
+func (m *mounter) unmountSyscall(target string, force bool) error {
+	var flags int
+	if force {
+		flags = syscall.MNT_FORCE | syscall.MNT_DETACH
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"target": target,
+		"force":  force,
+	}).Info("unmounting with umount syscall")
+
+	if err := syscall.Unmount(target, flags); err != nil {
+		return fmt.Errorf("unmounting %q failed: %s", target, err)
+	}
+	return nil
+}
@@ -26,8 +26,11 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/sirupsen/logrus"
@@ -43,8 +46,62 @@ const (
 	// not formatted. Useful for cases if the user wants to reuse an existing
 	// volume.
 	annNoFormatVolume = "de.apricote.hcloud.csi/noformat"
+
+	// diskIDPrefix is the prefix of the udev created symlinks for Hetzner
+	// Cloud Volumes. The volume ID is appended to get the full path.
+	diskIDPrefix = "/dev/disk/by-id/scsi-0HC_Volume_"
+
+	// defaultDeviceWaitTimeout is the default time NodeStageVolume waits
+	// for the device of an attached volume to appear.
+	defaultDeviceWaitTimeout = 30 * time.Second
 )
 
+// FsckMode defines if and how existing filesystems are checked before they
+// are mounted to the staging path.
+type FsckMode string
+
+const (
+	// FsckModeOff disables filesystem checks.
+	FsckModeOff FsckMode = "off"
+
+	// FsckModePreen checks filesystems that are not marked as clean (i.e.
+	// the volume was detached uncleanly) and repairs safe problems.
+	FsckModePreen FsckMode = "preen"
+
+	// FsckModeForce checks every filesystem, even if it is marked as clean.
+	FsckModeForce FsckMode = "force"
+)
+
+// FormatPolicy defines whether volumes that already contain a filesystem
+// may be formatted in NodeStageVolume.
+type FormatPolicy string
+
+const (
+	// FormatPolicySafe only formats volumes without a filesystem. Staging a
+	// volume with a filesystem of a different type than requested fails.
+	FormatPolicySafe FormatPolicy = "safe"
+
+	// FormatPolicyReformatMismatch reformats volumes whose filesystem type
+	// doesn't match the requested one. All data on the volume is lost.
+	FormatPolicyReformatMismatch FormatPolicy = "reformat-mismatch"
+)
+
+func (p FormatPolicy) validate() error {
+	switch p {
+	case FormatPolicySafe, FormatPolicyReformatMismatch:
+		return nil
+	}
+	return fmt.Errorf("invalid format policy %q, must be one of: %s, %s", p, FormatPolicySafe, FormatPolicyReformatMismatch)
+}
+
+func (m FsckMode) validate() error {
+	switch m {
+	case FsckModeOff, FsckModePreen, FsckModeForce:
+		return nil
+	}
+	return fmt.Errorf("invalid fsck mode %q, must be one of: %s, %s, %s", m, FsckModeOff, FsckModePreen, FsckModeForce)
+}
+
 // NodeStageVolume mounts the volume to a staging path on the node. This is
 // called by the CO before NodePublishVolume and is used to temporary mount the
 // volume to a staging path. Once mounted, NodePublishVolume will make sure to
@@ -63,56 +120,157 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
+	if !d.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %q is already in progress", req.VolumeId)
+	}
+	defer d.volumeLocks.Release(req.VolumeId)
+
 	var volumeID int
 	volumeID, err := strconv.Atoi(req.VolumeId)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume Volume ID can not be converted to integer")
 	}
 
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
-	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
+	// without privileged mode the kubelet directory has to be mounted with
+	// bidirectional propagation, otherwise the pods would see empty volumes
+	if d.reducedPrivileges {
+		if err := checkSharedMount(req.StagingTargetPath); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	// without a token the node service only works with the local device
+	var volumeName string
+	if d.hasHCloud() {
+		// volumes created with the token of the secrets live in its project
+		ctx, err := d.withSecrets(ctx, req.NodeStageSecrets)
+		if err != nil {
+			return nil, err
+		}
+		ctx, err = d.withVolumeProject(ctx, volumeID, req.VolumeAttributes)
+		if err != nil {
+			return nil, err
+		}
+
+		vol, resp, err := d.client(ctx).Volume.GetByID(ctx, volumeID)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+			}
+			// TODO: replace with actual error handling
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+			// return nil, err
+		}
+
+		if vol == nil {
 			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
 		}
-		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
-		// return nil, err
+		volumeName = vol.Name
 	}
 
-	source := vol.LinuxDevice
+	source := devicePath(volumeID)
 	target := req.StagingTargetPath
 
 	mnt := req.VolumeCapability.GetMount()
-	options := mnt.MountFlags
+	options := mnt.GetMountFlags()
 
 	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
+	if mnt.GetFsType() != "" {
+		fsType = mnt.GetFsType()
 	}
 
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
-		"volume_name":         vol.Name,
+		"volume_name":         volumeName,
 		"volume_attributes":   req.VolumeAttributes,
 		"staging_target_path": req.StagingTargetPath,
 		"source":              source,
 		"fsType":              fsType,
 		"mount_options":       options,
 		"method":              "node_stage_volume",
-	})
+	}).WithFields(attributeClaimFields(req.VolumeAttributes))
+
+	// udev might not have created the device link yet if the volume was
+	// attached just now
+	if d.udevSettle {
+		if err := d.mounter.SettleUdev(d.deviceWaitTimeout); err != nil {
+			// not fatal, we wait for the device below anyway
+			ll.WithError(err).Warn("waiting for udev to settle failed")
+		}
+	}
+
+	if err := d.mounter.WaitForDevice(source, d.deviceWaitTimeout); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// raw block volumes are neither formatted nor mounted, NodePublishVolume
+	// bind mounts the device directly
+	if req.VolumeCapability.GetBlock() != nil {
+		err := d.saveStagingState(&stagingState{
+			VolumeID:          req.VolumeId,
+			StagingTargetPath: target,
+			Device:            source,
+			Block:             true,
+			PVCName:           req.VolumeAttributes[paramPVCName],
+			PVCNamespace:      req.VolumeAttributes[paramPVCNamespace],
+		})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		ll.Info("block volume is available for publishing")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// freshly formatted volumes don't need to be checked
+	formattedNow := false
 
 	_, ok := req.VolumeAttributes[annNoFormatVolume]
 	if !ok {
-		formatted, err := d.mounter.IsFormatted(source)
+		existingFsType, err := d.mounter.GetFsType(source)
 		if err != nil {
-			return nil, err
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 
-		if !formatted {
+		formatOnStage, err := d.formatOnStage(req.VolumeAttributes)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if !formatOnStage && existingFsType == "" {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume %q is not formatted and formatting on stage is disabled", req.VolumeId)
+		}
+
+		format := existingFsType == ""
+		if existingFsType != "" && existingFsType != fsType {
+			if !formatOnStage || d.formatPolicy != FormatPolicyReformatMismatch {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"volume %q already contains a %s filesystem, but %s was requested", req.VolumeId, existingFsType, fsType)
+			}
+
+			ll.WithField("existing_fsType", existingFsType).Warn("reformatting the volume because the filesystem type does not match")
+			format = true
+		}
+
+		if format {
 			ll.Info("formatting the volume for staging")
-			if err := d.mounter.Format(source, fsType); err != nil {
+			formatOpts := FormatOptions{
+				Label: volumeLabel(volumeID),
+			}
+
+			if v, ok := req.VolumeAttributes[paramReservedBlocksPercent]; ok {
+				percent, err := parseReservedBlocksPercent(v)
+				if err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				formatOpts.ReservedBlocksPercent = &percent
+			}
+
+			if err := d.mounter.Format(source, fsType, formatOpts); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
+			formattedNow = true
 		} else {
 			ll.Info("source device is already formatted")
 		}
@@ -123,12 +281,37 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 
 	ll.Info("mounting the volume for staging")
 
-	mounted, err := d.mounter.IsMounted(target)
+	mounted, err := d.mounter.IsMountedFrom(source, target, options...)
 	if err != nil {
+		if _, ok := err.(*MountMismatchError); ok {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
 		return nil, err
 	}
 
 	if !mounted {
+		if !formattedNow && d.fsckMode != "" && d.fsckMode != FsckModeOff {
+			ll.WithField("fsck_mode", d.fsckMode).Info("checking the filesystem before mounting")
+			if err := d.mounter.Check(source, fsType, d.fsckMode == FsckModeForce); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		if !formattedNow {
+			// the volume might have been resized while it was detached
+			needsResize, err := d.mounter.NeedsResize(source, fsType)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			if needsResize {
+				ll.Info("growing the filesystem to the size of the volume")
+				if err := d.mounter.Resize(source, fsType); err != nil {
+					return nil, status.Error(codes.Internal, err.Error())
+				}
+			}
+		}
+
 		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -136,6 +319,19 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		ll.Info("source device is already mounted to the target path")
 	}
 
+	err = d.saveStagingState(&stagingState{
+		VolumeID:          req.VolumeId,
+		StagingTargetPath: target,
+		Device:            source,
+		FsType:            fsType,
+		MountOptions:      options,
+		PVCName:           req.VolumeAttributes[paramPVCName],
+		PVCNamespace:      req.VolumeAttributes[paramPVCNamespace],
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	ll.Info("formatting and mounting stage volume is finished")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -150,6 +346,17 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging Target Path must be provided")
 	}
 
+	// the ID names the staging record, so it must not point outside of
+	// the data directory
+	if _, err := strconv.Atoi(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeUnstageVolume Volume ID can not be converted to integer")
+	}
+
+	if !d.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %q is already in progress", req.VolumeId)
+	}
+	defer d.volumeLocks.Release(req.VolumeId)
+
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"staging_target_path": req.StagingTargetPath,
@@ -157,6 +364,30 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	})
 	ll.Info("node unstage volume called")
 
+	// the record of NodeStageVolume survives restarts of the plugin
+	state, err := d.loadStagingState(req.VolumeId)
+	if err != nil {
+		ll.WithError(err).Warn("could not load staging state")
+	} else if state != nil {
+		ll = ll.WithFields(logrus.Fields{
+			"source": state.Device,
+			"fsType": state.FsType,
+		}).WithFields(claimFields(state.PVCName, state.PVCNamespace))
+
+		if state.StagingTargetPath != req.StagingTargetPath {
+			ll.WithField("staged_target_path", state.StagingTargetPath).Warn("volume was staged to a different path")
+		}
+	}
+
+	// an interrupted unmount or a vanished device can leave a broken mount
+	// behind which can't be unmounted the usual way
+	if d.mounter.IsCorruptedMount(req.StagingTargetPath) {
+		ll.Warn("staging target path is a stale mount, forcing unmount")
+		if err := d.mounter.ForceUnmount(req.StagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	mounted, err := d.mounter.IsMounted(req.StagingTargetPath)
 	if err != nil {
 		return nil, err
@@ -172,6 +403,10 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		ll.Info("staging target path is already unmounted")
 	}
 
+	if err := d.removeStagingState(req.VolumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	ll.Info("unmounting stage volume is finished")
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -195,22 +430,32 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
 	}
 
+	if !d.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %q is already in progress", req.VolumeId)
+	}
+	defer d.volumeLocks.Release(req.VolumeId)
+
+	if req.VolumeCapability.GetBlock() != nil {
+		return d.nodePublishBlockVolume(req)
+	}
+
 	source := req.StagingTargetPath
 	target := req.TargetPath
 
 	mnt := req.VolumeCapability.GetMount()
-	options := mnt.MountFlags
+	options := mnt.GetMountFlags()
 
 	// TODO(arslan): do we need bind here? check it out
 	// Perform a bind mount to the full path to allow duplicate mounts of the same PD.
 	options = append(options, "bind")
-	if req.Readonly {
+	readOnly := req.Readonly || isReadOnlyCapability(req.VolumeCapability)
+	if readOnly {
 		options = append(options, "ro")
 	}
 
 	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
+	if mnt.GetFsType() != "" {
+		fsType = mnt.GetFsType()
 	}
 
 	ll := d.log.WithFields(logrus.Fields{
@@ -219,11 +464,15 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		"target":        target,
 		"fsType":        fsType,
 		"mount_options": options,
+		"read_only":     readOnly,
 		"method":        "node_publish_volume",
-	})
+	}).WithFields(attributeClaimFields(req.VolumeAttributes))
 
-	mounted, err := d.mounter.IsMounted(target)
+	mounted, err := d.mounter.IsMountedFrom(source, target, options...)
 	if err != nil {
+		if _, ok := err.(*MountMismatchError); ok {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
 		return nil, err
 	}
 
@@ -240,6 +489,50 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishBlockVolume bind mounts the device of a raw block volume to the
+// target path.
+func (d *Driver) nodePublishBlockVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID, err := strconv.Atoi(req.VolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume Volume ID can not be converted to integer")
+	}
+
+	source := devicePath(volumeID)
+	target := req.TargetPath
+
+	var options []string
+	readOnly := req.Readonly || isReadOnlyCapability(req.VolumeCapability)
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id":     req.VolumeId,
+		"source":        source,
+		"target":        target,
+		"mount_options": options,
+		"read_only":     readOnly,
+		"method":        "node_publish_volume",
+	})
+
+	mounted, err := d.mounter.IsMounted(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if !mounted {
+		ll.Info("mounting the block device")
+		if err := d.mounter.MountBlock(source, target, options...); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		ll.Info("block device is already mounted")
+	}
+
+	ll.Info("bind mounting the block device is finished")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -250,13 +543,36 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
 	}
 
+	// the ID names the staging record, so it must not point outside of
+	// the data directory
+	if _, err := strconv.Atoi(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeUnpublishVolume Volume ID can not be converted to integer")
+	}
+
+	if !d.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %q is already in progress", req.VolumeId)
+	}
+	defer d.volumeLocks.Release(req.VolumeId)
+
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"target_path": req.TargetPath,
 		"method":      "node_unpublish_volume",
 	})
+	if state, err := d.loadStagingState(req.VolumeId); err == nil && state != nil {
+		ll = ll.WithFields(claimFields(state.PVCName, state.PVCNamespace))
+	}
 	ll.Info("node unpublish volume called")
 
+	// an interrupted unmount or a vanished device can leave a broken mount
+	// behind which can't be unmounted the usual way
+	if d.mounter.IsCorruptedMount(req.TargetPath) {
+		ll.Warn("target path is a stale mount, forcing unmount")
+		if err := d.mounter.ForceUnmount(req.TargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	mounted, err := d.mounter.IsMounted(req.TargetPath)
 	if err != nil {
 		return nil, err
@@ -272,10 +588,67 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		ll.Info("target path is already unmounted")
 	}
 
+	// block volumes are bind mounted to a file that we created, directories
+	// of filesystem volumes are managed by the CO unless it expects the
+	// plugin to remove them, e.g. the per-allocation paths of Nomad
+	if fi, err := os.Stat(req.TargetPath); err == nil && (!fi.IsDir() || d.removeTargetPaths) {
+		ll.Info("removing the target path")
+		if err := os.Remove(req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "removing target path %q failed: %s", req.TargetPath, err)
+		}
+	}
+
 	ll.Info("unmounting volume is finished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// formatOnStage returns whether NodeStageVolume may format the volume.
+// Formatting has to be allowed globally and for the volume.
+func (d *Driver) formatOnStage(attributes map[string]string) (bool, error) {
+	if d.disableFormat {
+		return false, nil
+	}
+
+	v, ok := attributes[paramFormatOnStage]
+	if !ok {
+		return true, nil
+	}
+
+	format, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", paramFormatOnStage, v)
+	}
+	return format, nil
+}
+
+// isReadOnlyCapability returns true if the access mode of the given
+// capability only allows reading from the volume.
+func isReadOnlyCapability(cap *csi.VolumeCapability) bool {
+	if cap.AccessMode == nil {
+		return false
+	}
+
+	switch cap.AccessMode.Mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// volumeLabel returns the filesystem label for the given volume, which
+// allows operators to identify the volume without the CSI layer, e.g. in
+// the output of `lsblk -f`. It doesn't fit into the 12 characters of xfs
+// for 9 digit IDs, those volumes are formatted without a label.
+func volumeLabel(volumeID int) string {
+	return "vol-" + strconv.Itoa(volumeID)
+}
+
+// devicePath returns the path of the block device for the given volume.
+func devicePath(volumeID int) string {
+	return diskIDPrefix + strconv.Itoa(volumeID)
+}
+
 // NodeGetId returns the unique id of the node. This should eventually return
 // the droplet ID if possible. This is used so the CO knows where to place the
 // workload. The result of this function will be used by the CO in
@@ -318,10 +691,6 @@ func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (
 		MaxVolumesPerNode: maxVolumesPerNode,
 
 		// make sure that the driver works on this particular location only
-		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				"location": d.location,
-			},
-		},
+		AccessibleTopology: d.nodeTopology(),
 	}, nil
 }
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// formatMounter is a fake mounter reporting the given filesystem on every
+// device and recording the formatted devices.
+type formatMounter struct {
+	fakeMounter
+
+	fsType    string
+	formatted []string
+}
+
+func (f *formatMounter) GetFsType(source string) (string, error) {
+	return f.fsType, nil
+}
+
+func (f *formatMounter) Format(source string, fsType string, opts FormatOptions) error {
+	f.formatted = append(f.formatted, source)
+	return nil
+}
+
+func TestNodeStageVolumeFormat(t *testing.T) {
+	tests := []struct {
+		name          string
+		existing      string
+		policy        FormatPolicy
+		disableFormat bool
+		attributes    map[string]string
+		wantCode      codes.Code
+		wantFormatted bool
+	}{
+		{"unformatted", "", FormatPolicySafe, false, nil, codes.OK, true},
+		{"same filesystem", "ext4", FormatPolicySafe, false, nil, codes.OK, false},
+		{"mismatch", "xfs", FormatPolicySafe, false, nil, codes.FailedPrecondition, false},
+		{"mismatch reformatted", "xfs", FormatPolicyReformatMismatch, false, nil, codes.OK, true},
+		{"unformatted without format", "", FormatPolicySafe, true, nil, codes.FailedPrecondition, false},
+		{"formatted without format", "ext4", FormatPolicySafe, true, nil, codes.OK, false},
+		{"unformatted with formatOnStage false", "", FormatPolicySafe, false, map[string]string{paramFormatOnStage: "false"}, codes.FailedPrecondition, false},
+		{"mismatch with formatOnStage false", "xfs", FormatPolicyReformatMismatch, false, map[string]string{paramFormatOnStage: "false"}, codes.FailedPrecondition, false},
+		{"invalid formatOnStage", "", FormatPolicySafe, false, map[string]string{paramFormatOnStage: "maybe"}, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		m := &formatMounter{fsType: tt.existing}
+		d := &Driver{
+			mounter:       m,
+			formatPolicy:  tt.policy,
+			disableFormat: tt.disableFormat,
+			log:           logrus.New().WithField("test_enabled", true),
+		}
+
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "1234",
+			StagingTargetPath: "/stage",
+			VolumeAttributes:  tt.attributes,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+				},
+			},
+		})
+
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: got code %s, want %s (error: %v)", tt.name, code, tt.wantCode, err)
+		}
+
+		if formatted := len(m.formatted) > 0; formatted != tt.wantFormatted {
+			t.Errorf("%s: formatted = %t, want %t", tt.name, formatted, tt.wantFormatted)
+		}
+	}
+}
+
+func TestNodeUnpublishRemoveTargetPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-unpublish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, remove := range []bool{false, true} {
+		// the per-allocation target path of Nomad
+		target := filepath.Join(dir, "per-alloc", "8a9b8c7d", "vol", "rw-file-system-single-node-writer")
+		if err := os.MkdirAll(target, 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		d := &Driver{
+			mounter:           &fakeMounter{},
+			removeTargetPaths: remove,
+			log:               logrus.New().WithField("test_enabled", true),
+		}
+		_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "1234",
+			TargetPath: target,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(target); os.IsNotExist(err) != remove {
+			t.Errorf("remove target paths %t: got %v for the target path", remove, err)
+		}
+	}
+}
+
+func TestIsReadOnlyCapability(t *testing.T) {
+	tests := []struct {
+		name string
+		mode *csi.VolumeCapability_AccessMode
+		want bool
+	}{
+		{"no access mode", nil, false},
+		{"single node writer", &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}, false},
+		{"single node reader", &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY}, true},
+		{"multi node reader", &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}, true},
+		{"multi node writer", &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}, false},
+	}
+
+	for _, tt := range tests {
+		if got := isReadOnlyCapability(&csi.VolumeCapability{AccessMode: tt.mode}); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// staleMounter is a fake mounter reporting a stale mount on every path and
+// recording the forced unmounts.
+type staleMounter struct {
+	fakeMounter
+
+	err    error
+	forced []string
+}
+
+func (s *staleMounter) IsCorruptedMount(target string) bool {
+	return true
+}
+
+func (s *staleMounter) ForceUnmount(target string) error {
+	s.forced = append(s.forced, target)
+	return s.err
+}
+
+func TestNodeUnmountStaleMount(t *testing.T) {
+	for _, forceErr := range []error{nil, errors.New("umount: target is busy")} {
+		m := &staleMounter{err: forceErr}
+		d := &Driver{
+			mounter: m,
+			log:     logrus.New().WithField("test_enabled", true),
+		}
+
+		_, unstageErr := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          "1234",
+			StagingTargetPath: "/stage",
+		})
+		_, unpublishErr := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "1234",
+			TargetPath: "/target",
+		})
+
+		if len(m.forced) != 2 || m.forced[0] != "/stage" || m.forced[1] != "/target" {
+			t.Errorf("expected forced unmounts of the stale mounts, got %v", m.forced)
+		}
+
+		want := codes.OK
+		if forceErr != nil {
+			want = codes.Internal
+		}
+		for _, err := range []error{unstageErr, unpublishErr} {
+			if code := status.Code(err); code != want {
+				t.Errorf("got code %s, want %s (error: %v)", code, want, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the Go profiling endpoints on the given address until
+// the driver is stopped. The endpoints expose internals of the process, the
+// address should only be reachable from the host.
+func (d *Driver) servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-d.stopCh
+		srv.Close()
+	}()
+
+	d.log.WithField("addr", addr).Info("serving pprof")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		d.log.WithError(err).Error("serving pprof failed")
+	}
+}
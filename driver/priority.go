@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// apiPriority classifies hcloud API requests. If the rate limit is almost
+// exhausted, the remaining budget is left to requests users are waiting
+// for, like attaching and detaching volumes.
+type apiPriority int
+
+const (
+	// priorityForeground is used for all requests by default.
+	priorityForeground apiPriority = iota
+
+	// priorityBackground is used for requests nobody is waiting for, e.g.
+	// listing volumes or reconciling state. They are held back while the
+	// rate limit is low.
+	priorityBackground
+)
+
+const (
+	// backgroundPollInterval is the interval in which held back background
+	// requests check whether the rate limit recovered.
+	backgroundPollInterval = time.Second
+)
+
+type priorityKey struct{}
+
+// withPriority returns a context whose hcloud API requests are sent with
+// the given priority.
+func withPriority(ctx context.Context, p apiPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFromContext returns the priority of hcloud API requests sent with
+// the context.
+func priorityFromContext(ctx context.Context) apiPriority {
+	p, _ := ctx.Value(priorityKey{}).(apiPriority)
+	return p
+}
+
+// priorityTransport holds back background requests while the hcloud API
+// rate limit is low, so they don't use up the budget of foreground
+// requests. Foreground requests are never delayed.
+type priorityTransport struct {
+	next      http.RoundTripper
+	rateLimit *rateLimit
+}
+
+func (t *priorityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if priorityFromContext(ctx) == priorityBackground {
+		if err := t.waitForBudget(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// waitForBudget blocks until the rate limit isn't low anymore or the
+// context is done.
+func (t *priorityTransport) waitForBudget(ctx context.Context) error {
+	ticker := time.NewTicker(backgroundPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if low, _ := t.rateLimit.Low(); !low {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPriorityTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	r := &rateLimit{}
+	header := http.Header{}
+	header.Set("RateLimit-Limit", "3600")
+	header.Set("RateLimit-Remaining", "1")
+	header.Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	r.update(header)
+
+	client := &http.Client{Transport: &priorityTransport{next: http.DefaultTransport, rateLimit: r}}
+
+	get := func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(context.Background()); err != nil {
+		t.Errorf("foreground request failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(withPriority(context.Background(), priorityBackground), 50*time.Millisecond)
+	defer cancel()
+	if err := get(ctx); err == nil {
+		t.Error("expected background request to be held back")
+	}
+
+	header.Set("RateLimit-Remaining", "3000")
+	r.update(header)
+
+	if err := get(withPriority(context.Background(), priorityBackground)); err != nil {
+		t.Errorf("background request failed: %s", err)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// procStatusPath holds the capabilities of the driver process
+	procStatusPath = "/proc/self/status"
+
+	// capSysAdmin is the capability needed for mount(2) and umount2(2),
+	// see capabilities(7).
+	capSysAdmin = 21
+)
+
+// parseEffectiveCapabilities returns the effective capability set of a
+// /proc/<pid>/status file.
+func parseEffectiveCapabilities(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed effective capabilities %q: %s", line, err)
+		}
+		return caps, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no effective capabilities found")
+}
+
+// checkPrivileges verifies at startup that the node service can work with
+// reduced privileges: it has CAP_SYS_ADMIN to mount, sees the devices of
+// the host and doesn't need chroot. It warns if the driver has more
+// capabilities than it needs.
+func (d *Driver) checkPrivileges() error {
+	if d.hostRoot != "" {
+		return errors.New("the host root can't be used with reduced privileges, it needs chroot")
+	}
+
+	f, err := os.Open(procStatusPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	caps, err := parseEffectiveCapabilities(f)
+	if err != nil {
+		return err
+	}
+
+	if caps&(1<<capSysAdmin) == 0 {
+		return errors.New("CAP_SYS_ADMIN is needed to mount volumes, add it to the capabilities of the container")
+	}
+
+	if others := caps &^ (1 << capSysAdmin); others != 0 {
+		d.log.WithField("capabilities", fmt.Sprintf("%#x", caps)).Warn("running with more capabilities than CAP_SYS_ADMIN, consider dropping them")
+	}
+
+	if _, err := os.Stat(filepath.Dir(diskIDPrefix)); err != nil {
+		return fmt.Errorf("the devices of the host are not available, /dev of the host has to be mounted: %s", err)
+	}
+	return nil
+}
+
+// checkSharedMount returns an error if the mount containing the path
+// doesn't propagate its mounts to the host, so the volumes mounted by the
+// driver would not be visible to the kubelet.
+func checkSharedMount(path string) error {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+
+	mnt := containingMount(mounts, path)
+	if mnt == nil {
+		return fmt.Errorf("no mount contains %q", path)
+	}
+
+	if !mnt.Shared {
+		return fmt.Errorf("%q is not mounted with shared propagation, mounts of the driver would not reach the host", mnt.MountPoint)
+	}
+	return nil
+}
+
+// containingMount returns the topmost mount with the longest mount point
+// that contains the path.
+func containingMount(mounts []mountInfo, path string) *mountInfo {
+	path = filepath.Clean(path)
+
+	var found *mountInfo
+	for i := range mounts {
+		mp := mounts[i].MountPoint
+		if mp != "/" && path != mp && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+
+		// later entries are mounted on top of earlier ones
+		if found == nil || len(mp) >= len(found.MountPoint) {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := parseMountOptions([]string{"ro", "defaults", "noatime", "discard", "errors=remount-ro"})
+
+	if want := uintptr(syscall.MS_RDONLY | syscall.MS_NOATIME); flags != want {
+		t.Errorf("flags = %#x, want %#x", flags, want)
+	}
+
+	if data != "discard,errors=remount-ro" {
+		t.Errorf("data = %q, want %q", data, "discard,errors=remount-ro")
+	}
+
+	flags, data = parseMountOptions([]string{"bind"})
+	if flags != syscall.MS_BIND || data != "" {
+		t.Errorf("bind mount = %#x %q, want only the bind flag", flags, data)
+	}
+}
+
+func TestParseEffectiveCapabilities(t *testing.T) {
+	in := `Name:	hcloud-csi-driver
+CapInh:	0000000000000000
+CapPrm:	0000000000200000
+CapEff:	0000000000200000
+CapBnd:	0000000000200000
+`
+
+	caps, err := parseEffectiveCapabilities(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if caps != 1<<capSysAdmin {
+		t.Errorf("capabilities = %#x, want only CAP_SYS_ADMIN", caps)
+	}
+
+	if _, err := parseEffectiveCapabilities(strings.NewReader("Name:	sh\n")); err == nil {
+		t.Error("expected an error without effective capabilities")
+	}
+
+	if _, err := parseEffectiveCapabilities(strings.NewReader("CapEff:	xyz\n")); err == nil {
+		t.Error("expected an error for malformed capabilities")
+	}
+}
+
+func TestContainingMount(t *testing.T) {
+	in := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+100 22 8:1 /var/lib/kubelet /var/lib/kubelet rw,relatime - ext4 /dev/sda1 rw
+110 22 8:1 /var/lib/kubelet /var/lib/kubelet rw,relatime shared:1 - ext4 /dev/sda1 rw
+120 110 0:50 / /var/lib/kubelet-other rw,relatime - tmpfs tmpfs rw
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mnt := containingMount(mounts, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount")
+	if mnt == nil {
+		t.Fatal("no containing mount found")
+	}
+
+	if mnt.MountID != 110 || !mnt.Shared {
+		t.Errorf("got mount %d (shared %t), want the shared mount 110 on top", mnt.MountID, mnt.Shared)
+	}
+
+	mnt = containingMount(mounts, "/var/lib/kubelet-other/x")
+	if mnt == nil || mnt.MountID != 120 || mnt.Shared {
+		t.Errorf("got %+v, want the private mount 120", mnt)
+	}
+
+	mnt = containingMount(mounts, "/tmp")
+	if mnt == nil || mnt.MountID != 22 {
+		t.Errorf("got %+v, want the root mount", mnt)
+	}
+}
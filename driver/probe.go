@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"google.golang.org/grpc"
+)
+
+const (
+	// probeTimeout bounds the checks of a single health request.
+	probeTimeout = 5 * time.Second
+
+	// readinessCacheTTL is the time the result of the hcloud API check is
+	// reused for, so frequent probes don't use up the API budget.
+	readinessCacheTTL = 30 * time.Second
+)
+
+// apiCheck caches the result of the last hcloud API check.
+type apiCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// checkLive returns an error if the gRPC server isn't serving. The driver
+// calls its own Probe RPC through the endpoint, the same as the
+// livenessprobe sidecar, so a hanging server is detected as well.
+func (d *Driver) checkLive() error {
+	d.readyMu.Lock()
+	ready, addr := d.ready, d.addr
+	d.readyMu.Unlock()
+
+	if !ready {
+		return fmt.Errorf("the gRPC server is not serving yet")
+	}
+
+	// the Probe RPC needs a client certificate with TLS, only check that
+	// the endpoint accepts connections then
+	if addr != nil && d.tls != nil {
+		return dialEndpoint(addr)
+	}
+
+	if addr != nil {
+		return probeEndpoint(addr)
+	}
+	return nil
+}
+
+// dialEndpoint checks that the endpoint at the given address accepts
+// connections.
+func dialEndpoint(addr net.Addr) error {
+	c, err := net.DialTimeout(addr.Network(), addr.String(), probeTimeout)
+	if err != nil {
+		return fmt.Errorf("the gRPC endpoint is not accepting connections: %s", err)
+	}
+	return c.Close()
+}
+
+// probeEndpoint calls the Probe RPC of the CSI endpoint at the given
+// address.
+func probeEndpoint(addr net.Addr) error {
+	// a blocking gRPC dial retries until the timeout, a plain dial fails
+	// right away if nothing listens
+	if err := dialEndpoint(addr); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr.String(),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(addr.Network(), target, timeout)
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("the gRPC endpoint is not accepting connections: %s", err)
+	}
+	defer conn.Close()
+
+	resp, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		return fmt.Errorf("probing the gRPC endpoint failed: %s", err)
+	}
+
+	if resp.Ready != nil && !resp.Ready.Value {
+		return fmt.Errorf("the driver reports it is not ready")
+	}
+	return nil
+}
+
+// checkReady returns an error if the driver is not live or the controller
+// service can't use the hcloud API.
+func (d *Driver) checkReady(ctx context.Context) error {
+	if err := d.checkLive(); err != nil {
+		return err
+	}
+
+	if !d.runsController() {
+		return nil
+	}
+
+	d.apiCheck.mu.Lock()
+	defer d.apiCheck.mu.Unlock()
+
+	if time.Since(d.apiCheck.checked) > readinessCacheTTL {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+
+		d.apiCheck.err = d.checkHCloud(withPriority(ctx, priorityBackground))
+		d.apiCheck.checked = time.Now()
+	}
+	return d.apiCheck.err
+}
+
+// healthHandler serves the result of the given check, 503 if it fails.
+func (d *Driver) healthHandler(check func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(r.Context()); err != nil {
+			d.log.WithError(err).WithField("path", r.URL.Path).Warn("health check failed")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// registerHealthHandlers adds /healthz and /readyz to the mux.
+func (d *Driver) registerHealthHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", d.healthHandler(func(ctx context.Context) error {
+		return d.checkLive()
+	}))
+	mux.Handle("/readyz", d.healthHandler(d.checkReady))
+}
+
+// serveHealth serves the health endpoints on the given address until the
+// driver is stopped.
+func (d *Driver) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	d.registerHealthHandlers(mux)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-d.stopCh
+		srv.Close()
+	}()
+
+	d.log.WithField("addr", addr).Info("serving health endpoints")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		d.log.WithError(err).Error("serving health endpoints failed")
+	}
+}
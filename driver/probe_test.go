@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	var apiCalls int32
+	reachable := int32(1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&apiCalls, 1)
+		if atomic.LoadInt32(&reachable) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"locations": [{"id": 1, "name": "fsn1"}]}`))
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	mux := http.NewServeMux()
+	d.registerHealthHandlers(mux)
+
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := probe("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz before serving: expected 503, got %d", code)
+	}
+
+	d.readyMu.Lock()
+	d.ready = true
+	d.readyMu.Unlock()
+
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz: expected 200, got %d", code)
+	}
+
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("readyz: expected 200, got %d", code)
+	}
+
+	// the result of the API check is cached
+	atomic.StoreInt32(&reachable, 0)
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("cached readyz: expected 200, got %d", code)
+	}
+	if calls := atomic.LoadInt32(&apiCalls); calls != 1 {
+		t.Errorf("expected 1 API call, got %d", calls)
+	}
+
+	d.apiCheck.checked = d.apiCheck.checked.Add(-readinessCacheTTL)
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz with unreachable API: expected 503, got %d", code)
+	}
+}
+
+func TestCheckLiveProbesEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "csi.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		log:   logrus.New().WithField("test_enabled", true),
+		ready: true,
+		addr:  listener.Addr(),
+	}
+
+	srv := grpc.NewServer()
+	csi.RegisterIdentityServer(srv, d)
+	go srv.Serve(listener)
+
+	if err := d.checkLive(); err != nil {
+		t.Errorf("expected the driver to be live, got %s", err)
+	}
+
+	srv.Stop()
+	if err := d.checkLive(); err == nil {
+		t.Error("expected an error for a stopped server")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// paramProject is the StorageClass parameter selecting the hcloud
+	// project a volume is created in by its alias. It is passed to the
+	// node as a volume attribute.
+	paramProject = "project"
+)
+
+// volumeProjects caches the alias of the project each volume was found
+// in, so requests without volume attributes don't have to search every
+// project. The default project has the empty alias.
+type volumeProjects struct {
+	mu      sync.Mutex
+	aliases map[int]string
+}
+
+func (v *volumeProjects) get(volumeID int) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	alias, ok := v.aliases[volumeID]
+	return alias, ok
+}
+
+func (v *volumeProjects) set(volumeID int, alias string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.aliases == nil {
+		v.aliases = map[int]string{}
+	}
+	v.aliases[volumeID] = alias
+}
+
+func (v *volumeProjects) forget(volumeID int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.aliases, volumeID)
+}
+
+// readProjectsFile reads the mapping of project aliases to tokens from a
+// YAML file, e.g. "billing-a: <token>" per line.
+func readProjectsFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading projects file failed: %s", err)
+	}
+
+	projects := map[string]string{}
+	if err := yaml.Unmarshal(data, &projects); err != nil {
+		return nil, fmt.Errorf("invalid projects file %q: %s", path, err)
+	}
+	return projects, validateProjects(projects)
+}
+
+// projectsFromSecret returns the mapping of project aliases to tokens of
+// the Secret, every key is an alias.
+func projectsFromSecret(secret *v1.Secret) (map[string]string, error) {
+	projects := map[string]string{}
+	for alias, token := range secret.Data {
+		projects[alias] = string(token)
+	}
+	if len(projects) == 0 {
+		return nil, fmt.Errorf("secret %s/%s has no projects", secret.Namespace, secret.Name)
+	}
+	return projects, validateProjects(projects)
+}
+
+// validateProjects trims the tokens of the projects and rejects empty
+// ones, e.g. of a typo in a templated file.
+func validateProjects(projects map[string]string) error {
+	for alias, token := range projects {
+		token = strings.TrimSpace(token)
+		if alias == "" {
+			return fmt.Errorf("project aliases must not be empty")
+		}
+		if token == "" {
+			return fmt.Errorf("project %q has no token", alias)
+		}
+		projects[alias] = token
+	}
+	return nil
+}
+
+// loadProjects reads the configured projects file and Secret. Aliases of
+// the Secret take precedence over the ones of the file.
+func (d *Driver) loadProjects() error {
+	projects := map[string]string{}
+
+	if d.projectsFile != "" {
+		fromFile, err := readProjectsFile(d.projectsFile)
+		if err != nil {
+			return err
+		}
+		for alias, token := range fromFile {
+			projects[alias] = token
+		}
+	}
+
+	if d.projectsSecret != "" {
+		namespace, name, err := parseTokenSecret(d.projectsSecret)
+		if err != nil {
+			return fmt.Errorf("invalid projects secret: %s", err)
+		}
+
+		secret, err := d.kubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get projects secret %s: %s", d.projectsSecret, err)
+		}
+
+		fromSecret, err := projectsFromSecret(secret)
+		if err != nil {
+			return err
+		}
+		for alias, token := range fromSecret {
+			projects[alias] = token
+		}
+	}
+
+	d.projects = projects
+	return nil
+}
+
+// projectAliases returns the sorted aliases of the configured projects.
+func (d *Driver) projectAliases() []string {
+	aliases := make([]string, 0, len(d.projects))
+	for alias := range d.projects {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// withProject returns a context whose hcloud requests are sent to the
+// project with the given alias. The context is returned unchanged for the
+// empty alias. A project can't be selected if the token of the secrets
+// already did.
+func (d *Driver) withProject(ctx context.Context, alias string) (context.Context, error) {
+	if alias == "" {
+		return ctx, nil
+	}
+
+	if hasClient(ctx) {
+		return nil, status.Errorf(codes.InvalidArgument, "the %s parameter can't be combined with a token in the secrets", paramProject)
+	}
+
+	token, ok := d.projects[alias]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown %s %q, configured are: %s", paramProject, alias, strings.Join(d.projectAliases(), ", "))
+	}
+
+	client, err := d.secretClient(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not create hcloud client for project %q: %s", alias, err)
+	}
+	return d.withTokenClient(ctx, token, client), nil
+}
+
+// withVolumeProject returns a context whose hcloud requests are sent to
+// the project of the volume. The project is taken from the attributes of
+// the volume if present, otherwise the default project and then every
+// configured project is searched for the volume. If it isn't found, the
+// context is returned unchanged.
+func (d *Driver) withVolumeProject(ctx context.Context, volumeID int, attributes map[string]string) (context.Context, error) {
+	if len(d.projects) == 0 || hasClient(ctx) {
+		return ctx, nil
+	}
+
+	if alias := attributes[paramProject]; alias != "" {
+		d.volumeProjects.set(volumeID, alias)
+		return d.withProject(ctx, alias)
+	}
+
+	if alias, ok := d.volumeProjects.get(volumeID); ok {
+		return d.withProject(ctx, alias)
+	}
+
+	for _, alias := range append([]string{""}, d.projectAliases()...) {
+		projectCtx, err := d.withProject(ctx, alias)
+		if err != nil {
+			return nil, err
+		}
+
+		vol, _, err := d.client(projectCtx).Volume.GetByID(projectCtx, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not look up the project of volume %d: %s", volumeID, err)
+		}
+		if vol != nil {
+			d.volumeProjects.set(volumeID, alias)
+			return projectCtx, nil
+		}
+	}
+
+	return ctx, nil
+}
+
+// hasClient reports if the context already selects the hcloud project of
+// its requests.
+func hasClient(ctx context.Context) bool {
+	_, ok := ctx.Value(clientKey{}).(*hcloudServices)
+	return ok
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReadProjectsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		content  string
+		projects map[string]string
+		err      bool
+	}{
+		{
+			name:     "projects",
+			content:  "billing-a: token-a\nbilling-b: \" token-b\\n\"\n",
+			projects: map[string]string{"billing-a": "token-a", "billing-b": "token-b"},
+		},
+		{name: "empty token", content: "billing-a: \"\"\n", err: true},
+		{name: "no mapping", content: "- token-a\n", err: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strconv.Itoa(i))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			projects, err := readProjectsFile(path)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", projects)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(projects) != len(tt.projects) {
+				t.Fatalf("expected %v, got %v", tt.projects, projects)
+			}
+			for alias, token := range tt.projects {
+				if projects[alias] != token {
+					t.Errorf("expected token %q of project %q, got %q", token, alias, projects[alias])
+				}
+			}
+		})
+	}
+}
+
+func TestProjectsFromSecret(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "hcloud-projects"},
+		Data:       map[string][]byte{"billing-a": []byte("token-a\n")},
+	}
+
+	projects, err := projectsFromSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 1 || projects["billing-a"] != "token-a" {
+		t.Errorf("unexpected projects %v", projects)
+	}
+
+	if _, err := projectsFromSecret(&v1.Secret{}); err == nil {
+		t.Error("expected an error for a secret without projects")
+	}
+}
+
+func TestVolumeProjects(t *testing.T) {
+	global := &fakeAPI{t: t, volumes: map[int]*schema.Volume{}}
+	billing := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+		servers: map[int]*schema.Server{1234: {ID: 1234}},
+	}
+
+	// every token is a project of its own
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer global":
+			global.ServeHTTP(w, r)
+		case "Bearer token-b":
+			billing.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		hcloudURL:    ts.URL,
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL), hcloud.WithToken("global")),
+		projects:     map[string]string{"billing-b": "token-b"},
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	ctx := context.Background()
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: supportedAccessMode,
+	}}
+
+	_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-unknown",
+		Parameters:         map[string]string{paramProject: "billing-c"},
+		VolumeCapabilities: capabilities,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an unknown project, got %v", err)
+	}
+
+	_, err = d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                    "pvc-both",
+		Parameters:              map[string]string{paramProject: "billing-b"},
+		ControllerCreateSecrets: map[string]string{secretToken: "token-b"},
+		VolumeCapabilities:      capabilities,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a project together with a token in the secrets, got %v", err)
+	}
+
+	resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1234",
+		Parameters:         map[string]string{paramProject: "billing-b"},
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(global.volumes) != 0 || len(billing.volumes) != 1 {
+		t.Fatalf("expected the volume in the selected project, got %d in the default and %d in the other one", len(global.volumes), len(billing.volumes))
+	}
+	if resp.Volume.Attributes[paramProject] != "billing-b" {
+		t.Errorf("expected the project in the volume attributes, got %v", resp.Volume.Attributes)
+	}
+
+	// a restarted controller validates and lists the volume in its project
+	d.volumes = volumeCache{}
+	d.volumeProjects = volumeProjects{}
+	validated, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           resp.Volume.Id,
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validated.Supported {
+		t.Error("expected the capabilities of the volume to be supported")
+	}
+
+	listed, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Entries) != 1 || listed.Entries[0].Volume.Id != resp.Volume.Id {
+		t.Errorf("expected the volume of the other project to be listed, got %v", listed.Entries)
+	}
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         resp.Volume.Id,
+		NodeId:           "1234",
+		VolumeCapability: capabilities[0],
+		VolumeAttributes: resp.Volume.Attributes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted controller finds the project of the volume without the
+	// attributes
+	d.volumeProjects = volumeProjects{}
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: resp.Volume.Id,
+		NodeId:   "1234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.volumeProjects = volumeProjects{}
+	if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if len(billing.volumes) != 0 {
+		t.Errorf("expected the volume to be deleted in its project, got %v", billing.volumes)
+	}
+}
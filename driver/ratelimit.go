@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitLowFraction is the fraction of the rate limit below which
+	// the remaining budget is considered low and background work is
+	// throttled.
+	rateLimitLowFraction = 0.1
+)
+
+// rateLimit tracks the hcloud API rate limit as reported in the headers of
+// the API responses.
+type rateLimit struct {
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// update records the rate limit headers of the response.
+func (r *rateLimit) update(header http.Header) {
+	limit, err := strconv.Atoi(header.Get("RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+
+	remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	var reset time.Time
+	if ts, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		reset = time.Unix(ts, 0)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	r.remaining = remaining
+	r.reset = reset
+}
+
+// Remaining returns the number of remaining API requests. It returns -1 if
+// no response was seen yet.
+func (r *rateLimit) Remaining() float64 {
+	if r == nil {
+		return -1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit == 0 {
+		return -1
+	}
+	return float64(r.remaining)
+}
+
+// Limit returns the number of requests allowed per hour. It returns -1 if
+// no response was seen yet.
+func (r *rateLimit) Limit() float64 {
+	if r == nil {
+		return -1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit == 0 {
+		return -1
+	}
+	return float64(r.limit)
+}
+
+// Reset returns the time the budget is fully restored at as Unix
+// timestamp. It returns -1 if the time is unknown.
+func (r *rateLimit) Reset() float64 {
+	if r == nil {
+		return -1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reset.IsZero() {
+		return -1
+	}
+	return float64(r.reset.Unix())
+}
+
+// Low returns whether the remaining budget is low and the time it is reset
+// at. Background work should be postponed until then.
+func (r *rateLimit) Low() (bool, time.Time) {
+	if r == nil {
+		return false, time.Time{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit == 0 || !time.Now().Before(r.reset) {
+		return false, time.Time{}
+	}
+	return float64(r.remaining) < float64(r.limit)*rateLimitLowFraction, r.reset
+}
+
+// rateLimitTransport records the rate limit headers of all API responses.
+type rateLimitTransport struct {
+	next      http.RoundTripper
+	rateLimit *rateLimit
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.rateLimit.update(resp.Header)
+	}
+	return resp, err
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	remaining := 3000
+	reset := time.Now().Add(time.Hour).Unix()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "3600")
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	}))
+	defer ts.Close()
+
+	rl := &rateLimit{}
+	if got := rl.Remaining(); got != -1 {
+		t.Errorf("remaining before the first request = %v, want -1", got)
+	}
+	if got := rl.Reset(); got != -1 {
+		t.Errorf("reset before the first request = %v, want -1", got)
+	}
+
+	client := &http.Client{Transport: &rateLimitTransport{next: http.DefaultTransport, rateLimit: rl}}
+	get := func() {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	if got := rl.Remaining(); got != 3000 {
+		t.Errorf("remaining = %v, want 3000", got)
+	}
+	if got := rl.Limit(); got != 3600 {
+		t.Errorf("limit = %v, want 3600", got)
+	}
+	if got := rl.Reset(); got != float64(reset) {
+		t.Errorf("reset = %v, want %d", got, reset)
+	}
+	if low, _ := rl.Low(); low {
+		t.Error("budget of 3000 should not be low")
+	}
+
+	remaining = 100
+	get()
+	low, resetAt := rl.Low()
+	if !low {
+		t.Error("budget of 100 should be low")
+	}
+	if resetAt.Unix() != reset {
+		t.Errorf("reset = %d, want %d", resetAt.Unix(), reset)
+	}
+
+	var nilLimit *rateLimit
+	if low, _ := nilLimit.Low(); low {
+		t.Error("unknown budget should not be low")
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// nodeIDAnnotation holds the CSI node IDs of a Kubernetes node by
+	// driver name. It is set by the driver-registrar.
+	nodeIDAnnotation = "csi.volume.kubernetes.io/nodeid"
+
+	// providerIDPrefix prefixes the server ID in the provider ID of nodes
+	// initialized by the hcloud cloud controller manager.
+	providerIDPrefix = "hcloud://"
+)
+
+// runAttachmentReconciliation repairs drift between the VolumeAttachments
+// of the cluster and the attachments of the hcloud volumes periodically
+// until the driver is stopped.
+func (d *Driver) runAttachmentReconciliation() {
+	ticker := time.NewTicker(d.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			return
+		}
+
+		if !d.isLeader() {
+			continue
+		}
+
+		if err := d.reconcileAttachments(); err != nil {
+			d.log.WithError(err).Warn("could not reconcile volume attachments")
+		}
+	}
+}
+
+// reconcileAttachments compares the attached VolumeAttachments of the
+// driver with the managed hcloud volumes. Volumes which are detached
+// although they should be attached are attached again. Volumes attached
+// without any VolumeAttachment are detached, once they were seen as strays
+// twice in a row, so in-flight attach operations are left alone.
+func (d *Driver) reconcileAttachments() error {
+	ctx := withPriority(context.Background(), priorityBackground)
+
+	desired, known, err := d.desiredAttachments()
+	if err != nil {
+		return err
+	}
+
+	volumes, err := d.client(ctx).Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage:       50,
+			LabelSelector: d.managedLabelSelector(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	strays := map[int]bool{}
+	for _, vol := range volumes {
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id":   vol.ID,
+			"volume_name": vol.Name,
+			"method":      "reconcile_attachments",
+		})
+
+		serverID, wanted := desired[vol.ID]
+		switch {
+		case wanted && vol.Server == nil:
+			ll.WithField("server_id", serverID).Warn("volume should be attached but is detached, attaching it again")
+			d.repairAttachment(ctx, ll, vol.ID, "attach", func() (*hcloud.Action, error) {
+				action, _, err := d.client(ctx).Volume.Attach(ctx, vol, &hcloud.Server{ID: serverID})
+				return action, err
+			})
+
+		case wanted && vol.Server.ID != serverID:
+			// moving the volume could break the workload using it, this
+			// needs a human
+			ll.WithFields(logrus.Fields{
+				"server_id":          serverID,
+				"attached_server_id": vol.Server.ID,
+			}).Warn("volume is attached to another server than its VolumeAttachment")
+
+		case !wanted && vol.Server != nil && !known[vol.ID]:
+			if !d.attachmentStrays[vol.ID] {
+				strays[vol.ID] = true
+				continue
+			}
+
+			ll.WithField("server_id", vol.Server.ID).Warn("volume is attached without a VolumeAttachment, detaching it")
+			d.repairAttachment(ctx, ll, vol.ID, "detach", func() (*hcloud.Action, error) {
+				action, _, err := d.client(ctx).Volume.Detach(ctx, vol)
+				return action, err
+			})
+		}
+	}
+
+	d.attachmentStrays = strays
+	return nil
+}
+
+// repairAttachment runs an attach or detach of the reconciliation and waits
+// for it to complete.
+func (d *Driver) repairAttachment(ctx context.Context, ll *logrus.Entry, volumeID int, operation string, run func() (*hcloud.Action, error)) {
+	d.volumes.invalidate(volumeID)
+
+	action, err := run()
+	if err == nil && action != nil {
+		err = d.waitAction(ctx, volumeID, action.ID)
+	}
+
+	d.metrics.attachmentRepaired(operation, err)
+	if err != nil {
+		ll.WithError(err).Warnf("could not %s volume", operation)
+		return
+	}
+	ll.Infof("volume %s repaired", operation)
+}
+
+// desiredAttachments returns the server every volume should be attached
+// to according to the attached VolumeAttachments of the driver. It also
+// returns all volumes with a VolumeAttachment, whether attached or not.
+func (d *Driver) desiredAttachments() (map[int]int, map[int]bool, error) {
+	attachments, err := d.kubeClient.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list VolumeAttachments: %s", err)
+	}
+
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list PersistentVolumes: %s", err)
+	}
+
+	nodes, err := d.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list Nodes: %s", err)
+	}
+
+	volumeIDs := map[string]int{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.driverName() {
+			continue
+		}
+		if id, err := strconv.Atoi(pv.Spec.CSI.VolumeHandle); err == nil {
+			volumeIDs[pv.Name] = id
+		}
+	}
+
+	serverIDs := map[string]int{}
+	for _, node := range nodes.Items {
+		if id, err := d.nodeServerID(&node); err == nil {
+			serverIDs[node.Name] = id
+		}
+	}
+
+	desired := map[int]int{}
+	known := map[int]bool{}
+	for _, va := range attachments.Items {
+		if va.Spec.Attacher != d.driverName() || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+
+		volumeID, ok := volumeIDs[*va.Spec.Source.PersistentVolumeName]
+		if !ok {
+			continue
+		}
+		known[volumeID] = true
+
+		// only attachments which completed and are not being removed are
+		// enforced
+		if !va.Status.Attached || va.DeletionTimestamp != nil {
+			continue
+		}
+
+		if serverID, ok := serverIDs[va.Spec.NodeName]; ok {
+			desired[volumeID] = serverID
+		}
+	}
+
+	return desired, known, nil
+}
+
+// nodeServerID returns the ID of the hcloud server of a Kubernetes node,
+// from the node ID registered by the driver or otherwise from the provider
+// ID set by the hcloud cloud controller manager.
+func (d *Driver) nodeServerID(node *v1.Node) (int, error) {
+	if raw, ok := node.Annotations[nodeIDAnnotation]; ok {
+		ids := map[string]string{}
+		if err := json.Unmarshal([]byte(raw), &ids); err == nil {
+			if id, ok := ids[d.driverName()]; ok {
+				return strconv.Atoi(id)
+			}
+		}
+	}
+
+	if strings.HasPrefix(node.Spec.ProviderID, providerIDPrefix) {
+		return strconv.Atoi(strings.TrimPrefix(node.Spec.ProviderID, providerIDPrefix))
+	}
+
+	return 0, errors.New("node has no hcloud server id")
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClusterAPI serves the VolumeAttachments, PersistentVolumes and Nodes
+// of a cluster.
+type fakeClusterAPI struct {
+	attachments []storagev1beta1.VolumeAttachment
+	pvs         []v1.PersistentVolume
+	nodes       []v1.Node
+}
+
+func (f *fakeClusterAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/apis/storage.k8s.io/v1beta1/volumeattachments":
+		json.NewEncoder(w).Encode(&storagev1beta1.VolumeAttachmentList{
+			TypeMeta: metav1.TypeMeta{Kind: "VolumeAttachmentList", APIVersion: "storage.k8s.io/v1beta1"},
+			Items:    f.attachments,
+		})
+	case "/api/v1/persistentvolumes":
+		json.NewEncoder(w).Encode(&v1.PersistentVolumeList{
+			TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeList", APIVersion: "v1"},
+			Items:    f.pvs,
+		})
+	case "/api/v1/nodes":
+		json.NewEncoder(w).Encode(&v1.NodeList{
+			TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"},
+			Items:    f.nodes,
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestReconcileAttachments(t *testing.T) {
+	managed := map[string]string{labelCreatedBy: createdByHCloud}
+	server := 10
+	fakeHCloud := &fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			// detached, but should be attached
+			1: {ID: 1, Name: "pvc-1", Labels: managed},
+			// attached without a VolumeAttachment
+			2: {ID: 2, Name: "pvc-2", Labels: managed, Server: &server},
+			// attached as it should be
+			3: {ID: 3, Name: "pvc-3", Labels: managed, Server: &server},
+			// not managed by the driver
+			4: {ID: 4, Name: "other", Server: &server},
+		},
+		servers: map[int]*schema.Server{
+			10: {ID: 10},
+		},
+	}
+	tsHCloud := httptest.NewServer(fakeHCloud)
+	defer tsHCloud.Close()
+
+	pv := func(name, handle string) v1.PersistentVolume {
+		return v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: handle},
+				},
+			},
+		}
+	}
+	va := func(pv string) storagev1beta1.VolumeAttachment {
+		return storagev1beta1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "va-" + pv},
+			Spec: storagev1beta1.VolumeAttachmentSpec{
+				Attacher: DefaultDriverName,
+				Source:   storagev1beta1.VolumeAttachmentSource{PersistentVolumeName: &pv},
+				NodeName: "node-1",
+			},
+			Status: storagev1beta1.VolumeAttachmentStatus{Attached: true},
+		}
+	}
+	tsKube := httptest.NewServer(&fakeClusterAPI{
+		attachments: []storagev1beta1.VolumeAttachment{va("pvc-1"), va("pvc-3")},
+		pvs:         []v1.PersistentVolume{pv("pvc-1", "1"), pv("pvc-2", "2"), pv("pvc-3", "3")},
+		nodes: []v1.Node{{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+			Spec:       v1.NodeSpec{ProviderID: "hcloud://10"},
+		}},
+	})
+	defer tsKube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: tsKube.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		hcloudClient:       hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL)),
+		kubeClient:         kubeClient,
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+
+	if err := d.reconcileAttachments(); err != nil {
+		t.Fatal(err)
+	}
+
+	if vol := fakeHCloud.volumes[1]; vol.Server == nil || *vol.Server != 10 {
+		t.Errorf("expected volume 1 to be attached again, got server %v", vol.Server)
+	}
+	if fakeHCloud.volumes[2].Server == nil {
+		t.Error("expected volume 2 not to be detached before it was seen as stray twice")
+	}
+
+	if err := d.reconcileAttachments(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fakeHCloud.volumes[2].Server != nil {
+		t.Error("expected stray volume 2 to be detached")
+	}
+	if fakeHCloud.volumes[3].Server == nil || fakeHCloud.volumes[4].Server == nil {
+		t.Error("expected volumes 3 and 4 to stay attached")
+	}
+}
+
+func TestNodeServerID(t *testing.T) {
+	d := &Driver{}
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{nodeIDAnnotation: `{"` + DefaultDriverName + `":"42"}`},
+	}}
+	if id, err := d.nodeServerID(node); err != nil || id != 42 {
+		t.Errorf("expected server id 42 from the annotation, got %d, %v", id, err)
+	}
+
+	node = &v1.Node{Spec: v1.NodeSpec{ProviderID: "hcloud://43"}}
+	if id, err := d.nodeServerID(node); err != nil || id != 43 {
+		t.Errorf("expected server id 43 from the provider id, got %d, %v", id, err)
+	}
+
+	if _, err := d.nodeServerID(&v1.Node{}); err == nil {
+		t.Error("expected an error for a node without server id")
+	}
+}
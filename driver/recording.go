@@ -0,0 +1,280 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// recording is a file of requests to and responses of the hcloud API.
+// Tests replay them to cover the behavior of the real API, e.g. its error
+// bodies and pagination.
+type recording struct {
+	Interactions []interaction `json:"interactions"`
+}
+
+// interaction is a request and its response. The URL is relative to the
+// API endpoint, the token is not recorded.
+type interaction struct {
+	Request struct {
+		Method string          `json:"method"`
+		URL    string          `json:"url"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	} `json:"request"`
+
+	Response struct {
+		Status int               `json:"status"`
+		Header map[string]string `json:"header,omitempty"`
+		Body   json.RawMessage   `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// rawBody returns a JSON body as it is and other bodies as a JSON string,
+// so recordings stay readable.
+func rawBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+// bodyBytes is the reverse of rawBody.
+func bodyBytes(raw json.RawMessage) []byte {
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return []byte(s)
+	}
+	return raw
+}
+
+// relativeURL returns the path and query of the request below the path of
+// the endpoint.
+func relativeURL(endpoint string, u *url.URL) string {
+	prefix := ""
+	if e, err := url.Parse(endpoint); err == nil {
+		prefix = strings.TrimSuffix(e.Path, "/")
+	}
+
+	rel := strings.TrimPrefix(u.Path, prefix)
+	if u.RawQuery != "" {
+		rel += "?" + u.RawQuery
+	}
+	return rel
+}
+
+// recorder writes the interactions of all hcloud clients to the recording
+// file. The file is rewritten after each interaction, so it is complete
+// whenever the driver stops.
+type recorder struct {
+	path string
+
+	mu  sync.Mutex
+	rec recording
+}
+
+// recordTransport records the requests and responses of every attempt.
+type recordTransport struct {
+	next     http.RoundTripper
+	recorder *recorder
+	endpoint string
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var i interaction
+	i.Request.Method = req.Method
+	i.Request.URL = relativeURL(t.endpoint, req.URL)
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		i.Request.Body = rawBody(body)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	i.Response.Status = resp.StatusCode
+	i.Response.Body = rawBody(body)
+	i.Response.Header = map[string]string{}
+	for name := range resp.Header {
+		i.Response.Header[name] = resp.Header.Get(name)
+	}
+
+	if err := t.recorder.append(i); err != nil {
+		return nil, fmt.Errorf("recording hcloud API response failed: %s", err)
+	}
+	return resp, nil
+}
+
+func (r *recorder) append(i interaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rec.Interactions = append(r.rec.Interactions, i)
+	data, err := json.MarshalIndent(&r.rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// recorded returns the transport recording the requests sent through next,
+// or next if recording is disabled.
+func (d *Driver) recorded(next http.RoundTripper) http.RoundTripper {
+	if d.recorder == nil {
+		return next
+	}
+	return &recordTransport{
+		next:     next,
+		recorder: d.recorder,
+		endpoint: d.hcloudURL,
+	}
+}
+
+// replayTransport serves the responses of a recording. Every request gets
+// the first unused interaction with the same method, URL and body.
+type replayTransport struct {
+	endpoint string
+
+	mu   sync.Mutex
+	rec  recording
+	used []bool
+}
+
+// newReplayTransport reads the recording of the file for requests to the
+// given endpoint.
+func newReplayTransport(path, endpoint string) (*replayTransport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &replayTransport{endpoint: endpoint}
+	if err := json.Unmarshal(data, &t.rec); err != nil {
+		return nil, fmt.Errorf("invalid recording %q: %s", path, err)
+	}
+	t.used = make([]bool, len(t.rec.Interactions))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	rel := relativeURL(t.endpoint, req.URL)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for n, i := range t.rec.Interactions {
+		if t.used[n] || i.Request.Method != req.Method || i.Request.URL != rel {
+			continue
+		}
+		if len(i.Request.Body) > 0 && !jsonEqual(bodyBytes(i.Request.Body), body) {
+			continue
+		}
+		t.used[n] = true
+
+		resp := &http.Response{
+			StatusCode: i.Response.Status,
+			Status:     fmt.Sprintf("%d %s", i.Response.Status, http.StatusText(i.Response.Status)),
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(bodyBytes(i.Response.Body))),
+			Request:    req,
+		}
+		for name, value := range i.Response.Header {
+			resp.Header.Set(name, value)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no recorded response left for %s %s", req.Method, rel)
+}
+
+// unused returns the interactions that were not replayed.
+func (t *replayTransport) unused() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var unused []string
+	for n, i := range t.rec.Interactions {
+		if !t.used[n] {
+			unused = append(unused, i.Request.Method+" "+i.Request.URL)
+		}
+	}
+	return unused
+}
+
+// jsonEqual reports whether two bodies are equal, ignoring the formatting
+// of JSON bodies.
+func jsonEqual(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
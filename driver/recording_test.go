@@ -0,0 +1,194 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-csi-driver/driver/fakehcloud"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLifecycle creates, attaches, detaches and deletes a volume.
+func volumeLifecycle(t *testing.T, d *Driver) {
+	ctx := context.Background()
+
+	created, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: supportedAccessMode,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         created.Volume.Id,
+		NodeId:           "10",
+		VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: created.Volume.Id, NodeId: "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Volume.Id}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayDriver returns a driver talking to the hcloud API of the recording.
+func replayDriver(t *testing.T, path string) (*Driver, *replayTransport) {
+	replay, err := newReplayTransport(path, "http://hcloud.replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		location:           "fsn1",
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+	d.hcloudClient = d.clientWithTransport("token", "http://hcloud.replay", replay, d.rateLimit)
+	return d, replay
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.json")
+
+	fake := fakehcloud.New()
+	fake.ActionLatency = 0
+	fake.AddServer(10, "node-10", "fsn1")
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	d := &Driver{
+		location:           "fsn1",
+		hcloudURL:          ts.URL,
+		recorder:           &recorder{path: path},
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+	d.hcloudClient = d.clientWithTransport("secret-token", ts.URL, d.recorded(http.DefaultTransport), d.rateLimit)
+	volumeLifecycle(t, d)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Error("the recording contains the token")
+	}
+
+	replayed, replay := replayDriver(t, path)
+	volumeLifecycle(t, replayed)
+	if unused := replay.unused(); len(unused) > 0 {
+		t.Errorf("interactions not replayed: %v", unused)
+	}
+
+	// a recording is used up after its interactions are replayed
+	if _, err := replayed.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1"}); err == nil {
+		t.Error("expected an error for a request without a recorded response")
+	}
+}
+
+// The fixtures in testdata/hcloud are responses of the real hcloud API, see
+// the hcloud-record flag.
+func TestReplayFixtures(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		fixture string
+		run     func(d *Driver) error
+	}{
+		{
+			fixture: "list_volumes_pages.json",
+			run: func(d *Driver) error {
+				resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+				if err != nil {
+					return err
+				}
+				if len(resp.Entries) != 3 || resp.NextToken != "2" {
+					t.Errorf("expected 3 volumes of 2 pages, got %v", resp)
+				}
+				return nil
+			},
+		},
+		{
+			// the action is polled again after the load balancer of the API
+			// responded with an HTML error page
+			fixture: "attach_unavailable.json",
+			run: func(d *Driver) error {
+				_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+					VolumeId:         "4711",
+					NodeId:           "10",
+					VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+				})
+				return err
+			},
+		},
+		{
+			fixture: "create_volume_limit.json",
+			run: func(d *Driver) error {
+				_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name: "pvc-1234",
+					VolumeCapabilities: []*csi.VolumeCapability{{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: supportedAccessMode,
+					}},
+				})
+				if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "project limit exceeded") {
+					t.Errorf("got %v, want the limit error of the API", err)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			d, replay := replayDriver(t, filepath.Join("testdata", "hcloud", tt.fixture))
+			if err := tt.run(d); err != nil {
+				t.Fatal(err)
+			}
+			if unused := replay.unused(); len(unused) > 0 {
+				t.Errorf("interactions not replayed: %v", unused)
+			}
+		})
+	}
+}
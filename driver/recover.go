@@ -0,0 +1,48 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoverInterceptor turns a panic in a handler into an Internal error, so
+// a single bad request doesn't crash the driver and interrupt all other
+// operations.
+func (d *Driver) recoverInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.log.WithFields(logrus.Fields{
+				"method": info.FullMethod,
+				"panic":  r,
+				"stack":  string(debug.Stack()),
+			}).Error("recovered from panic")
+			d.metrics.panicked(info.FullMethod)
+
+			resp = nil
+			err = status.Errorf(codes.Internal, "panic in %s: %v", info.FullMethod, r)
+		}
+	}()
+
+	return handler(ctx, req)
+}
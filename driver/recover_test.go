@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecoverInterceptor(t *testing.T) {
+	d := &Driver{
+		metrics: newMetrics(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Node/NodeStageVolume"}
+
+	resp, err := d.recoverInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var m map[string]string
+		m["boom"] = "boom"
+		return "unreachable", nil
+	})
+	if resp != nil {
+		t.Errorf("expected no response, got %v", resp)
+	}
+	if code := status.Code(err); code != codes.Internal {
+		t.Errorf("expected code %s, got %s", codes.Internal, code)
+	}
+
+	body := scrape(t, d.metrics)
+	want := `hcloud_csi_rpc_panics_total{method="/csi.v0.Node/NodeStageVolume"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected metrics to contain %q:\n%s", want, body)
+	}
+
+	resp, err = d.recoverInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	if resp != "ok" || err != nil {
+		t.Errorf("expected the response of the handler, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// bearerRegexp matches the authorization header of dumped requests.
+	bearerRegexp = regexp.MustCompile(`Bearer\s+[^\s"',}]+`)
+
+	// tokenLikeRegexp matches strings shaped like an hcloud token, 64
+	// letters and digits.
+	tokenLikeRegexp = regexp.MustCompile(`\b[A-Za-z0-9]{64}\b`)
+
+	// hexRegexp matches hex digests, e.g. SHA-256 checksums, which are
+	// shaped like tokens but harmless.
+	hexRegexp = regexp.MustCompile(`^[a-f0-9]+$`)
+)
+
+// redactFormatter scrubs the hcloud tokens from the message and fields of
+// every log entry before formatting it.
+type redactFormatter struct {
+	next logrus.Formatter
+
+	// tokens returns the tokens known to the driver, including rotated
+	// ones and those of request secrets.
+	tokens func() []string
+}
+
+func (f *redactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.next.Format(scrubEntry(entry, f.tokens()))
+}
+
+// redactHook scrubs the entries before passing them to the next hook, e.g.
+// a log sink.
+type redactHook struct {
+	next   logrus.Hook
+	tokens func() []string
+}
+
+func (h *redactHook) Levels() []logrus.Level {
+	return h.next.Levels()
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	return h.next.Fire(scrubEntry(entry, h.tokens()))
+}
+
+// scrubEntry returns a copy of the entry without tokens in its message and
+// fields. The fields are shared with the logger the entry was created from,
+// so they are never modified in place.
+func scrubEntry(entry *logrus.Entry, tokens []string) *logrus.Entry {
+	scrubbed := *entry
+	scrubbed.Message = scrubTokens(entry.Message, tokens)
+
+	scrubbed.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if isSecretField(k) {
+			scrubbed.Data[k] = redacted
+			continue
+		}
+
+		if v == nil {
+			scrubbed.Data[k] = v
+			continue
+		}
+
+		s := fmt.Sprint(v)
+		if clean := scrubTokens(s, tokens); clean != s {
+			scrubbed.Data[k] = clean
+			continue
+		}
+		scrubbed.Data[k] = v
+	}
+	return &scrubbed
+}
+
+// isSecretField returns whether the field holds a secret by its name, e.g.
+// the secrets map of a request.
+func isSecretField(key string) bool {
+	key = strings.ToLower(key)
+	return key == "token" || key == "authorization" || strings.HasSuffix(key, "secrets")
+}
+
+// scrubTokens replaces the known tokens, bearer credentials and anything
+// shaped like an hcloud token in s.
+func scrubTokens(s string, tokens []string) string {
+	for _, token := range tokens {
+		if token != "" {
+			s = strings.Replace(s, token, redacted, -1)
+		}
+	}
+
+	s = bearerRegexp.ReplaceAllString(s, "Bearer "+redacted)
+
+	return tokenLikeRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		if hexRegexp.MatchString(match) {
+			return match
+		}
+		return redacted
+	})
+}
+
+// knownTokens returns all hcloud tokens of the driver.
+func (d *Driver) knownTokens() []string {
+	tokens := []string{d.hcloudToken, d.hcloudSecondaryToken}
+
+	if d.tokens != nil {
+		d.tokens.mu.Lock()
+		tokens = append(tokens, d.tokens.tokens...)
+		d.tokens.mu.Unlock()
+	}
+
+	d.secretClients.mu.Lock()
+	for token := range d.secretClients.clients {
+		tokens = append(tokens, token)
+	}
+	d.secretClients.mu.Unlock()
+
+	return tokens
+}
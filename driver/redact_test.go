@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+func TestScrubTokens(t *testing.T) {
+	token := strings.Repeat("aB3", 21) + "x"
+	digest := strings.Repeat("0f", 32)
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"known secret-token-1 in message", "known <redacted> in message"},
+		{"Authorization: Bearer abc.def", "Authorization: Bearer <redacted>"},
+		{"token " + token + " leaked", "token <redacted> leaked"},
+		{"checksum " + digest, "checksum " + digest},
+		{"nothing to hide", "nothing to hide"},
+	}
+
+	for _, tt := range tests {
+		if got := scrubTokens(tt.in, []string{"secret-token-1"}); got != tt.want {
+			t.Errorf("scrubTokens(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &redactFormatter{
+		next:   logger.Formatter,
+		tokens: func() []string { return []string{"secret-token-1"} },
+	}
+
+	base := logger.WithField("request", map[string]string{"key": "secret-token-1"})
+	base.WithFields(logrus.Fields{
+		"controller_publish_secrets": map[string]string{"token": "other"},
+		"volume_id":                  42,
+	}).WithError(errors.New("request with secret-token-1 failed")).Error("using secret-token-1")
+
+	out := buf.String()
+	if strings.Contains(out, "secret-token-1") || strings.Contains(out, "other") {
+		t.Errorf("expected the tokens to be redacted, got %s", out)
+	}
+	if !strings.Contains(out, "volume_id=42") {
+		t.Errorf("expected other fields to be kept, got %s", out)
+	}
+
+	// the fields of the parent entry are not modified
+	if base.Data["request"].(map[string]string)["key"] != "secret-token-1" {
+		t.Error("expected the fields of the parent entry to be unchanged")
+	}
+}
+
+func TestKnownTokens(t *testing.T) {
+	d := &Driver{
+		hcloudToken: "primary",
+		tokens:      &tokenTransport{tokens: []string{"rotated"}},
+	}
+	d.secretClients.clients = map[string]*hcloud.Client{"project": nil}
+
+	known := strings.Join(d.knownTokens(), ",")
+	for _, token := range []string{"primary", "rotated", "project"} {
+		if !strings.Contains(known, token) {
+			t.Errorf("expected %q in the known tokens, got %s", token, known)
+		}
+	}
+}
+
+// recordingHook records the messages of the entries it is fired for.
+type recordingHook struct {
+	messages []string
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *logrus.Entry) error {
+	h.messages = append(h.messages, entry.Message)
+	return nil
+}
+
+func TestRedactHook(t *testing.T) {
+	sink := &recordingHook{}
+	logger := logrus.New()
+	logger.Out = &bytes.Buffer{}
+	logger.AddHook(&redactHook{next: sink, tokens: func() []string { return []string{"secret-token-1"} }})
+
+	logger.Info("using secret-token-1")
+	if len(sink.messages) != 1 || sink.messages[0] != "using <redacted>" {
+		t.Errorf("expected the sink to get the redacted message, got %v", sink.messages)
+	}
+}
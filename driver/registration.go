@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// The kubelet plugin registration API (pluginregistration.v1) isn't
+// vendored, its few messages and the service are defined here. The proto
+// package is "pluginregistration":
+//
+//   service Registration {
+//     rpc GetInfo(InfoRequest) returns (PluginInfo) {}
+//     rpc NotifyRegistrationStatus(RegistrationStatus) returns (RegistrationStatusResponse) {}
+//   }
+
+const (
+	// csiPluginType is the plugin type kubelet expects from CSI drivers.
+	csiPluginType = "CSIPlugin"
+
+	registrationService = "pluginregistration.Registration"
+)
+
+// pluginInfo is returned to kubelet to register the driver.
+type pluginInfo struct {
+	Type              string   `protobuf:"bytes,1,opt,name=type,proto3"`
+	Name              string   `protobuf:"bytes,2,opt,name=name,proto3"`
+	Endpoint          string   `protobuf:"bytes,3,opt,name=endpoint,proto3"`
+	SupportedVersions []string `protobuf:"bytes,4,rep,name=supported_versions,json=supportedVersions,proto3"`
+}
+
+func (m *pluginInfo) Reset()         { *m = pluginInfo{} }
+func (m *pluginInfo) String() string { return proto.CompactTextString(m) }
+func (*pluginInfo) ProtoMessage()    {}
+
+// registrationStatus tells whether kubelet registered the driver.
+type registrationStatus struct {
+	PluginRegistered bool   `protobuf:"varint,1,opt,name=plugin_registered,json=pluginRegistered,proto3"`
+	Error            string `protobuf:"bytes,2,opt,name=error,proto3"`
+}
+
+func (m *registrationStatus) Reset()         { *m = registrationStatus{} }
+func (m *registrationStatus) String() string { return proto.CompactTextString(m) }
+func (*registrationStatus) ProtoMessage()    {}
+
+type infoRequest struct{}
+
+func (m *infoRequest) Reset()         { *m = infoRequest{} }
+func (m *infoRequest) String() string { return proto.CompactTextString(m) }
+func (*infoRequest) ProtoMessage()    {}
+
+type registrationStatusResponse struct{}
+
+func (m *registrationStatusResponse) Reset()         { *m = registrationStatusResponse{} }
+func (m *registrationStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*registrationStatusResponse) ProtoMessage()    {}
+
+// registrationServer is implemented by the Driver.
+type registrationServer interface {
+	getPluginInfo(ctx context.Context, req *infoRequest) (*pluginInfo, error)
+	notifyRegistrationStatus(ctx context.Context, req *registrationStatus) (*registrationStatusResponse, error)
+}
+
+var registrationServiceDesc = grpc.ServiceDesc{
+	ServiceName: registrationService,
+	HandlerType: (*registrationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInfo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &infoRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(registrationServer).getPluginInfo(ctx, req)
+			},
+		},
+		{
+			MethodName: "NotifyRegistrationStatus",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &registrationStatus{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(registrationServer).notifyRegistrationStatus(ctx, req)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// getPluginInfo returns the name and the CSI endpoint of the driver as
+// seen by kubelet.
+func (d *Driver) getPluginInfo(ctx context.Context, req *infoRequest) (*pluginInfo, error) {
+	return &pluginInfo{
+		Type:              csiPluginType,
+		Name:              d.driverName(),
+		Endpoint:          d.kubeletEndpoint,
+		SupportedVersions: []string{csiSpecVersion},
+	}, nil
+}
+
+// notifyRegistrationStatus logs whether kubelet registered the driver.
+func (d *Driver) notifyRegistrationStatus(ctx context.Context, req *registrationStatus) (*registrationStatusResponse, error) {
+	ll := d.log.WithFields(logrus.Fields{
+		"endpoint": d.kubeletEndpoint,
+		"method":   "notify_registration_status",
+	})
+
+	if !req.PluginRegistered {
+		ll.WithField("error", req.Error).Error("kubelet could not register the driver")
+	} else {
+		ll.Info("driver registered with kubelet")
+	}
+	return &registrationStatusResponse{}, nil
+}
+
+// registrationSocket returns the path of the socket kubelet discovers the
+// driver through.
+func (d *Driver) registrationSocket() string {
+	return filepath.Join(d.registrationDir, d.driverName()+"-reg.sock")
+}
+
+// servePluginRegistration serves the kubelet plugin registration service
+// in the plugin registration directory of kubelet until the driver is
+// stopped, so no driver-registrar sidecar is needed.
+func (d *Driver) servePluginRegistration() {
+	socket := d.registrationSocket()
+	ll := d.log.WithField("socket", socket)
+
+	if err := d.removeStaleSocket(socket); err != nil {
+		ll.WithError(err).Error("serving plugin registration failed")
+		return
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		ll.WithError(err).Error("serving plugin registration failed")
+		return
+	}
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&registrationServiceDesc, d)
+	go func() {
+		<-d.stopCh
+		srv.Stop()
+		os.Remove(socket)
+	}()
+
+	ll.Info("serving plugin registration")
+	if err := srv.Serve(listener); err != nil {
+		ll.WithError(err).Error("serving plugin registration failed")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+func TestPluginRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Driver{
+		registrationDir: dir,
+		kubeletEndpoint: "/var/lib/kubelet/plugins/" + DefaultDriverName + "/csi.sock",
+		log:             logrus.New().WithField("test_enabled", true),
+		stopCh:          make(chan struct{}),
+	}
+	go d.servePluginRegistration()
+	defer close(d.stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, d.registrationSocket(),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", target, timeout)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	info := &pluginInfo{}
+	if err := conn.Invoke(ctx, "/"+registrationService+"/GetInfo", &infoRequest{}, info); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &pluginInfo{
+		Type:              csiPluginType,
+		Name:              DefaultDriverName,
+		Endpoint:          d.kubeletEndpoint,
+		SupportedVersions: []string{csiSpecVersion},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("expected plugin info %v, got %v", want, info)
+	}
+
+	status := &registrationStatus{PluginRegistered: true}
+	if err := conn.Invoke(ctx, "/"+registrationService+"/NotifyRegistrationStatus", status, &registrationStatusResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
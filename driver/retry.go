@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRetries is the number of times a failed hcloud API request is
+	// retried.
+	maxRetries = 3
+
+	// retryBaseDelay and retryMaxDelay bound the jittered exponential
+	// backoff between retries.
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+
+	// retryBudgetMax is the maximum number of retries that can be spent in a
+	// row. Every request refills the budget by retryBudgetRatio, so during
+	// an outage at most one in ten requests is retried.
+	retryBudgetMax   = 10
+	retryBudgetRatio = 0.1
+)
+
+// retryTransport retries hcloud API requests failing with transient errors,
+// i.e. 5xx responses, timeouts and connection resets. Only idempotent
+// requests are retried, a failed POST might have been processed already.
+type retryTransport struct {
+	next http.RoundTripper
+
+	mu     sync.Mutex
+	budget float64
+}
+
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		next:   next,
+		budget: retryBudgetMax,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.refill()
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(attemptReq)
+		if !isRetryable(req, resp, err) || attempt >= maxRetries || !t.spend() {
+			return resp, err
+		}
+
+		// a RoundTripper must not modify the request, the body of every
+		// retry is set on a copy
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+
+			attemptReq = new(http.Request)
+			*attemptReq = *req
+			attemptReq.Body = body
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// refill adds to the retry budget for every request.
+func (t *retryTransport) refill() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.budget += retryBudgetRatio
+	if t.budget > retryBudgetMax {
+		t.budget = retryBudgetMax
+	}
+}
+
+// spend takes a retry from the budget. It returns false if the budget is
+// exhausted.
+func (t *retryTransport) spend() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.budget < 1 {
+		return false
+	}
+	t.budget--
+	return true
+}
+
+// isRetryable returns whether the request failed with a transient error and
+// can be retried safely.
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	if err != nil {
+		// the request was canceled by the caller
+		return req.Context().Err() == nil
+	}
+
+	return resp.StatusCode >= 500
+}
+
+// retryDelay returns a random delay of up to the exponential backoff of the
+// given attempt.
+func retryDelay(attempt int) time.Duration {
+	backoff := retryBaseDelay << uint(attempt)
+	if backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
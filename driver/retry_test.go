@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRetryTransport(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport)}
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || requests != 2 {
+		t.Errorf("got status %d after %d requests, want 200 after 2", resp.StatusCode, requests)
+	}
+
+	requests = 0
+	resp, err = client.Post(ts.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || requests != 1 {
+		t.Errorf("got status %d after %d requests, want POST not to be retried", resp.StatusCode, requests)
+	}
+}
+
+func TestRetryTransportBody(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL, strings.NewReader(`{"name":"pvc-1234"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+
+	resp, err := newRetryTransport(http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(bodies) != 2 || bodies[0] != bodies[1] {
+		t.Errorf("expected the body to be sent again, got %q", bodies)
+	}
+	if req.Body != body {
+		t.Error("expected the body of the request not to be replaced")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tr := newRetryTransport(http.DefaultTransport)
+
+	for i := 0; i < retryBudgetMax; i++ {
+		if !tr.spend() {
+			t.Fatalf("budget exhausted after %d retries, want %d", i, retryBudgetMax)
+		}
+	}
+
+	if tr.spend() {
+		t.Error("retry allowed with an exhausted budget")
+	}
+
+	for i := 0; i < 20; i++ {
+		tr.refill()
+	}
+	if !tr.spend() {
+		t.Error("budget not refilled by requests")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tokenBucket allows burst requests at once and refills one request every
+// interval.
+type tokenBucket struct {
+	mu       sync.Mutex
+	burst    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket returns a full bucket allowing n requests per period.
+func newTokenBucket(n int, period time.Duration) *tokenBucket {
+	return &tokenBucket{
+		burst:    float64(n),
+		interval: period / time.Duration(n),
+		tokens:   float64(n),
+	}
+}
+
+// take removes a token from the bucket. It returns false and the time
+// until the next token is available if the bucket is empty.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(b.interval))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// parseRPCRateLimits parses comma separated rate limits of RPCs of the
+// form "method=n/period", e.g. "ListVolumes=1/30s,CreateVolume=20/1m".
+// The method is the name of the RPC without its service.
+func parseRPCRateLimits(s string) (map[string]*tokenBucket, error) {
+	limits := map[string]*tokenBucket{}
+	if s == "" {
+		return limits, nil
+	}
+
+	for _, spec := range strings.Split(s, ",") {
+		invalid := fmt.Errorf("invalid RPC rate limit %q, must be of the form method=n/period, e.g. ListVolumes=1/30s", spec)
+
+		parts := strings.SplitN(strings.TrimSpace(spec), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, invalid
+		}
+
+		rate := strings.SplitN(parts[1], "/", 2)
+		if len(rate) != 2 {
+			return nil, invalid
+		}
+
+		n, err := strconv.Atoi(rate[0])
+		if err != nil || n < 1 {
+			return nil, invalid
+		}
+
+		period, err := time.ParseDuration(rate[1])
+		if err != nil || period <= 0 {
+			return nil, invalid
+		}
+
+		if _, ok := limits[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate RPC rate limit for %q", parts[0])
+		}
+		limits[parts[0]] = newTokenBucket(n, period)
+	}
+	return limits, nil
+}
+
+// rateLimitInterceptor rejects RPCs exceeding their configured rate with
+// ResourceExhausted, so aggressive resync loops of the sidecars don't use
+// up the hcloud API budget. The sidecars retry with a backoff.
+func (d *Driver) rateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	bucket := d.rpcRateLimits[path.Base(info.FullMethod)]
+	if bucket == nil {
+		return handler(ctx, req)
+	}
+
+	if ok, wait := bucket.take(time.Now()); !ok {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit of %s exceeded, retry in %s", path.Base(info.FullMethod), wait.Round(time.Millisecond))
+	}
+	return handler(ctx, req)
+}
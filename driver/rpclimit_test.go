@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRPCRateLimits(t *testing.T) {
+	limits, err := parseRPCRateLimits("ListVolumes=1/30s, CreateVolume=20/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["ListVolumes"].interval != 30*time.Second || limits["CreateVolume"].interval != 3*time.Second {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+
+	for _, s := range []string{"ListVolumes", "ListVolumes=1", "ListVolumes=0/30s", "ListVolumes=1/0s", "=1/30s", "ListVolumes=1/30s,ListVolumes=2/1m"} {
+		if _, err := parseRPCRateLimits(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 10*time.Second)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("expected request %d of the burst to pass", i)
+		}
+	}
+
+	ok, wait := b.take(now)
+	if ok || wait != 5*time.Second {
+		t.Errorf("expected to wait 5s for the next request, got %v, %s", ok, wait)
+	}
+
+	if ok, _ := b.take(now.Add(5 * time.Second)); !ok {
+		t.Error("expected a refilled token after 5s")
+	}
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	limits, err := parseRPCRateLimits("ListVolumes=1/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{rpcRateLimits: limits}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	list := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/ListVolumes"}
+	probe := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Identity/Probe"}
+
+	if _, err := d.rateLimitInterceptor(context.Background(), nil, list, handler); err != nil {
+		t.Fatalf("expected the first request to pass, got %v", err)
+	}
+	if _, err := d.rateLimitInterceptor(context.Background(), nil, list, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted, got %v", err)
+	}
+	if _, err := d.rateLimitInterceptor(context.Background(), nil, probe, handler); err != nil {
+		t.Errorf("expected unlimited RPCs to pass, got %v", err)
+	}
+}
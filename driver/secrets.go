@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// secretToken is the key of the hcloud token in the secrets of a
+	// request. It overrides the configured token, so a StorageClass can
+	// provision into another project.
+	secretToken = "token"
+)
+
+type clientKey struct{}
+
+type rateLimitKey struct{}
+
+// secretClients caches the hcloud clients of the tokens passed in
+// secrets, so their connections are reused, and the rate limits of their
+// projects.
+type secretClients struct {
+	mu      sync.Mutex
+	clients map[string]*hcloud.Client
+	limits  map[string]*rateLimit
+}
+
+// limit returns the rate limit of the project of the token.
+func (c *secretClients) limit(token string) *rateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limits[token]
+}
+
+// withSecrets returns a context whose hcloud requests are sent with the
+// token of the secrets. The context is returned unchanged if the secrets
+// have no token.
+func (d *Driver) withSecrets(ctx context.Context, secrets map[string]string) (context.Context, error) {
+	token := secrets[secretToken]
+	if token == "" {
+		return ctx, nil
+	}
+
+	client, err := d.secretClient(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not create hcloud client for the token of the secrets: %s", err)
+	}
+	return d.withTokenClient(ctx, token, client), nil
+}
+
+// withTokenClient returns a context whose hcloud requests are sent with the
+// client of the token and held back by the rate limit of its project.
+func (d *Driver) withTokenClient(ctx context.Context, token string, client *hcloud.Client) context.Context {
+	ctx = context.WithValue(ctx, clientKey{}, servicesOf(client))
+	return context.WithValue(ctx, rateLimitKey{}, d.secretClients.limit(token))
+}
+
+// rateLimitOf returns the rate limit of the project the hcloud requests of
+// the context are sent to.
+func (d *Driver) rateLimitOf(ctx context.Context) *rateLimit {
+	if limit, ok := ctx.Value(rateLimitKey{}).(*rateLimit); ok {
+		return limit
+	}
+	return d.rateLimit
+}
+
+// client returns the hcloud services of the token passed in the secrets of
+// the request or the configured ones.
+func (d *Driver) client(ctx context.Context) *hcloudServices {
+	services, ok := ctx.Value(clientKey{}).(*hcloudServices)
+	if !ok {
+		services = d.services
+	}
+	if services == nil {
+		services = servicesOf(d.hcloudClient)
+	}
+
+	if d.faults != nil {
+		services = d.faults.wrap(services)
+	}
+	if d.dryRun {
+		services = withDryRun(services, d.log)
+	}
+	return services
+}
+
+// secretClient returns the cached client of the token or creates it. Every
+// token belongs to a project with a rate limit of its own, which is
+// tracked separately from the one of the configured token.
+func (d *Driver) secretClient(token string) (*hcloud.Client, error) {
+	d.secretClients.mu.Lock()
+	defer d.secretClients.mu.Unlock()
+
+	if client, ok := d.secretClients.clients[token]; ok {
+		return client, nil
+	}
+
+	transport, err := d.hcloudTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	limit := &rateLimit{}
+	client := d.clientWithTransport(token, d.hcloudURL, &rateLimitTransport{
+		next: &metricsTransport{
+			next:    d.recorded(transport),
+			metrics: d.metrics,
+		},
+		rateLimit: limit,
+	}, limit)
+
+	if d.secretClients.clients == nil {
+		d.secretClients.clients = map[string]*hcloud.Client{}
+		d.secretClients.limits = map[string]*rateLimit{}
+	}
+	d.secretClients.clients[token] = client
+	d.secretClients.limits[token] = limit
+	return client, nil
+}
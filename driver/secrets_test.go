@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tokenRecorder records the tokens of the requests to the hcloud API.
+type tokenRecorder struct {
+	next http.Handler
+
+	mu     sync.Mutex
+	tokens map[string]bool
+}
+
+func (r *tokenRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.tokens[req.Header.Get("Authorization")] = true
+	r.mu.Unlock()
+	r.next.ServeHTTP(w, req)
+}
+
+func TestCreateVolumeSecretToken(t *testing.T) {
+	recorder := &tokenRecorder{
+		next:   &fakeAPI{t: t, volumes: map[int]*schema.Volume{}},
+		tokens: map[string]bool{},
+	}
+	ts := httptest.NewServer(recorder)
+	defer ts.Close()
+
+	d := &Driver{
+		location:     "fsn1",
+		hcloudURL:    ts.URL,
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL), hcloud.WithToken("global")),
+		rateLimit:    &rateLimit{},
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:                    "pvc-1234",
+		ControllerCreateSecrets: map[string]string{secretToken: "project"},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: supportedAccessMode,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !recorder.tokens["Bearer project"] || recorder.tokens["Bearer global"] {
+		t.Errorf("expected only the token of the secrets to be used, got %v", recorder.tokens)
+	}
+
+	// the client of a token is reused
+	first, _ := d.secretClient("project")
+	second, _ := d.secretClient("project")
+	if first != second {
+		t.Error("expected the client of the token to be cached")
+	}
+
+	// the project of the token is rate limited on its own
+	ctx, err := d.withSecrets(context.Background(), map[string]string{secretToken: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := d.rateLimitOf(ctx); limit == nil || limit == d.rateLimit {
+		t.Errorf("expected a rate limit of the project of the token, got %v", limit)
+	}
+	if d.rateLimitOf(context.Background()) != d.rateLimit {
+		t.Error("expected the configured rate limit without secrets")
+	}
+
+	if d.client(context.Background()).Volume != VolumeService(&d.hcloudClient.Volume) {
+		t.Error("expected the configured client without secrets")
+	}
+}
+
+func TestNodeStageVolumeSecretToken(t *testing.T) {
+	global := &fakeAPI{t: t, volumes: map[int]*schema.Volume{}}
+	project := &fakeAPI{t: t, volumes: map[int]*schema.Volume{
+		1234: {ID: 1234, Name: "pvc-1234"},
+	}}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer project" {
+			project.ServeHTTP(w, r)
+			return
+		}
+		global.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		hcloudURL:    ts.URL,
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL), hcloud.WithToken("global")),
+		mounter:      &fakeMounter{},
+		log:          logrus.New().WithField("test_enabled", true),
+	}
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "1234",
+		StagingTargetPath: "/stage",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	}
+	if _, err := d.NodeStageVolume(context.Background(), req); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound without the secrets, got %v", err)
+	}
+
+	// the volume only exists in the project of the token of the secrets
+	req.NodeStageSecrets = map[string]string{secretToken: "project"}
+	if _, err := d.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+const (
+	// hcloudAPIVersion is the version of the hcloud API the driver is built
+	// against.
+	hcloudAPIVersion = "v1"
+
+	// labelPurpose marks the resources the self-check creates, so leftovers
+	// can be found and removed.
+	labelPurpose     = "purpose"
+	purposeSelfCheck = "self-check"
+)
+
+// verifySetup verifies the configuration beyond checkHCloud at startup: the
+// API version, that volumes can be listed and that the token can write.
+// The write permission is tested by creating and deleting a labelled SSH
+// key, which costs nothing and affects no server.
+func (d *Driver) verifySetup(ctx context.Context) error {
+	if !strings.HasSuffix(strings.TrimSuffix(d.hcloudURL, "/"), "/"+hcloudAPIVersion) {
+		return fmt.Errorf("unsupported hcloud API URL %q: the driver needs API version %s, e.g. %s", d.hcloudURL, hcloudAPIVersion, hcloud.Endpoint)
+	}
+
+	if err := d.checkLocationExists(ctx); err != nil {
+		return err
+	}
+
+	if _, _, err := d.hcloudClient.Volume.List(ctx, hcloud.VolumeListOpts{ListOpts: hcloud.ListOpts{PerPage: 1}}); err != nil {
+		return fmt.Errorf("could not list volumes, check that the hcloud API URL is correct: %s", err)
+	}
+
+	if d.dryRun {
+		d.log.Info("dry run: would test the write permission of the token with an SSH key")
+		return nil
+	}
+
+	publicKey, err := selfCheckPublicKey()
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	key, _, err := d.hcloudClient.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
+		Name:      createdByHCloud + "-self-check-" + hex.EncodeToString(suffix),
+		PublicKey: publicKey,
+		Labels: map[string]string{
+			labelCreatedBy: createdByHCloud,
+			labelPurpose:   purposeSelfCheck,
+		},
+	})
+	if err != nil {
+		if hcloud.IsError(err, errorCodeForbidden) {
+			return fmt.Errorf("the token is read-only: create a token with read & write permission in the Hetzner Cloud Console under Security > API Tokens")
+		}
+		return fmt.Errorf("could not test the write permission of the token: %s", err)
+	}
+
+	if _, err := d.hcloudClient.SSHKey.Delete(ctx, key); err != nil {
+		d.log.WithError(err).WithField("ssh_key", key.Name).Warn("could not delete the SSH key of the self-check, it can be deleted manually")
+	}
+	return nil
+}
+
+// checkLocationExists returns an error listing the available locations if
+// the location of the driver doesn't exist.
+func (d *Driver) checkLocationExists(ctx context.Context) error {
+	location, _, err := d.hcloudClient.Location.GetByName(ctx, d.location)
+	if err != nil {
+		return fmt.Errorf("could not get location %q: %s", d.location, err)
+	}
+
+	if location != nil {
+		return nil
+	}
+
+	locations, err := d.hcloudClient.Location.All(ctx)
+	if err != nil {
+		return fmt.Errorf("unknown location %q", d.location)
+	}
+
+	var names []string
+	for _, l := range locations {
+		names = append(names, l.Name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown location %q, available locations: %s", d.location, strings.Join(names, ", "))
+}
+
+// selfCheckPublicKey returns a random ed25519 public key in the OpenSSH
+// format. Nobody has the private key, so it grants no access even if the
+// SSH key isn't deleted.
+func selfCheckPublicKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	var blob []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), key} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		blob = append(blob, length...)
+		blob = append(blob, field...)
+	}
+
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob), nil
+}
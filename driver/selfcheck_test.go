@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSelfCheckAPI serves the requests of the self-check under /v1.
+type fakeSelfCheckAPI struct {
+	t        *testing.T
+	readOnly bool
+	keys     map[string]*schema.SSHKeyCreateRequest
+}
+
+func (f *fakeSelfCheckAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.URL.Path == "/v1/locations" && r.URL.Query().Get("name") == "fsn1":
+		w.Write([]byte(`{"locations": [{"id": 1, "name": "fsn1"}]}`))
+	case r.URL.Path == "/v1/locations" && r.URL.Query().Get("name") != "":
+		w.Write([]byte(`{"locations": []}`))
+	case r.URL.Path == "/v1/locations":
+		w.Write([]byte(`{"locations": [{"id": 2, "name": "nbg1"}, {"id": 3, "name": "hel1"}]}`))
+	case r.URL.Path == "/v1/volumes":
+		w.Write([]byte(`{"volumes": []}`))
+	case r.URL.Path == "/v1/ssh_keys" && r.Method == http.MethodPost:
+		if f.readOnly {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"code": "forbidden", "message": "insufficient permissions"}}`))
+			return
+		}
+
+		req := &schema.SSHKeyCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			f.t.Fatal(err)
+		}
+		f.keys[req.Name] = req
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&schema.SSHKeyCreateResponse{
+			SSHKey: schema.SSHKey{ID: 1, Name: req.Name, PublicKey: req.PublicKey},
+		})
+	case r.URL.Path == "/v1/ssh_keys/1" && r.Method == http.MethodDelete:
+		for name := range f.keys {
+			delete(f.keys, name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": "not_found"}}`))
+	}
+}
+
+func TestVerifySetup(t *testing.T) {
+	api := &fakeSelfCheckAPI{t: t, keys: map[string]*schema.SSHKeyCreateRequest{}}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	newDriver := func(url, location string) *Driver {
+		return &Driver{
+			location:     location,
+			hcloudURL:    url,
+			hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(url)),
+			log:          logrus.New().WithField("test_enabled", true),
+		}
+	}
+
+	if err := newDriver(ts.URL+"/v1", "fsn1").verifySetup(context.Background()); err != nil {
+		t.Fatalf("expected the self-check to pass, got %s", err)
+	}
+	if len(api.keys) != 0 {
+		t.Errorf("expected the SSH key of the self-check to be deleted, got %v", api.keys)
+	}
+
+	err := newDriver(ts.URL+"/v2", "fsn1").verifySetup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "API version") {
+		t.Errorf("expected an error about the API version, got %v", err)
+	}
+
+	err = newDriver(ts.URL+"/v1", "ash").verifySetup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "hel1, nbg1") {
+		t.Errorf("expected an error listing the available locations, got %v", err)
+	}
+
+	api.readOnly = true
+	err = newDriver(ts.URL+"/v1", "fsn1").verifySetup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("expected an error about a read-only token, got %v", err)
+	}
+}
+
+func TestSelfCheckPublicKey(t *testing.T) {
+	key, err := selfCheckPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.SplitN(key, " ", 2)
+	if len(parts) != 2 || parts[0] != "ssh-ed25519" {
+		t.Fatalf("unexpected public key %q", key)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two length prefixes, the key type and the 32 byte key
+	if len(blob) != 4+len("ssh-ed25519")+4+32 {
+		t.Errorf("unexpected key blob length %d", len(blob))
+	}
+}
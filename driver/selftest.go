@@ -0,0 +1,214 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+// selfTestCleanupTimeout bounds the cleanup of the self test, which runs
+// even if the context of the test is done.
+const selfTestCleanupTimeout = 5 * time.Minute
+
+// SelfTest runs the storage path of the driver once on the local server: it
+// creates a small volume, attaches, formats and mounts it, writes a file
+// and reads it back. The volume is deleted afterwards, also if a step
+// failed. The progress is written to out.
+func (d *Driver) SelfTest(ctx context.Context, out io.Writer) error {
+	if !d.runsController() || !d.runsNode() {
+		return errors.New("the self test needs a token and runs the controller and the node service")
+	}
+
+	step := func(name string, fn func() error) error {
+		start := time.Now()
+		if err := fn(); err != nil {
+			fmt.Fprintf(out, "FAIL %s: %s\n", name, err)
+			return err
+		}
+		fmt.Fprintf(out, "ok   %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+
+	// the cleanup steps run in reverse order, the first error is returned
+	var cleanups []func(ctx context.Context) error
+	var err error
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), selfTestCleanupTimeout)
+		defer cancel()
+
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			if cleanupErr := cleanups[i](cleanupCtx); cleanupErr != nil && err == nil {
+				err = cleanupErr
+			}
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-selftest")
+	if err != nil {
+		return err
+	}
+	cleanups = append(cleanups, func(context.Context) error {
+		return os.RemoveAll(dir)
+	})
+
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	for _, path := range []string{stagingPath, targetPath} {
+		if err = os.Mkdir(path, 0750); err != nil {
+			return err
+		}
+	}
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: supportedAccessMode,
+	}
+
+	var volumeID string
+	name := fmt.Sprintf("selftest-%d", time.Now().Unix())
+	err = step("create volume "+name, func() error {
+		resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: d.minVolumeSizeBytes()},
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+		})
+		if err != nil {
+			return err
+		}
+		volumeID = resp.Volume.Id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cleanups = append(cleanups, func(ctx context.Context) error {
+		return step("delete volume "+volumeID, func() error {
+			_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			return err
+		})
+	})
+
+	var publishInfo map[string]string
+	err = step("attach volume to server "+d.nodeID, func() error {
+		resp, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           d.nodeID,
+			VolumeCapability: capability,
+		})
+		if err != nil {
+			return err
+		}
+		publishInfo = resp.PublishInfo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cleanups = append(cleanups, func(ctx context.Context) error {
+		return step("detach volume", func() error {
+			_, err := d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: d.nodeID})
+			return err
+		})
+	})
+
+	err = step("format and stage volume at "+stagingPath, func() error {
+		_, err := d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			PublishInfo:       publishInfo,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cleanups = append(cleanups, func(ctx context.Context) error {
+		return step("unstage volume", func() error {
+			_, err := d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+			return err
+		})
+	})
+
+	err = step("mount volume at "+targetPath, func() error {
+		_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			PublishInfo:       publishInfo,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cleanups = append(cleanups, func(ctx context.Context) error {
+		return step("unmount volume", func() error {
+			_, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+			return err
+		})
+	})
+
+	return step("write and verify a file", func() error {
+		return verifyWrite(filepath.Join(targetPath, "selftest"))
+	})
+}
+
+// verifyWrite writes random data to the file, syncs it and reads it back.
+func verifyWrite(path string) error {
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("the content of %s differs from the written data", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestSelfTest(t *testing.T) {
+	f := newFakeServices(10)
+	d := newFakeServicesDriver(f)
+	d.nodeID = "10"
+	d.mounter = &fakeMounter{}
+
+	var out bytes.Buffer
+	if err := d.SelfTest(context.Background(), &out); err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+
+	for _, step := range []string{"create volume", "attach volume", "format and stage volume", "mount volume", "write and verify", "unmount volume", "unstage volume", "detach volume", "delete volume"} {
+		if !strings.Contains(out.String(), "ok   "+step) {
+			t.Errorf("step %q missing in the output:\n%s", step, out.String())
+		}
+	}
+	if len(f.volumes) != 0 {
+		t.Errorf("expected the volume to be deleted, %d left", len(f.volumes))
+	}
+}
+
+func TestSelfTestCleanup(t *testing.T) {
+	f := newFakeServices(10)
+	f.errors["Volume.Attach"] = hcloud.Error{Code: hcloud.ErrorCodeServiceError, Message: "injected"}
+	d := newFakeServicesDriver(f)
+	d.nodeID = "10"
+	d.mounter = &fakeMounter{}
+
+	var out bytes.Buffer
+	if err := d.SelfTest(context.Background(), &out); err == nil {
+		t.Fatal("expected the self test to fail")
+	}
+	if !strings.Contains(out.String(), "FAIL attach volume") {
+		t.Errorf("expected the attach to fail, got:\n%s", out.String())
+	}
+
+	// the volume is deleted, the steps after the failed one are skipped
+	if len(f.volumes) != 0 || strings.Contains(out.String(), "stage") {
+		t.Errorf("expected only the volume to be cleaned up, %d left:\n%s", len(f.volumes), out.String())
+	}
+}
+
+func TestSelfTestNeedsToken(t *testing.T) {
+	d := &Driver{}
+	if err := d.SelfTest(context.Background(), &bytes.Buffer{}); err == nil {
+		t.Error("expected the self test to fail without a token")
+	}
+}
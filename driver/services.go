@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// VolumeService are the volume endpoints of the hcloud API the driver uses,
+// implemented by the Volume field of hcloud.Client.
+type VolumeService interface {
+	GetByID(ctx context.Context, id int) (*hcloud.Volume, *hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Volume, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error)
+	AllWithOpts(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, error)
+	Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error)
+	Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+	Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error)
+}
+
+// ServerService are the server endpoints of the hcloud API the driver
+// uses, implemented by the Server field of hcloud.Client.
+type ServerService interface {
+	GetByID(ctx context.Context, id int) (*hcloud.Server, *hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error)
+}
+
+// ActionService are the action endpoints of the hcloud API the driver
+// uses, implemented by the Action field of hcloud.Client.
+type ActionService interface {
+	GetByID(ctx context.Context, id int) (*hcloud.Action, *hcloud.Response, error)
+}
+
+// hcloudServices are the services the controller and node logic talk to
+// the hcloud API through. The startup checks, the self check and the cost
+// exporter use the hcloud.Client directly.
+type hcloudServices struct {
+	Volume VolumeService
+	Server ServerService
+	Action ActionService
+}
+
+// servicesOf returns the services of the client, nil for a nil client.
+func servicesOf(client *hcloud.Client) *hcloudServices {
+	if client == nil {
+		return nil
+	}
+	return &hcloudServices{
+		Volume: &client.Volume,
+		Server: &client.Server,
+		Action: &client.Action,
+	}
+}
+
+// hasHCloud reports if the driver can talk to the hcloud API.
+func (d *Driver) hasHCloud() bool {
+	return d.services != nil || d.hcloudClient != nil
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServices is an in-memory implementation of the hcloud services.
+// Actions succeed right away, errors can be injected per method.
+type fakeServices struct {
+	mu      sync.Mutex
+	volumes map[int]*hcloud.Volume
+	servers map[int]*hcloud.Server
+	actions map[int]*hcloud.Action
+	lastID  int
+
+	// errors are returned by the methods of the given name, e.g.
+	// "Volume.Attach", instead of calling them
+	errors map[string]error
+
+	// calls counts the calls of each method
+	calls map[string]int
+}
+
+func newFakeServices(serverIDs ...int) *fakeServices {
+	f := &fakeServices{
+		volumes: map[int]*hcloud.Volume{},
+		servers: map[int]*hcloud.Server{},
+		actions: map[int]*hcloud.Action{},
+		lastID:  1000,
+		errors:  map[string]error{},
+		calls:   map[string]int{},
+	}
+	for _, id := range serverIDs {
+		f.servers[id] = &hcloud.Server{ID: id, Name: fmt.Sprintf("server-%d", id)}
+	}
+	return f
+}
+
+// services returns the fakes, to be passed to WithHCloudServices.
+func (f *fakeServices) services() (VolumeService, ServerService, ActionService) {
+	return fakeVolumes{f}, fakeServers{f}, fakeActions{f}
+}
+
+// call records the call of the method and returns its injected error. The
+// lock is held by the caller.
+func (f *fakeServices) call(method string) error {
+	f.calls[method]++
+	return f.errors[method]
+}
+
+func (f *fakeServices) nextID() int {
+	f.lastID++
+	return f.lastID
+}
+
+func (f *fakeServices) action(command string) *hcloud.Action {
+	action := &hcloud.Action{
+		ID:       f.nextID(),
+		Command:  command,
+		Status:   hcloud.ActionStatusSuccess,
+		Progress: 100,
+	}
+	f.actions[action.ID] = action
+	return action
+}
+
+func (f *fakeServices) volume(id int) *hcloud.Volume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.volumes[id]
+}
+
+func fakeResponse(status int) *hcloud.Response {
+	return &hcloud.Response{Response: &http.Response{StatusCode: status}}
+}
+
+func notFound(resource string, id int) (*hcloud.Response, error) {
+	return fakeResponse(http.StatusNotFound), hcloud.Error{
+		Code:    hcloud.ErrorCodeNotFound,
+		Message: fmt.Sprintf("%s %d not found", resource, id),
+	}
+}
+
+type fakeVolumes struct{ f *fakeServices }
+
+func (v fakeVolumes) GetByID(ctx context.Context, id int) (*hcloud.Volume, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.GetByID"); err != nil {
+		return nil, nil, err
+	}
+
+	vol, ok := v.f.volumes[id]
+	if !ok {
+		return nil, fakeResponse(http.StatusNotFound), nil
+	}
+	return vol, fakeResponse(http.StatusOK), nil
+}
+
+func (v fakeVolumes) GetByName(ctx context.Context, name string) (*hcloud.Volume, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.GetByName"); err != nil {
+		return nil, nil, err
+	}
+
+	for _, vol := range v.f.volumes {
+		if vol.Name == name {
+			return vol, fakeResponse(http.StatusOK), nil
+		}
+	}
+	return nil, fakeResponse(http.StatusOK), nil
+}
+
+func (v fakeVolumes) List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.List"); err != nil {
+		return nil, nil, err
+	}
+
+	var ids []int
+	for id, vol := range v.f.volumes {
+		if matchesLabels(vol.Labels, opts.LabelSelector) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	page, perPage := opts.Page, opts.PerPage
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 25
+	}
+	lastPage := (len(ids) + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	var vols []*hcloud.Volume
+	for i := (page - 1) * perPage; i < len(ids) && i < page*perPage; i++ {
+		vols = append(vols, v.f.volumes[ids[i]])
+	}
+
+	resp := fakeResponse(http.StatusOK)
+	resp.Meta.Pagination = &hcloud.Pagination{
+		Page:         page,
+		PerPage:      perPage,
+		LastPage:     lastPage,
+		TotalEntries: len(ids),
+	}
+	if page < lastPage {
+		resp.Meta.Pagination.NextPage = page + 1
+	}
+	return vols, resp, nil
+}
+
+func (v fakeVolumes) AllWithOpts(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, error) {
+	var all []*hcloud.Volume
+	opts.Page = 1
+	for {
+		vols, resp, err := v.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, vols...)
+
+		if resp.Meta.Pagination.NextPage == 0 {
+			return all, nil
+		}
+		opts.Page = resp.Meta.Pagination.NextPage
+	}
+}
+
+func (v fakeVolumes) Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.Create"); err != nil {
+		return hcloud.VolumeCreateResult{}, nil, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return hcloud.VolumeCreateResult{}, nil, err
+	}
+
+	for _, vol := range v.f.volumes {
+		if vol.Name == opts.Name {
+			return hcloud.VolumeCreateResult{}, fakeResponse(http.StatusConflict), hcloud.Error{
+				Code:    hcloud.ErrorCodeInvalidInput,
+				Message: "name is already used",
+			}
+		}
+	}
+
+	vol := &hcloud.Volume{
+		ID:       v.f.nextID(),
+		Name:     opts.Name,
+		Size:     opts.Size,
+		Location: opts.Location,
+		Labels:   opts.Labels,
+		Created:  time.Now(),
+	}
+	v.f.volumes[vol.ID] = vol
+
+	return hcloud.VolumeCreateResult{
+		Volume: vol,
+		Action: v.f.action("create_volume"),
+	}, fakeResponse(http.StatusCreated), nil
+}
+
+func (v fakeVolumes) Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.Delete"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := v.f.volumes[volume.ID]; !ok {
+		return notFound("volume", volume.ID)
+	}
+	delete(v.f.volumes, volume.ID)
+	return fakeResponse(http.StatusNoContent), nil
+}
+
+func (v fakeVolumes) Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.Attach"); err != nil {
+		return nil, nil, err
+	}
+
+	vol, ok := v.f.volumes[volume.ID]
+	if !ok {
+		resp, err := notFound("volume", volume.ID)
+		return nil, resp, err
+	}
+
+	srv, ok := v.f.servers[server.ID]
+	if !ok {
+		resp, err := notFound("server", server.ID)
+		return nil, resp, err
+	}
+
+	if vol.Server != nil {
+		return nil, fakeResponse(http.StatusUnprocessableEntity), hcloud.Error{
+			Code:    hcloud.ErrorCodeInvalidInput,
+			Message: fmt.Sprintf("volume is already attached to server %d", vol.Server.ID),
+		}
+	}
+
+	vol.Server = srv
+	return v.f.action("attach_volume"), fakeResponse(http.StatusCreated), nil
+}
+
+func (v fakeVolumes) Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	if err := v.f.call("Volume.Detach"); err != nil {
+		return nil, nil, err
+	}
+
+	vol, ok := v.f.volumes[volume.ID]
+	if !ok {
+		resp, err := notFound("volume", volume.ID)
+		return nil, resp, err
+	}
+
+	vol.Server = nil
+	return v.f.action("detach_volume"), fakeResponse(http.StatusCreated), nil
+}
+
+type fakeServers struct{ f *fakeServices }
+
+func (s fakeServers) GetByID(ctx context.Context, id int) (*hcloud.Server, *hcloud.Response, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call("Server.GetByID"); err != nil {
+		return nil, nil, err
+	}
+
+	srv, ok := s.f.servers[id]
+	if !ok {
+		return nil, fakeResponse(http.StatusNotFound), nil
+	}
+	return srv, fakeResponse(http.StatusOK), nil
+}
+
+func (s fakeServers) GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call("Server.GetByName"); err != nil {
+		return nil, nil, err
+	}
+
+	for _, srv := range s.f.servers {
+		if srv.Name == name {
+			return srv, fakeResponse(http.StatusOK), nil
+		}
+	}
+	return nil, fakeResponse(http.StatusOK), nil
+}
+
+type fakeActions struct{ f *fakeServices }
+
+func (a fakeActions) GetByID(ctx context.Context, id int) (*hcloud.Action, *hcloud.Response, error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+	if err := a.f.call("Action.GetByID"); err != nil {
+		return nil, nil, err
+	}
+
+	action, ok := a.f.actions[id]
+	if !ok {
+		return nil, fakeResponse(http.StatusNotFound), nil
+	}
+	return action, fakeResponse(http.StatusOK), nil
+}
+
+// newFakeServicesDriver returns a driver talking to the fake services.
+func newFakeServicesDriver(f *fakeServices) *Driver {
+	d := &Driver{
+		location:           "fsn1",
+		actionPollInterval: time.Millisecond,
+		log:                logrus.New().WithField("test_enabled", true),
+	}
+	WithHCloudServices(f.services())(d)
+	return d
+}
+
+func TestFakeServicesVolumeLifecycle(t *testing.T) {
+	f := newFakeServices(10, 20)
+	d := newFakeServicesDriver(f)
+	ctx := context.Background()
+
+	createReq := &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: supportedAccessMode,
+		}},
+	}
+
+	created, err := d.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// creating the same volume again returns the existing one
+	again, err := d.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Volume.Id != created.Volume.Id || f.calls["Volume.Create"] != 1 {
+		t.Errorf("expected the volume to be created once, got ids %s/%s and %d creates", created.Volume.Id, again.Volume.Id, f.calls["Volume.Create"])
+	}
+
+	// the name of the existing volume is cached now
+	if _, err := d.CreateVolume(ctx, createReq); err != nil {
+		t.Fatal(err)
+	}
+	if f.calls["Volume.GetByName"] != 2 {
+		t.Errorf("expected the name to be looked up twice, got %d lookups", f.calls["Volume.GetByName"])
+	}
+
+	publish := func(node string) error {
+		_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         created.Volume.Id,
+			NodeId:           node,
+			VolumeCapability: createReq.VolumeCapabilities[0],
+		})
+		return err
+	}
+
+	if err := publish("10"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := strconv.Atoi(created.Volume.Id)
+	if vol := f.volume(id); vol.Server == nil || vol.Server.ID != 10 {
+		t.Errorf("expected the volume to be attached to server 10, got %+v", vol.Server)
+	}
+
+	// publishing to the same server again succeeds, to another one fails
+	if err := publish("10"); err != nil {
+		t.Errorf("publishing again: %s", err)
+	}
+	if code := status.Code(publish("20")); code != codes.FailedPrecondition {
+		t.Errorf("publishing to another server: got code %s, want %s", code, codes.FailedPrecondition)
+	}
+	if code := status.Code(publish("30")); code != codes.NotFound {
+		t.Errorf("publishing to an unknown server: got code %s, want %s", code, codes.NotFound)
+	}
+
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: created.Volume.Id,
+		NodeId:   "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := f.volume(id); vol.Server != nil {
+		t.Errorf("expected the volume to be detached, got server %d", vol.Server.ID)
+	}
+
+	// deleting is idempotent
+	for i := 0; i < 2; i++ {
+		if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Volume.Id}); err != nil {
+			t.Fatalf("delete %d: %s", i, err)
+		}
+	}
+	if f.volume(id) != nil {
+		t.Error("expected the volume to be deleted")
+	}
+}
+
+func TestFakeServicesInjectedErrors(t *testing.T) {
+	f := newFakeServices(10)
+	f.volumes[1] = &hcloud.Volume{ID: 1, Name: "volume", Server: f.servers[10]}
+	f.errors["Volume.Detach"] = hcloud.Error{Code: hcloud.ErrorCodeServiceError, Message: "injected"}
+	d := newFakeServicesDriver(f)
+
+	_, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "1",
+		NodeId:   "10",
+	})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("got code %s, want %s (error: %v)", code, codes.Aborted, err)
+	}
+
+	// the node service looks up the volume before staging it
+	d.mounter = &fakeMounter{}
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "2",
+		StagingTargetPath: "/stage",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("staging an unknown volume: got code %s, want %s (error: %v)", code, codes.NotFound, err)
+	}
+}
+
+func TestFakeServicesListVolumesPages(t *testing.T) {
+	f := newFakeServices()
+	for i := 1; i <= 60; i++ {
+		f.volumes[i] = &hcloud.Volume{ID: i, Name: fmt.Sprintf("volume-%d", i)}
+	}
+	d := newFakeServicesDriver(f)
+
+	resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Entries) != 60 || f.calls["Volume.List"] != 3 {
+		t.Errorf("got %d volumes in %d pages, want 60 in 3", len(resp.Entries), f.calls["Volume.List"])
+	}
+}
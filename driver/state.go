@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stagingState is recorded for every staged volume, so the node service can
+// finish operations on the volume after the plugin was restarted.
+type stagingState struct {
+	VolumeID          string   `json:"volume_id"`
+	StagingTargetPath string   `json:"staging_target_path"`
+	Device            string   `json:"device"`
+	Block             bool     `json:"block,omitempty"`
+	FsType            string   `json:"fs_type,omitempty"`
+	MountOptions      []string `json:"mount_options,omitempty"`
+	PVCName           string   `json:"pvc_name,omitempty"`
+	PVCNamespace      string   `json:"pvc_namespace,omitempty"`
+}
+
+// stagingStatePath returns the path of the staging record of the volume.
+func (d *Driver) stagingStatePath(volumeID string) string {
+	return filepath.Join(d.dataDir, "volumes", volumeID+".json")
+}
+
+// saveStagingState writes the staging record of a volume. It does nothing if
+// no data directory is configured.
+func (d *Driver) saveStagingState(state *stagingState) error {
+	if d.dataDir == "" {
+		return nil
+	}
+
+	path := d.stagingStatePath(state.VolumeID)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("creating staging state directory failed: %s", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a partial
+	// record behind
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("writing staging state failed: %s", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing staging state failed: %s", err)
+	}
+	return nil
+}
+
+// loadStagingState reads the staging record of a volume. It returns nil if
+// the volume has no record or no data directory is configured.
+func (d *Driver) loadStagingState(volumeID string) (*stagingState, error) {
+	if d.dataDir == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(d.stagingStatePath(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading staging state failed: %s", err)
+	}
+
+	state := &stagingState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("staging state of volume %q is corrupted: %s", volumeID, err)
+	}
+	return state, nil
+}
+
+// removeStagingState deletes the staging record of a volume.
+func (d *Driver) removeStagingState(volumeID string) error {
+	if d.dataDir == "" {
+		return nil
+	}
+
+	err := os.Remove(d.stagingStatePath(volumeID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing staging state failed: %s", err)
+	}
+	return nil
+}
+
+// listStagingStates returns the staging records of all volumes staged on
+// this node.
+func (d *Driver) listStagingStates() ([]*stagingState, error) {
+	if d.dataDir == "" {
+		return nil, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(d.dataDir, "volumes", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*stagingState
+	for _, path := range paths {
+		state, err := d.loadStagingState(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStagingState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Driver{dataDir: dir}
+
+	state, err := d.loadStagingState("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Fatalf("expected no state, got %+v", state)
+	}
+
+	want := &stagingState{
+		VolumeID:          "1234",
+		StagingTargetPath: "/var/lib/kubelet/plugins/staging/1234",
+		Device:            "/dev/disk/by-id/scsi-0HC_Volume_1234",
+		FsType:            "ext4",
+		MountOptions:      []string{"noatime"},
+	}
+	if err := d.saveStagingState(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.loadStagingState("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	if err := d.removeStagingState("1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.removeStagingState("1234"); err != nil {
+		t.Errorf("removing a missing state should succeed, got %s", err)
+	}
+}
+
+func TestStagingStateInvalidVolumeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a record outside of the volumes directory of the data directory
+	outside := filepath.Join(dir, "x.json")
+	if err := ioutil.WriteFile(outside, []byte("{}"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		dataDir: filepath.Join(dir, "data"),
+		mounter: &fakeMounter{},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "../../x",
+		StagingTargetPath: "/stage",
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unstage: expected InvalidArgument, got %v", err)
+	}
+
+	_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "../../x",
+		TargetPath: "/target",
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unpublish: expected InvalidArgument, got %v", err)
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("expected the file outside of the data directory to be kept, got %v", err)
+	}
+}
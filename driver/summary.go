@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secrets in the configuration summary.
+const redacted = "<redacted>"
+
+// configSummary returns the effective configuration of the driver as log
+// fields. Secrets like tokens are redacted, so the summary can be shared
+// safely.
+func (d *Driver) configSummary() logrus.Fields {
+	defaultSize, _ := d.defaultVolumeSizeFor(nil)
+
+	return logrus.Fields{
+		"endpoint":        d.endpoint,
+		"driver_name":     d.driverName(),
+		"mode":            d.mode,
+		"node_id":         d.nodeID,
+		"cluster_name":    d.clusterName,
+		"location":        d.location,
+		"topology_keys":   strings.Join(d.topologyKeys(), ","),
+		"controller":      d.runsController(),
+		"node":            d.runsNode(),
+		"token":           redact(d.hcloudToken),
+		"token_file":      d.tokenFile,
+		"token_secret":    d.tokenSecret,
+		"projects":        strings.Join(d.projectAliases(), ","),
+		"secondary_token": redact(d.hcloudSecondaryToken),
+		"hcloud_url":      d.hcloudURL,
+		"hcloud_proxy":    redactURL(d.hcloudProxy),
+		"hcloud_ca_file":  d.hcloudCAFile,
+
+		"hcloud_request_timeout":    d.hcloudRequestTimeout.String(),
+		"inject_errors":             d.injectErrors,
+		"hcloud_record":             d.hcloudRecordFile,
+		"dry_run":                   d.dryRun,
+		"action_timeout":            d.actionTimeout.String(),
+		"action_poll_interval":      d.actionPollInterval.String(),
+		"action_log_every":          d.actionLogEvery,
+		"device_wait_timeout":       d.deviceWaitTimeout.String(),
+		"slow_request_threshold":    d.slowRequestThreshold.String(),
+		"max_concurrent_operations": d.maxConcurrentOperations,
+		"rpc_rate_limits":           d.rpcRateLimit,
+		"tls":                       d.tls != nil,
+
+		"default_volume_size_gb":  defaultSize / GB,
+		"min_volume_size_gb":      d.minVolumeSizeBytes() / GB,
+		"round_up_small_requests": d.roundUpSmallRequests,
+		"list_only_managed":       d.listOnlyManaged,
+		"fsck_mode":               d.fsckMode,
+		"format_policy":           d.formatPolicy,
+		"format_on_stage":         !d.disableFormat,
+		"udev_settle":             d.udevSettle,
+		"fstrim_interval":         d.fstrimInterval.String(),
+		"data_dir":                d.dataDir,
+		"mount_health_interval":   d.mountHealthInterval.String(),
+		"remount_staged":          d.remountStaged,
+		"remove_target_paths":     d.removeTargetPaths,
+		"reduced_privileges":      d.reducedPrivileges,
+		"metrics_address":         d.metricsAddress,
+		"inventory_interval":      d.inventoryInterval.String(),
+		"health_address":          d.healthAddress,
+		"pprof_address":           d.pprofAddress,
+		"grpc_reflection":         d.grpcReflection,
+		"kube_events":             d.kubeEvents,
+		"leader_election":         d.leaderElection,
+		"self_check":              d.selfCheck,
+		"registration_dir":        d.registrationDir,
+		"kubelet_endpoint":        d.kubeletEndpoint,
+		"docker_plugin_socket":    d.dockerPluginSocket,
+		"journal_dir":             d.journalDir,
+		"orphan_grace_period":     d.orphanGracePeriod.String(),
+		"reconcile_interval":      d.reconcileInterval.String(),
+		"embedded_controllers":    d.embeddedControllers,
+		"cost_exporter":           d.costExporter,
+		"webhook_url":             redact(d.webhookURL),
+		"webhook_format":          d.webhookFormat,
+		"webhook_threshold":       d.webhookThreshold,
+		"host_root":               d.hostRoot,
+		"log_format":              d.logFormat,
+		"log_sink":                d.logSink,
+		"log_level":               logLevel(d.log.Logger).String(),
+	}
+}
+
+// redact hides a secret, but still tells whether it is set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL hides the password of a URL, e.g. of a proxy.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redact(s)
+	}
+
+	if u.User == nil {
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		// angle brackets would be escaped in the URL
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
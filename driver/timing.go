@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// defaultSlowRequestThreshold is the duration above which a request is
+// logged as slow, unless another threshold is configured.
+const defaultSlowRequestThreshold = 30 * time.Second
+
+type timingKey struct{}
+
+// requestTiming accumulates where a request spent its time.
+type requestTiming struct {
+	mu         sync.Mutex
+	api        time.Duration
+	apiCalls   int
+	actionWait time.Duration
+}
+
+// withTiming returns a context that accumulates the timing of a request.
+func withTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+// timingFromContext returns the timing of the request, nil if it's not
+// recorded.
+func timingFromContext(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(timingKey{}).(*requestTiming)
+	return t
+}
+
+// addAPICall records a request to the hcloud API.
+func (t *requestTiming) addAPICall(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.api += d
+	t.apiCalls++
+}
+
+// addActionWait records the time spent waiting for an action.
+func (t *requestTiming) addActionWait(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.actionWait += d
+}
+
+// fields returns the timing as log fields.
+func (t *requestTiming) fields() logrus.Fields {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return logrus.Fields{
+		"api_duration":         t.api.String(),
+		"api_calls":            t.apiCalls,
+		"action_wait_duration": t.actionWait.String(),
+	}
+}
+
+// slowRequestInterceptor logs requests that took longer than the slow
+// request threshold with a breakdown of where the time was spent.
+func (d *Driver) slowRequestInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if d.slowRequestThreshold <= 0 {
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	ctx, timing := withTiming(ctx)
+	resp, err := handler(ctx, req)
+
+	if duration := time.Since(start); duration >= d.slowRequestThreshold {
+		d.log.WithFields(timing.fields()).WithFields(logrus.Fields{
+			"method":    info.FullMethod,
+			"code":      status.Code(err).String(),
+			"duration":  duration.String(),
+			"threshold": d.slowRequestThreshold.String(),
+		}).Warn("slow request")
+	}
+	return resp, err
+}
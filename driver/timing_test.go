@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+func TestSlowRequestInterceptor(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &metricsTransport{next: http.DefaultTransport}}
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+
+	d := &Driver{
+		slowRequestThreshold: time.Millisecond,
+		log:                  logger.WithField("test_enabled", true),
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/ControllerPublishVolume"}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		r, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(r.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+
+		timingFromContext(ctx).addActionWait(2 * time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		return nil, nil
+	}
+
+	if _, err := d.slowRequestInterceptor(context.Background(), nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"slow request", "api_calls=1", "action_wait_duration=2ms", "method=/csi.v0.Controller/ControllerPublishVolume"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected log to contain %q: %s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	d.slowRequestThreshold = time.Hour
+	if _, err := d.slowRequestInterceptor(context.Background(), nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no log for a fast request: %s", out.String())
+	}
+}
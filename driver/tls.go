@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tlsReloadInterval is the interval the certificate, key and CA files
+	// are read again in, so rotated certificates are picked up.
+	tlsReloadInterval = time.Minute
+)
+
+// tlsFiles serves the gRPC endpoint with the certificate and key from
+// disk and optionally verifies client certificates against a CA. The
+// files are reloaded periodically, new connections use the latest ones.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// load reads the certificate, key and CA. The previous ones stay in use
+// if one of the files is invalid.
+func (t *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if t.caFile != "" {
+		data, err := ioutil.ReadFile(t.caFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CA: %s", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("client CA %q contains no PEM encoded certificates", t.caFile)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	t.clientCA = pool
+	return nil
+}
+
+// config returns the TLS configuration of the server. It takes the
+// certificate and CA loaded last for every connection.
+func (t *tlsFiles) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.cert},
+				NextProtos:   []string{"h2"},
+			}
+			if t.clientCA != nil {
+				cfg.ClientCAs = t.clientCA
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// validateTLS checks that the TLS files are only configured for a TCP
+// endpoint and are complete.
+func (d *Driver) validateTLS() error {
+	if d.tls == nil {
+		return nil
+	}
+
+	if d.tls.certFile == "" || d.tls.keyFile == "" {
+		return errors.New("TLS needs a certificate and a key")
+	}
+
+	if !strings.HasPrefix(d.endpoint, "tcp:") {
+		return fmt.Errorf("TLS is only supported for tcp endpoints, got %q", d.endpoint)
+	}
+
+	return d.tls.load()
+}
+
+// watchTLSFiles reloads the TLS files periodically until the driver is
+// stopped, so rotated certificates are used without a restart.
+func (d *Driver) watchTLSFiles() {
+	ll := d.log.WithField("cert_file", d.tls.certFile)
+
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			return
+		}
+
+		// a Secret is replaced by swapping a symlink, the files might be
+		// missing for a moment
+		if err := d.tls.load(); err != nil {
+			ll.WithError(err).Warn("could not reload TLS files")
+		}
+	}
+}
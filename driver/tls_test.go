@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCert is a certificate and its key signed by parent, or self-signed if
+// parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", false, ca).write(t, dir, "server")
+	client := newTestCert(t, "client", false, ca)
+
+	d := &Driver{
+		endpoint: "tcp://127.0.0.1:0",
+		log:      logrus.New().WithField("test_enabled", true),
+		ready:    true,
+		tls:      &tlsFiles{certFile: certFile, keyFile: keyFile, caFile: caFile},
+	}
+	if err := d.validateTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(d.tls.config())))
+	csi.RegisterIdentityServer(srv, d)
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	probe := func(certs []tls.Certificate) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+		return err
+	}
+
+	if err := probe([]tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}); err != nil {
+		t.Errorf("expected a client with certificate to be served, got %s", err)
+	}
+	if err := probe(nil); err == nil {
+		t.Error("expected a client without certificate to be rejected")
+	}
+
+	// the liveness check can't present a client certificate
+	d.addr = listener.Addr()
+	if err := d.checkLive(); err != nil {
+		t.Errorf("expected the driver to be live, got %s", err)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	d := &Driver{endpoint: "unix:///csi/csi.sock", tls: &tlsFiles{certFile: "tls.crt", keyFile: "tls.key"}}
+	if err := d.validateTLS(); err == nil {
+		t.Error("expected an error for TLS on a unix endpoint")
+	}
+
+	d = &Driver{endpoint: "tcp://0.0.0.0:10000", tls: &tlsFiles{caFile: "ca.crt"}}
+	if err := d.validateTLS(); err == nil {
+		t.Error("expected an error for a CA without certificate")
+	}
+}
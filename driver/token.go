@@ -0,0 +1,311 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// tokenFileInterval is the interval in which the token file is checked
+	// for a rotated token.
+	tokenFileInterval = 10 * time.Second
+
+	// tokenSecretKey is the key of the token in the token Secret, the same
+	// the deployment manifests use.
+	tokenSecretKey = "access-token"
+
+	// tokenSecretRetryInterval is the interval a failed watch of the token
+	// Secret is started again in.
+	tokenSecretRetryInterval = 5 * time.Second
+)
+
+// tokenTransport authenticates hcloud API requests with one of several
+// tokens. If the API rejects the current token or rate limits it, the
+// transport switches to the next token and repeats the request with it.
+// The tokens can be replaced at any time, e.g. after reading a rotated
+// token file.
+type tokenTransport struct {
+	next   http.RoundTripper
+	tokens []string
+
+	// onFailover is called after switching to another token.
+	onFailover func(from, to int, status int)
+
+	mu      sync.Mutex
+	current int
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idx, token := t.currentToken()
+
+	resp, err := t.next.RoundTrip(authorize(req, token))
+	if err != nil || len(t.tokens) < 2 || !isTokenRejected(resp) {
+		return resp, err
+	}
+
+	// the rejected request wasn't processed, so it's safe to repeat it
+	// regardless of the method
+	var body io.ReadCloser
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return resp, err
+		}
+
+		var bodyErr error
+		body, bodyErr = req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+	}
+
+	token = t.failover(idx, resp.StatusCode)
+	resp.Body.Close()
+
+	// the request of the caller must not be modified, the repeated one gets
+	// the new body
+	r := authorize(req, token)
+	if body != nil {
+		r.Body = body
+	}
+	return t.next.RoundTrip(r)
+}
+
+// currentToken returns the index of the token in use and the token.
+func (t *tokenTransport) currentToken() (int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current, t.tokens[t.current]
+}
+
+// token returns the token with the given index.
+func (t *tokenTransport) token(idx int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tokens[idx]
+}
+
+// setToken replaces the token with the given index, e.g. after it was
+// rotated. The replaced token is used again right away.
+func (t *tokenTransport) setToken(idx int, token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[idx] = token
+	t.current = idx
+}
+
+// failover switches from the rejected token to the next one and returns
+// it. If a concurrent request already switched away from the rejected
+// token, the token it switched to is used.
+func (t *tokenTransport) failover(rejected int, status int) string {
+	t.mu.Lock()
+	if t.current != rejected {
+		defer t.mu.Unlock()
+		return t.tokens[t.current]
+	}
+
+	t.current = (rejected + 1) % len(t.tokens)
+	next := t.current
+	token := t.tokens[next]
+	t.mu.Unlock()
+
+	if t.onFailover != nil {
+		t.onFailover(rejected, next, status)
+	}
+	return token
+}
+
+// authorize returns a copy of the request authenticated with the given
+// token. A RoundTripper must not modify the original request.
+func authorize(req *http.Request, token string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// isTokenRejected returns whether the API refused the request because of
+// the token it was sent with.
+func isTokenRejected(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// readTokenFile reads an hcloud token from the given file, e.g. a mounted
+// Kubernetes Secret.
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file failed: %s", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %q is empty", path)
+	}
+	return token, nil
+}
+
+// watchTokenFile reloads the token file periodically and switches the hcloud
+// client to the new token once it changed, until the driver is stopped.
+func (d *Driver) watchTokenFile() {
+	ll := d.log.WithField("token_file", d.tokenFile)
+	ll.WithField("interval", tokenFileInterval).Info("watching token file for changes")
+
+	ticker := time.NewTicker(tokenFileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stopCh:
+			return
+		}
+
+		token, err := readTokenFile(d.tokenFile)
+		if err != nil {
+			// a Secret is replaced by swapping a symlink, the file might be
+			// missing for a moment
+			ll.WithError(err).Warn("could not reload token file")
+			continue
+		}
+
+		if token == d.tokens.token(0) {
+			continue
+		}
+
+		d.tokens.setToken(0, token)
+		ll.Info("token file changed, switched to the new token")
+	}
+}
+
+// parseTokenSecret parses a reference to a Secret of the form
+// namespace/name.
+func parseTokenSecret(ref string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid token secret %q, must be of the form namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// tokenFromSecret returns the hcloud token of the Secret.
+func tokenFromSecret(secret *v1.Secret) (string, error) {
+	token := strings.TrimSpace(string(secret.Data[tokenSecretKey]))
+	if token == "" {
+		return "", fmt.Errorf("secret %s/%s has no %q", secret.Namespace, secret.Name, tokenSecretKey)
+	}
+	return token, nil
+}
+
+// readTokenSecret reads the hcloud token from the configured Secret.
+func (d *Driver) readTokenSecret() (string, error) {
+	namespace, name, err := parseTokenSecret(d.tokenSecret)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := d.kubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get token secret %s: %s", d.tokenSecret, err)
+	}
+	return tokenFromSecret(secret)
+}
+
+// watchTokenSecret watches the token Secret and switches the hcloud client
+// to the new token as soon as it changed, until the driver is stopped.
+func (d *Driver) watchTokenSecret() {
+	ll := d.log.WithField("token_secret", d.tokenSecret)
+	ll.Info("watching token secret for changes")
+
+	// validated by NewDriver already
+	namespace, name, _ := parseTokenSecret(d.tokenSecret)
+
+	for {
+		if err := d.watchTokenSecretOnce(namespace, name); err != nil {
+			ll.WithError(err).Warn("watching token secret failed")
+		}
+
+		select {
+		case <-time.After(tokenSecretRetryInterval):
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// watchTokenSecretOnce applies the changes of the token Secret until the
+// watch ends, which the API server does after a while.
+func (d *Driver) watchTokenSecretOnce(namespace, name string) error {
+	w, err := d.kubeClient.CoreV1().Secrets(namespace).Watch(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for {
+		var event watch.Event
+		var ok bool
+		select {
+		case event, ok = <-w.ResultChan():
+		case <-d.stopCh:
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+
+		secret, isSecret := event.Object.(*v1.Secret)
+		if !isSecret || (event.Type != watch.Added && event.Type != watch.Modified) {
+			continue
+		}
+
+		token, err := tokenFromSecret(secret)
+		if err != nil {
+			d.log.WithError(err).Warn("could not reload token secret")
+			continue
+		}
+
+		if token == d.tokens.token(0) {
+			continue
+		}
+
+		d.tokens.setToken(0, token)
+		d.log.WithField("token_secret", d.tokenSecret).Info("token secret changed, switched to the new token")
+	}
+}
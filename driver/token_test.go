@@ -0,0 +1,242 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestTokenTransport(t *testing.T) {
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		auth := r.Header.Get("Authorization")
+		seen = append(seen, auth+" "+string(body))
+
+		if auth != "Bearer secondary" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	failovers := 0
+	transport := &tokenTransport{
+		next:   http.DefaultTransport,
+		tokens: []string{"primary", "secondary"},
+		onFailover: func(from, to int, status int) {
+			failovers++
+			if from != 0 || to != 1 || status != http.StatusUnauthorized {
+				t.Errorf("unexpected failover from %d to %d on status %d", from, to, status)
+			}
+		},
+	}
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	if failovers != 1 {
+		t.Errorf("expected 1 failover, got %d", failovers)
+	}
+
+	want := []string{"Bearer primary body", "Bearer secondary body", "Bearer secondary body"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Errorf("expected requests %q, got %q", want, seen)
+	}
+}
+
+func TestTokenTransportBody(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer secondary" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"name":"pvc-1234"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+
+	transport := &tokenTransport{
+		next:   http.DefaultTransport,
+		tokens: []string{"primary", "secondary"},
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(bodies) != 2 || bodies[0] != bodies[1] {
+		t.Errorf("expected the body to be sent again, got %q", bodies)
+	}
+	if req.Body != body {
+		t.Error("expected the body of the request not to be replaced")
+	}
+}
+
+func TestTokenTransportSetToken(t *testing.T) {
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	transport := &tokenTransport{
+		next:   http.DefaultTransport,
+		tokens: []string{"old"},
+	}
+	client := &http.Client{Transport: transport}
+
+	for _, token := range []string{"old", "new"} {
+		transport.setToken(0, token)
+
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []string{"Bearer old", "Bearer new"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Errorf("expected requests %q, got %q", want, seen)
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if _, err := readTokenFile(path); err == nil {
+		t.Error("expected an error for a missing token file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTokenFile(path); err == nil {
+		t.Error("expected an error for an empty token file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := readTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "secret" {
+		t.Errorf("expected token %q, got %q", "secret", token)
+	}
+}
+
+func TestTokenSecret(t *testing.T) {
+	secret := func(token string) *v1.Secret {
+		return &v1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "hcloud"},
+			Data:       map[string][]byte{tokenSecretKey: []byte(token)},
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v1/namespaces/kube-system/secrets/hcloud":
+			json.NewEncoder(w).Encode(secret("initial"))
+		case r.URL.Path == "/api/v1/namespaces/kube-system/secrets" && r.URL.Query().Get("watch") == "true":
+			if r.URL.Query().Get("fieldSelector") != "metadata.name=hcloud" {
+				t.Errorf("unexpected field selector %q", r.URL.Query().Get("fieldSelector"))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"type": "MODIFIED", "object": secret("rotated")})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: ts.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		tokenSecret: "kube-system/hcloud",
+		kubeClient:  kubeClient,
+		log:         logrus.New().WithField("test_enabled", true),
+		stopCh:      make(chan struct{}),
+	}
+
+	token, err := d.readTokenSecret()
+	if err != nil || token != "initial" {
+		t.Fatalf("expected the initial token, got %q, %v", token, err)
+	}
+
+	d.tokens = &tokenTransport{tokens: []string{token}}
+	if err := d.watchTokenSecretOnce("kube-system", "hcloud"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := d.tokens.token(0); got != "rotated" {
+		t.Errorf("expected the rotated token, got %q", got)
+	}
+}
+
+func TestParseTokenSecret(t *testing.T) {
+	if ns, name, err := parseTokenSecret("kube-system/hcloud"); err != nil || ns != "kube-system" || name != "hcloud" {
+		t.Errorf("unexpected result %q, %q, %v", ns, name, err)
+	}
+
+	for _, ref := range []string{"hcloud", "/hcloud", "kube-system/", "a/b/c"} {
+		if _, _, err := parseTokenSecret(ref); err == nil {
+			t.Errorf("expected an error for %q", ref)
+		}
+	}
+}
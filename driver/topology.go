@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+const (
+	// defaultTopologyKey is the topology segment holding the location of a
+	// node or volume, unless another key is configured.
+	defaultTopologyKey = "location"
+)
+
+// topologyKeys returns the configured topology key followed by its aliases.
+func (d *Driver) topologyKeys() []string {
+	key := d.topologyKey
+	if key == "" {
+		key = defaultTopologyKey
+	}
+	return append([]string{key}, d.topologyAliases...)
+}
+
+// nodeTopology returns the topology of the node. It contains the location
+// under every topology key, so volumes of any of them can be scheduled to
+// the node.
+func (d *Driver) nodeTopology() *csi.Topology {
+	segments := map[string]string{}
+	for _, key := range d.topologyKeys() {
+		segments[key] = d.location
+	}
+	return &csi.Topology{Segments: segments}
+}
+
+// volumeTopology returns the topologies a volume is accessible from. Every
+// key gets its own topology, so nodes that only know one of them, e.g.
+// nodes of another driver during a migration, match as well.
+func (d *Driver) volumeTopology() []*csi.Topology {
+	var topologies []*csi.Topology
+	for _, key := range d.topologyKeys() {
+		topologies = append(topologies, &csi.Topology{
+			Segments: map[string]string{key: d.location},
+		})
+	}
+	return topologies
+}
+
+// topologyLocation returns the location of the topology under the first
+// known topology key.
+func (d *Driver) topologyLocation(t *csi.Topology) (string, bool) {
+	for _, key := range d.topologyKeys() {
+		if location, ok := t.Segments[key]; ok {
+			return location, true
+		}
+	}
+	return "", false
+}
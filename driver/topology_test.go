@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+func TestTopologyAliases(t *testing.T) {
+	d := &Driver{
+		location:        "fsn1",
+		topologyAliases: []string{"csi.hetzner.cloud/location"},
+	}
+
+	wantNode := map[string]string{"location": "fsn1", "csi.hetzner.cloud/location": "fsn1"}
+	if segments := d.nodeTopology().Segments; !reflect.DeepEqual(segments, wantNode) {
+		t.Errorf("expected node topology %v, got %v", wantNode, segments)
+	}
+
+	if topologies := d.volumeTopology(); len(topologies) != 2 {
+		t.Errorf("expected a volume topology per key, got %v", topologies)
+	}
+
+	location, ok := d.topologyLocation(&csi.Topology{Segments: map[string]string{"csi.hetzner.cloud/location": "nbg1"}})
+	if !ok || location != "nbg1" {
+		t.Errorf("expected location nbg1 from alias, got %q", location)
+	}
+
+	if _, ok := d.topologyLocation(&csi.Topology{Segments: map[string]string{"zone": "nbg1"}}); ok {
+		t.Error("expected no location for an unknown key")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// csiSpecVersion is the version of the CSI spec the driver implements.
+const csiSpecVersion = "0.3.0"
+
+// BuildInfo describes the binary of the driver.
+type BuildInfo struct {
+	Version        string `json:"version"`
+	Commit         string `json:"commit"`
+	TreeState      string `json:"tree_state"`
+	BuildDate      string `json:"build_date"`
+	GoVersion      string `json:"go_version"`
+	Platform       string `json:"platform"`
+	CSISpecVersion string `json:"csi_spec_version"`
+}
+
+// GetBuildInfo returns the build information of the running binary.
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:        version,
+		Commit:         commit,
+		TreeState:      gitTreeState,
+		BuildDate:      buildDate,
+		GoVersion:      runtime.Version(),
+		Platform:       fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		CSISpecVersion: csiSpecVersion,
+	}
+}
+
+// manifest returns the build information as manifest of GetPluginInfo.
+func (b BuildInfo) manifest() map[string]string {
+	return map[string]string{
+		"commit":           b.Commit,
+		"tree_state":       b.TreeState,
+		"build_date":       b.BuildDate,
+		"go_version":       b.GoVersion,
+		"platform":         b.Platform,
+		"csi_spec_version": b.CSISpecVersion,
+	}
+}
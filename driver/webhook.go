@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultWebhookThreshold is the number of consecutive failures of an
+	// operation on the same volume after which the webhook is notified.
+	defaultWebhookThreshold = 3
+
+	// webhookTimeout bounds a single webhook request.
+	webhookTimeout = 10 * time.Second
+)
+
+// WebhookFormat defines the payload sent to the webhook.
+type WebhookFormat string
+
+const (
+	// WebhookFormatJSON posts a webhookPayload.
+	WebhookFormatJSON WebhookFormat = "json"
+
+	// WebhookFormatSlack posts a message for Slack incoming webhooks.
+	WebhookFormatSlack WebhookFormat = "slack"
+)
+
+func (f WebhookFormat) validate() error {
+	switch f {
+	case WebhookFormatJSON, WebhookFormatSlack:
+		return nil
+	}
+	return fmt.Errorf("invalid webhook format %q, must be one of: %s, %s", f, WebhookFormatJSON, WebhookFormatSlack)
+}
+
+// webhookPayload describes an operation that failed repeatedly.
+type webhookPayload struct {
+	Driver    string `json:"driver"`
+	Cluster   string `json:"cluster,omitempty"`
+	Location  string `json:"location"`
+	Operation string `json:"operation"`
+	Volume    string `json:"volume"`
+	Failures  int    `json:"failures"`
+	Code      string `json:"code"`
+	ErrorCode string `json:"hcloud_error_code"`
+	Error     string `json:"error"`
+}
+
+// failureTracker counts consecutive failures of operations per volume.
+type failureTracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// track records the result of an operation and returns the number of
+// consecutive failures.
+func (t *failureTracker) track(key string, err error) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		delete(t.failures, key)
+		return 0
+	}
+
+	if t.failures == nil {
+		t.failures = map[string]int{}
+	}
+	t.failures[key]++
+	return t.failures[key]
+}
+
+// trackFailure records the result of an operation on a volume and notifies
+// the webhook once the operation failed as often as the threshold in a row.
+func (d *Driver) trackFailure(operation, volume string, err error) {
+	if d.webhookURL == "" {
+		return
+	}
+
+	failures := d.failures.track(operation+"/"+volume, err)
+	if failures != d.webhookThreshold {
+		return
+	}
+
+	payload := &webhookPayload{
+		Driver:    d.driverName(),
+		Cluster:   d.clusterName,
+		Location:  d.location,
+		Operation: operation,
+		Volume:    volume,
+		Failures:  failures,
+		Code:      status.Code(err).String(),
+		ErrorCode: errorCode(err),
+		Error:     err.Error(),
+	}
+
+	go func() {
+		if err := d.notifyWebhook(payload); err != nil {
+			d.log.WithError(err).WithFields(logrus.Fields{
+				"operation": operation,
+				"volume":    volume,
+			}).Warn("could not notify webhook")
+		}
+	}()
+}
+
+// notifyWebhook posts the payload in the configured format.
+func (d *Driver) notifyWebhook(payload *webhookPayload) error {
+	var body interface{} = payload
+	if d.webhookFormat == WebhookFormatSlack {
+		body = map[string]string{
+			"text": fmt.Sprintf("%s: %s of volume %s failed %d times in a row in %s: %s",
+				payload.Driver, payload.Operation, payload.Volume, payload.Failures, payload.Location, payload.Error),
+		}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.webhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
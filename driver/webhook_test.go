@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTrackFailure(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("could not decode payload: %s", err)
+		}
+		received <- payload
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		log:              logrus.New().WithField("test_enabled", true),
+		location:         "fsn1",
+		webhookURL:       ts.URL,
+		webhookFormat:    WebhookFormatJSON,
+		webhookThreshold: 2,
+	}
+	err := status.Error(codes.Internal, "server is locked")
+
+	d.trackFailure(operationPublishVolume, "1", err)
+	d.trackFailure(operationPublishVolume, "2", err)
+	d.trackFailure(operationPublishVolume, "1", nil)
+	d.trackFailure(operationPublishVolume, "1", err)
+	select {
+	case payload := <-received:
+		t.Fatalf("expected no notification before the threshold, got %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	d.trackFailure(operationPublishVolume, "2", err)
+	select {
+	case payload := <-received:
+		if payload["volume"] != "2" || payload["operation"] != operationPublishVolume || payload["code"] != "Internal" || payload["failures"] != float64(2) {
+			t.Errorf("unexpected payload %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+
+	// only the failure reaching the threshold is notified
+	d.trackFailure(operationPublishVolume, "2", err)
+	select {
+	case payload := <-received:
+		t.Fatalf("expected a single notification, got %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	d.webhookFormat = WebhookFormatSlack
+	d.trackFailure(operationCreateVolume, "pvc-1", errors.New("boom"))
+	d.trackFailure(operationCreateVolume, "pvc-1", errors.New("boom"))
+	select {
+	case payload := <-received:
+		text, _ := payload["text"].(string)
+		if !strings.Contains(text, "pvc-1") || !strings.Contains(text, "boom") {
+			t.Errorf("unexpected slack message %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+}
+
+func TestWebhookFormatValidate(t *testing.T) {
+	for _, f := range []WebhookFormat{WebhookFormatJSON, WebhookFormatSlack} {
+		if err := f.validate(); err != nil {
+			t.Errorf("expected %q to be valid, got %s", f, err)
+		}
+	}
+
+	if err := WebhookFormat("teams").validate(); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
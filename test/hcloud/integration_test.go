@@ -0,0 +1,232 @@
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-csi-driver/driver"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The tests create real volumes in the project of HCLOUD_TOKEN and attach
+// them to the server HCLOUD_SERVER (its ID), they are skipped without them.
+// All volumes carry a cluster label unique to the run and are deleted
+// after the tests, also if they failed.
+
+const (
+	// gb is a gigabyte in bytes
+	gb = 1 << 30
+
+	// timeout bounds every test and the cleanup
+	timeout = 10 * time.Minute
+)
+
+var (
+	drv      *driver.Driver
+	client   *hcloud.Client
+	serverID string
+	cluster  string
+)
+
+func TestMain(m *testing.M) {
+	token, server := os.Getenv("HCLOUD_TOKEN"), os.Getenv("HCLOUD_SERVER")
+	if token == "" || server == "" {
+		log.Println("HCLOUD_TOKEN and HCLOUD_SERVER are not set, skipping the tests against the hcloud API")
+		os.Exit(0)
+	}
+
+	if err := setup(token, server); err != nil {
+		log.Fatalln(err)
+	}
+
+	// run the tests, don't call any defer yet as it'll fail due `os.Exit()
+	exitStatus := m.Run()
+
+	if err := teardown(); err != nil {
+		// don't call log.Fatalln() as we exit with `m.Run()`'s exit status
+		log.Println(err)
+		exitStatus = 1
+	}
+
+	os.Exit(exitStatus)
+}
+
+func setup(token, server string) error {
+	serverID = server
+	cluster = fmt.Sprintf("it-%d", time.Now().Unix())
+	client = hcloud.NewClient(hcloud.WithToken(token))
+
+	var err error
+	drv, err = driver.NewDriver(
+		driver.WithEndpoint("unix:///tmp/hcloud-csi-integration.sock"),
+		driver.WithToken(token),
+		driver.WithNodeID(server),
+		driver.WithClusterName(cluster),
+		driver.WithListOnlyManaged(true),
+		driver.WithMode(driver.ModeController),
+	)
+	return err
+}
+
+// teardown detaches and deletes the volumes of the run that are left.
+func teardown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	volumes, err := client.Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: "cluster=" + cluster},
+	})
+	if err != nil {
+		return fmt.Errorf("listing the volumes of the run failed: %s", err)
+	}
+
+	for _, vol := range volumes {
+		log.Printf("deleting volume %d (%s) left by the tests", vol.ID, vol.Name)
+
+		if vol.Server != nil {
+			action, _, err := client.Volume.Detach(ctx, vol)
+			if err == nil {
+				err = waitForAction(ctx, action)
+			}
+			if err != nil {
+				return fmt.Errorf("detaching volume %d failed: %s", vol.ID, err)
+			}
+		}
+
+		if _, err := client.Volume.Delete(ctx, vol); err != nil {
+			return fmt.Errorf("deleting volume %d failed: %s", vol.ID, err)
+		}
+	}
+	return nil
+}
+
+func waitForAction(ctx context.Context, action *hcloud.Action) error {
+	_, errs := client.Action.WatchProgress(ctx, action)
+	return <-errs
+}
+
+// volume returns the volume of the hcloud API, nil if it doesn't exist.
+func volume(t *testing.T, ctx context.Context, id string) *hcloud.Volume {
+	volumeID, err := strconv.Atoi(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, _, err := client.Volume.GetByID(ctx, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vol
+}
+
+func createVolume(t *testing.T, ctx context.Context, name string) *csi.Volume {
+	resp, err := drv.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * gb},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Volume
+}
+
+func TestVolume_Lifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	created := createVolume(t, ctx, "pvc-lifecycle")
+	vol := volume(t, ctx, created.Id)
+	if vol == nil || vol.Labels["cluster"] != cluster || vol.Size != 10 {
+		t.Fatalf("expected a labelled 10 GB volume, got %+v", vol)
+	}
+
+	// creating the volume again returns the existing one
+	if again := createVolume(t, ctx, "pvc-lifecycle"); again.Id != created.Id {
+		t.Errorf("expected volume %s again, got %s", created.Id, again.Id)
+	}
+
+	_, err := drv.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: created.Id,
+		NodeId:   serverID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := volume(t, ctx, created.Id); vol.Server == nil || strconv.Itoa(vol.Server.ID) != serverID {
+		t.Errorf("expected the volume to be attached to server %s, got %+v", serverID, vol.Server)
+	}
+
+	_, err = drv.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: created.Id, NodeId: serverID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := volume(t, ctx, created.Id); vol.Server != nil {
+		t.Errorf("expected the volume to be detached, got server %d", vol.Server.ID)
+	}
+
+	// CSI v0.3 has no volume expansion, volumes are resized with the API
+	// and the node grows the filesystem when the volume is staged again
+	action, _, err := client.Volume.Resize(ctx, vol, 20)
+	if err == nil {
+		err = waitForAction(ctx, action)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := drv.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Volume.CapacityBytes != 20*gb {
+		t.Errorf("expected the resized volume of the run to be listed, got %v", list.Entries)
+	}
+
+	if _, err := drv.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if vol := volume(t, ctx, created.Id); vol != nil {
+		t.Errorf("expected the volume to be deleted, got %+v", vol)
+	}
+
+	// deleting is idempotent
+	if _, err := drv.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Id}); err != nil {
+		t.Errorf("deleting the volume again: %s", err)
+	}
+}
+
+func TestVolume_PublishUnknownServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	created := createVolume(t, ctx, "pvc-unknown-server")
+	defer drv.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Id})
+
+	_, err := drv.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: created.Id,
+		NodeId:   "1",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want NotFound for an unknown server", err)
+	}
+}